@@ -0,0 +1,51 @@
+// Command backfill rewrites historical rows of the log table to the current
+// format, in rate limited batches. The DB is configured from env the same way
+// as the server, e.g. `DB_DRIVER` and `DB_DSN`.
+//
+//	backfill -transform hash-binary -batch 1000 -interval 100ms
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/eidng8/go-utils"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/eidng8/gin-persist-log/server"
+)
+
+var transforms = map[string]server.BackfillFunc{
+	"hash-binary": server.HexHashToBinary,
+}
+
+func main() {
+	name := flag.String("transform", "", "name of the transform to apply")
+	batch := flag.Int("batch", 1000, "number of rows in each batch")
+	interval := flag.Duration("interval", 0, "pause between batches")
+	flag.Parse()
+	fn, ok := transforms[*name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown transform: %q\n", *name)
+		os.Exit(2)
+	}
+	conn, err := server.ConnectDB(server.DefaultDbConfigFromEnv())
+	utils.PanicIfError(err)
+	defer func() { utils.PanicIfError(conn.Close()) }()
+	ctx, stop := signal.NotifyContext(context.Background(),
+		syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	n, err := server.Backfill(ctx, conn, fn, server.BackfillOptions{
+		BatchSize: *batch, Interval: *interval,
+	})
+	fmt.Printf("%d rows updated\n", n)
+	if nil != err {
+		fmt.Fprintf(os.Stderr, "backfill stopped: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,83 @@
+// Command canary compares the persisted responses of a baseline and a canary,
+// selected by time ranges or `req_hash` values, and prints the report as
+// JSON. The DB is configured from env the same way as the server.
+//
+//	canary -baseline 2024-01-01T00:00:00Z/2024-01-01T01:00:00Z \
+//		-canary 2024-01-01T01:00:00Z/2024-01-01T02:00:00Z
+//	canary -baseline-hashes 0a1b...,2c3d... -canary-hashes 4e5f...
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/eidng8/gin-persist-log/server"
+)
+
+func main() {
+	baseline := flag.String("baseline", "", "time range of the baseline, "+
+		"as RFC 3339 `from/to`")
+	canary := flag.String("canary", "", "time range of the canary")
+	baseHashes := flag.String("baseline-hashes", "",
+		"comma separated hex `req_hash` values of the baseline")
+	canaryHashes := flag.String("canary-hashes", "",
+		"comma separated hex `req_hash` values of the canary")
+	flag.Parse()
+	base, err := selector(*baseline, *baseHashes)
+	exitIfError(err)
+	can, err := selector(*canary, *canaryHashes)
+	exitIfError(err)
+	conn, err := server.ConnectDB(server.DefaultDbConfigFromEnv())
+	utils.PanicIfError(err)
+	defer func() { utils.PanicIfError(conn.Close()) }()
+	report, err := server.CompareCanary(context.Background(), conn, base, can)
+	exitIfError(err)
+	out := struct {
+		*server.CanaryReport
+		BodyDiffRate float64 `json:"body_diff_rate"`
+	}{report, report.BodyDiffRate()}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	exitIfError(enc.Encode(out))
+}
+
+func selector(period, hashes string) (server.CanarySelector, error) {
+	var sel server.CanarySelector
+	if "" != hashes {
+		for _, h := range strings.Split(hashes, ",") {
+			b, err := hex.DecodeString(strings.TrimSpace(h))
+			if nil != err {
+				return sel, fmt.Errorf("invalid req_hash %q: %w", h, err)
+			}
+			sel.Hashes = append(sel.Hashes, b)
+		}
+		return sel, nil
+	}
+	from, to, ok := strings.Cut(period, "/")
+	if !ok {
+		return sel, fmt.Errorf("invalid time range: %q", period)
+	}
+	var err error
+	if sel.From, err = time.Parse(time.RFC3339, from); nil != err {
+		return sel, err
+	}
+	sel.To, err = time.Parse(time.RFC3339, to)
+	return sel, err
+}
+
+func exitIfError(err error) {
+	if nil != err {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,42 @@
+// Command loadtest serves a trivial endpoint behind the persistence
+// middleware, as the target of load tests. See `loadtest.sh`.
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/eidng8/gin-persist-log/server"
+)
+
+func main() {
+	// report problems of both configs at once
+	dbcfg, dbErr := server.DbConfigFromEnv()
+	cfg, err := server.ConfigFromEnv()
+	utils.PanicIfError(errors.Join(dbErr, err))
+	cfg.Db = dbcfg
+	// connects with fallback to the spill store
+	svr, sigChan, stopChan, cleanup := server.DefaultServer(nil, cfg)
+	defer cleanup()
+	svr.Config(func(s *server.Server) {
+		s.Engine.Any("/t", func(c *gin.Context) {
+			c.Data(http.StatusOK, "application/json", []byte(`"ok"`))
+		})
+	})
+	go svr.Serve()
+	sig := <-sigChan
+	svr.Logger.Infof("Received signal: %v. Shutting down...", sig)
+	close(stopChan)
+	cancel, err := svr.Shutdown()
+	defer cancel()
+	if nil != err {
+		svr.Logger.Errorf("Server Shutdown error: %v", err)
+		os.Exit(1)
+	}
+}
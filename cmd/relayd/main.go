@@ -0,0 +1,45 @@
+// Command relayd is the writer daemon shared by processes on one host. It
+// persists records sent by RelaySink to the unix socket at `RELAY_SOCKET`,
+// so that the processes share the DB connections and batches of the daemon.
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/eidng8/go-utils"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/eidng8/gin-persist-log/server"
+)
+
+func main() {
+	dbcfg, dbErr := server.DbConfigFromEnv()
+	cfg, err := server.ConfigFromEnv()
+	utils.PanicIfError(errors.Join(dbErr, err))
+	cfg.Db = dbcfg
+	if "" == cfg.RelaySocket {
+		utils.PanicIfError(errors.New("RELAY_SOCKET is empty"))
+	}
+	conn, err := server.ConnectDB(dbcfg)
+	utils.PanicIfError(err)
+	svr, sigChan, stopChan, cleanup := server.DefaultServer(conn, cfg)
+	defer cleanup()
+	sock, err := server.ListenRelay(cfg.RelaySocket)
+	utils.PanicIfError(err)
+	go func() {
+		if err := svr.ServeRelay(sock); nil != err {
+			svr.Logger.Errorf("Relay error: %v", err)
+		}
+	}()
+	sig := <-sigChan
+	svr.Logger.Infof("Received signal: %v. Shutting down...", sig)
+	close(stopChan)
+	cancel, err := svr.Shutdown()
+	defer cancel()
+	if nil != err {
+		svr.Logger.Errorf("Server Shutdown error: %v", err)
+		os.Exit(1)
+	}
+}
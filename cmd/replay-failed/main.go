@@ -0,0 +1,64 @@
+// Command replay-failed retries the inserts of records in failed logs, such
+// as `failed_db.log` and `failed_req.log`. The DB is configured from env the
+// same way as the server, e.g. `DB_DRIVER` and `DB_DSN`. Records failing
+// again are written to the file given by `-out`, to be replayed later.
+//
+//	replay-failed -out failed_db.retry.log failed_db.log failed_req.log
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/eidng8/go-utils"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/eidng8/gin-persist-log/server"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+// run replays the logs, returning the exit code, so deferred closes run
+// before exiting.
+func run() int {
+	out := flag.String("out", "failed_retry.log",
+		"file records failing again are appended to")
+	batch := flag.Int("batch", 1000, "number of records in each transaction")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "no failed log given")
+		return 2
+	}
+	dbcfg := server.DefaultDbConfigFromEnv()
+	conn, err := server.ConnectDB(dbcfg)
+	utils.PanicIfError(err)
+	defer func() { utils.PanicIfError(conn.Close()) }()
+	failed, err := os.OpenFile(*out, os.O_CREATE|os.O_APPEND|os.O_WRONLY,
+		0600)
+	utils.PanicIfError(err)
+	defer func() { utils.PanicIfError(failed.Close()) }()
+	ctx, stop := signal.NotifyContext(context.Background(),
+		syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	code := 0
+	for _, path := range flag.Args() {
+		n, err := server.ReingestFailedLog(ctx, conn, path,
+			server.ReingestOptions{
+				Db: dbcfg, HashAlgorithm: os.Getenv("HASH_ALGO"),
+				Failed: failed, BatchSize: *batch,
+			})
+		fmt.Printf("%s: %d records persisted\n", path, n)
+		if nil != err {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			code = 1
+		}
+	}
+	return code
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// BufferPool keeps reusable byte slices in tiers of capacities. Buffers only
+// ever grow by moving to the next tier, instead of repeated reallocation.
+type BufferPool struct {
+	tiers []int
+	pools []sync.Pool
+}
+
+// NewBufferPool creates a pool with the given tiers of capacities.
+func NewBufferPool(tiers []int) *BufferPool {
+	tiers = slices.Clone(tiers)
+	slices.Sort(tiers)
+	tiers = slices.Compact(tiers)
+	p := &BufferPool{tiers: tiers, pools: make([]sync.Pool, len(tiers))}
+	for i, size := range tiers {
+		p.pools[i].New = func() any {
+			b := make([]byte, 0, size)
+			return &b
+		}
+	}
+	return p
+}
+
+// Get returns an empty buffer with at least the given capacity.
+func (p *BufferPool) Get(size int) []byte {
+	if nil != p {
+		for i, tier := range p.tiers {
+			if tier >= size {
+				return (*p.pools[i].Get().(*[]byte))[:0]
+			}
+		}
+	}
+	return make([]byte, 0, size)
+}
+
+// Put returns the buffer to the tier it belongs to. Buffers not matching any
+// tier are left to the GC.
+func (p *BufferPool) Put(b []byte) {
+	if nil == p {
+		return
+	}
+	for i, tier := range p.tiers {
+		if tier == cap(b) {
+			b = b[:0]
+			p.pools[i].Put(&b)
+			return
+		}
+	}
+}
+
+// CaptureBuffer accumulates captured bytes using buffers from a BufferPool,
+// up to an optional limit.
+type CaptureBuffer struct {
+	pool *BufferPool
+	buf  []byte
+	// maximum bytes kept, 0 means unlimited
+	Limit int
+	// total bytes written, including those beyond Limit
+	Total int
+	// whether some bytes were discarded due to Limit or Budget
+	Truncated bool
+	// Optional, bytes shared with other captures of the same request
+	Budget *Budget
+}
+
+// NewCaptureBuffer creates a buffer drawing from the given pool, which can be
+// nil to always allocate.
+func NewCaptureBuffer(pool *BufferPool, limit int) *CaptureBuffer {
+	return &CaptureBuffer{pool: pool, Limit: limit}
+}
+
+func (c *CaptureBuffer) Write(b []byte) (int, error) {
+	n := len(b)
+	c.Total += n
+	if c.Limit > 0 && len(c.buf)+len(b) > c.Limit {
+		b = b[:max(0, c.Limit-len(c.buf))]
+		c.Truncated = true
+	}
+	if kept := c.Budget.Take(len(b)); kept < len(b) {
+		b = b[:kept]
+		c.Truncated = true
+	}
+	if len(b) < 1 {
+		return n, nil
+	}
+	if need := len(c.buf) + len(b); need > cap(c.buf) {
+		nb := c.pool.Get(max(need, 2*cap(c.buf)))
+		nb = append(nb, c.buf...)
+		c.release()
+		c.buf = nb
+	}
+	c.buf = append(c.buf, b...)
+	return n, nil
+}
+
+// Bytes returns the captured bytes, which are only valid until Release.
+func (c *CaptureBuffer) Bytes() []byte {
+	return c.buf
+}
+
+// Len returns the number of bytes kept.
+func (c *CaptureBuffer) Len() int {
+	return len(c.buf)
+}
+
+// Release returns the underlying buffer to the pool.
+func (c *CaptureBuffer) Release() {
+	c.release()
+	c.buf = nil
+}
+
+func (c *CaptureBuffer) release() {
+	if nil != c.buf {
+		c.pool.Put(c.buf)
+	}
+}
+
+// Budget is a number of bytes shared by captures, which is safe for
+// concurrent use. A nil Budget is unlimited.
+type Budget struct {
+	left      atomic.Int64
+	exhausted atomic.Bool
+	// Optional, budget the bytes are also taken off
+	parent *Budget
+}
+
+// NewBudget creates a budget of the given bytes.
+func NewBudget(n int) *Budget {
+	b := &Budget{}
+	b.left.Store(int64(max(0, n)))
+	return b
+}
+
+// Sub returns a budget of at most n bytes, which are also taken off this
+// budget. It returns this budget if n is not positive, and a new one if this
+// budget is unlimited. Running out of this budget doesn't exhaust the sub.
+func (b *Budget) Sub(n int) *Budget {
+	if n <= 0 {
+		return b
+	}
+	sub := NewBudget(n)
+	sub.parent = b
+	return sub
+}
+
+// Take takes up to n bytes off the budget, and returns the bytes taken.
+func (b *Budget) Take(n int) int {
+	if nil == b {
+		return n
+	}
+	for {
+		left := b.left.Load()
+		taken := min(int64(n), left)
+		if b.left.CompareAndSwap(left, left-taken) {
+			if taken < int64(n) {
+				b.exhausted.Store(true)
+			}
+			if granted := b.parent.Take(int(taken)); granted < int(taken) {
+				b.left.Add(taken - int64(granted))
+				return granted
+			}
+			return int(taken)
+		}
+	}
+}
+
+// Left returns the bytes left, -1 if unlimited.
+func (b *Budget) Left() int {
+	if nil == b {
+		return -1
+	}
+	left := int(b.left.Load())
+	if p := b.parent.Left(); p >= 0 {
+		return min(left, p)
+	}
+	return left
+}
+
+// Exhausted reports whether some bytes have been refused.
+func (b *Budget) Exhausted() bool {
+	return nil != b && b.exhausted.Load()
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultClickhouseTable returns the ClickHouse variant of the default table.
+// Rows are sorted by `req_hash` and time within monthly partitions, so
+// lookups of a request and drops of old partitions are cheap. IDs are kept
+// in their binary form, but aren't unique as there's no primary key
+// constraint.
+func DefaultClickhouseTable() string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `
+		CREATE TABLE IF NOT EXISTS tx_log (
+			id FixedString(16),
+			req_hash String,
+			headers String,
+			body Nullable(String),
+			created_at DateTime64(6) DEFAULT now64(6),
+			client_aborted Bool DEFAULT false,
+			attributes Nullable(String),
+			hash_algo LowCardinality(String) DEFAULT 'xxh64',
+			partner LowCardinality(Nullable(String)),
+			schema_version UInt16 DEFAULT 1,
+			request_line Nullable(String),
+			request_line_full Nullable(String),
+			body_codec LowCardinality(Nullable(String)),
+			remote_port Nullable(UInt16),
+			conn_id Nullable(UInt64),
+			conn_reused Nullable(Bool),
+			method LowCardinality(Nullable(String)),
+			path Nullable(String),
+			status_code Nullable(UInt16),
+			duration_ms Nullable(UInt32),
+			tx_id Nullable(FixedString(16)),
+			direction LowCardinality(Nullable(String)),
+			truncated Bool DEFAULT false,
+			slo_violated Bool DEFAULT false
+		) ENGINE = MergeTree
+		PARTITION BY toYYYYMM(created_at)
+		ORDER BY (req_hash, created_at)`
+}
+
+// ClickhouseIndex returns the statement adding a bloom filter skipping index
+// of given columns.
+func ClickhouseIndex(name string, columns []string) string {
+	return fmt.Sprintf("ALTER TABLE tx_log ADD INDEX IF NOT EXISTS %s (%s) "+
+		"TYPE bloom_filter GRANULARITY 4", name, strings.Join(columns, ", "))
+}
+
+// ClickhouseInsertSettings makes the server buffer inserts, merging small
+// batches into one part, and acknowledge them once they're flushed.
+const ClickhouseInsertSettings = " SETTINGS async_insert=1, " +
+	"wait_for_async_insert=1"
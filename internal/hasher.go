@@ -1,7 +1,17 @@
 package internal
 
 import (
+	"encoding/binary"
+
 	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/xxh3"
+)
+
+const (
+	// HashXxh64 is the 64-bit xxHash, the default algorithm.
+	HashXxh64 = "xxh64"
+	// HashXxh3 is the 128-bit XXH3, filling the whole BINARY(16) column.
+	HashXxh3 = "xxh3-128"
 )
 
 type Hasher interface {
@@ -9,6 +19,21 @@ type Hasher interface {
 	Reset()
 	WriteString(string) (int, error)
 	Hash() uint64
+	// Sum returns the big-endian digest.
+	Sum() []byte
+	// Algorithm returns the name of hash algorithm.
+	Algorithm() string
+}
+
+// NewHasher returns the hasher of given algorithm, or nil if not supported.
+func NewHasher(algorithm string) Hasher {
+	switch algorithm {
+	case "", HashXxh64:
+		return &XxHasher{}
+	case HashXxh3:
+		return &Xxh3Hasher{}
+	}
+	return nil
 }
 
 type XxHasher struct {
@@ -30,3 +55,54 @@ func (h *XxHasher) WriteString(s string) (int, error) {
 func (h *XxHasher) Hash() uint64 {
 	return h.hasher.Sum64()
 }
+
+func (h *XxHasher) Sum() []byte {
+	return h.hasher.Sum(nil)
+}
+
+func (h *XxHasher) Algorithm() string {
+	return HashXxh64
+}
+
+type Xxh3Hasher struct {
+	hasher *xxh3.Hasher
+}
+
+func (h *Xxh3Hasher) New() {
+	h.hasher = xxh3.New()
+}
+
+func (h *Xxh3Hasher) Reset() {
+	h.hasher.Reset()
+}
+
+func (h *Xxh3Hasher) WriteString(s string) (int, error) {
+	return h.hasher.WriteString(s)
+}
+
+// Hash returns the low 64 bits of the 128-bit digest.
+func (h *Xxh3Hasher) Hash() uint64 {
+	return h.hasher.Sum128().Lo
+}
+
+func (h *Xxh3Hasher) Sum() []byte {
+	b := h.hasher.Sum128().Bytes()
+	return b[:]
+}
+
+func (h *Xxh3Hasher) Algorithm() string {
+	return HashXxh3
+}
+
+// SumString is a stateless shortcut of Hasher.Sum of the given algorithm,
+// safe for concurrent use. It returns nil if the algorithm is not supported.
+func SumString(algorithm, s string) []byte {
+	switch algorithm {
+	case "", HashXxh64:
+		return binary.BigEndian.AppendUint64(nil, xxhash.Sum64String(s))
+	case HashXxh3:
+		b := xxh3.HashString128(s).Bytes()
+		return b[:]
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package internal
+
+import "strconv"
+
+// Observe adds the value to the histogram of the given name and labels, kept
+// as counters in the Prometheus layout: a cumulative `<name>_bucket` counter
+// of each upper bound, labeled `le`, along with `<name>_sum` and
+// `<name>_count`. Bounds must be sorted in ascending order.
+func (c *Counters) Observe(
+	value uint64, name string, bounds []uint64, labels ...string,
+) {
+	if nil == c {
+		return
+	}
+	bucket := name + "_bucket"
+	for _, b := range bounds {
+		if value <= b {
+			c.Inc(bucket, append(labels, "le", strconv.FormatUint(b, 10))...)
+		}
+	}
+	c.Inc(bucket, append(labels, "le", "+Inf")...)
+	c.Add(value, name+"_sum", labels...)
+	c.Inc(name+"_count", labels...)
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"math"
+	"math/bits"
+)
+
+// precision of HyperLogLog, giving 2^14 registers and ~0.8% standard error
+const hllPrecision = 14
+
+const hllRegisters = 1 << hllPrecision
+
+// HyperLogLog estimates the number of distinct 64-bit hashes added. It's not
+// safe for concurrent use.
+type HyperLogLog struct {
+	registers [hllRegisters]uint8
+}
+
+// Add adds a hash, which must be uniformly distributed.
+func (h *HyperLogLog) Add(hash uint64) {
+	idx := hash >> (64 - hllPrecision)
+	// the sentinel bit caps the rank of the remaining bits
+	w := hash<<hllPrecision | 1<<(hllPrecision-1)
+	rho := uint8(bits.LeadingZeros64(w)) + 1
+	if rho > h.registers[idx] {
+		h.registers[idx] = rho
+	}
+}
+
+// Merge adds all hashes added to the other one.
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// Reset removes all hashes.
+func (h *HyperLogLog) Reset() {
+	clear(h.registers[:])
+}
+
+// Estimate returns the estimated number of distinct hashes added.
+func (h *HyperLogLog) Estimate() uint64 {
+	m := float64(hllRegisters)
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if 0 == r {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// linear counting is more accurate for small cardinalities
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
@@ -1,17 +1,137 @@
 package internal
 
 import (
-	"bytes"
+	"net/http"
+	"strings"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/gin-gonic/gin"
 )
 
 type ResponseLogWriter struct {
 	gin.ResponseWriter
-	Body *bytes.Buffer
+	Body *CaptureBuffer
+	// the first error occurred writing to the client
+	Err error
+	// whether written bytes are kept in Body
+	SkipBody bool
+	// whether to stop keeping bytes in Body for 206 partial content
+	SkipPartial bool
+	digest      *xxhash.Digest
+	// status and headers as sent to the client, set when headers are written
+	sentStatus int
+	sentHeader http.Header
 }
 
-func (w ResponseLogWriter) Write(b []byte) (int, error) {
-	w.Body.Write(b)
-	return w.ResponseWriter.Write(b)
+func (w *ResponseLogWriter) Write(b []byte) (int, error) {
+	w.commit(b)
+	w.capture(b)
+	n, err := w.ResponseWriter.Write(b)
+	w.setErr(err)
+	return n, err
+}
+
+func (w *ResponseLogWriter) WriteString(s string) (int, error) {
+	w.commit([]byte(s))
+	w.capture([]byte(s))
+	n, err := w.ResponseWriter.WriteString(s)
+	w.setErr(err)
+	return n, err
+}
+
+func (w *ResponseLogWriter) WriteHeader(code int) {
+	if w.SkipPartial && http.StatusPartialContent == code {
+		w.SkipBody = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ResponseLogWriter) WriteHeaderNow() {
+	w.commit(nil)
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *ResponseLogWriter) Flush() {
+	w.commit(nil)
+	w.ResponseWriter.Flush()
+}
+
+// Sent returns the status and headers as sent to the client. Headers changed
+// after being sent are not included, nor are trailers. If nothing is sent
+// yet, the current ones are returned, as gin sends them after handlers.
+func (w *ResponseLogWriter) Sent() (int, http.Header) {
+	if nil == w.sentHeader {
+		return w.Status(), w.Header().Clone()
+	}
+	return w.sentStatus, w.sentHeader.Clone()
+}
+
+// Trailers returns the trailers set so far, either declared by the `Trailer`
+// header sent, or prefixed by http.TrailerPrefix.
+func (w *ResponseLogWriter) Trailers() http.Header {
+	_, sent := w.Sent()
+	var trailers http.Header
+	add := func(key string, values []string) {
+		if nil == trailers {
+			trailers = make(http.Header)
+		}
+		trailers[http.CanonicalHeaderKey(key)] = append([]string(nil),
+			values...)
+	}
+	for _, declared := range sent.Values("Trailer") {
+		for _, key := range strings.Split(declared, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+			if values, ok := w.Header()[key]; ok && "" != key {
+				add(key, values)
+			}
+		}
+	}
+	for key, values := range w.Header() {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			add(strings.TrimPrefix(key, http.TrailerPrefix), values)
+		}
+	}
+	return trailers
+}
+
+// commit snapshots the status and headers about to be sent, along with the
+// `Content-Type` net/http sniffs from the first bytes of a body without one.
+func (w *ResponseLogWriter) commit(b []byte) {
+	if nil != w.sentHeader || w.ResponseWriter.Written() {
+		return
+	}
+	w.sentStatus, w.sentHeader = w.Status(), w.Header().Clone()
+	_, typed := w.sentHeader["Content-Type"]
+	if len(b) > 0 && !typed && "" == w.sentHeader.Get("Transfer-Encoding") {
+		w.sentHeader.Set("Content-Type", http.DetectContentType(b))
+	}
+}
+
+// EnableChecksum starts hashing all bytes written from now on, regardless of
+// whether they are kept in Body.
+func (w *ResponseLogWriter) EnableChecksum() {
+	w.digest = xxhash.New()
+}
+
+// Checksum returns the hash of bytes written since EnableChecksum was called.
+func (w *ResponseLogWriter) Checksum() uint64 {
+	if nil == w.digest {
+		return 0
+	}
+	return w.digest.Sum64()
+}
+
+func (w *ResponseLogWriter) capture(b []byte) {
+	if nil != w.digest {
+		_, _ = w.digest.Write(b)
+	}
+	if !w.SkipBody {
+		_, _ = w.Body.Write(b)
+	}
+}
+
+func (w *ResponseLogWriter) setErr(err error) {
+	if nil != err && nil == w.Err {
+		w.Err = err
+	}
 }
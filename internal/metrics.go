@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counters is a set of monotonic counters, each identified by its name and
+// labels. A nil Counters discards all increments.
+type Counters struct {
+	m sync.Map
+}
+
+// Inc increments the counter of the given name and labels. Labels are given
+// in key, value pairs, e.g. `Inc("decisions_total", "policy", "truncated")`.
+func (c *Counters) Inc(name string, labels ...string) {
+	c.Add(1, name, labels...)
+}
+
+// Add adds delta to the counter of the given name and labels.
+func (c *Counters) Add(delta uint64, name string, labels ...string) {
+	if nil == c || 0 == delta {
+		return
+	}
+	key := CounterKey(name, labels...)
+	v, ok := c.m.Load(key)
+	if !ok {
+		v, _ = c.m.LoadOrStore(key, &atomic.Uint64{})
+	}
+	v.(*atomic.Uint64).Add(delta)
+}
+
+// Get returns the value of the counter of the given name and labels.
+func (c *Counters) Get(name string, labels ...string) uint64 {
+	if nil == c {
+		return 0
+	}
+	if v, ok := c.m.Load(CounterKey(name, labels...)); ok {
+		return v.(*atomic.Uint64).Load()
+	}
+	return 0
+}
+
+// Snapshot returns the values of all counters, keyed by CounterKey.
+func (c *Counters) Snapshot() map[string]uint64 {
+	s := make(map[string]uint64)
+	if nil == c {
+		return s
+	}
+	c.m.Range(func(k, v any) bool {
+		s[k.(string)] = v.(*atomic.Uint64).Load()
+		return true
+	})
+	return s
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// CounterKey returns the key of a counter in the Prometheus text format, e.g.
+// `decisions_total{policy="truncated"}`.
+func CounterKey(name string, labels ...string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteString("{")
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(labelEscaper.Replace(labels[i+1]))
+		sb.WriteString(`"`)
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
@@ -1,14 +1,266 @@
 package internal
 
-func DefaultMysqlTable() string {
+import (
+	"fmt"
+	"strings"
+)
+
+// Types of the MySQL `body` column, in the order of capacity.
+const (
+	MysqlBlob       = "BLOB"
+	MysqlMediumBlob = "MEDIUMBLOB"
+	MysqlLongBlob   = "LONGBLOB"
+)
+
+// MysqlSchema customizes columns of the MySQL family of default tables.
+type MysqlSchema struct {
+	// type of the `body` column, one of the `MysqlBlob*` constants, defaults to
+	// MysqlBlob
+	Body string
+	// default character set of the table, defaults to `utf8mb4`
+	Charset string
+	// collation of `headers`, defaults to the binary collation of Charset
+	HeadersCollation string
+}
+
+// BodyBytes returns the capacity of the `body` column. 0 means it's only
+// limited by `max_allowed_packet`, or the type is unknown.
+func (s MysqlSchema) BodyBytes() int {
+	switch s.bodyType() {
+	case MysqlBlob:
+		return 65535
+	case MysqlMediumBlob:
+		return 16777215
+	}
+	return 0
+}
+
+// Valid reports whether the schema only has known column types, and well
+// formed charset and collation names.
+func (s MysqlSchema) Valid() bool {
+	switch s.bodyType() {
+	case MysqlBlob, MysqlMediumBlob, MysqlLongBlob:
+		return isSqlName(s.charset()) && isSqlName(s.headersCollation())
+	}
+	return false
+}
+
+func (s MysqlSchema) charset() string {
+	if "" == s.Charset {
+		return "utf8mb4"
+	}
+	return s.Charset
+}
+
+func (s MysqlSchema) headersCollation() string {
+	if "" == s.HeadersCollation {
+		return s.charset() + "_bin"
+	}
+	return s.HeadersCollation
+}
+
+// isSqlName reports whether the name can be put in statements as is.
+func isSqlName(name string) bool {
+	if "" == name {
+		return false
+	}
+	for _, c := range name {
+		if '_' != c && (c < '0' || c > '9') && (c < 'a' || c > 'z') &&
+			(c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s MysqlSchema) bodyType() string {
+	if "" == s.Body {
+		return MysqlBlob
+	}
+	return strings.ToUpper(s.Body)
+}
+
+func DefaultMysqlTable(schema MysqlSchema) string {
+	return mysqlTable("BINARY(16)", "", "", schema)
+}
+
+// DefaultMariadbTable returns the MariaDB variant of the default table,
+// optionally using the native `UUID` type (MariaDB 10.7+) for ID and InnoDB
+// page compression.
+func DefaultMariadbTable(uuid, compressed bool, schema MysqlSchema) string {
+	idType, options := "BINARY(16)", ""
+	if uuid {
+		idType = "UUID"
+	}
+	if compressed {
+		options = " PAGE_COMPRESSED=1"
+	}
+	return mysqlTable(idType, "", options, schema)
+}
+
+// DefaultTidbTable returns the TiDB variant of the default table. IDs are
+// time ordered UUIDs, so the primary key is non-clustered, and rows are
+// scattered across 2^shardBits regions to avoid write hotspot.
+func DefaultTidbTable(shardBits int, schema MysqlSchema) string {
+	return mysqlTable("BINARY(16)", " NONCLUSTERED", fmt.Sprintf(
+		" SHARD_ROW_ID_BITS=%d PRE_SPLIT_REGIONS=%d", shardBits, shardBits),
+		schema)
+}
+
+func mysqlTable(idType, pkType, options string, schema MysqlSchema) string {
+	var sb strings.Builder
+	for _, col := range MysqlColumns(idType, schema) {
+		sb.WriteString("\n\t\t\t" + col.Name + " " + col.Definition + ",")
+	}
 	//goland:noinspection SqlNoDataSourceInspection
 	return `
 		CREATE TABLE IF NOT EXISTS tx_log (
-			id BINARY(16) NOT NULL PRIMARY KEY,
-			req_hash BINARY(16) NOT NULL,
-			headers TEXT NOT NULL,
-			body BLOB,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			id ` + idType + ` NOT NULL PRIMARY KEY` + pkType + `,
+			req_hash VARBINARY(16) NOT NULL,
+			headers TEXT COLLATE ` + schema.headersCollation() + ` NOT NULL,
+			body ` + schema.bodyType() + `,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,` +
+		sb.String() + `
 			INDEX ix_tx_log_hash (req_hash)
+		) DEFAULT CHARSET=` + schema.charset() + options
+}
+
+// MysqlColumns returns the columns added to `tx_log` since the first release,
+// in the order they were added, see Column.
+func MysqlColumns(idType string, schema MysqlSchema) []Column {
+	text := "TEXT COLLATE " + schema.headersCollation()
+	return []Column{
+		{"client_aborted", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"attributes", "TEXT"},
+		{"hash_algo", "VARCHAR(16) NOT NULL DEFAULT 'xxh64'"},
+		{"partner", "VARCHAR(64)"},
+		{"schema_version", "SMALLINT NOT NULL DEFAULT 1"},
+		{"request_line", text},
+		{"request_line_full", "MEDIUM" + text},
+		{"body_codec", "VARCHAR(16)"},
+		{"remote_port", "SMALLINT UNSIGNED"},
+		{"conn_id", "BIGINT UNSIGNED"},
+		{"conn_reused", "BOOLEAN"},
+		{"method", "VARCHAR(16)"},
+		{"path", text},
+		{"status_code", "SMALLINT UNSIGNED"},
+		{"duration_ms", "INT UNSIGNED"},
+		{"tx_id", idType},
+		{"direction", "VARCHAR(3)"},
+		{"truncated", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"slo_violated", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	}
+}
+
+// MysqlSchemaTable returns the statement creating the `tx_schema` table,
+// holding the versions of migrations applied to `tx_log`.
+func MysqlSchemaTable() string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `
+		CREATE TABLE IF NOT EXISTS tx_schema (
+			version SMALLINT NOT NULL PRIMARY KEY,
+			applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`
+}
+
+// MysqlHashToBinary returns statements converting legacy hex `req_hash` to raw
+// digests, the UPDATE converts at most the given number of rows at a time.
+func MysqlHashToBinary(batch int) (alter, update string) {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `ALTER TABLE tx_log MODIFY req_hash VARBINARY(16) NOT NULL`,
+		fmt.Sprintf(`UPDATE tx_log SET req_hash = UNHEX(req_hash)
+			WHERE hash_algo = 'xxh64' AND LENGTH(req_hash) = 16 LIMIT %d`, batch)
+}
+
+// MysqlPurge returns the statement deleting at most the given number of rows
+// created before the time bound to it.
+func MysqlPurge(batch int) string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return fmt.Sprintf(`DELETE FROM tx_log WHERE created_at < ? LIMIT %d`,
+		batch)
+}
+
+// MysqlIndex returns the statement creating an index of given columns.
+func MysqlIndex(name string, columns []string) string {
+	return fmt.Sprintf("CREATE INDEX %s ON tx_log (%s)", name,
+		strings.Join(columns, ", "))
+}
+
+// MysqlViews returns the statements creating the analysis views, dropping
+// those of earlier versions.
+func MysqlViews() []string {
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	return []string{
+		viewPairs, viewErrors, viewLatencyByRoute, viewStatusByRoute,
+		`DROP VIEW IF EXISTS v_tx_responses, v_tx_routes`,
+	}
+}
+
+// MysqlAuditTable returns the statement creating the audit table of admin
+// actions.
+func MysqlAuditTable() string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `
+		CREATE TABLE IF NOT EXISTS admin_audit (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			actor VARCHAR(64) NOT NULL,
+			action VARCHAR(32) NOT NULL,
+			params TEXT,
+			created_at DATETIME(6) NOT NULL,
+			INDEX ix_admin_audit_actor (actor, created_at)
+		)`
+}
+
+// MysqlRawErrorTable returns the statement creating the table of connections
+// rejected before reaching handlers.
+func MysqlRawErrorTable() string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `
+		CREATE TABLE IF NOT EXISTS tx_raw_error (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			remote_addr VARCHAR(64) NOT NULL,
+			raw BLOB NOT NULL,
+			response TEXT,
+			created_at DATETIME(6) NOT NULL,
+			INDEX ix_tx_raw_error_created (created_at)
+		)`
+}
+
+// MysqlMetaTable returns the statement creating the table of metadata of the
+// code writing the log, stamped upon each startup.
+func MysqlMetaTable() string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `
+		CREATE TABLE IF NOT EXISTS tx_meta (
+			id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+			version VARCHAR(64) NOT NULL,
+			schema_version SMALLINT NOT NULL,
+			dialect VARCHAR(16) NOT NULL,
+			config_hash VARCHAR(16) NOT NULL,
+			started_at DATETIME(6) NOT NULL,
+			INDEX ix_tx_meta_started (started_at)
 		)`
 }
+
+// MysqlCheckpointTable returns the statement creating the `tx_checkpoint`
+// table, holding the cursor of each consumer of `tx_log`.
+func MysqlCheckpointTable() string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `
+		CREATE TABLE IF NOT EXISTS tx_checkpoint (
+			name VARCHAR(64) NOT NULL PRIMARY KEY,
+			created_at DATETIME(6) NOT NULL,
+			record_id VARBINARY(36) NOT NULL,
+			updated_at DATETIME(6) NOT NULL
+		)`
+}
+
+// MysqlSaveCheckpoint returns the statement upserting the cursor of a
+// consumer.
+func MysqlSaveCheckpoint() string {
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	return `INSERT INTO tx_checkpoint (name, created_at, record_id, updated_at)
+		VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE
+		created_at = VALUES(created_at), record_id = VALUES(record_id),
+		updated_at = VALUES(updated_at)`
+}
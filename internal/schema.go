@@ -0,0 +1,24 @@
+package internal
+
+import "strings"
+
+// Column is a column added to `tx_log` after the first release, whose table
+// only had `id`, `req_hash`, `headers`, `body` and `created_at`. The index of
+// a column in MysqlColumns and SqliteColumns, plus 1, is the schema version
+// adding it, so columns must only be appended. Columns added to existing
+// tables must be nullable or have a default.
+type Column struct {
+	Name string
+	// type and constraints of the column
+	Definition string
+}
+
+// AddColumns returns the statement adding the columns to `tx_log`. SQLite
+// only accepts one column per statement.
+func AddColumns(cols ...Column) string {
+	defs := make([]string, len(cols))
+	for i, col := range cols {
+		defs[i] = "ADD COLUMN " + col.Name + " " + col.Definition
+	}
+	return "ALTER TABLE tx_log " + strings.Join(defs, ", ")
+}
@@ -1,6 +1,15 @@
 package internal
 
+import (
+	"fmt"
+	"strings"
+)
+
 func DefaultSqliteTable() string {
+	var sb strings.Builder
+	for _, col := range SqliteColumns() {
+		sb.WriteString(",\n\t\t\t" + col.Name + " " + col.Definition)
+	}
 	//goland:noinspection SqlNoDataSourceInspection
 	return `
 		CREATE TABLE IF NOT EXISTS tx_log (
@@ -8,7 +17,158 @@ func DefaultSqliteTable() string {
 			req_hash BYTEA NOT NULL,
 			headers TEXT NOT NULL,
 			body BYTEA,
-			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP` +
+		sb.String() + `
 		);
 		CREATE INDEX IF NOT EXISTS ix_tx_log_hash ON tx_log (req_hash);`
 }
+
+// SqliteColumns returns the columns added to `tx_log` since the first release,
+// in the order they were added, see Column.
+func SqliteColumns() []Column {
+	return []Column{
+		{"client_aborted", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"attributes", "TEXT"},
+		{"hash_algo", "TEXT NOT NULL DEFAULT 'xxh64'"},
+		{"partner", "TEXT"},
+		{"schema_version", "INTEGER NOT NULL DEFAULT 1"},
+		{"request_line", "TEXT"},
+		{"request_line_full", "TEXT"},
+		{"body_codec", "TEXT"},
+		{"remote_port", "INTEGER"},
+		{"conn_id", "INTEGER"},
+		{"conn_reused", "BOOLEAN"},
+		{"method", "TEXT"},
+		{"path", "TEXT"},
+		{"status_code", "INTEGER"},
+		{"duration_ms", "INTEGER"},
+		{"tx_id", "BLOB"},
+		{"direction", "TEXT"},
+		{"truncated", "BOOLEAN NOT NULL DEFAULT 0"},
+		{"slo_violated", "BOOLEAN NOT NULL DEFAULT 0"},
+	}
+}
+
+// SqliteSchemaTable returns the statement creating the `tx_schema` table,
+// holding the versions of migrations applied to `tx_log`.
+func SqliteSchemaTable() string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `
+		CREATE TABLE IF NOT EXISTS tx_schema (
+			version INTEGER PRIMARY KEY,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`
+}
+
+// SqliteHashToBinary returns the statement converting legacy hex `req_hash`
+// to raw digests, at most the given number of rows at a time.
+func SqliteHashToBinary(batch int) string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return fmt.Sprintf(`UPDATE tx_log SET req_hash = unhex(req_hash)
+		WHERE rowid IN (SELECT rowid FROM tx_log WHERE hash_algo = 'xxh64'
+			AND typeof(req_hash) = 'text' AND length(req_hash) = 16
+			LIMIT %d)`, batch)
+}
+
+// SqlitePurge returns the statement deleting at most the given number of rows
+// created before the time bound to it.
+func SqlitePurge(batch int) string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return fmt.Sprintf(`DELETE FROM tx_log WHERE rowid IN (SELECT rowid
+		FROM tx_log WHERE created_at < ? LIMIT %d)`, batch)
+}
+
+// SqliteIndex returns the statement creating an index of given columns.
+func SqliteIndex(name string, columns []string) string {
+	return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON tx_log (%s)", name,
+		strings.Join(columns, ", "))
+}
+
+// SqliteViews returns the statements creating the analysis views, dropping
+// those of earlier versions.
+func SqliteViews() []string {
+	var stmts []string
+	for _, view := range [][2]string{
+		{"v_tx_pairs", viewPairs}, {"v_tx_errors", viewErrors},
+		{"v_tx_latency_by_route", viewLatencyByRoute},
+		{"v_tx_status_by_route", viewStatusByRoute},
+	} {
+		stmts = append(stmts, "DROP VIEW IF EXISTS "+view[0],
+			strings.Replace(view[1], "OR REPLACE ", "", 1))
+	}
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	return append(stmts, `DROP VIEW IF EXISTS v_tx_responses`,
+		`DROP VIEW IF EXISTS v_tx_routes`)
+}
+
+// SqliteAuditTable returns the statement creating the audit table of admin
+// actions.
+func SqliteAuditTable() string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `
+		CREATE TABLE IF NOT EXISTS admin_audit (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			actor TEXT NOT NULL,
+			action TEXT NOT NULL,
+			params TEXT,
+			created_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS ix_admin_audit_actor
+			ON admin_audit (actor, created_at);`
+}
+
+// SqliteRawErrorTable returns the statement creating the table of connections
+// rejected before reaching handlers.
+func SqliteRawErrorTable() string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `
+		CREATE TABLE IF NOT EXISTS tx_raw_error (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			remote_addr TEXT NOT NULL,
+			raw BYTEA NOT NULL,
+			response TEXT,
+			created_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS ix_tx_raw_error_created
+			ON tx_raw_error (created_at);`
+}
+
+// SqliteMetaTable returns the statement creating the table of metadata of the
+// code writing the log, stamped upon each startup.
+func SqliteMetaTable() string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `
+		CREATE TABLE IF NOT EXISTS tx_meta (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			version TEXT NOT NULL,
+			schema_version INTEGER NOT NULL,
+			dialect TEXT NOT NULL,
+			config_hash TEXT NOT NULL,
+			started_at TIMESTAMP NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS ix_tx_meta_started
+			ON tx_meta (started_at);`
+}
+
+// SqliteCheckpointTable returns the statement creating the `tx_checkpoint`
+// table, holding the cursor of each consumer of `tx_log`.
+func SqliteCheckpointTable() string {
+	//goland:noinspection SqlNoDataSourceInspection
+	return `
+		CREATE TABLE IF NOT EXISTS tx_checkpoint (
+			name TEXT PRIMARY KEY,
+			created_at TIMESTAMP NOT NULL,
+			record_id BLOB NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);`
+}
+
+// SqliteSaveCheckpoint returns the statement upserting the cursor of a
+// consumer.
+func SqliteSaveCheckpoint() string {
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	return `INSERT INTO tx_checkpoint (name, created_at, record_id, updated_at)
+		VALUES (?, ?, ?, ?) ON CONFLICT (name) DO UPDATE SET
+		created_at = excluded.created_at, record_id = excluded.record_id,
+		updated_at = excluded.updated_at`
+}
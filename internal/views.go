@@ -0,0 +1,28 @@
+package internal
+
+// views common to all dialects, built upon the `method`, `path`,
+// `status_code`, `duration_ms`, `tx_id` and `direction` columns
+//
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+const (
+	viewPairs = `CREATE OR REPLACE VIEW v_tx_pairs AS
+		SELECT q.tx_id, q.id AS request_id, r.id AS response_id,
+			q.method, q.path, r.status_code, r.duration_ms,
+			q.created_at AS requested_at, r.created_at AS responded_at,
+			r.client_aborted, q.partner
+		FROM tx_log q LEFT JOIN tx_log r
+			ON r.tx_id = q.tx_id AND r.direction = 'res'
+		WHERE q.direction = 'req'`
+	viewErrors = `CREATE OR REPLACE VIEW v_tx_errors AS
+		SELECT * FROM v_tx_pairs WHERE status_code >= 400`
+	viewLatencyByRoute = `CREATE OR REPLACE VIEW v_tx_latency_by_route AS
+		SELECT method, path, COUNT(*) AS responses,
+			AVG(duration_ms) AS avg_ms, MIN(duration_ms) AS min_ms,
+			MAX(duration_ms) AS max_ms
+		FROM tx_log WHERE direction = 'res' AND duration_ms IS NOT NULL
+		GROUP BY method, path`
+	viewStatusByRoute = `CREATE OR REPLACE VIEW v_tx_status_by_route AS
+		SELECT method, path, status_code AS status, COUNT(*) AS responses,
+			SUM(client_aborted) AS aborted
+		FROM tx_log WHERE direction = 'res' GROUP BY method, path, status_code`
+)
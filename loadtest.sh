@@ -0,0 +1,37 @@
+#!/usr/bin/env bash
+# Runs the micro benchmarks, then a load test against cmd/loadtest using
+# bombardier or vegeta, whichever is installed.
+#   DURATION  duration of the load test, defaults to 30s
+#   RATE      requests per second for vegeta, defaults to 2000
+#   CONNS     concurrent connections for bombardier, defaults to 64
+set -e
+
+cd "$(dirname "$0")"
+DURATION=${DURATION:-30s}
+RATE=${RATE:-2000}
+CONNS=${CONNS:-64}
+mkdir -p coverage
+
+go test -run '^$' -bench . -benchmem ./server/ | tee "coverage/bench_$(date '+%Y%m%d%H%M%S').txt"
+
+export DB_DRIVER=${DB_DRIVER:-sqlite3}
+export DB_DSN=${DB_DSN:-"file:coverage/loadtest.db?_journal=WAL&_timeout=5000"}
+export LISTEN=${LISTEN:-127.0.0.1:8080}
+export ACCESS_LOG=${ACCESS_LOG:-json}
+go build -o coverage/loadtest ./cmd/loadtest
+coverage/loadtest > /dev/null &
+pid=$!
+trap 'kill $pid' EXIT
+sleep 1
+
+target="http://$LISTEN/t?a=b%21c"
+if command -v bombardier > /dev/null; then
+  bombardier -c "$CONNS" -d "$DURATION" -m POST -b '{"test":"value"}' \
+    -H 'Content-Type: application/json' -l "$target"
+elif command -v vegeta > /dev/null; then
+  echo "POST $target" | vegeta attack -rate "$RATE" -duration "$DURATION" \
+    -header 'Content-Type: application/json' -body <(echo '{"test":"value"}') |
+    vegeta report
+else
+  echo 'Neither bombardier nor vegeta is installed, load test skipped.'
+fi
@@ -0,0 +1,42 @@
+// Package persistlog provides the middleware persisting requests and
+// responses, for Gin applications that don't need the lifecycle of
+// server.Server:
+//
+//	writer := server.NewCachedWriter(conn,
+//		server.SqlBuilder(logger, failedLog), logger, failedLog)
+//	writer.Start(stopChan)
+//	engine.Use(persistlog.Middleware(writer,
+//		persistlog.WithConfig(cfg), persistlog.WithLogger(logger)))
+//
+// The bundled server installs the same middleware, see Server.RequestLogger in
+// package server.
+package persistlog
+
+import (
+	"github.com/eidng8/go-db"
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+
+	"github.com/eidng8/gin-persist-log/server"
+)
+
+// Option configures the middleware.
+type Option = server.Option
+
+// WithConfig sets the config of the middleware, such as the hash algorithm,
+// redaction and limits of bodies.
+func WithConfig(cfg *server.Config) Option {
+	return server.WithConfig(cfg)
+}
+
+// WithLogger sets the logger of the middleware.
+func WithLogger(logger utils.TaggedLogger) Option {
+	return server.WithLogger(logger)
+}
+
+// Middleware returns the middleware persisting requests and responses to the
+// writer, which must be started and drained by the caller, see
+// server.NewMiddleware.
+func Middleware(writer db.CachedWriter, opts ...Option) gin.HandlerFunc {
+	return server.NewMiddleware(writer, opts...)
+}
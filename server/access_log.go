@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type accessLine struct {
+	Time      string  `json:"time"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	ClientIp  string  `json:"client_ip"`
+	ReqHash   string  `json:"req_hash,omitempty"`
+	ReqId     string  `json:"req_id,omitempty"`
+	ResId     string  `json:"res_id,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// accessLogger returns the access log middleware selected by configuration.
+// The JSON format carries the same hash and record IDs persisted to DB, so
+// container log pipelines can correlate the two.
+func (s *Server) accessLogger() gin.HandlerFunc {
+	cfg := s.Conf
+	if nil == cfg || AccessLogJson != cfg.AccessLog {
+		return gin.Logger()
+	}
+	out := cfg.AccessLogOutput
+	if nil == out {
+		out = os.Stdout
+	}
+	return func(gc *gin.Context) {
+		start := time.Now()
+		path := gc.Request.URL.Path
+		if raw := gc.Request.URL.RawQuery; "" != raw {
+			path += "?" + raw
+		}
+		gc.Next()
+		s.dropUnstored(gc)
+		p := gin.LogFormatterParams{
+			Request:      gc.Request,
+			TimeStamp:    time.Now(),
+			StatusCode:   gc.Writer.Status(),
+			ClientIP:     gc.ClientIP(),
+			Method:       gc.Request.Method,
+			Path:         path,
+			ErrorMessage: gc.Errors.ByType(gin.ErrorTypePrivate).String(),
+			BodySize:     gc.Writer.Size(),
+			Keys:         gc.Keys,
+		}
+		p.Latency = p.TimeStamp.Sub(start)
+		_, _ = fmt.Fprint(out, formatJsonAccessLine(p))
+	}
+}
+
+// dropUnstored unsets the ID of the response record dropped by SkipLogging or
+// the policy, before the access log line is formatted.
+func (s *Server) dropUnstored(gc *gin.Context) {
+	v, _ := gc.Get(ctxKeyPending)
+	pending, ok := v.(*pendingRequest)
+	if !ok {
+		return
+	}
+	if gc.GetBool(ctxKeySkip) || !s.responseKept(gc, pending.start) {
+		dropRecordId(gc, ctxKeyResId)
+	}
+}
+
+// formatJsonAccessLine formats the access log line. The hash is the one
+// computed by RequestLogger, and record IDs are omitted if not stored.
+func formatJsonAccessLine(p gin.LogFormatterParams) string {
+	line := accessLine{
+		Time:      p.TimeStamp.Format("2006-01-02T15:04:05.000000Z07:00"),
+		Method:    p.Method,
+		Path:      p.Path,
+		Status:    p.StatusCode,
+		LatencyMs: float64(p.Latency.Microseconds()) / 1000,
+		ClientIp:  p.ClientIP,
+		Error:     p.ErrorMessage,
+	}
+	if h, ok := p.Keys[ctxKeyReqHash].([]byte); ok {
+		line.ReqHash = hex.EncodeToString(h)
+	}
+	line.ReqId = formatUuid(p.Keys[ctxKeyReqId])
+	line.ResId = formatUuid(p.Keys[ctxKeyResId])
+	b, err := json.Marshal(line)
+	if nil != err {
+		return fmt.Sprintf("{\"error\":%q}\n", err.Error())
+	}
+	return string(append(b, '\n'))
+}
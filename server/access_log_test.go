@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+func Test_JsonAccessLog_emits_correlation_data(t *testing.T) {
+	require.Nil(t, os.Setenv("LISTEN", "127.0.0.1:0"))
+	var out bytes.Buffer
+	cfg := DefaultConfigFromEnv()
+	cfg.AccessLog = AccessLogJson
+	cfg.AccessLogOutput = &out
+	s, conn := setupWithConfig(t, cfg)
+	testGet(t, s)
+	var line map[string]any
+	require.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	require.Equal(t, "GET", line["method"])
+	require.Equal(t, "/t", line["path"])
+	require.Equal(t, float64(200), line["status"])
+	require.Equal(t,
+		fmt.Sprintf("%016x", xxhash.Sum64String("GET http://localhost/t")),
+		line["req_hash"])
+	require.Len(t, line["req_id"], 36)
+	require.Len(t, line["res_id"], 36)
+	time.Sleep(1100 * time.Millisecond)
+	var count int
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	rows, err := conn.Query(`SELECT id FROM tx_log;`)
+	require.Nil(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var id []byte
+		require.Nil(t, rows.Scan(&id))
+		if formatUuid(id) == line["req_id"] || formatUuid(id) == line["res_id"] {
+			count++
+		}
+	}
+	require.Equal(t, 2, count)
+}
+
+func Test_JsonAccessLog_hashes_normalized_request_line(t *testing.T) {
+	var out bytes.Buffer
+	cfg := &Config{
+		AccessLog: AccessLogJson, AccessLogOutput: &out,
+		Db: &DbConfig{MaxRequestLine: 24},
+	}
+	svr := NewServer(&http.Server{}, &mockCachedWriter{}, utils.NewLogger(),
+		cfg)
+	svr.Engine.GET("/long", func(c *gin.Context) { c.Status(http.StatusOK) })
+	url := "http://localhost/long?q=" + strings.Repeat("a", 64)
+	svr.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, url, nil))
+	var line map[string]any
+	require.Nil(t, json.Unmarshal(out.Bytes(), &line))
+	hash := internal.SumString(internal.HashXxh64,
+		NormalizeRequestLine("GET "+url, 24))
+	require.Equal(t, hex.EncodeToString(hash), line["req_hash"])
+}
+
+func Test_JsonAccessLog_omits_dropped_response_id(t *testing.T) {
+	var out bytes.Buffer
+	policy, err := ParsePolicy(`skip if status == 204`)
+	require.Nil(t, err)
+	cfg := &Config{
+		AccessLog: AccessLogJson, AccessLogOutput: &out, Policy: policy,
+	}
+	svr := NewServer(&http.Server{}, &mockCachedWriter{}, utils.NewLogger(),
+		cfg)
+	svr.Engine.GET("/skip", func(c *gin.Context) {
+		SkipLogging(c)
+		c.Status(http.StatusOK)
+	})
+	svr.Engine.GET("/drop", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	for path, reqKept := range map[string]bool{"/skip": false, "/drop": true} {
+		out.Reset()
+		svr.Engine.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, path, nil))
+		var line map[string]any
+		require.Nil(t, json.Unmarshal(out.Bytes(), &line))
+		if reqKept {
+			require.Len(t, line["req_id"], 36, path)
+		} else {
+			require.NotContains(t, line, "req_id", path)
+		}
+		require.NotContains(t, line, "res_id", path)
+	}
+}
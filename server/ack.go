@@ -0,0 +1,306 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// pendingRequest is the request record of RequestLogger, which handlers can
+// persist synchronously, taking it from the writer it's pushed to.
+type pendingRequest struct {
+	rec *TxRecord
+	// snapshot to dump headers from, if they're dumped by capture workers
+	req *http.Request
+	// reader capturing the body, if it's not read up front
+	cr *captureReader
+	// who persists the record, shared with the copy pushed to the writer
+	owner *recordOwner
+	// guards pushed, since lazy bodies may be read by other goroutines
+	mu sync.Mutex
+	// whether the record has been pushed to the writer
+	pushed bool
+	// when RequestLogger started, for the policy
+	start time.Time
+	// capture budget of the request, to tell why lazy bodies are truncated
+	budget *internal.Budget
+	// whether lazy bodies beyond `MaxBodyBytes` are removed
+	skipOversized bool
+	// whether the client expects `100 Continue`
+	continues bool
+}
+
+// owners of recordOwner
+const (
+	ownerNone int32 = iota
+	ownerWriter
+	ownerHandler
+)
+
+// recordOwner tells who persists a request record pushed before its handlers
+// run, either the writer building it, or a handler persisting it
+// synchronously, so it's not inserted twice.
+type recordOwner struct {
+	v atomic.Int32
+}
+
+// take makes the given one the owner, unless another one is. It's true for
+// records without owner, which aren't persisted synchronously.
+func (o *recordOwner) take(by int32) bool {
+	return nil == o || o.v.CompareAndSwap(ownerNone, by) || by == o.v.Load()
+}
+
+// is reports whether the given one is the owner.
+func (o *recordOwner) is(by int32) bool {
+	return nil != o && by == o.v.Load()
+}
+
+// errRecordTaken is returned when handlers try to persist a request record
+// the writer is flushing.
+var errRecordTaken = errors.New("request record is being flushed")
+
+// Acknowledged persists the request record before the handlers following it
+// run, so responses are only sent once their requests have been logged. It
+// responds 503 if the record can't be persisted. It suits audit-critical
+// routes, since each request waits for a DB round trip. The record is taken
+// from the writer, which may refuse it in the rare case it's being flushed.
+// Bodies are read up front, even with `LazyRequestBody`. The writer must
+// support synchronous inserts, like CachedWriter wrapping a RowWriter.
+func (s *Server) Acknowledged() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		v, ok := gc.Get(ctxKeyPending)
+		if !ok {
+			// not logged, such as suppressed requests
+			gc.Next()
+			return
+		}
+		if err := s.acknowledge(gc, v.(*pendingRequest), 0); nil != err {
+			s.Logger.Errorf("Failed to persist request record: %v", err)
+			s.countPolicy(PolicyAckFailed)
+			gc.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+		gc.Set(ctxKeyAcked, true)
+		s.countPolicy(PolicyAcknowledged)
+		gc.Next()
+	}
+}
+
+// SyncPersist works like Acknowledged, persisting the request record within
+// the timeout, 0 means unlimited. If it can't, the handlers still run, and the
+// record is cached as usual. Routes can also be marked by `SyncRoutes`.
+func (s *Server) SyncPersist(timeout time.Duration) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		s.persistSync(gc, timeout)
+		gc.Next()
+	}
+}
+
+// persistSync persists the pending request record, falling back to the cache.
+func (s *Server) persistSync(gc *gin.Context, timeout time.Duration) {
+	v, ok := gc.Get(ctxKeyPending)
+	if !ok || gc.GetBool(ctxKeyAcked) {
+		return
+	}
+	if err := s.acknowledge(gc, v.(*pendingRequest), timeout); nil != err {
+		s.Logger.Errorf("Failed to persist request record, cached: %v", err)
+		s.countPolicy(PolicySyncFallback)
+		return
+	}
+	gc.Set(ctxKeyAcked, true)
+	s.countPolicy(PolicyAcknowledged)
+}
+
+// syncRoute reports whether the route is marked by `SyncRoutes`.
+func (s *Server) syncRoute(gc *gin.Context) bool {
+	if len(s.syncRoutes) < 1 || "" == gc.FullPath() {
+		return false
+	}
+	return s.syncRoutes[gc.Request.Method+" "+gc.FullPath()] ||
+		s.syncRoutes["* "+gc.FullPath()]
+}
+
+func (s *Server) acknowledge(
+	gc *gin.Context, pending *pendingRequest, timeout time.Duration,
+) error {
+	w, ok := s.writer().(persister)
+	if !ok {
+		return ErrNoPersist
+	}
+	if !pending.owner.take(ownerHandler) {
+		return errRecordTaken
+	}
+	rec, err := pending.record(gc)
+	if nil == err {
+		ctx := gc.Request.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		err = w.Persist(ctx, rec)
+	}
+	if nil != err {
+		s.release(pending)
+	}
+	return err
+}
+
+// release hands the record back to the writer after it failed to be
+// persisted synchronously, pushing it again if it's been pushed.
+func (s *Server) release(pending *pendingRequest) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	if !pending.pushed {
+		pending.owner.v.Store(ownerNone)
+		return
+	}
+	rec := *pending.rec
+	rec.owner = nil
+	s.pushRequest(pending.req, rec)
+}
+
+// record completes the request record before the handler runs, reading the
+// rest of the body, if it's not been read up front, and dumping headers.
+func (p *pendingRequest) record(gc *gin.Context) (TxRecord, error) {
+	if nil != p.cr {
+		body, err := io.ReadAll(p.cr)
+		if nil != err {
+			return TxRecord{}, fmt.Errorf(
+				"error reading request body: %w", err)
+		}
+		gc.Request.Body = io.NopCloser(bytes.NewReader(body))
+		p.captureBody()
+	}
+	if nil == p.rec.Headers && nil != p.req {
+		headers, err := dumpRequest(p.req, false)
+		if nil != err {
+			return TxRecord{}, fmt.Errorf(
+				"error reading request headers: %w", err)
+		}
+		p.rec.Headers = headers
+	}
+	rec := *p.rec
+	rec.owner = nil
+	return rec, nil
+}
+
+// captureBody moves the body read along with the handlers into the record,
+// flagging it like bodies read up front.
+func (p *pendingRequest) captureBody() {
+	cr := p.cr
+	if nil == cr {
+		return
+	}
+	p.cr = nil
+	p.rec.Body, p.rec.ClientAborted = cr.buf.Bytes(), nil != cr.err
+	if !cr.truncated && !p.continues {
+		return
+	}
+	if nil == p.rec.Attributes {
+		p.rec.Attributes = make(map[string]any)
+	}
+	if cr.truncated {
+		key := truncationKey(cr.budget, p.budget)
+		p.rec.Attributes[key] = true
+		if "body_truncated" == key && p.skipOversized {
+			p.rec.Body = nil
+		}
+	}
+	if p.continues {
+		p.rec.Attributes["continue_sent"] = cr.continued()
+	}
+}
+
+// AckResponse is the body responded by AckJSON.
+var AckResponse = gin.H{"status": "ok"}
+
+// AckJSON acknowledges callbacks with AckResponse in JSON and the status, for
+// the common pattern of persisting callbacks by RequestLogger, and handling
+// them later. Placed after other handlers, it only responds if they haven't.
+func AckJSON(status int) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		if !gc.Writer.Written() {
+			gc.JSON(status, AckResponse)
+		}
+	}
+}
+
+// AckEmpty acknowledges callbacks with 204 and no body, see AckJSON.
+func AckEmpty() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		if !gc.Writer.Written() {
+			gc.Status(http.StatusNoContent)
+			gc.Writer.WriteHeaderNow()
+		}
+	}
+}
+
+// LogFirst responds with the `ack` handler, such as AckJSON, before the
+// handlers following it run, so callbacks are acknowledged whatever the
+// handlers do. Their responses are discarded, and their panics recovered.
+// Panics and errors the handlers add to the gin context are stored in the
+// `ack_error` attribute of the response record, which still records the
+// acknowledgement.
+func (s *Server) LogFirst(ack gin.HandlerFunc) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		ack(gc)
+		if gc.IsAborted() {
+			return
+		}
+		gc.Writer.Flush()
+		w := gc.Writer
+		gc.Writer = &ackedWriter{ResponseWriter: w}
+		defer func() {
+			gc.Writer = w
+			if r := recover(); nil != r {
+				s.Logger.Errorf("Handler panicked after ack: %v", r)
+				Annotate(gc, "ack_error", fmt.Sprintf("panic: %v", r))
+				s.countPolicy(PolicyAckHandlerFailed)
+			} else if len(gc.Errors) > 0 {
+				Annotate(gc, "ack_error", gc.Errors.String())
+				s.countPolicy(PolicyAckHandlerFailed)
+			}
+		}()
+		gc.Next()
+	}
+}
+
+// ackedWriter discards responses of handlers run after LogFirst acknowledged
+// the request.
+type ackedWriter struct {
+	gin.ResponseWriter
+	// headers set by handlers, never sent
+	header http.Header
+}
+
+func (w *ackedWriter) Header() http.Header {
+	if nil == w.header {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *ackedWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *ackedWriter) WriteString(s string) (int, error) {
+	return len(s), nil
+}
+
+func (w *ackedWriter) WriteHeader(int) {}
+
+func (w *ackedWriter) WriteHeaderNow() {}
+
+func (w *ackedWriter) Flush() {}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_Acknowledged_persists_request_before_handler(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	for _, cfg := range []*Config{{}, {LazyRequestBody: true}} {
+		_, err := conn.Exec("DELETE FROM tx_log")
+		require.Nil(t, err)
+		w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard),
+			logger), logger)
+		s := NewServer(&http.Server{}, w, logger, cfg)
+		var logged int
+		var received string
+		s.Engine.POST("/audit", s.Acknowledged(), func(c *gin.Context) {
+			require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log
+				WHERE body = CAST('payload' AS BLOB)`).Scan(&logged))
+			b, _ := io.ReadAll(c.Request.Body)
+			received = string(b)
+			c.Status(http.StatusOK)
+		})
+		res := httptest.NewRecorder()
+		s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost,
+			"/audit", strings.NewReader("payload")))
+		require.Equal(t, http.StatusOK, res.Code)
+		require.Equal(t, 1, logged)
+		require.Equal(t, "payload", received)
+		w.Write()
+		var count int
+		require.Nil(t, conn.QueryRow("SELECT COUNT(*) FROM tx_log").
+			Scan(&count))
+		// the request record isn't pushed again
+		require.Equal(t, 2, count)
+		require.Equal(t, uint64(1), s.metrics.Get(MetricPolicyDecisions,
+			"policy", PolicyAcknowledged))
+	}
+}
+
+func Test_Acknowledged_refuses_requests_not_persisted(t *testing.T) {
+	writer := &mockCachedWriter{}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	var called bool
+	s.Engine.POST("/audit", s.Acknowledged(), func(c *gin.Context) {
+		called = true
+	})
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/audit",
+		strings.NewReader("payload")))
+	require.Equal(t, http.StatusServiceUnavailable, res.Code)
+	require.False(t, called)
+	// the request record is still cached as usual
+	require.Len(t, writer.records, 2)
+	require.Equal(t, uint64(1), s.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyAckFailed))
+}
+
+type slowPersister struct {
+	mockCachedWriter
+	delay time.Duration
+}
+
+func (w *slowPersister) Persist(ctx context.Context, data ...any) error {
+	select {
+	case <-time.After(w.delay):
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for _, d := range data {
+			w.records = append(w.records, d.(TxRecord))
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func Test_SyncRoutes_persist_marked_routes_with_fallback(t *testing.T) {
+	writer := &slowPersister{}
+	cfg := &Config{
+		SyncRoutes:  []string{"post /orders/:id", "* /audit"},
+		SyncTimeout: 50 * time.Millisecond,
+	}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+	var before int
+	handler := func(c *gin.Context) {
+		writer.mu.Lock()
+		before = len(writer.records)
+		writer.mu.Unlock()
+		c.Status(http.StatusOK)
+	}
+	s.Engine.POST("/orders/:id", handler)
+	s.Engine.GET("/audit", handler)
+	s.Engine.GET("/orders/:id", handler)
+	for _, r := range []struct {
+		method, path string
+		before       int
+	}{
+		{http.MethodPost, "/orders/1", 1},
+		{http.MethodGet, "/audit", 1},
+		// pushed before the handler, instead of persisted
+		{http.MethodGet, "/orders/1", 1},
+	} {
+		writer.records = nil
+		res := httptest.NewRecorder()
+		s.Engine.ServeHTTP(res, httptest.NewRequest(r.method, r.path, nil))
+		require.Equal(t, http.StatusOK, res.Code)
+		require.Equal(t, r.before, before, r.path)
+		require.Len(t, writer.records, 2, r.path)
+	}
+	require.Equal(t, uint64(2), s.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyAcknowledged))
+	// falls back to the cache upon timeout
+	writer.records, writer.delay = nil, time.Second
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/audit",
+		nil))
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, 1, before)
+	require.Len(t, writer.records, 2)
+	require.Equal(t, uint64(1), s.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicySyncFallback))
+}
+
+func Test_AckJSON_and_AckEmpty_respond_unless_written(t *testing.T) {
+	writer := &mockCachedWriter{}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	s.Engine.POST("/json", AckJSON(http.StatusAccepted))
+	s.Engine.POST("/empty", AckEmpty())
+	s.Engine.POST("/handled", func(c *gin.Context) {
+		c.String(http.StatusConflict, "dup")
+	}, AckEmpty())
+	for _, v := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/json", http.StatusAccepted, `{"status":"ok"}`},
+		{"/empty", http.StatusNoContent, ""},
+		{"/handled", http.StatusConflict, "dup"},
+	} {
+		res := httptest.NewRecorder()
+		s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost, v.path,
+			strings.NewReader("cb")))
+		require.Equal(t, v.status, res.Code)
+		require.Equal(t, v.body, res.Body.String())
+	}
+	require.Len(t, writer.records, 6)
+	require.Equal(t, []byte(`{"status":"ok"}`), writer.records[1].Body)
+}
+
+func Test_LogFirst_acks_even_if_handlers_fail(t *testing.T) {
+	writer := &mockCachedWriter{}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	s.Engine.POST("/panic", s.LogFirst(AckJSON(http.StatusOK)),
+		func(c *gin.Context) { panic("boom") })
+	s.Engine.POST("/error", s.LogFirst(AckEmpty()), func(c *gin.Context) {
+		_ = c.AbortWithError(http.StatusInternalServerError,
+			errors.New("db down"))
+		c.String(http.StatusInternalServerError, "failed")
+	})
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/panic",
+		strings.NewReader("cb")))
+	require.Equal(t, http.StatusOK, res.Code)
+	require.Equal(t, `{"status":"ok"}`, res.Body.String())
+	res = httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/error",
+		strings.NewReader("cb")))
+	require.Equal(t, http.StatusNoContent, res.Code)
+	require.Empty(t, res.Body.String())
+	require.Len(t, writer.records, 4)
+	require.Equal(t, "panic: boom", writer.records[1].Attributes["ack_error"])
+	require.Contains(t, writer.records[3].Attributes["ack_error"], "db down")
+	require.Empty(t, writer.records[3].Body)
+	require.Equal(t, uint64(2), s.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyAckHandlerFailed))
+}
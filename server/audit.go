@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// ActionQuery is the audited action of the logs API, see ServeLogs.
+const ActionQuery = "query"
+
+// Auditor records admin actions into the `admin_audit` table.
+type Auditor struct {
+	conn *sql.DB
+}
+
+// NewAuditor creates an auditor writing to the given DB.
+func NewAuditor(conn *sql.DB) *Auditor {
+	return &Auditor{conn: conn}
+}
+
+// CreateAuditTable creates the `admin_audit` table.
+func CreateAuditTable(cfg *DbConfig, conn *sql.DB) error {
+	stmt := internal.SqliteAuditTable()
+	if cfg.mysqlFamily() {
+		stmt = internal.MysqlAuditTable()
+	}
+	_, err := conn.Exec(stmt)
+	return err
+}
+
+// Record inserts an audit row of the action taken by the actor.
+func (a *Auditor) Record(
+	ctx context.Context, actor, action string, params map[string]any,
+) error {
+	var p sql.Null[string]
+	if len(params) > 0 {
+		b, err := json.Marshal(params)
+		if nil != err {
+			return err
+		}
+		p = sql.Null[string]{V: string(b), Valid: true}
+	}
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	_, err := a.conn.ExecContext(ctx, `INSERT INTO admin_audit
+		(actor, action, params, created_at) VALUES (?, ?, ?, ?)`,
+		actor, action, p, formatStoredTime(time.Now()))
+	return err
+}
+
+// Audited returns a middleware recording the action with the actor set by
+// RequireScope, and the path and query parameters of the request. Requests
+// are responded 500 if the action can't be recorded, since actions mustn't go
+// unaudited. It does nothing if the server has no Auditor.
+func (s *Server) Audited(action string) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		if nil == s.Audit {
+			return
+		}
+		params := make(map[string]any)
+		for _, p := range gc.Params {
+			params[p.Key] = p.Value
+		}
+		for k, v := range gc.Request.URL.Query() {
+			params[k] = v
+		}
+		err := s.Audit.Record(gc.Request.Context(), AdminActor(gc), action,
+			params)
+		if nil != err {
+			s.Logger.Errorf("Failed to audit %s: %v", action, err)
+			gc.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+}
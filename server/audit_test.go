@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_Audited_records_admin_actions(t *testing.T) {
+	cfg, conn := setupDb(t)
+	cfg.Audit = true
+	require.Nil(t, CreateDefaultTable(cfg, conn))
+	svr := NewServer(&http.Server{}, &mockCachedWriter{}, utils.NewLogger(),
+		&Config{AdminKeys: []AdminKey{{"alice", ScopeAdmin, "k1"}}})
+	svr.Audit = NewAuditor(conn)
+	svr.Engine.POST("/erase/:id", svr.RequireScope(ScopeAdmin),
+		svr.Audited("erase"), func(c *gin.Context) { c.Status(204) })
+	req := httptest.NewRequest(http.MethodPost, "/erase/abc?force=1", nil)
+	req.Header.Set("X-Api-Key", "k1")
+	w := httptest.NewRecorder()
+	svr.Engine.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Code)
+	var actor, action, params string
+	require.Nil(t, conn.QueryRow(
+		`SELECT actor, action, params FROM admin_audit;`,
+	).Scan(&actor, &action, &params))
+	require.Equal(t, "alice", actor)
+	require.Equal(t, "erase", action)
+	require.JSONEq(t, `{"id":"abc","force":["1"]}`, params)
+	// actions are refused if they can't be audited
+	_, err := conn.Exec(`DROP TABLE admin_audit;`)
+	require.Nil(t, err)
+	w = httptest.NewRecorder()
+	svr.Engine.ServeHTTP(w, req)
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+}
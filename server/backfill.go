@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"github.com/eidng8/go-db"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// BackfillFunc rewrites a row in place, and returns whether it's changed. Only
+// `ReqHash`, `Headers`, `Body`, `HashAlgo` and `Version` are read and written.
+// `Body` is as stored, encoded by `BodyCodec`, which is read only.
+type BackfillFunc func(row *StoredRow) (bool, error)
+
+// BackfillOptions controls the pace of Backfill.
+type BackfillOptions struct {
+	// number of rows read and updated in each transaction, defaults to 1000
+	BatchSize int
+	// pause between batches, to limit the load on the DB
+	Interval time.Duration
+}
+
+// Backfill walks through all rows in the order of ID, in batches, and updates
+// those changed by the given function. It returns the number of rows updated,
+// and stops at the first error or upon cancellation of the context.
+func Backfill(
+	ctx context.Context, conn *sql.DB, fn BackfillFunc, opts BackfillOptions,
+) (int64, error) {
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1000
+	}
+	var total int64
+	var last any
+	for {
+		rows, err := backfillBatch(ctx, conn, last, opts.BatchSize)
+		if nil != err || len(rows) < 1 {
+			return total, err
+		}
+		last = rows[len(rows)-1].Id
+		var n int64
+		_, err = db.Transaction(conn, func(tx *sql.Tx) (bool, error) {
+			for _, row := range rows {
+				changed, err := fn(&row)
+				if nil != err {
+					return false, err
+				}
+				if !changed {
+					continue
+				}
+				//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+				_, err = tx.ExecContext(ctx, `UPDATE tx_log SET req_hash=?,
+					headers=?, body=?, hash_algo=?, schema_version=?
+					WHERE id=?`, row.ReqHash, row.Headers,
+					sql.Null[[]byte]{V: row.Body, Valid: len(row.Body) > 0},
+					row.HashAlgo, row.Version, row.Id)
+				if nil != err {
+					return false, err
+				}
+				n++
+			}
+			return true, nil
+		})
+		if nil != err {
+			return total, err
+		}
+		total += n
+		if len(rows) < opts.BatchSize {
+			return total, nil
+		}
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(opts.Interval):
+		}
+	}
+}
+
+func backfillBatch(
+	ctx context.Context, conn *sql.DB, after any, limit int,
+) ([]StoredRow, error) {
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	query := `SELECT id, req_hash, headers, body, hash_algo, schema_version,
+		body_codec FROM tx_log ORDER BY id LIMIT ?`
+	args := []any{limit}
+	if nil != after {
+		//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+		query = `SELECT id, req_hash, headers, body, hash_algo, schema_version,
+			body_codec FROM tx_log WHERE id > ? ORDER BY id LIMIT ?`
+		args = []any{after, limit}
+	}
+	rs, err := conn.QueryContext(ctx, query, args...)
+	if nil != err {
+		return nil, err
+	}
+	defer func() { _ = rs.Close() }()
+	var rows []StoredRow
+	for rs.Next() {
+		var row StoredRow
+		var codec sql.NullString
+		err = rs.Scan(&row.Id, &row.ReqHash, &row.Headers, &row.Body,
+			&row.HashAlgo, &row.Version, &codec)
+		if nil != err {
+			return nil, err
+		}
+		row.BodyCodec = codec.String
+		rows = append(rows, row)
+	}
+	return rows, rs.Err()
+}
+
+// HexHashToBinary converts `req_hash` written as hex string by earlier
+// versions to the raw digest. Unlike MigrateHashToBinary, it doesn't alter
+// the column type of MySQL tables.
+func HexHashToBinary(row *StoredRow) (bool, error) {
+	if internal.HashXxh64 != row.HashAlgo || 16 != len(row.ReqHash) {
+		return false, nil
+	}
+	sum, err := hex.DecodeString(string(row.ReqHash))
+	if nil != err {
+		// a raw digest of 16 bytes is not of xxh64, leave it alone
+		return false, nil
+	}
+	row.ReqHash = sum
+	return true, nil
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_Backfill_rewrites_rows_in_batches(t *testing.T) {
+	_, conn := setupDb(t)
+	sum := internal.SumString(internal.HashXxh64, "GET http://localhost/t")
+	for i := 0; i < 5; i++ {
+		_, err := conn.Exec(
+			`INSERT INTO tx_log (id, req_hash, headers) VALUES (?, ?, '');`,
+			[]byte{byte(i)}, hex.EncodeToString(sum))
+		require.Nil(t, err)
+	}
+	_, err := conn.Exec(
+		`INSERT INTO tx_log (id, req_hash, headers) VALUES (?, ?, '');`,
+		[]byte{9}, sum)
+	require.Nil(t, err)
+	var calls int
+	n, err := Backfill(context.Background(), conn,
+		func(row *StoredRow) (bool, error) {
+			calls++
+			return HexHashToBinary(row)
+		}, BackfillOptions{BatchSize: 2})
+	require.Nil(t, err)
+	require.Equal(t, int64(5), n)
+	require.Equal(t, 6, calls)
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log WHERE req_hash=?;`,
+		sum).Scan(&count))
+	require.Equal(t, 6, count)
+}
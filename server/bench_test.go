@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-db"
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+)
+
+func Benchmark_RequestLogger(b *testing.B) {
+	b.Run("sync", func(b *testing.B) {
+		benchmarkRequestLogger(b, &Config{})
+	})
+	b.Run("workers", func(b *testing.B) {
+		benchmarkRequestLogger(b,
+			&Config{CaptureWorkers: 4, CaptureQueue: 1024})
+	})
+}
+
+func Benchmark_BuildValues(b *testing.B) {
+	data := benchRecords(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, _, _ = BuildValues(data)
+	}
+}
+
+func Benchmark_SqlBuilder(b *testing.B) {
+	fn := SqlBuilder(utils.NewLogger(), io.Discard)
+	data := benchRecords(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = fn(data)
+	}
+}
+
+func benchmarkRequestLogger(b *testing.B, cfg *Config) {
+	gin.SetMode(gin.ReleaseMode)
+	cfg.ResponseBufferTiers = []int{4096, 65536, 1048576}
+	svr := NewServer(&http.Server{}, &nopCachedWriter{}, utils.NewLogger(),
+		cfg)
+	// replace the access log, which is not what's benchmarked
+	svr.Engine = gin.New()
+	svr.Engine.Use(svr.RequestLogger())
+	svr.Engine.POST("/t", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", []byte(`"post ok"`))
+	})
+	body := []byte(`{"test":"value"}`)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/t?a=b%21c",
+			bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		svr.Engine.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	b.StopTimer()
+	_, _ = svr.Shutdown()
+}
+
+func benchRecords(n int) []any {
+	data := make([]any, n)
+	for i := range data {
+		data[i] = TxRecord{
+			Request: "POST http://localhost/t?a=b%21c",
+			Headers: []byte("POST /t?a=b%21c HTTP/1.1\r\nHost: localhost\r\n" +
+				"Content-Type: application/json\r\n\r\n"),
+			Body: []byte(`{"test":"value"}`),
+			At:   time.Now(),
+		}
+	}
+	return data
+}
+
+type nopCachedWriter struct {
+	db.MemCachedWriter
+}
+
+func (w *nopCachedWriter) Push(any) {}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// captureBudget returns the bytes left for bodies of the request after its
+// request line and headers, nil if `MaxCaptureBytes` is unlimited. Headers
+// dumped later are estimated from the given header.
+func (s *Server) captureBudget(
+	line string, headers []byte, h http.Header,
+) *internal.Budget {
+	if nil == s.Conf || s.Conf.MaxCaptureBytes <= 0 {
+		return nil
+	}
+	used := len(line) + len(headers)
+	if nil == headers {
+		used += headerBytes(h)
+	}
+	return internal.NewBudget(s.Conf.MaxCaptureBytes - used)
+}
+
+// headerBytes returns the bytes of the header in wire format.
+func headerBytes(h http.Header) int {
+	n := 0
+	for k, vs := range h {
+		for _, v := range vs {
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
+
+// readCapped reads the request body up to the budget. Bytes beyond it are
+// left unread, for the handler to read after those already read. It returns
+// the bytes kept and whether the body is truncated.
+func readCapped(
+	req *http.Request, budget *internal.Budget,
+) ([]byte, bool, error) {
+	body, err := readBody(io.LimitReader(req.Body, int64(budget.Left())+1))
+	kept := budget.Take(len(body))
+	if nil != err {
+		return body[:kept], kept < len(body), err
+	}
+	if kept < len(body) {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return body[:kept], true, nil
+	}
+	req.Body = io.NopCloser(bytes.NewBuffer(body))
+	return body, false, nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RequestLogger_caps_capture_bytes(t *testing.T) {
+	writer := &mockCachedWriter{}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(),
+		&Config{MaxCaptureBytes: 64})
+	var received string
+	s.Engine.POST("/t", func(c *gin.Context) {
+		b, _ := io.ReadAll(c.Request.Body)
+		received = string(b)
+		c.String(http.StatusOK, strings.Repeat("r", 100))
+	})
+	sent := strings.Repeat("q", 100)
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/t",
+		strings.NewReader(sent)))
+	// the handler still reads the whole body
+	require.Equal(t, sent, received)
+	require.Equal(t, strings.Repeat("r", 100), res.Body.String())
+	require.Len(t, writer.records, 2)
+	req, rsp := writer.records[0], writer.records[1]
+	size := len(req.Request) + len(req.Headers) + len(req.Body)
+	require.LessOrEqual(t, size, 64)
+	require.Less(t, len(req.Body), 100)
+	require.Equal(t, true, req.Attributes["capture_truncated"])
+	require.Equal(t, true, rsp.Attributes["capture_truncated"])
+	// cut by the budget, not by the body limit
+	require.NotContains(t, req.Attributes, "body_truncated")
+	require.NotContains(t, rsp.Attributes, "body_truncated")
+	require.Equal(t, uint64(1), s.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyCaptureCapped))
+	require.Zero(t, s.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyBodyTruncated))
+}
+
+func Test_RequestLogger_caps_lazy_capture_bytes(t *testing.T) {
+	writer := &mockCachedWriter{}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(),
+		&Config{MaxCaptureBytes: 1024, LazyRequestBody: true})
+	s.Engine.POST("/t", func(c *gin.Context) {
+		_, _ = io.Copy(io.Discard, c.Request.Body)
+		c.Status(http.StatusOK)
+	})
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/t",
+		strings.NewReader(strings.Repeat("q", 2048))))
+	require.Len(t, writer.records, 2)
+	// kept by the request record once read through
+	req := writer.records[0]
+	require.Equal(t, DirectionRequest, req.Direction)
+	require.Less(t, len(req.Body), 1024)
+	require.Equal(t, true, req.Attributes["capture_truncated"])
+	require.NotContains(t, writer.records[1].Attributes, "request_body")
+}
+
+func Test_RequestLogger_keeps_captures_within_budget(t *testing.T) {
+	writer := &mockCachedWriter{}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(),
+		&Config{MaxCaptureBytes: 4096})
+	s.Engine.POST("/t", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/t",
+		strings.NewReader("body")))
+	require.Len(t, writer.records, 2)
+	require.Equal(t, "body", string(writer.records[0].Body))
+	require.NotContains(t, writer.records[0].Attributes, "capture_truncated")
+	require.NotContains(t, writer.records[1].Attributes, "capture_truncated")
+}
+
+func Test_RequestLogger_caps_body_bytes(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger),
+		logger)
+	s := NewServer(&http.Server{}, w, logger, &Config{MaxBodyBytes: 10})
+	var received string
+	s.Engine.POST("/t", func(c *gin.Context) {
+		b, _ := io.ReadAll(c.Request.Body)
+		received = string(b)
+		c.String(http.StatusOK, strings.Repeat("r", 20))
+	})
+	sent := strings.Repeat("q", 20)
+	s.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodPost, "/t", strings.NewReader(sent)))
+	require.Equal(t, sent, received)
+	w.Write()
+	rows, err := NewRecordStore(conn, true).Records(context.Background(),
+		RecordQuery{})
+	require.Nil(t, err)
+	require.Len(t, rows, 2)
+	for _, row := range rows {
+		require.True(t, row.Truncated)
+		require.Contains(t, row.Attributes, `"body_truncated":true`)
+		require.NotContains(t, row.Attributes, "capture_truncated")
+	}
+	var n int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log
+		WHERE LENGTH(body) = 10`).Scan(&n))
+	require.Equal(t, 2, n)
+}
+
+func Test_RequestLogger_skips_oversized_bodies(t *testing.T) {
+	writer := &mockCachedWriter{}
+	cfg := &Config{MaxBodyBytes: 10, SkipOversizedBody: true}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+	s.Engine.POST("/t", func(c *gin.Context) {
+		c.String(http.StatusOK, strings.Repeat("r", 20))
+	})
+	s.Engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+		http.MethodPost, "/t", strings.NewReader(strings.Repeat("q", 20))))
+	s.Engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+		http.MethodPost, "/t", strings.NewReader("small")))
+	require.Len(t, writer.records, 4)
+	require.Empty(t, writer.records[0].Body)
+	require.Empty(t, writer.records[1].Body)
+	require.Equal(t, true, writer.records[0].Attributes["body_truncated"])
+	require.Equal(t, []byte("small"), writer.records[2].Body)
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// CanarySelector selects the response records of one side of a canary
+// comparison, either those created within `[From, To)`, or those of the given
+// `req_hash` values if `Hashes` is not empty.
+type CanarySelector struct {
+	From, To time.Time
+	Hashes   [][]byte
+}
+
+// CanarySide aggregates the response records of one side.
+type CanarySide struct {
+	Responses int `json:"responses"`
+	// number of responses of each status code
+	Statuses map[int]int `json:"statuses"`
+	// most frequent body digest of each `req_hash`, keyed by the raw digest
+	bodies map[string]uint64
+}
+
+// CanaryReport compares the responses of the baseline and the canary. Latency
+// isn't compared, since it can't be told from the log table.
+type CanaryReport struct {
+	Baseline CanarySide `json:"baseline"`
+	Canary   CanarySide `json:"canary"`
+	// number of `req_hash` values found on both sides
+	Compared int `json:"compared"`
+	// number of compared `req_hash` values whose most frequent response body
+	// differs between the sides
+	BodyDiffs int `json:"body_diffs"`
+}
+
+// BodyDiffRate returns the proportion of compared requests whose responses
+// differ, 0 if nothing is compared.
+func (r *CanaryReport) BodyDiffRate() float64 {
+	if r.Compared < 1 {
+		return 0
+	}
+	return float64(r.BodyDiffs) / float64(r.Compared)
+}
+
+// CompareCanary aggregates the response records selected by each selector,
+// and compares the two sides.
+func CompareCanary(
+	ctx context.Context, conn *sql.DB, baseline, canary CanarySelector,
+) (*CanaryReport, error) {
+	report := &CanaryReport{}
+	var err error
+	if report.Baseline, err = canarySide(ctx, conn, baseline); nil != err {
+		return nil, err
+	}
+	if report.Canary, err = canarySide(ctx, conn, canary); nil != err {
+		return nil, err
+	}
+	for h, b := range report.Baseline.bodies {
+		c, ok := report.Canary.bodies[h]
+		if !ok {
+			continue
+		}
+		report.Compared++
+		if b != c {
+			report.BodyDiffs++
+		}
+	}
+	return report, nil
+}
+
+func canarySide(
+	ctx context.Context, conn *sql.DB, sel CanarySelector,
+) (CanarySide, error) {
+	side := CanarySide{Statuses: make(map[int]int)}
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	query := `SELECT req_hash, headers, body, body_codec FROM tx_log
+		WHERE headers LIKE 'HTTP/%' AND `
+	var args []any
+	if len(sel.Hashes) > 0 {
+		query += "req_hash IN (" +
+			strings.Repeat(",?", len(sel.Hashes))[1:] + ")"
+		for _, h := range sel.Hashes {
+			args = append(args, h)
+		}
+	} else {
+		query += "created_at >= ? AND created_at < ?"
+		args = append(args, formatStoredTime(sel.From),
+			formatStoredTime(sel.To))
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if nil != err {
+		return side, err
+	}
+	defer func() { _ = rows.Close() }()
+	// occurrences of each body digest of each `req_hash`
+	digests := make(map[string]map[uint64]int)
+	for rows.Next() {
+		var hash, body []byte
+		var headers string
+		var codec sql.NullString
+		if err = rows.Scan(&hash, &headers, &body, &codec); nil != err {
+			return side, err
+		}
+		if body, err = DecodeBody(codec.String, body); nil != err {
+			return side, err
+		}
+		side.Responses++
+		side.Statuses[storedStatus(headers)]++
+		h := string(hash)
+		if nil == digests[h] {
+			digests[h] = make(map[uint64]int)
+		}
+		digests[h][xxhash.Sum64(body)]++
+	}
+	if err = rows.Err(); nil != err {
+		return side, err
+	}
+	side.bodies = make(map[string]uint64, len(digests))
+	for h, counts := range digests {
+		var top uint64
+		for d, n := range counts {
+			if n > counts[top] || (n == counts[top] && d < top) {
+				top = d
+			}
+		}
+		side.bodies[h] = top
+	}
+	return side, nil
+}
+
+// storedStatus returns the status code in the status line of response
+// headers, 0 if it can't be parsed.
+func storedStatus(headers string) int {
+	_, rest, _ := strings.Cut(headers, " ")
+	code, _, _ := strings.Cut(rest, " ")
+	status, err := strconv.Atoi(code)
+	if nil != err {
+		return 0
+	}
+	return status
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+func Test_CompareCanary_compares_time_ranges(t *testing.T) {
+	_, conn := setupDb(t)
+	t0 := time.Now().Add(-time.Hour)
+	t1 := t0.Add(10 * time.Minute)
+	res := func(at time.Time, line, status, body string) TxRecord {
+		return TxRecord{
+			Request: line, At: at, Body: []byte(body),
+			Headers: []byte("HTTP/1.1 " + status + "\r\n"),
+		}
+	}
+	records := []any{
+		TxRecord{Request: "GET /a", At: t0, Headers: []byte("GET /a HTTP/1.1")},
+		res(t0, "GET /a", "200 OK", "a"),
+		res(t0, "GET /b", "200 OK", "b"),
+		res(t0, "GET /c", "200 OK", "c"),
+		res(t1, "GET /a", "200 OK", "a"),
+		res(t1, "GET /b", "500 Internal Server Error", "error"),
+		res(t1, "GET /b", "500 Internal Server Error", "error"),
+		res(t1, "GET /b", "200 OK", "b"),
+	}
+	query, args := SqlBuilder(utils.NewLogger(), &mockWriter{})(records)
+	_, err := conn.Exec(query, args...)
+	require.Nil(t, err)
+	report, err := CompareCanary(context.Background(), conn,
+		CanarySelector{From: t0, To: t1},
+		CanarySelector{From: t1, To: t1.Add(time.Minute)})
+	require.Nil(t, err)
+	require.Equal(t, 3, report.Baseline.Responses)
+	require.Equal(t, map[int]int{200: 3}, report.Baseline.Statuses)
+	require.Equal(t, 4, report.Canary.Responses)
+	require.Equal(t, map[int]int{200: 2, 500: 2}, report.Canary.Statuses)
+	require.Equal(t, 2, report.Compared)
+	require.Equal(t, 1, report.BodyDiffs)
+	require.Equal(t, 0.5, report.BodyDiffRate())
+	report, err = CompareCanary(context.Background(), conn,
+		CanarySelector{Hashes: [][]byte{
+			internal.SumString(internal.HashXxh64, "GET /a")}},
+		CanarySelector{Hashes: [][]byte{
+			internal.SumString(internal.HashXxh64, "GET /b")}})
+	require.Nil(t, err)
+	require.Equal(t, 2, report.Baseline.Responses)
+	require.Equal(t, 4, report.Canary.Responses)
+	require.Zero(t, report.Compared)
+}
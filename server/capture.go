@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// capturePool runs capture jobs, such as dumping headers and copying bodies,
+// off the request goroutines. Jobs are run inline if the queue is full.
+type capturePool struct {
+	jobs   chan func()
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newCapturePool(workers, queue int) *capturePool {
+	p := &capturePool{jobs: make(chan func(), queue)}
+	p.wg.Add(workers)
+	for range workers {
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+func (p *capturePool) submit(job func()) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		job()
+		return
+	}
+	select {
+	case p.jobs <- job:
+	default:
+		job()
+	}
+}
+
+// close waits for all queued jobs to finish.
+func (p *capturePool) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.jobs)
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// snapshotRequest returns a shallow copy of the request with its own header,
+// safe to dump after the handler has returned.
+func snapshotRequest(req *http.Request) *http.Request {
+	r := *req
+	r.Header = req.Header.Clone()
+	r.Body = nil
+	return &r
+}
+
+// responseCapture is a snapshot of the response taken on the request
+// goroutine, safe to be processed after the gin context is recycled.
+type responseCapture struct {
+	id      []byte
+	line    string
+	proto   string
+	status  int
+	header  http.Header
+	trailer http.Header
+	body    *internal.CaptureBuffer
+	aborted bool
+	attrs   map[string]any
+	partner string
+	at      time.Time
+	trace   *Trace
+	method  string
+	path    string
+	// time taken to serve the request
+	duration time.Duration
+	// shared with the request record
+	txId []byte
+	// whether bodies beyond the limit of the buffer are removed
+	skipOversized bool
+	// whether the response is slower than the SLO of its route
+	sloViolated bool
+}
+
+// oversized tells whether the body is beyond the limit of the buffer, thus
+// truncated regardless of the capture budget.
+func (rc *responseCapture) oversized() bool {
+	return rc.body.Limit > 0 && rc.body.Total > rc.body.Limit
+}
+
+// build formats the response record, and releases the capture buffer. The
+// record is usable even if an error is returned.
+func (rc *responseCapture) build() (TxRecord, error) {
+	rec := TxRecord{
+		Id: rc.id, Request: rc.line, At: rc.at, ClientAborted: rc.aborted,
+		Attributes: rc.attrs, Partner: rc.partner, Trace: rc.trace,
+		Method: rc.method, Path: rc.path, Status: rc.status,
+		Duration: rc.duration, TxId: rc.txId, Direction: DirectionResponse,
+		SloViolated: rc.sloViolated,
+	}
+	// bodies cut by the capture budget are flagged by RequestLogger instead
+	oversized := rc.oversized()
+	if oversized {
+		if nil == rec.Attributes {
+			rec.Attributes = make(map[string]any)
+		}
+		rec.Attributes["body_truncated"] = true
+		rec.Attributes["body_size"] = rc.body.Total
+	}
+	if len(rc.trailer) > 0 {
+		if nil == rec.Attributes {
+			rec.Attributes = make(map[string]any)
+		}
+		rec.Attributes["trailers"] = rc.trailer
+	}
+	// the capture buffer goes back to the pool, keep a copy
+	rec.Body = bytes.Clone(rc.body.Bytes())
+	if rc.skipOversized && oversized {
+		rec.Body = nil
+	}
+	rc.body.Release()
+	var err error
+	var buf bytes.Buffer
+	buf.Grow(4096)
+	if err = writeResponseLine(rc.proto, rc.status, &buf); err != nil {
+		err = fmt.Errorf("error dumping status: %w", err)
+	} else if err = writeResponseHeaders(rc.header, &buf); err != nil {
+		err = fmt.Errorf("error dumping headers: %w", err)
+	}
+	rec.Headers = buf.Bytes()
+	return rec, err
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RequestLogger_captures_response_as_sent(t *testing.T) {
+	writer := &mockCachedWriter{}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	s.Engine.GET("/t", func(c *gin.Context) {
+		c.Header("Trailer", "X-Checksum")
+		c.Status(http.StatusAccepted)
+		_, _ = c.Writer.WriteString("<html></html>")
+		// neither is sent as a header
+		c.Header("X-Late", "1")
+		c.Header("X-Checksum", "abc")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/t", nil)
+	req.Proto, req.ProtoMinor = "HTTP/1.0", 0
+	s.Engine.ServeHTTP(httptest.NewRecorder(), req)
+	require.Len(t, writer.records, 2)
+	rec := writer.records[1]
+	headers := string(rec.Headers)
+	require.True(t, strings.HasPrefix(headers, "HTTP/1.0 202 Accepted\r\n"))
+	require.Contains(t, headers, "Content-Type: text/html; charset=utf-8")
+	require.NotContains(t, headers, "X-Late")
+	require.NotContains(t, headers, "X-Checksum: abc")
+	require.Equal(t, http.Header{"X-Checksum": {"abc"}},
+		rec.Attributes["trailers"])
+}
+
+func Test_RequestLogger_pushes_request_record_before_handler(t *testing.T) {
+	writer := &mockCachedWriter{}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	var before int
+	s.Engine.POST("/t", func(c *gin.Context) {
+		writer.mu.Lock()
+		before = len(writer.records)
+		writer.mu.Unlock()
+		panic("boom")
+	})
+	s.Engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+		http.MethodPost, "/t", strings.NewReader("payload")))
+	require.Equal(t, 1, before)
+	require.Equal(t, DirectionRequest, writer.records[0].Direction)
+	require.Equal(t, "payload", string(writer.records[0].Body))
+}
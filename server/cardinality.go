@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// name of the gauge of distinct `req_hash` values in the rolling window
+const MetricReqHashCardinality = "persist_req_hash_cardinality"
+
+// CardinalityTracker estimates the number of distinct `req_hash` values in a
+// rolling window, made of a number of slots of equal length. A sudden rise
+// usually means a partner changed their URL scheme, or the service is being
+// fuzzed.
+type CardinalityTracker struct {
+	mu     sync.Mutex
+	slot   time.Duration
+	slots  []internal.HyperLogLog
+	cur    int
+	filled int
+	start  time.Time
+	// spike detection, disabled if factor is 0
+	factor  float64
+	floor   uint64
+	onSpike func(current, baseline uint64)
+	now     func() time.Time
+}
+
+// NewCardinalityTracker creates a tracker of the given number of slots, each
+// covering the given duration.
+func NewCardinalityTracker(
+	slot time.Duration, slots int,
+) *CardinalityTracker {
+	if slots < 1 {
+		slots = 1
+	}
+	return &CardinalityTracker{
+		slot: slot, slots: make([]internal.HyperLogLog, slots), filled: 1,
+		start: time.Now(), now: time.Now,
+	}
+}
+
+// OnSpike runs the given function whenever a slot is completed with more than
+// `factor` times the average distinct values of previous slots. Slots of no
+// more than `floor` distinct values are ignored, to tolerate quiet periods.
+// Slots are completed upon the first Observe or Estimate after their end.
+func (t *CardinalityTracker) OnSpike(
+	factor float64, floor uint64, fn func(current, baseline uint64),
+) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.factor, t.floor, t.onSpike = factor, floor, fn
+}
+
+// Observe adds a `req_hash` value to the current slot.
+func (t *CardinalityTracker) Observe(digest []byte) {
+	if nil == t {
+		return
+	}
+	t.mu.Lock()
+	spike := t.rotate()
+	t.slots[t.cur].Add(xxhash.Sum64(digest))
+	t.mu.Unlock()
+	spike()
+}
+
+// Estimate returns the number of distinct values in the whole window.
+func (t *CardinalityTracker) Estimate() uint64 {
+	if nil == t {
+		return 0
+	}
+	t.mu.Lock()
+	spike := t.rotate()
+	var all internal.HyperLogLog
+	for i := range t.slots {
+		all.Merge(&t.slots[i])
+	}
+	t.mu.Unlock()
+	spike()
+	return all.Estimate()
+}
+
+// rotate completes elapsed slots, and returns the function reporting a spike
+// of the last completed one, to be called without holding the lock.
+func (t *CardinalityTracker) rotate() func() {
+	report := func() {}
+	if t.slot <= 0 {
+		return report
+	}
+	elapsed := int(t.now().Sub(t.start) / t.slot)
+	for i := 0; i < elapsed && i < len(t.slots); i++ {
+		if 0 == i {
+			report = t.checkSpike()
+		}
+		t.cur = (t.cur + 1) % len(t.slots)
+		t.slots[t.cur].Reset()
+		t.filled = min(t.filled+1, len(t.slots))
+	}
+	t.start = t.start.Add(time.Duration(elapsed) * t.slot)
+	return report
+}
+
+func (t *CardinalityTracker) checkSpike() func() {
+	report := func() {}
+	if nil == t.onSpike || t.factor <= 0 || t.filled < 2 {
+		return report
+	}
+	current := t.slots[t.cur].Estimate()
+	if current <= t.floor {
+		return report
+	}
+	var sum uint64
+	for i := 1; i < t.filled; i++ {
+		idx := (t.cur - i + len(t.slots)) % len(t.slots)
+		sum += t.slots[idx].Estimate()
+	}
+	baseline := sum / uint64(t.filled-1)
+	if float64(current) <= t.factor*float64(baseline) {
+		return report
+	}
+	fn := t.onSpike
+	return func() { fn(current, baseline) }
+}
+
+// TrackCardinality exposes the tracker as MetricReqHashCardinality, and raises
+// an Alert of kind "cardinality" upon spikes if `CardinalitySpike` is set. The
+// tracker is fed by the SQL builder, see WithCardinality.
+func (s *Server) TrackCardinality(t *CardinalityTracker) {
+	s.cardinality = t
+	if nil == s.Conf || s.Conf.CardinalitySpike <= 0 {
+		return
+	}
+	t.OnSpike(s.Conf.CardinalitySpike, s.Conf.CardinalityFloor,
+		func(current, baseline uint64) {
+			s.Alert(Alert{
+				Kind: "cardinality",
+				Detail: fmt.Sprintf("%d distinct req_hash, baseline %d",
+					current, baseline),
+				Time: time.Now(),
+			})
+		})
+}
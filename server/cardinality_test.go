@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/binary"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+)
+
+func observeDistinct(t *CardinalityTracker, from, to int) {
+	for i := from; i < to; i++ {
+		t.Observe(binary.BigEndian.AppendUint64(nil, uint64(i)))
+	}
+}
+
+func Test_CardinalityTracker_estimates_rolling_window(t *testing.T) {
+	now := time.Now()
+	tracker := NewCardinalityTracker(time.Minute, 3)
+	tracker.start, tracker.now = now, func() time.Time { return now }
+	observeDistinct(tracker, 0, 1000)
+	observeDistinct(tracker, 0, 1000)
+	require.InEpsilon(t, 1000, tracker.Estimate(), 0.03)
+	now = now.Add(time.Minute)
+	observeDistinct(tracker, 1000, 2000)
+	require.InEpsilon(t, 2000, tracker.Estimate(), 0.03)
+	now = now.Add(3 * time.Minute)
+	require.Zero(t, tracker.Estimate())
+}
+
+func Test_TrackCardinality_alerts_spikes(t *testing.T) {
+	cfg := &Config{CardinalitySpike: 3, CardinalityFloor: 10}
+	s := NewServer(&http.Server{}, &mockCachedWriter{}, utils.NewLogger(), cfg)
+	var alerts []Alert
+	s.OnAlert(func(a Alert) { alerts = append(alerts, a) })
+	now := time.Now()
+	tracker := NewCardinalityTracker(time.Minute, 4)
+	tracker.start, tracker.now = now, func() time.Time { return now }
+	s.TrackCardinality(tracker)
+	observeDistinct(tracker, 0, 100)
+	now = now.Add(time.Minute)
+	observeDistinct(tracker, 0, 120)
+	now = now.Add(time.Minute)
+	observeDistinct(tracker, 0, 2000)
+	require.Empty(t, alerts)
+	now = now.Add(time.Minute)
+	require.Positive(t, s.Metrics()[MetricReqHashCardinality])
+	require.Len(t, alerts, 1)
+	require.Equal(t, "cardinality", alerts[0].Kind)
+}
+
+func Test_SqlBuilder_feeds_cardinality_tracker(t *testing.T) {
+	tracker := NewCardinalityTracker(time.Minute, 1)
+	build := SqlBuilder(utils.NewLogger(), nil, WithCardinality(tracker))
+	build([]any{
+		TxRecord{Request: "GET /a"}, TxRecord{Request: "GET /a"},
+		TxRecord{Request: "GET /b"},
+	})
+	require.Equal(t, uint64(2), tracker.Estimate())
+}
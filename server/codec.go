@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Names of built-in codecs, recorded in `body_codec`. Codecs not built in,
+// such as lz4, can be added with RegisterCodec.
+const (
+	CodecIdentity = "identity"
+	CodecGzip     = "gzip"
+	CodecZstd     = "zstd"
+	CodecSnappy   = "snappy"
+)
+
+// Codec compresses bodies before they are persisted. Implementations must be
+// safe for concurrent use.
+type Codec interface {
+	// Name returns the name recorded in `body_codec`, at most 16 bytes.
+	Name() string
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+var (
+	codecs   = map[string]Codec{}
+	codecsMu sync.RWMutex
+)
+
+func init() {
+	for _, c := range []Codec{
+		identityCodec{}, gzipCodec{}, &zstdCodec{name: CodecZstd}, snappyCodec{},
+	} {
+		RegisterCodec(c)
+	}
+}
+
+// RegisterCodec adds a codec to the registry, replacing the one of the same
+// name.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// LookupCodec returns the codec of the given name, empty being identity.
+func LookupCodec(name string) (Codec, bool) {
+	if "" == name {
+		name = CodecIdentity
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// DecodeBody decodes a body persisted with the codec of the given name.
+func DecodeBody(codec string, body []byte) ([]byte, error) {
+	if len(body) < 1 {
+		return body, nil
+	}
+	c, ok := LookupCodec(codec)
+	if !ok {
+		return nil, fmt.Errorf("unknown body codec: %s", codec)
+	}
+	return c.Decode(body)
+}
+
+type identityCodec struct{}
+
+func (identityCodec) Name() string { return CodecIdentity }
+
+func (identityCodec) Encode(src []byte) ([]byte, error) { return src, nil }
+
+func (identityCodec) Decode(src []byte) ([]byte, error) { return src, nil }
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return CodecGzip }
+
+func (gzipCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); nil != err {
+		return nil, err
+	}
+	if err := w.Close(); nil != err {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if nil != err {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	return io.ReadAll(r)
+}
+
+// zstdCodec creates the encoder and decoder upon first use, both are safe for
+// concurrent EncodeAll and DecodeAll. It compresses with the dictionary if
+// there is one.
+type zstdCodec struct {
+	name string
+	dict []byte
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (c *zstdCodec) Name() string { return c.name }
+
+func (c *zstdCodec) init() error {
+	c.once.Do(func() {
+		var eo []zstd.EOption
+		var do []zstd.DOption
+		if nil != c.dict {
+			eo = append(eo, zstd.WithEncoderDict(c.dict))
+			do = append(do, zstd.WithDecoderDicts(c.dict))
+		}
+		if c.enc, c.err = zstd.NewWriter(nil, eo...); nil != c.err {
+			return
+		}
+		c.dec, c.err = zstd.NewReader(nil, do...)
+	})
+	return c.err
+}
+
+func (c *zstdCodec) Encode(src []byte) ([]byte, error) {
+	if err := c.init(); nil != err {
+		return nil, err
+	}
+	return c.enc.EncodeAll(src, nil), nil
+}
+
+func (c *zstdCodec) Decode(src []byte) ([]byte, error) {
+	if err := c.init(); nil != err {
+		return nil, err
+	}
+	return c.dec.DecodeAll(src, nil)
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return CodecSnappy }
+
+func (snappyCodec) Encode(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCodec) Decode(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Codecs_round_trip(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"id":1,"status":"ok"}`), 50)
+	for _, name := range []string{
+		CodecIdentity, CodecGzip, CodecZstd, CodecSnappy,
+	} {
+		c, ok := LookupCodec(name)
+		require.True(t, ok, name)
+		encoded, err := c.Encode(body)
+		require.Nil(t, err, name)
+		decoded, err := DecodeBody(name, encoded)
+		require.Nil(t, err, name)
+		require.Equal(t, body, decoded, name)
+	}
+	_, err := DecodeBody("lz4", body)
+	require.ErrorContains(t, err, "unknown body codec: lz4")
+}
+
+func Test_SqlBuilder_compresses_bodies(t *testing.T) {
+	_, conn := setupDb(t)
+	codec, _ := LookupCodec(CodecZstd)
+	body := bytes.Repeat([]byte(`{"id":1,"status":"ok"}`), 50)
+	query, args := SqlBuilder(utils.NewLogger(), &mockWriter{},
+		WithBodyCodec(codec))([]any{
+		TxRecord{Request: "GET /a", Body: body, At: time.Now()},
+		// incompressible bodies are kept as is
+		TxRecord{Request: "GET /b", Body: []byte("x"), At: time.Now()},
+	})
+	require.Equal(t, sql.Null[string]{V: CodecZstd, Valid: true}, args[12])
+	require.False(t, args[numColumns+12].(sql.Null[string]).Valid)
+	_, err := conn.Exec(query, args...)
+	require.Nil(t, err)
+	store := NewRecordStore(conn, true)
+	ctx := context.Background()
+	page, err := store.Records(ctx, RecordQuery{})
+	require.Nil(t, err)
+	bodies, err := store.Bodies(ctx, page[0].Id, page[1].Id)
+	require.Nil(t, err)
+	require.Equal(t, body, bodies[formatUuid(page[0].Id)])
+	require.Equal(t, []byte("x"), bodies[formatUuid(page[1].Id)])
+}
+
+func Test_TrainZstdDict_compresses_similar_bodies(t *testing.T) {
+	_, conn := setupDb(t)
+	var records []any
+	for i := 0; i < 200; i++ {
+		records = append(records, TxRecord{
+			Request: "POST /callback", At: time.Now(),
+			Body: []byte(fmt.Sprintf(`{"event":"payment.succeeded",`+
+				`"order_id":"ord_%06d","amount":%d,"currency":"USD"}`,
+				i, i*100)),
+		})
+	}
+	query, args := SqlBuilder(utils.NewLogger(), &mockWriter{})(records)
+	_, err := conn.Exec(query, args...)
+	require.Nil(t, err)
+	dictionary, err := TrainZstdDict(context.Background(), conn,
+		ZstdDictOptions{Id: 12345})
+	require.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "bodies.dict")
+	require.Nil(t, os.WriteFile(path, dictionary, 0o600))
+	name, err := LoadZstdDict(path)
+	require.Nil(t, err)
+	require.Equal(t, "zstd:12345", name)
+	codec, ok := LookupCodec(name)
+	require.True(t, ok)
+	plain, _ := LookupCodec(CodecZstd)
+	body := []byte(`{"event":"payment.succeeded","order_id":"ord_999999",` +
+		`"amount":42,"currency":"USD"}`)
+	encoded, err := codec.Encode(body)
+	require.Nil(t, err)
+	unprimed, err := plain.Encode(body)
+	require.Nil(t, err)
+	require.Less(t, len(encoded), len(unprimed))
+	decoded, err := DecodeBody(name, encoded)
+	require.Nil(t, err)
+	require.Equal(t, body, decoded)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// envReader collects errors of reading env variables, so all of them are
+// reported at once.
+type envReader struct {
+	errs []error
+}
+
+// check records the error of the given variable, if any.
+func (r *envReader) check(key string, err error) {
+	if nil != err {
+		r.errs = append(r.errs, fmt.Errorf("%s: %w", key, err))
+	}
+}
+
+// err returns all recorded errors joined, nil if there is none.
+func (r *envReader) err() error {
+	return errors.Join(r.errs...)
+}
+
+// envValue reads the variable with one of the `utils.GetEnvX` functions, and
+// records its error.
+func envValue[T any](
+	r *envReader, key string, fn func(string, T) (T, error), def T,
+) T {
+	v, err := fn(key, def)
+	r.check(key, err)
+	return v
+}
+
+// envDuration returns a `utils.GetEnvX` like function reading durations,
+// either Go duration strings, such as `750ms` or `2m`, or bare numbers in the
+// given unit, as the variables were formerly read.
+func envDuration(
+	unit time.Duration,
+) func(string, time.Duration) (time.Duration, error) {
+	return func(key string, def time.Duration) (time.Duration, error) {
+		val := strings.TrimSpace(os.Getenv(key))
+		if "" == val {
+			return def, nil
+		}
+		if n, err := strconv.ParseUint(val, 10, 32); nil == err {
+			return time.Duration(n) * unit, nil
+		}
+		d, err := time.ParseDuration(val)
+		if nil != err {
+			return 0, err
+		}
+		if d < 0 {
+			return 0, fmt.Errorf("negative duration: %s", val)
+		}
+		return d, nil
+	}
+}
+
+// Validate reports all problems of the config joined in one error, including
+// those of Db, nil if there is none.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if "" == c.ListenAddr {
+		fail("LISTEN: listen address is empty")
+	}
+	if 0 != c.FilePerm&^0777 || 0 == c.FilePerm&0200 {
+		fail("LOG_FILE_MODE: log files must be owner writable, got %#o",
+			c.FilePerm)
+	}
+	if "" != c.AccessLog && AccessLogText != c.AccessLog &&
+		AccessLogJson != c.AccessLog {
+		fail("ACCESS_LOG: unsupported access log format: %s", c.AccessLog)
+	}
+	if "" != c.OverflowPolicy && OverflowLog != c.OverflowPolicy &&
+		OverflowDrop != c.OverflowPolicy {
+		fail("OVERFLOW_POLICY: unsupported overflow policy: %s",
+			c.OverflowPolicy)
+	}
+	if "" != c.HashAlgorithm && nil == internal.NewHasher(c.HashAlgorithm) {
+		fail("HASH_ALGO: unsupported hash algorithm: %s", c.HashAlgorithm)
+	}
+	for _, t := range c.ResponseBufferTiers {
+		if t < 1 {
+			fail("RES_BUFFER_TIERS: tiers must be positive, got %d", t)
+		}
+	}
+	for _, v := range []struct {
+		key string
+		v   int64
+	}{
+		{"LOG_FILE_MAX_BYTES", c.LogFileMaxBytes},
+		{"RES_BUFFER_MAX", int64(c.MaxResponseBuffer)},
+		{"MAX_CAPTURE_BYTES", int64(c.MaxCaptureBytes)},
+		{"MAX_BODY_BYTES", int64(c.MaxBodyBytes)},
+		{"READY_MAX_PENDING_BYTES", c.ReadyMaxPendingBytes},
+		{"SYNC_TIMEOUT_MS", int64(c.SyncTimeout)},
+		{"RETRY_BACKOFF_MS", int64(c.RetryBackoff)},
+		{"SHUTDOWN_TIMEOUT", int64(c.ShutdownTimeout)},
+		{"MAX_RETRIES", int64(c.MaxRetries)},
+		{"INTERVAL", int64(c.FlushInterval)},
+		{"INTERVAL_JITTER_MS", int64(c.FlushJitter)},
+		{"DRAIN_TIMEOUT", int64(c.DrainTimeout)},
+		{"MAX_PENDING_BYTES", c.MaxPendingBytes},
+		{"TLS_RELOAD_INTERVAL", int64(c.TLSReloadInterval)},
+	} {
+		if v.v < 0 {
+			fail("%s: must not be negative, got %d", v.key, v.v)
+		}
+	}
+	// stored headers carry credentials, and metrics tell the traffic
+	if len(c.AdminKeys) < 1 && ("" != c.LogsPath || "" != c.MetricsPath) {
+		fail("LOGS_PATH, METRICS_PATH: require ADMIN_KEYS")
+	}
+	if len(c.AdminKeys) < 1 && "" != c.GrpcListen {
+		fail("GRPC_LISTEN: requires ADMIN_KEYS")
+	}
+	if "" != c.RelaySocket && c.RelayQueue < 1 {
+		fail("RELAY_QUEUE: must be positive, got %d", c.RelayQueue)
+	}
+	if c.RetentionDays > 0 && c.PurgeInterval <= 0 {
+		fail("PURGE_INTERVAL: must be positive, got %v", c.PurgeInterval)
+	}
+	if c.RetentionDays > 0 && c.PurgeBatch < 1 {
+		fail("PURGE_BATCH: must be positive, got %d", c.PurgeBatch)
+	}
+	if c.RetentionDays > 0 && c.Db.clickhouse() {
+		fail("RETENTION_DAYS: can't be used with clickhouse, " +
+			"use a TTL of the table instead")
+	}
+	if "" != c.LeaderLock && c.LeaderInterval <= 0 {
+		fail("LEADER_INTERVAL: must be positive, got %v", c.LeaderInterval)
+	}
+	if len(c.LeaderLock) > 64 {
+		fail("LEADER_LOCK: must not be longer than 64, got %d",
+			len(c.LeaderLock))
+	}
+	if "" != c.LeaderLock && c.Db.clickhouse() {
+		fail("LEADER_LOCK: can't be used with clickhouse")
+	}
+	// the leader pins a connection, leaving none to the writer
+	if "" != c.LeaderLock && nil != c.Db && c.Db.mysqlFamily() &&
+		1 == c.Db.MaxOpenConns {
+		fail("DB_MAX_OPEN_CONNS: must be at least 2 with LEADER_LOCK")
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		fail("LOG_SAMPLE_RATE: must be within 0.0 to 1.0, got %v",
+			c.SampleRate)
+	}
+	if c.CardinalityWindow > 0 && c.CardinalitySlots < 1 {
+		fail("CARDINALITY_SLOTS: at least 1 slot is required")
+	}
+	if c.CardinalitySpike < 0 ||
+		(c.CardinalitySpike > 0 && c.CardinalitySpike <= 1) {
+		fail("CARDINALITY_SPIKE: must be 0 or greater than 1, got %v",
+			c.CardinalitySpike)
+	}
+	if c.HTTP3 && strings.HasPrefix(c.ListenAddr, "unix:") {
+		fail("HTTP3: can't be served on unix socket %s", c.ListenAddr)
+	}
+	if c.HTTP3 && nil == http3Factory.Load() {
+		fail("HTTP3: no HTTP/3 server is registered, see RegisterHTTP3")
+	}
+	if c.HTTP3 && "" == c.TLSCert {
+		fail("HTTP3: requires TLS_CERT and TLS_KEY")
+	}
+	if ("" == c.TLSCert) != ("" == c.TLSKey) {
+		fail("TLS_CERT, TLS_KEY: both or neither must be set")
+	}
+	if "" != c.TLSCert && strings.HasPrefix(c.ListenAddr, "unix:") {
+		fail("TLS_CERT: TLS can't be served on unix socket %s", c.ListenAddr)
+	}
+	for _, r := range c.SyncRoutes {
+		method, path, _ := strings.Cut(strings.TrimSpace(r), " ")
+		if "" == method || !strings.HasPrefix(strings.TrimSpace(path), "/") {
+			fail("SYNC_ROUTES: route must be `METHOD /path`, got %q", r)
+		}
+	}
+	if nil != c.Db {
+		errs = append(errs, c.Db.Validate())
+	}
+	return errors.Join(errs...)
+}
+
+// Validate reports all problems of the config joined in one error, nil if
+// there is none.
+func (c *DbConfig) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if "" == c.Driver {
+		fail("DB_DRIVER: DB driver is empty")
+	}
+	if "" == c.Dsn {
+		fail("DB_DSN: DSN is empty")
+	}
+	if "" != c.Driver && !slices.Contains(
+		[]string{"mysql", "mariadb", "tidb", "sqlite3", "clickhouse"},
+		c.dialect()) {
+		fail("DB_DRIVER: unsupported SQL dialect: %s", c.dialect())
+	}
+	if "" != c.Oversized && OversizedTruncate != c.Oversized &&
+		OversizedReject != c.Oversized {
+		fail("DB_OVERSIZED: must be `%s` or `%s`, got %s",
+			OversizedTruncate, OversizedReject, c.Oversized)
+	}
+	if c.mysqlFamily() && !c.mysqlSchema().Valid() {
+		fail("DB_BODY_TYPE, DB_CHARSET, DB_HEADERS_COLLATION: "+
+			"unsupported MySQL schema: %+v", c.mysqlSchema())
+	}
+	for _, cols := range c.Indexes {
+		for _, col := range cols {
+			if !slices.Contains(indexColumns, col) {
+				fail("DB_INDEXES: column can't be indexed: %s", col)
+			}
+		}
+	}
+	// dictionary codecs are only registered by DefaultServer
+	if _, ok := LookupCodec(c.BodyCodec); !ok && len(c.BodyDicts) < 1 {
+		fail("DB_BODY_CODEC: unknown codec: %s", c.BodyCodec)
+	}
+	if c.TidbShardBits < 0 || c.TidbShardBits > 15 {
+		fail("DB_TIDB_SHARD_BITS: must be within 0-15, got %d",
+			c.TidbShardBits)
+	}
+	if (c.MariadbUuid || c.MariadbCompressed) &&
+		"mysql" != c.dialect() && "mariadb" != c.dialect() {
+		fail("DB_MARIADB_UUID, DB_MARIADB_COMPRESSED: MariaDB options "+
+			"can't be used with %s", c.dialect())
+	}
+	if c.KeepFullRequestLine && c.MaxRequestLine < 1 {
+		fail("DB_KEEP_FULL_REQUEST_LINE: requires DB_MAX_REQUEST_LINE")
+	}
+	if "" != c.FallbackDsn && c.FallbackRetry <= 0 {
+		fail("DB_FALLBACK_RETRY: must be positive with DB_FALLBACK_DSN")
+	}
+	if c.WarmupConns > 0 && c.WarmupTimeout <= 0 {
+		fail("DB_WARMUP_TIMEOUT: must be positive with DB_WARMUP_CONNS")
+	}
+	if c.clickhouse() && (c.Views || c.Audit || c.Meta || c.Checkpoints ||
+		c.RawErrors || c.Savepoints || c.SingleRowInserts) {
+		fail("DB_VIEWS, DB_AUDIT, DB_META, DB_CHECKPOINTS, DB_RAW_ERRORS, " +
+			"DB_SAVEPOINTS, DB_SINGLE_ROW: can't be used with clickhouse")
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ConfigFromEnv_reports_all_problems(t *testing.T) {
+	t.Setenv("LOG_FILE_MODE", "abc")
+	t.Setenv("CAPTURE_WORKERS", "-1")
+	t.Setenv("ACCESS_LOG", "xml")
+	t.Setenv("SYNC_ROUTES", "/no-method")
+	t.Setenv("MAX_RETRIES", "often")
+	t.Setenv("OVERFLOW_POLICY", "block")
+	cfg, err := ConfigFromEnv()
+	require.NotNil(t, cfg)
+	require.ErrorContains(t, err, "LOG_FILE_MODE: ")
+	require.ErrorContains(t, err, "CAPTURE_WORKERS: ")
+	require.ErrorContains(t, err, "ACCESS_LOG: unsupported access log format")
+	require.ErrorContains(t, err, "SYNC_ROUTES: ")
+	require.ErrorContains(t, err, "MAX_RETRIES: ")
+	require.ErrorContains(t, err,
+		"OVERFLOW_POLICY: unsupported overflow policy: block")
+	require.Panics(t, func() { DefaultConfigFromEnv() })
+}
+
+func Test_DbConfigFromEnv_reports_all_problems(t *testing.T) {
+	t.Setenv("DB_DRIVER", "")
+	t.Setenv("DB_DSN", "")
+	t.Setenv("DB_BATCH_SIZE", "many")
+	t.Setenv("DB_ISOLATION", "sloppy")
+	t.Setenv("DB_INDEXES", "body")
+	_, err := DbConfigFromEnv()
+	require.ErrorContains(t, err, "DB_DRIVER: DB driver is empty")
+	require.ErrorContains(t, err, "DB_DSN: DSN is empty")
+	require.ErrorContains(t, err, "DB_BATCH_SIZE: ")
+	require.ErrorContains(t, err, "DB_ISOLATION: unsupported isolation level")
+	require.ErrorContains(t, err, "DB_INDEXES: column can't be indexed: body")
+	require.Panics(t, func() { DefaultDbConfigFromEnv() })
+}
+
+func Test_Config_Validate_reports_conflicts(t *testing.T) {
+	cfg := &Config{
+		ListenAddr:        "unix:/tmp/test.sock",
+		FilePerm:          0444,
+		HTTP3:             true,
+		CardinalityWindow: time.Second,
+		CardinalitySpike:  0.5,
+		Db: &DbConfig{
+			Driver: "sqlite3", Dsn: ":memory:", MariadbUuid: true,
+			KeepFullRequestLine: true, FallbackDsn: "file::memory:",
+		},
+	}
+	err := cfg.Validate()
+	require.ErrorContains(t, err, "LOG_FILE_MODE: ")
+	require.ErrorContains(t, err, "HTTP3: ")
+	require.ErrorContains(t, err, "CARDINALITY_SLOTS: ")
+	require.ErrorContains(t, err, "CARDINALITY_SPIKE: ")
+	require.ErrorContains(t, err, "DB_MARIADB_UUID, DB_MARIADB_COMPRESSED: ")
+	require.ErrorContains(t, err, "DB_KEEP_FULL_REQUEST_LINE: ")
+	require.ErrorContains(t, err, "DB_FALLBACK_RETRY: ")
+}
+
+func Test_Config_Validate_accepts_defaults(t *testing.T) {
+	t.Setenv("DB_DRIVER", "sqlite3")
+	t.Setenv("DB_DSN", ":memory:")
+	dbcfg, err := DbConfigFromEnv()
+	require.Nil(t, err)
+	cfg, err := ConfigFromEnv()
+	require.Nil(t, err)
+	cfg.Db = dbcfg
+	require.Nil(t, cfg.Validate())
+}
+
+func Test_envDuration_accepts_duration_strings(t *testing.T) {
+	t.Setenv("INTERVAL", "750ms")
+	t.Setenv("DRAIN_TIMEOUT", "3")
+	t.Setenv("SHUTDOWN_TIMEOUT", "2m")
+	t.Setenv("SYNC_TIMEOUT_MS", "250")
+	t.Setenv("DB_FLUSH_TIMEOUT", "soon")
+	d, err := envDuration(time.Second)("INTERVAL", time.Second)
+	require.Nil(t, err)
+	require.Equal(t, 750*time.Millisecond, d)
+	d, err = envDuration(time.Second)("DRAIN_TIMEOUT", time.Second)
+	require.Nil(t, err)
+	require.Equal(t, 3*time.Second, d)
+	cfg, err := ConfigFromEnv()
+	require.Nil(t, err)
+	require.Equal(t, 2*time.Minute, cfg.ShutdownTimeout)
+	require.Equal(t, 250*time.Millisecond, cfg.SyncTimeout)
+	require.Equal(t, 750*time.Millisecond, cfg.FlushInterval)
+	require.Equal(t, 3*time.Second, cfg.DrainTimeout)
+	t.Setenv("DB_DRIVER", "sqlite3")
+	t.Setenv("DB_DSN", ":memory:")
+	_, err = DbConfigFromEnv()
+	require.ErrorContains(t, err, "DB_FLUSH_TIMEOUT: ")
+	t.Setenv("INTERVAL", "-1s")
+	_, err = envDuration(time.Second)("INTERVAL", time.Second)
+	require.ErrorContains(t, err, "negative duration")
+}
+
+func Test_ConfigFromEnv_accepts_millisecond_durations(t *testing.T) {
+	for _, v := range []struct {
+		val      string
+		expected time.Duration
+	}{{"750ms", 750 * time.Millisecond}, {"1s", time.Second},
+		{"20", 20 * time.Millisecond}} {
+		t.Setenv("SYNC_TIMEOUT_MS", v.val)
+		t.Setenv("INTERVAL_JITTER_MS", v.val)
+		t.Setenv("RETRY_BACKOFF_MS", v.val)
+		cfg, err := ConfigFromEnv()
+		require.Nil(t, err, v.val)
+		require.Equal(t, v.expected, cfg.SyncTimeout, v.val)
+		require.Equal(t, v.expected, cfg.FlushJitter, v.val)
+		require.Equal(t, v.expected, cfg.RetryBackoff, v.val)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// connMeta tracks a connection accepted by the server.
+type connMeta struct {
+	id uint64
+	// number of requests served so far
+	requests atomic.Uint64
+}
+
+type connMetaKey struct{}
+
+var connIds atomic.Uint64
+
+// attachConnMeta numbers connections in request contexts, chaining the
+// existing ConnContext.
+func (s *Server) attachConnMeta(svr *http.Server) {
+	next := svr.ConnContext
+	svr.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if nil != next {
+			ctx = next(ctx, c)
+		}
+		return context.WithValue(ctx, connMetaKey{},
+			&connMeta{id: connIds.Add(1)})
+	}
+}
+
+// annotateConn sets the remote port and connection of the request on the
+// record, counting the request on its connection.
+func annotateConn(req *http.Request, rec *TxRecord) {
+	if _, port, err := net.SplitHostPort(req.RemoteAddr); nil == err {
+		rec.RemotePort, _ = strconv.Atoi(port)
+	}
+	if meta, ok := req.Context().Value(connMetaKey{}).(*connMeta); ok {
+		rec.ConnId = meta.id
+		rec.ConnReused = meta.requests.Add(1) > 1
+	}
+}
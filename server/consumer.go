@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eidng8/go-utils"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// Cursor is the position of a record in `tx_log`, in the order of
+// `created_at` and ID.
+type Cursor struct {
+	CreatedAt time.Time
+	// ID as stored, binary or text
+	Id any
+}
+
+// CreateCheckpointTable creates the `tx_checkpoint` table.
+func CreateCheckpointTable(cfg *DbConfig, conn *sql.DB) error {
+	stmt := internal.SqliteCheckpointTable()
+	if cfg.mysqlFamily() {
+		stmt = internal.MysqlCheckpointTable()
+	}
+	_, err := conn.Exec(stmt)
+	return err
+}
+
+// LoadCheckpoint returns the cursor saved of the consumer, and false if there
+// is none.
+func LoadCheckpoint(
+	ctx context.Context, conn *sql.DB, name string,
+) (Cursor, bool, error) {
+	var at, id any
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	err := conn.QueryRowContext(ctx, `SELECT created_at, record_id
+		FROM tx_checkpoint WHERE name = ?`, name).Scan(&at, &id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Cursor{}, false, nil
+	}
+	if nil != err {
+		return Cursor{}, false, err
+	}
+	t, err := parseStoredTime(at)
+	if nil != err {
+		return Cursor{}, false, err
+	}
+	return Cursor{CreatedAt: t, Id: id}, true, nil
+}
+
+// SaveCheckpoint saves the cursor of the consumer in `tx_checkpoint`.
+func SaveCheckpoint(
+	ctx context.Context, cfg *DbConfig, conn *sql.DB, name string, c Cursor,
+) error {
+	stmt := internal.SqliteSaveCheckpoint()
+	if cfg.mysqlFamily() {
+		stmt = internal.MysqlSaveCheckpoint()
+	}
+	_, err := conn.ExecContext(ctx, stmt, name, formatStoredTime(c.CreatedAt),
+		c.Id, formatStoredTime(time.Now()))
+	return err
+}
+
+// ConsumerOptions configures a Consumer. Zero fields take their defaults.
+type ConsumerOptions struct {
+	// key of the checkpoint in `tx_checkpoint`, required
+	Name string
+	// only records of the direction, DirectionRequest or DirectionResponse,
+	// are dispatched, all records if empty
+	Direction string
+	// whether records are dispatched with their decoded bodies
+	Bodies bool
+	// maximum number of records read at a time, defaults to 100
+	Batch int
+	// interval of polling once caught up, defaults to 1 second
+	Interval time.Duration
+	// records are only read once they're older than it, defaults to 5
+	// seconds, so those of batches committed late aren't skipped
+	Lag time.Duration
+	// Optional, Start only polls while the elector is the leader
+	Elector *Elector
+	Logger  utils.TaggedLogger
+}
+
+// Consumer tails `tx_log` in the order of `created_at` and ID, dispatching
+// records to a handler, for processing callbacks after they've been stored.
+// The cursor is checkpointed in `tx_checkpoint` after each batch, so
+// consumers resume where they stopped. Records are dispatched at least once:
+// one failed by the handler stops its batch, and is dispatched again upon
+// the next poll, along with the records following it.
+type Consumer struct {
+	cfg     *DbConfig
+	conn    *sql.DB
+	store   *RecordStore
+	opts    ConsumerOptions
+	handler func(context.Context, StoredRow) error
+	// the cursor of the last record handled, nil until loaded
+	cursor *Cursor
+}
+
+// NewConsumer creates a consumer dispatching records to the handler.
+func NewConsumer(
+	cfg *DbConfig, conn *sql.DB, opts ConsumerOptions,
+	handler func(ctx context.Context, row StoredRow) error,
+) (*Consumer, error) {
+	if "" == opts.Name {
+		return nil, errors.New("consumer name is empty")
+	}
+	if len(opts.Name) > 64 {
+		return nil, fmt.Errorf("consumer name is longer than 64: %s",
+			opts.Name)
+	}
+	if opts.Batch < 1 {
+		opts.Batch = 100
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Lag <= 0 {
+		opts.Lag = 5 * time.Second
+	}
+	if nil == opts.Logger {
+		opts.Logger = utils.NewLogger()
+	}
+	return &Consumer{
+		cfg: cfg, conn: conn, store: NewRecordStore(conn, opts.Bodies),
+		opts: opts, handler: handler,
+	}, nil
+}
+
+// Poll dispatches the next batch of records, returning the number of records
+// handled. The cursor is checkpointed after the last record handled or
+// skipped, even if the handler fails one.
+func (c *Consumer) Poll(ctx context.Context) (int, error) {
+	_, handled, err := c.poll(ctx)
+	return handled, err
+}
+
+// poll returns the number of records read along with those handled.
+func (c *Consumer) poll(ctx context.Context) (int, int, error) {
+	if nil == c.cursor {
+		cursor, _, err := LoadCheckpoint(ctx, c.conn, c.opts.Name)
+		if nil != err {
+			return 0, 0, fmt.Errorf("error loading checkpoint: %w", err)
+		}
+		if nil == cursor.Id {
+			cursor.Id = []byte{}
+		}
+		c.cursor = &cursor
+	}
+	rows, err := c.store.Records(ctx, RecordQuery{
+		Since: c.cursor, To: time.Now().Add(-c.opts.Lag), Limit: c.opts.Batch,
+	})
+	if nil != err {
+		return 0, 0, err
+	}
+	if c.opts.Bodies {
+		if err = c.fillBodies(ctx, rows); nil != err {
+			return 0, 0, err
+		}
+	}
+	read, handled := 0, 0
+	for _, row := range rows {
+		if "" == c.opts.Direction || c.opts.Direction == row.Direction {
+			if err = c.handler(ctx, row); nil != err {
+				err = fmt.Errorf("error handling record %s: %w",
+					storedId(row.Id), err)
+				break
+			}
+			handled++
+		}
+		read++
+	}
+	if read > 0 {
+		last := rows[read-1]
+		next := Cursor{CreatedAt: last.CreatedAt, Id: last.Id}
+		e := SaveCheckpoint(ctx, c.cfg, c.conn, c.opts.Name, next)
+		if nil != e {
+			return read, handled, errors.Join(err,
+				fmt.Errorf("error saving checkpoint: %w", e))
+		}
+		c.cursor = &next
+	}
+	return read, handled, err
+}
+
+func (c *Consumer) fillBodies(ctx context.Context, rows []StoredRow) error {
+	ids := make([]any, len(rows))
+	for i, row := range rows {
+		ids[i] = row.Id
+	}
+	bodies, err := c.store.Bodies(ctx, ids...)
+	if nil != err {
+		return err
+	}
+	for i := range rows {
+		rows[i].Body = bodies[storedId(rows[i].Id)]
+	}
+	return nil
+}
+
+// Start polls until the given channel is closed, which also cancels the poll
+// in flight. Batches are read back to back until caught up, then every
+// `Interval`. With an Elector, the checkpoint is reloaded upon each election.
+func (c *Consumer) Start(stopChan <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopChan
+		cancel()
+	}()
+	go func() {
+		leader := true
+		for {
+			if nil != c.opts.Elector {
+				if !c.opts.Elector.IsLeader() {
+					leader = false
+				} else if !leader {
+					// another replica may have moved the checkpoint
+					c.cursor, leader = nil, true
+				}
+			}
+			if leader {
+				read, _, err := c.poll(ctx)
+				if nil != err && !errors.Is(err, context.Canceled) {
+					c.opts.Logger.Errorf("Consumer %s failed: %v",
+						c.opts.Name, err)
+				}
+				if nil == err && read >= c.opts.Batch {
+					continue
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(c.opts.Interval):
+			}
+		}
+	}()
+}
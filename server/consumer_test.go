@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Consumer_dispatches_records_and_resumes_from_checkpoint(
+	t *testing.T,
+) {
+	cfg, conn := setupDb(t)
+	require.Nil(t, CreateCheckpointTable(cfg, conn))
+	at := time.Now().Add(-time.Minute)
+	var records []any
+	for i, d := range []string{
+		DirectionRequest, DirectionResponse, DirectionRequest,
+		DirectionRequest,
+	} {
+		records = append(records, TxRecord{
+			Request: "POST /cb", Headers: []byte("h"), Body: []byte("payload"),
+			At: at.Add(time.Duration(i) * time.Second), Direction: d,
+			Attributes: map[string]any{"n": i},
+		})
+	}
+	records = append(records, TxRecord{
+		Request: "POST /cb", Headers: []byte("h"), At: time.Now(),
+		Direction: DirectionRequest,
+	})
+	query, args := SqlBuilder(utils.NewLogger(), &mockWriter{})(records)
+	_, err := conn.Exec(query, args...)
+	require.Nil(t, err)
+	var seen []string
+	fail := true
+	handler := func(_ context.Context, row StoredRow) error {
+		if fail && 1 == len(seen) {
+			fail = false
+			return assert.AnError
+		}
+		require.Equal(t, []byte("payload"), row.Body)
+		seen = append(seen, row.Attributes)
+		return nil
+	}
+	opts := ConsumerOptions{
+		Name: "test", Direction: DirectionRequest, Bodies: true, Batch: 2,
+	}
+	c, err := NewConsumer(cfg, conn, opts, handler)
+	require.Nil(t, err)
+	n, err := c.Poll(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	n, err = c.Poll(context.Background())
+	require.ErrorIs(t, err, assert.AnError)
+	require.Zero(t, n)
+	// a new consumer resumes from the checkpoint, retrying the failed record
+	c, err = NewConsumer(cfg, conn, opts, handler)
+	require.Nil(t, err)
+	n, err = c.Poll(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	// the last record is within the lag
+	n, err = c.Poll(context.Background())
+	require.Nil(t, err)
+	require.Zero(t, n)
+	require.Equal(t, []string{`{"n":0}`, `{"n":2}`, `{"n":3}`}, seen)
+	cursor, ok, err := LoadCheckpoint(context.Background(), conn, "test")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.WithinDuration(t, at.Add(3*time.Second), cursor.CreatedAt,
+		time.Millisecond)
+}
+
+func Test_NewConsumer_rejects_invalid_name(t *testing.T) {
+	_, err := NewConsumer(nil, nil, ConsumerOptions{}, nil)
+	require.EqualError(t, err, "consumer name is empty")
+	_, err = NewConsumer(nil, nil, ConsumerOptions{
+		Name: string(make([]byte, 65)),
+	}, nil)
+	require.ErrorContains(t, err, "longer than 64")
+}
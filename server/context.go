@@ -0,0 +1,101 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// Keys set on the gin context by RequestLogger.
+const (
+	ctxKeyReqHash = "gin-persist-log.req_hash"
+	ctxKeyReqId   = "gin-persist-log.req_id"
+	ctxKeyResId   = "gin-persist-log.res_id"
+	ctxKeyTxId    = "gin-persist-log.tx_id"
+	ctxKeyAttrs   = "gin-persist-log.attrs"
+	ctxKeyActor   = "gin-persist-log.actor"
+	ctxKeyScope   = "gin-persist-log.scope"
+	ctxKeySkip    = "gin-persist-log.skip"
+	ctxKeyForce   = "gin-persist-log.force_body"
+	ctxKeyPending = "gin-persist-log.pending_request"
+	ctxKeyAcked   = "gin-persist-log.acked"
+	ctxKeyKept    = "gin-persist-log.kept"
+)
+
+// RequestRecordId returns the binary UUID of the request record of current
+// request. Handlers can store it as a reference to the log. It returns false
+// if RequestLogger is not in effect, or failed to generate the ID, in which
+// case the ID is generated upon insert.
+func RequestRecordId(gc *gin.Context) ([]byte, bool) {
+	return recordId(gc, ctxKeyReqId)
+}
+
+// ResponseRecordId returns the binary UUID of the response record of current
+// request, see RequestRecordId. It also returns false once the response record
+// is dropped, by SkipLogging or the policy.
+func ResponseRecordId(gc *gin.Context) ([]byte, bool) {
+	return recordId(gc, ctxKeyResId)
+}
+
+// TransactionId returns the binary UUID shared by the request and response
+// records of current request, stored in `tx_id`, see RequestRecordId.
+func TransactionId(gc *gin.Context) ([]byte, bool) {
+	return recordId(gc, ctxKeyTxId)
+}
+
+// dropRecordId unsets the record ID of current request, whose record isn't
+// stored, so it isn't referred to, such as by the access log.
+func dropRecordId(gc *gin.Context, key string) {
+	gc.Set(key, []byte(nil))
+}
+
+func recordId(gc *gin.Context, key string) ([]byte, bool) {
+	v, _ := gc.Get(key)
+	id, ok := v.([]byte)
+	return id, ok && nil != id
+}
+
+// Annotate adds application metadata, such as order ID, to the response
+// record of current request. It is persisted in the attributes column, and
+// can be called anytime before the handler returns.
+func Annotate(gc *gin.Context, key string, value any) {
+	attrs := attributes(gc)
+	if nil == attrs {
+		attrs = make(map[string]any)
+		gc.Set(ctxKeyAttrs, attrs)
+	}
+	attrs[key] = value
+}
+
+func attributes(gc *gin.Context) map[string]any {
+	if v, ok := gc.Get(ctxKeyAttrs); ok {
+		return v.(map[string]any)
+	}
+	return nil
+}
+
+// SkipLogging tells RequestLogger not to persist the current request at all,
+// neither the request record nor the response record. It can be called
+// anytime before the handler returns. The request record is pushed before the
+// handler runs, so it's taken back from the writer, unless the writer is
+// already flushing it. Call it first thing in the handler to be sure.
+func SkipLogging(gc *gin.Context) {
+	gc.Set(ctxKeySkip, true)
+	v, ok := gc.Get(ctxKeyPending)
+	if ok && !gc.GetBool(ctxKeyAcked) &&
+		v.(*pendingRequest).owner.take(ownerHandler) {
+		dropRecordId(gc, ctxKeyReqId)
+	}
+}
+
+// ForceBody keeps the whole response body of the current request, overriding
+// `MaxResponseBuffer`, and skipping of partial contents and served files.
+// Only bytes written after the call are affected. The body is still bounded by
+// `MaxCaptureBytes`.
+func ForceBody(gc *gin.Context) {
+	gc.Set(ctxKeyForce, true)
+	if rlw, ok := gc.Writer.(*internal.ResponseLogWriter); ok {
+		rlw.SkipBody, rlw.SkipPartial = false, false
+		rlw.Body.Limit = 0
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RecordId_returns_ids_of_persisted_records(t *testing.T) {
+	var reqId, resId []byte
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	svr.Engine.GET("/t", func(c *gin.Context) {
+		var ok bool
+		reqId, ok = RequestRecordId(c)
+		require.True(t, ok)
+		resId, ok = ResponseRecordId(c)
+		require.True(t, ok)
+	})
+	svr.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/t", nil))
+	require.Len(t, writer.records, 2)
+	require.Len(t, reqId, 16)
+	require.Equal(t, reqId, writer.records[0].Id)
+	require.Equal(t, resId, writer.records[1].Id)
+	require.NotEqual(t, reqId, resId)
+}
+
+func Test_RecordId_returns_false_without_RequestLogger(t *testing.T) {
+	gc, _ := gin.CreateTestContext(httptest.NewRecorder())
+	_, ok := RequestRecordId(gc)
+	require.False(t, ok)
+}
+
+func Test_Annotate_adds_attributes_to_response_record(t *testing.T) {
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	svr.Engine.GET("/t", func(c *gin.Context) {
+		Annotate(c, "order_id", 123)
+		Annotate(c, "partner", "abc")
+	})
+	svr.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/t", nil))
+	require.Len(t, writer.records, 2)
+	require.Nil(t, writer.records[0].Attributes)
+	require.Equal(t, map[string]any{"order_id": 123, "partner": "abc"},
+		writer.records[1].Attributes)
+	args, err := marshalAttributes(writer.records[1].Attributes)
+	require.Nil(t, err)
+	require.Equal(t, `{"order_id":123,"partner":"abc"}`, args.V)
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_SkipLogging_drops_request_and_response_records(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger),
+		logger)
+	svr := NewServer(&http.Server{}, w, logger, &Config{})
+	svr.Engine.POST("/admin", func(c *gin.Context) {
+		SkipLogging(c)
+		c.String(http.StatusOK, "secret")
+	})
+	svr.Engine.GET("/t", func(c *gin.Context) { c.Status(http.StatusOK) })
+	svr.Engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+		http.MethodPost, "/admin", strings.NewReader("password")))
+	svr.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/t", nil))
+	w.Write()
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log
+		WHERE path = '/admin'`).Scan(&count))
+	require.Zero(t, count)
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log
+		WHERE path = '/t'`).Scan(&count))
+	require.Equal(t, 2, count)
+	require.Equal(t, uint64(1), svr.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyLoggingSkipped))
+}
+
+func Test_SkipLogging_never_pushes_lazy_request_record(t *testing.T) {
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(),
+		&Config{LazyRequestBody: true})
+	svr.Engine.POST("/admin", func(c *gin.Context) {
+		SkipLogging(c)
+		_, _ = io.Copy(io.Discard, c.Request.Body)
+		c.String(http.StatusOK, "secret")
+	})
+	svr.Engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+		http.MethodPost, "/admin", strings.NewReader("password")))
+	require.Empty(t, writer.records)
+}
+
+func Test_ForceBody_keeps_whole_response_body(t *testing.T) {
+	writer := &mockCachedWriter{}
+	cfg := &Config{MaxResponseBuffer: 2}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+	svr.Engine.GET("/t", func(c *gin.Context) {
+		ForceBody(c)
+		c.String(http.StatusPartialContent, "whole")
+	})
+	svr.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/t", nil))
+	require.Len(t, writer.records, 2)
+	require.Equal(t, []byte("whole"), writer.records[1].Body)
+	require.NotContains(t, writer.records[1].Attributes, "body_truncated")
+	require.Equal(t, uint64(1), svr.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyBodyForced))
+}
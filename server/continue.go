@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// expectsContinue reports whether the client waits for `100 Continue` before
+// sending the body, which net/http sends upon the first read of the body.
+func expectsContinue(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
+// captureReader keeps bytes of the request body as the handler reads them,
+// so bodies of requests rejected before being read are never received, and
+// streamed uploads aren't buffered up front.
+type captureReader struct {
+	io.ReadCloser
+	buf bytes.Buffer
+	// first error other than EOF
+	err error
+	// whether the body has been read
+	read bool
+	// whether the response had been written upon the first read, in which
+	// case net/http doesn't send `100 Continue`
+	late    bool
+	written func() bool
+	// Optional, bytes that can be kept, see `MaxCaptureBytes`
+	budget *internal.Budget
+	// whether some bytes read weren't kept due to the budget
+	truncated bool
+	// Optional, called once the body is read through, or closed
+	done func()
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	if !r.read {
+		r.read, r.late = true, r.written()
+	}
+	n, err := r.ReadCloser.Read(p)
+	kept := r.budget.Take(n)
+	r.buf.Write(p[:kept])
+	r.truncated = r.truncated || kept < n
+	if nil != err && !errors.Is(err, io.EOF) && nil == r.err {
+		r.err = err
+	}
+	if nil != err {
+		r.finish()
+	}
+	return n, err
+}
+
+// Close closes the body, after which nothing more is captured.
+func (r *captureReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.finish()
+	return err
+}
+
+func (r *captureReader) finish() {
+	if done := r.done; nil != done {
+		r.done = nil
+		done()
+	}
+}
+
+func (s *Server) lazyBody() bool {
+	return nil != s.Conf && s.Conf.LazyRequestBody
+}
+
+// continued reports whether `100 Continue` has been sent.
+func (r *captureReader) continued() bool {
+	return r.read && !r.late
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RequestLogger_defers_reading_expect_continue_bodies(t *testing.T) {
+	writer := &mockCachedWriter{}
+	ts := httptest.NewUnstartedServer(nil)
+	s := NewServer(ts.Config, writer, utils.NewLogger(), &Config{})
+	s.Engine.PUT("/reject", func(c *gin.Context) {
+		c.Status(http.StatusRequestEntityTooLarge)
+	})
+	s.Engine.PUT("/accept", func(c *gin.Context) {
+		_, _ = io.Copy(io.Discard, c.Request.Body)
+		c.Status(http.StatusOK)
+	})
+	ts.Start()
+	defer ts.Close()
+	client := ts.Client()
+	client.Transport.(*http.Transport).ExpectContinueTimeout = 5 * time.Second
+	for _, path := range []string{"/reject", "/accept"} {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+path,
+			strings.NewReader("large upload"))
+		require.Nil(t, err)
+		req.Header.Set("Expect", "100-continue")
+		res, err := client.Do(req)
+		require.Nil(t, err)
+		require.Nil(t, res.Body.Close())
+	}
+	require.Len(t, writer.records, 4)
+	rejected, accepted := writer.records[0], writer.records[2]
+	require.Equal(t, DirectionRequest, rejected.Direction)
+	require.Empty(t, rejected.Body)
+	require.Equal(t, false, rejected.Attributes["continue_sent"])
+	require.Equal(t, DirectionRequest, accepted.Direction)
+	require.Equal(t, "large upload", string(accepted.Body))
+	require.Equal(t, true, accepted.Attributes["continue_sent"])
+}
+
+func Test_RequestLogger_captures_bodies_lazily(t *testing.T) {
+	writer := &mockCachedWriter{}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(),
+		&Config{LazyRequestBody: true})
+	var streamed bool
+	s.Engine.POST("/t", func(c *gin.Context) {
+		// the body is still the client's stream, not buffered up front
+		_, streamed = c.Request.Body.(*captureReader)
+		b := make([]byte, 4)
+		_, _ = io.ReadFull(c.Request.Body, b)
+		c.Status(http.StatusOK)
+	})
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/t",
+		strings.NewReader("partially read")))
+	require.True(t, streamed)
+	require.Len(t, writer.records, 2)
+	// pushed once the handler returns, since it's not read through
+	require.Equal(t, "part", string(writer.records[0].Body))
+	require.NotContains(t, writer.records[0].Attributes, "continue_sent")
+	require.NotContains(t, writer.records[1].Attributes, "request_body")
+}
+
+func Test_RequestLogger_pushes_lazy_request_record_once_read(t *testing.T) {
+	writer := &mockCachedWriter{}
+	s := NewServer(&http.Server{}, writer, utils.NewLogger(),
+		&Config{LazyRequestBody: true})
+	var pushed int
+	s.Engine.POST("/t", func(c *gin.Context) {
+		_, _ = io.Copy(io.Discard, c.Request.Body)
+		writer.mu.Lock()
+		pushed = len(writer.records)
+		writer.mu.Unlock()
+		c.Status(http.StatusOK)
+	})
+	s.Engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+		http.MethodPost, "/t", strings.NewReader("upload")))
+	require.Equal(t, 1, pushed)
+	require.Len(t, writer.records, 2)
+	require.Equal(t, "upload", string(writer.records[0].Body))
+}
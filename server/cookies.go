@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// scrubCookies removes values of cookies in `Cookie` and `Set-Cookie`
+// headers in place, keeping their names and `Set-Cookie` attributes. It
+// returns the number of header values scrubbed.
+func scrubCookies(h http.Header) int {
+	n := 0
+	for i, v := range h["Cookie"] {
+		pairs := strings.Split(v, ";")
+		for j, p := range pairs {
+			name, _, _ := strings.Cut(p, "=")
+			pairs[j] = name + "="
+		}
+		h["Cookie"][i] = strings.Join(pairs, ";")
+		n++
+	}
+	for i, v := range h["Set-Cookie"] {
+		pair, attrs, found := strings.Cut(v, ";")
+		name, _, _ := strings.Cut(pair, "=")
+		if found {
+			attrs = ";" + attrs
+		}
+		h["Set-Cookie"][i] = name + "=" + attrs
+		n++
+	}
+	return n
+}
+
+func (s *Server) scrubCookies(h http.Header) {
+	if nil == s.Conf || !s.Conf.ScrubCookies {
+		return
+	}
+	s.metrics.Add(uint64(scrubCookies(h)), MetricPolicyDecisions,
+		"policy", PolicyCookieScrubbed)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_scrubCookies_keeps_names_and_attributes(t *testing.T) {
+	h := http.Header{
+		"Cookie":     {"a=1; b=2", "c"},
+		"Set-Cookie": {"sid=secret; Path=/; HttpOnly", "x=y"},
+	}
+	require.Equal(t, 4, scrubCookies(h))
+	require.Equal(t, []string{"a=; b=", "c="}, h["Cookie"])
+	require.Equal(t, []string{"sid=; Path=/; HttpOnly", "x="}, h["Set-Cookie"])
+}
+
+func Test_RequestLogger_scrubs_cookies(t *testing.T) {
+	for _, workers := range []int{0, 1} {
+		writer := &mockCachedWriter{}
+		cfg := &Config{ScrubCookies: true, CaptureWorkers: workers}
+		svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+		svr.Engine.GET("/t", func(c *gin.Context) {
+			v, err := c.Cookie("sid")
+			require.Nil(t, err)
+			require.Equal(t, "secret", v)
+			c.SetCookie("sid", "renewed", 0, "/", "", false, true)
+			c.Status(http.StatusOK)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/t", nil)
+		req.Header.Set("Cookie", "sid=secret")
+		svr.Engine.ServeHTTP(httptest.NewRecorder(), req)
+		_, err := svr.Shutdown()
+		require.Nil(t, err)
+		require.Len(t, writer.records, 2)
+		require.Contains(t, string(writer.records[0].Headers), "Cookie: sid=\r\n")
+		require.Contains(t, string(writer.records[1].Headers),
+			"Set-Cookie: sid=; Path=/; HttpOnly")
+		require.Equal(t, uint64(2), svr.metrics.Get(MetricPolicyDecisions,
+			"policy", PolicyCookieScrubbed))
+	}
+}
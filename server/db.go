@@ -2,63 +2,587 @@ package server
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/eidng8/go-utils"
+	"github.com/go-sql-driver/mysql"
 
 	"github.com/eidng8/gin-persist-log/internal"
 )
 
-const numColumns = 5
+// columns of the log table, in the order of values built by BuildValues
+var columns = [...]string{
+	"id", "req_hash", "headers", "body", "created_at", "client_aborted",
+	"attributes", "hash_algo", "partner", "schema_version", "request_line",
+	"request_line_full", "body_codec", "remote_port", "conn_id", "conn_reused",
+	"method", "path", "status_code", "duration_ms", "tx_id", "direction",
+	"truncated", "slo_violated",
+}
+
+const numColumns = len(columns)
+
+// RecordVersion is stamped in `schema_version` of each row, telling the format
+// of `headers` and `body`. It's bumped whenever what they contain changes.
+// Version 1 keeps raw dumps of headers and bodies.
+const RecordVersion = 1
 
-var uuid utils.UUID = &utils.Uuid{}
-var hasher internal.Hasher = &internal.XxHasher{}
+var insertStmt = "INSERT INTO tx_log (" + strings.Join(columns[:], ", ") + ")"
+
+// columns can be used in secondary indexes
+var indexColumns = []string{
+	"req_hash", "created_at", "client_aborted", "hash_algo", "partner",
+	"conn_id", "method", "status_code", "tx_id", "truncated", "slo_violated",
+}
 
 type DbConfig struct {
 	Driver, Dsn string
 	// Optional, just in case can't determine from `Driver`
 	Dialect string
+	// Optional, secondary indexes created by CreateDefaultTable, each is a
+	// list of columns, e.g. `{"req_hash", "created_at"}`
+	Indexes [][]string
+	// Optional, MariaDB only, use the native `UUID` type for ID
+	MariadbUuid bool
+	// Optional, MariaDB only, create the table with InnoDB page compression
+	MariadbCompressed bool
+	// Optional, TiDB only, rows are scattered to 2^TidbShardBits regions
+	TidbShardBits int
+	// Optional, maximum number of records in each insert transaction, 0 to
+	// use the default of the dialect
+	BatchSize int
+	// Optional, insert each record with its own statement, in a transaction
+	// per batch, for proxies that can't handle long multi-row statements
+	SingleRowInserts bool
+	// Optional, create the analysis views along with the default table
+	Views bool
+	// Optional, create the `admin_audit` table along with the default table,
+	// and audit admin actions with DefaultServer
+	Audit bool
+	// Optional, create the `tx_meta` table along with the default table, and
+	// stamp it with the BuildInfo upon startup with DefaultServer
+	Meta bool
+	// Optional, create the `tx_checkpoint` table along with the default
+	// table, holding cursors of Consumer
+	Checkpoints bool
+	// Optional, create the `tx_raw_error` table along with the default table,
+	// and record connections rejected before reaching handlers with
+	// DefaultServer
+	RawErrors bool
+	// Optional, DSN of the local SQLite spill store used by
+	// ConnectDBWithFallback while the DB is unreachable at startup
+	FallbackDsn string
+	// Optional, interval of checking whether the DB has become reachable
+	FallbackRetry time.Duration
+	// Optional, maximum duration of each flush, including retries, 0 means
+	// unlimited
+	FlushTimeout time.Duration
+	// Optional, maximum number of open connections of the pool, 0 means
+	// unlimited. The Elector of LEADER_LOCK pins one of them while it's the
+	// leader, on MySQL and compatible DBs.
+	MaxOpenConns int
+	// Optional, number of connections DefaultServer establishes upon startup,
+	// see WarmUp, 0 to skip warming up
+	WarmupConns int
+	// Optional, maximum duration of warming up
+	WarmupTimeout time.Duration
+	// Optional, isolation level of insert transactions
+	Isolation sql.IsolationLevel
+	// Optional, insert each record under its own savepoint, so records refused
+	// by the DB don't fail the rest of the batch
+	Savepoints bool
+	// Optional, how headers and bodies beyond the column limits are handled,
+	// either `truncate` (default) or `reject`. Truncated ones are flagged like
+	// MaxBodyBytes does, with `headers_truncated` and `headers_size` for
+	// headers
+	Oversized string
+	// Optional, MySQL family only, type of the `body` column, either `BLOB`
+	// (default), `MEDIUMBLOB` or `LONGBLOB`
+	BodyType string
+	// Optional, MySQL family only, default charset of the table, defaults to
+	// `utf8mb4`
+	Charset string
+	// Optional, MySQL family only, collation of `headers`, defaults to the
+	// binary collation of Charset, e.g. `utf8mb4_bin`
+	HeadersCollation string
+	// Optional, maximum bytes of the stored request line, 0 means unlimited.
+	// Longer lines are truncated, and hashed as truncated.
+	MaxRequestLine int
+	// Optional, keep the full request line in `request_line_full` if it's
+	// truncated
+	KeepFullRequestLine bool
+	// Optional, codec compressing bodies, see Codec, defaults to identity
+	BodyCodec string
+	// Optional, files of zstd dictionaries registered by DefaultServer, see
+	// LoadZstdDict. Codecs of dictionaries no longer used must stay
+	// registered, so their bodies can still be read.
+	BodyDicts []string
+}
+
+const (
+	// OversizedTruncate truncates headers and bodies to fit their columns,
+	// ending them with TruncatedMarker.
+	OversizedTruncate = "truncate"
+	// OversizedReject writes records not fitting their columns to the failed
+	// log, instead of sending them to the DB.
+	OversizedReject = "reject"
+)
+
+const (
+	// DirectionRequest marks request records in `direction`.
+	DirectionRequest = "req"
+	// DirectionResponse marks response records in `direction`.
+	DirectionResponse = "res"
+)
+
+// TruncatedMarker ends headers and bodies truncated to fit their columns.
+const TruncatedMarker = "\n...[truncated]"
+
+// capacity of MySQL `TEXT` columns
+const mysqlTextBytes = 65535
+
+// default batch size of TiDB, keeping optimistic transactions small
+const tidbBatchSize = 256
+
+// default batch size of ClickHouse, which favors few large inserts
+const clickhouseBatchSize = 10000
+
+func (c *DbConfig) batchSize() int {
+	switch {
+	case c.BatchSize > 0:
+		return c.BatchSize
+	case "tidb" == c.dialect():
+		return tidbBatchSize
+	case c.clickhouse():
+		return clickhouseBatchSize
+	}
+	return c.BatchSize
+}
+
+// whether the dialect is ClickHouse
+func (c *DbConfig) clickhouse() bool {
+	return nil != c && "clickhouse" == c.dialect()
+}
+
+// whether the dialect speaks MySQL
+func (c *DbConfig) mysqlFamily() bool {
+	d := c.dialect()
+	return "mysql" == d || "mariadb" == d || "tidb" == d
+}
+
+func (c *DbConfig) mysqlSchema() internal.MysqlSchema {
+	return internal.MysqlSchema{
+		Body: c.BodyType, Charset: c.Charset,
+		HeadersCollation: c.HeadersCollation,
+	}
+}
+
+// type of IDs of the MySQL family of tables
+func (c *DbConfig) mysqlIdType() string {
+	if "mariadb" == c.dialect() && c.MariadbUuid {
+		return "UUID"
+	}
+	return "BINARY(16)"
+}
+
+// SqlOption customizes statements built by SqlBuilder.
+type SqlOption func(*sqlOptions)
+
+type sqlOptions struct {
+	// whether IDs are sent in the text form
+	textId bool
+	// generates IDs of records without one
+	uuid utils.UUID
+	// digests requests into `req_hash`
+	hasher internal.Hasher
+	// maximum bytes of headers and body, 0 means unlimited
+	maxHeaders, maxBody int
+	// maximum bytes of marshaled attributes, 0 means unlimited
+	maxAttrs int
+	// whether oversized headers and bodies are truncated, or rejected
+	truncate bool
+	// maximum bytes of request lines, 0 means unlimited
+	maxLine int
+	// whether full request lines are kept if truncated
+	keepFullLine bool
+	// Optional, observes `req_hash` values of built records
+	cardinality *CardinalityTracker
+	// Optional, compresses bodies
+	codec Codec
+}
+
+func newSqlOptions(options ...SqlOption) *sqlOptions {
+	opts := &sqlOptions{}
+	for _, o := range options {
+		o(opts)
+	}
+	if nil == opts.uuid {
+		opts.uuid = &utils.Uuid{}
+	}
+	if nil == opts.hasher {
+		opts.hasher = &internal.XxHasher{}
+	}
+	opts.hasher.New()
+	return opts
+}
+
+// WithTextId sends IDs in the canonical text form, as required by the MariaDB
+// native `UUID` type.
+func WithTextId() SqlOption {
+	return func(o *sqlOptions) { o.textId = true }
+}
+
+// WithUuid generates IDs of records using the given UUID generator, instead
+// of the default UUID v7 one.
+func WithUuid(uuid utils.UUID) SqlOption {
+	return func(o *sqlOptions) { o.uuid = uuid }
+}
+
+// WithHasher digests requests using the given hasher, instead of the default
+// xxh64 one. The hasher is owned by the builder, and mustn't be shared.
+func WithHasher(hasher internal.Hasher) SqlOption {
+	return func(o *sqlOptions) { o.hasher = hasher }
+}
+
+// WithBodyCodec compresses bodies with the given codec, recording its name in
+// `body_codec`. Bodies are compressed after being fitted to the column, and
+// are kept as is if the codec fails or doesn't make them smaller.
+func WithBodyCodec(c Codec) SqlOption {
+	return func(o *sqlOptions) { o.codec = c }
+}
+
+// WithCardinality feeds `req_hash` values of built records to the tracker.
+func WithCardinality(t *CardinalityTracker) SqlOption {
+	return func(o *sqlOptions) { o.cardinality = t }
+}
+
+// WithColumnLimits validates headers and bodies against the given capacities
+// of their columns, 0 means unlimited. Oversized ones are truncated if
+// `truncate` is set, otherwise their records are rejected.
+func WithColumnLimits(headers, body int, truncate bool) SqlOption {
+	return func(o *sqlOptions) {
+		o.maxHeaders, o.maxBody, o.truncate = headers, body, truncate
+	}
+}
+
+// WithAttributesLimit validates marshaled attributes against the given
+// capacity of their column, 0 means unlimited. Oversized ones are handled as
+// told by WithColumnLimits.
+func WithAttributesLimit(limit int) SqlOption {
+	return func(o *sqlOptions) { o.maxAttrs = limit }
+}
+
+// WithRequestLineLimit truncates request lines longer than the given bytes
+// with NormalizeRequestLine, keeping the full line in `request_line_full` if
+// told so.
+func WithRequestLineLimit(limit int, keepFull bool) SqlOption {
+	return func(o *sqlOptions) { o.maxLine, o.keepFullLine = limit, keepFull }
+}
+
+// textId tells whether IDs are stored in the canonical text form.
+func (c *DbConfig) textId() bool {
+	return nil != c && "mariadb" == c.dialect() && c.MariadbUuid
+}
+
+// SqlOptions returns the SqlBuilder options matching the DB config.
+func SqlOptions(cfg *DbConfig) []SqlOption {
+	var opts []SqlOption
+	if nil == cfg {
+		return opts
+	}
+	if cfg.textId() {
+		opts = append(opts, WithTextId())
+	}
+	if cfg.mysqlFamily() {
+		opts = append(opts, WithColumnLimits(mysqlTextBytes,
+			cfg.mysqlSchema().BodyBytes(), OversizedReject != cfg.Oversized))
+		opts = append(opts, WithAttributesLimit(mysqlTextBytes))
+	}
+	if cfg.MaxRequestLine > 0 {
+		opts = append(opts,
+			WithRequestLineLimit(cfg.MaxRequestLine, cfg.KeepFullRequestLine))
+	}
+	if c, ok := LookupCodec(cfg.BodyCodec); ok && CodecIdentity != c.Name() {
+		opts = append(opts, WithBodyCodec(c))
+	}
+	return opts
 }
 
 type TxRecord struct {
+	// Optional, binary UUID of the record, generated upon insert if empty
+	Id      []byte
 	Request string
 	Headers []byte
 	Body    []byte
 	At      time.Time
+	// whether the client went away before the exchange was completed
+	ClientAborted bool
+	// Optional, extra metadata persisted as JSON
+	Attributes map[string]any
+	// Optional, label derived from the partner header
+	Partner string
+	// Optional, port of the client, 0 if unknown
+	RemotePort int
+	// Optional, ID of the connection, unique within the process, 0 if unknown
+	ConnId uint64
+	// whether earlier requests were served on the same connection
+	ConnReused bool
+	// Optional, method and path of the request, without the query
+	Method string
+	Path   string
+	// Optional, status code of response records, 0 for request records
+	Status int
+	// Optional, time taken to serve response records
+	Duration time.Duration
+	// Optional, binary UUID shared by the request and response records of one
+	// exchange, joining a request to its exact response
+	TxId []byte
+	// Optional, either DirectionRequest or DirectionResponse
+	Direction string
+	// whether the response is slower than the LatencySlo of its route
+	SloViolated bool
+	// Optional, codec the body has been encoded with by SerializeWriter, in
+	// which case the record is persisted as is
+	BodyCodec string
+	// Optional, times the record passes each stage of the pipeline
+	Trace *Trace
+	// who persists request records pushed by RequestLogger, nil for others
+	owner *recordOwner
 }
 
+// DefaultDbConfigFromEnv reads config from env, panicking with the error of
+// DbConfigFromEnv.
 func DefaultDbConfigFromEnv() *DbConfig {
-	return &DbConfig{
-		Driver: utils.MustGetEnvNE("DB_DRIVER"),
-		Dsn:    utils.MustGetEnvNE("DB_DSN"),
+	cfg, err := DbConfigFromEnv()
+	utils.PanicIfError(err)
+	return cfg
+}
+
+// DbConfigFromEnv reads config from env. Indexes are read from `DB_INDEXES`,
+// a comma separated list of `+` joined columns, e.g.
+// `req_hash+created_at,created_at`. It returns all problems found, of
+// unparsable variables and those found by DbConfig.Validate, joined in one
+// error, along with the config read.
+func DbConfigFromEnv() (*DbConfig, error) {
+	r := &envReader{}
+	isolation, err := ParseIsolation(utils.GetEnvWithDefault("DB_ISOLATION", ""))
+	r.check("DB_ISOLATION", err)
+	cfg := &DbConfig{
+		Driver: utils.GetEnvWithDefault("DB_DRIVER", ""),
+		Dsn:    utils.GetEnvWithDefault("DB_DSN", ""),
+		Indexes: utils.SliceMapFunc[[][]string](
+			utils.GetEnvCsv("DB_INDEXES", nil),
+			func(s string) []string { return strings.Split(s, "+") }),
+		MariadbUuid: envValue(r, "DB_MARIADB_UUID", utils.GetEnvBool, false),
+		MariadbCompressed: envValue(r, "DB_MARIADB_COMPRESSED",
+			utils.GetEnvBool, false),
+		TidbShardBits: int(envValue(r, "DB_TIDB_SHARD_BITS",
+			utils.GetEnvUint8, 4)),
+		BatchSize: int(envValue(r, "DB_BATCH_SIZE", utils.GetEnvUint16, 0)),
+		SingleRowInserts: envValue(r, "DB_SINGLE_ROW", utils.GetEnvBool,
+			false),
+		Views:       envValue(r, "DB_VIEWS", utils.GetEnvBool, false),
+		Audit:       envValue(r, "DB_AUDIT", utils.GetEnvBool, false),
+		Meta:        envValue(r, "DB_META", utils.GetEnvBool, false),
+		Checkpoints: envValue(r, "DB_CHECKPOINTS", utils.GetEnvBool, false),
+		RawErrors:   envValue(r, "DB_RAW_ERRORS", utils.GetEnvBool, false),
+		FallbackDsn: utils.GetEnvWithDefault("DB_FALLBACK_DSN", ""),
+		FallbackRetry: envValue(r, "DB_FALLBACK_RETRY",
+			envDuration(time.Second), 5*time.Second),
+		FlushTimeout: envValue(r, "DB_FLUSH_TIMEOUT",
+			envDuration(time.Second), 30*time.Second),
+		MaxOpenConns: int(envValue(r, "DB_MAX_OPEN_CONNS",
+			utils.GetEnvUint16, 0)),
+		WarmupConns: int(envValue(r, "DB_WARMUP_CONNS", utils.GetEnvUint8,
+			0)),
+		WarmupTimeout: envValue(r, "DB_WARMUP_TIMEOUT",
+			envDuration(time.Second), 30*time.Second),
+		Isolation:  isolation,
+		Savepoints: envValue(r, "DB_SAVEPOINTS", utils.GetEnvBool, false),
+		Oversized:  utils.GetEnvWithDefault("DB_OVERSIZED", OversizedTruncate),
+		BodyType:   utils.GetEnvWithDefault("DB_BODY_TYPE", internal.MysqlBlob),
+		Charset:    utils.GetEnvWithDefault("DB_CHARSET", "utf8mb4"),
+		HeadersCollation: utils.GetEnvWithDefault(
+			"DB_HEADERS_COLLATION", ""),
+		MaxRequestLine: int(envValue(r, "DB_MAX_REQUEST_LINE",
+			utils.GetEnvUint32, 0)),
+		KeepFullRequestLine: envValue(r, "DB_KEEP_FULL_REQUEST_LINE",
+			utils.GetEnvBool, false),
+		BodyCodec: utils.GetEnvWithDefault("DB_BODY_CODEC", CodecIdentity),
+		BodyDicts: utils.GetEnvCsv("DB_BODY_DICTS", nil),
+	}
+	return cfg, errors.Join(r.err(), cfg.Validate())
+}
+
+// ParseIsolation parses the isolation level in the form of `read-committed`,
+// empty is the driver's default.
+func ParseIsolation(level string) (sql.IsolationLevel, error) {
+	switch strings.ToLower(strings.ReplaceAll(level, "_", "-")) {
+	case "", "default":
+		return sql.LevelDefault, nil
+	case "read-uncommitted":
+		return sql.LevelReadUncommitted, nil
+	case "read-committed":
+		return sql.LevelReadCommitted, nil
+	case "repeatable-read":
+		return sql.LevelRepeatableRead, nil
+	case "serializable":
+		return sql.LevelSerializable, nil
 	}
+	return sql.LevelDefault, fmt.Errorf("unsupported isolation level: %s", level)
 }
 
+// CreateDefaultTable creates the log table, indexes and views. If any of the
+// MariaDB options is set on a `mysql` dialect, the server is checked, and the
+// dialect is set to `mariadb` on the given config if it is MariaDB.
 func CreateDefaultTable(cfg *DbConfig, conn *sql.DB) error {
-	var dialect, stmt string
-	if "" == cfg.Dialect {
-		dialect = cfg.Driver
-	} else {
-		dialect = cfg.Dialect
+	var stmt string
+	if "mysql" == cfg.dialect() && (cfg.MariadbUuid || cfg.MariadbCompressed) {
+		is, err := IsMariadb(conn)
+		if nil != err {
+			return err
+		}
+		if is {
+			cfg.Dialect = "mariadb"
+		}
+	}
+	schema := cfg.mysqlSchema()
+	if cfg.mysqlFamily() && !schema.Valid() {
+		return fmt.Errorf("unsupported MySQL schema: %+v", schema)
 	}
-	switch dialect {
+	switch cfg.dialect() {
 	case "mysql":
-		stmt = internal.DefaultMysqlTable()
+		stmt = internal.DefaultMysqlTable(schema)
+	case "mariadb":
+		stmt = internal.DefaultMariadbTable(
+			cfg.MariadbUuid, cfg.MariadbCompressed, schema)
+	case "tidb":
+		stmt = internal.DefaultTidbTable(cfg.TidbShardBits, schema)
 	case "sqlite3":
 		stmt = internal.DefaultSqliteTable()
+	case "clickhouse":
+		stmt = internal.DefaultClickhouseTable()
 	default:
 		return errors.New("unsupported SQL dialect")
 	}
-	_, err := conn.Exec(stmt)
-	return err
+	if _, err := conn.Exec(stmt); nil != err {
+		return err
+	}
+	if !cfg.clickhouse() {
+		if err := MigrateSchema(cfg, conn); nil != err {
+			return fmt.Errorf("error migrating tx_log: %w", err)
+		}
+	}
+	if err := createIndexes(cfg, conn); nil != err {
+		return err
+	}
+	if cfg.Audit {
+		if err := CreateAuditTable(cfg, conn); nil != err {
+			return err
+		}
+	}
+	if cfg.RawErrors {
+		if err := CreateRawErrorTable(cfg, conn); nil != err {
+			return err
+		}
+	}
+	if cfg.Meta {
+		if err := CreateMetaTable(cfg, conn); nil != err {
+			return err
+		}
+	}
+	if cfg.Checkpoints {
+		if err := CreateCheckpointTable(cfg, conn); nil != err {
+			return err
+		}
+	}
+	return createViews(cfg, conn)
+}
+
+// IsMariadb checks whether the connected server is MariaDB.
+func IsMariadb(conn *sql.DB) (bool, error) {
+	var version string
+	if err := conn.QueryRow("SELECT VERSION()").Scan(&version); nil != err {
+		return false, err
+	}
+	return strings.Contains(strings.ToLower(version), "mariadb"), nil
 }
 
-func BuildValues(data interface{}) (
-	count int, args []any, failed []TxRecord, err error,
+func createIndexes(cfg *DbConfig, conn *sql.DB) error {
+	for _, cols := range cfg.Indexes {
+		for _, col := range cols {
+			if !slices.Contains(indexColumns, col) {
+				return fmt.Errorf("column can't be indexed: %s", col)
+			}
+		}
+		name := "ix_tx_log_" + strings.Join(cols, "_")
+		var stmt string
+		switch {
+		case cfg.mysqlFamily():
+			stmt = internal.MysqlIndex(name, cols)
+		case cfg.clickhouse():
+			stmt = internal.ClickhouseIndex(name, cols)
+		default:
+			stmt = internal.SqliteIndex(name, cols)
+		}
+		_, err := conn.Exec(stmt)
+		var me *mysql.MySQLError
+		// MySQL doesn't support `IF NOT EXISTS`, ignore duplicate key name
+		if errors.As(err, &me) && 1061 == me.Number {
+			err = nil
+		}
+		if nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// createViews creates the analysis views if enabled. Requests are paired with
+// their responses by `tx_id`, and routes are their method and path.
+func createViews(cfg *DbConfig, conn *sql.DB) error {
+	if !cfg.Views {
+		return nil
+	}
+	stmts := internal.SqliteViews()
+	if cfg.mysqlFamily() {
+		stmts = internal.MysqlViews()
+	}
+	for _, stmt := range stmts {
+		if _, err := conn.Exec(stmt); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *DbConfig) dialect() string {
+	if "" == c.Dialect {
+		return c.Driver
+	}
+	return c.Dialect
+}
+
+// BuildValues returns the number of records built and their insert arguments.
+// Bad records are skipped, and returned as failed along with the last error,
+// while the rest of the records are still built.
+func BuildValues(data interface{}, options ...SqlOption) (
+	count int, args []any, failed []FailedRecord, err error,
+) {
+	return buildValues(data, newSqlOptions(options...))
+}
+
+func buildValues(data interface{}, opts *sqlOptions) (
+	count int, args []any, failed []FailedRecord, err error,
 ) {
 	records, ok := data.([]interface{})
 	if !ok {
@@ -67,78 +591,387 @@ func BuildValues(data interface{}) (
 	c := len(records)
 	args = make([]any, c*numColumns)
 	var e error
-	hasher.New()
-	for _, d := range records {
+	fail := func(i int, class string, rec TxRecord) {
+		f := failRecord(class, err, rec)
+		f.index = i
+		failed = append(failed, f)
+	}
+	uuid, hasher := opts.uuid, opts.hasher
+	for i, d := range records {
+		// dropped by an earlier build of the batch
+		if nil == d {
+			continue
+		}
 		rec, ok := d.(TxRecord)
 		if !ok {
 			err = fmt.Errorf("invalid record: %#v", d)
-			failed = append(failed, TxRecord{})
+			fail(i, FailInvalidRecord, TxRecord{})
 			continue
 		}
-		if e = uuid.New(); nil != e {
-			err = fmt.Errorf("error generating UUID: %w", e)
-			failed = append(failed, rec)
+		// persisted by its handler instead, see Acknowledged
+		if !rec.owner.take(ownerWriter) {
 			continue
 		}
 		idx := count * numColumns
-		if args[idx], e = uuid.MarshalBinary(); nil != e {
-			err = fmt.Errorf("error marshaling UUID: %w", e)
-			failed = append(failed, rec)
-			continue
+		if nil == rec.Id {
+			if e = uuid.New(); nil != e {
+				err = fmt.Errorf("error generating UUID: %w", e)
+				fail(i, FailUuid, rec)
+				continue
+			}
+			if opts.textId {
+				var id []byte
+				id, e = uuid.MarshalText()
+				args[idx] = string(id)
+			} else {
+				args[idx], e = uuid.MarshalBinary()
+			}
+			if nil != e {
+				err = fmt.Errorf("error marshaling UUID: %w", e)
+				fail(i, FailUuid, rec)
+				continue
+			}
+		} else if opts.textId {
+			args[idx] = formatUuid(rec.Id)
+		} else {
+			args[idx] = rec.Id
 		}
 		if "" == rec.Request {
-			return 0, nil, nil, errors.New("empty_request")
+			err = errors.New("empty_request")
+			fail(i, FailEmptyRequest, rec)
+			continue
+		}
+		if "" == rec.BodyCodec {
+			if rec, e = opts.fitColumns(rec); nil != e {
+				err = e
+				fail(i, FailOversized, rec)
+				continue
+			}
 		}
+		line := NormalizeRequestLine(rec.Request, opts.maxLine)
 		hasher.Reset()
-		_, err = hasher.WriteString(rec.Request)
-		if nil != err {
-			return 0, nil, nil, err
+		if _, e = hasher.WriteString(line); nil != e {
+			err = e
+			fail(i, FailHash, rec)
+			continue
 		}
-		// work around error uint64 values with high bit set are not supported
-		args[idx+1] = fmt.Sprintf("%016x", hasher.Hash())
+		args[idx+1] = hasher.Sum()
+		opts.cardinality.Observe(args[idx+1].([]byte))
 		args[idx+2] = string(rec.Headers)
-		if nil == rec.Body || 0 == len(rec.Body) {
+		body, codec := rec.Body, rec.BodyCodec
+		if "" == codec {
+			body, codec = opts.encodeBody(body)
+		} else if CodecIdentity == codec {
+			codec = ""
+		}
+		if nil == body || 0 == len(body) {
 			args[idx+3] = sql.Null[[]byte]{}
 		} else {
-			args[idx+3] = sql.Null[[]byte]{V: rec.Body, Valid: true}
+			args[idx+3] = sql.Null[[]byte]{V: body, Valid: true}
 		}
 		args[idx+4] = rec.At.Format("2006-01-02 15:04:05.000000")
+		args[idx+5] = rec.ClientAborted
+		if args[idx+6], e = marshalAttributes(rec.Attributes); nil != e {
+			err = fmt.Errorf("error marshaling attributes: %w", e)
+			fail(i, FailAttributes, rec)
+			continue
+		}
+		args[idx+7] = hasher.Algorithm()
+		args[idx+8] = sql.Null[string]{V: rec.Partner, Valid: "" != rec.Partner}
+		args[idx+9] = RecordVersion
+		args[idx+10] = line
+		args[idx+11] = sql.Null[string]{
+			V: rec.Request, Valid: opts.keepFullLine && line != rec.Request,
+		}
+		args[idx+12] = sql.Null[string]{V: codec, Valid: "" != codec}
+		args[idx+13] = sql.Null[int]{V: rec.RemotePort, Valid: rec.RemotePort > 0}
+		args[idx+14] = sql.Null[uint64]{V: rec.ConnId, Valid: rec.ConnId > 0}
+		args[idx+15] = sql.Null[bool]{V: rec.ConnReused, Valid: rec.ConnId > 0}
+		args[idx+16] = sql.Null[string]{V: rec.Method, Valid: "" != rec.Method}
+		args[idx+17] = sql.Null[string]{V: rec.Path, Valid: "" != rec.Path}
+		args[idx+18] = sql.Null[int]{V: rec.Status, Valid: rec.Status > 0}
+		args[idx+19] = sql.Null[int64]{
+			V: rec.Duration.Milliseconds(), Valid: rec.Status > 0,
+		}
+		if opts.textId {
+			args[idx+20] = sql.Null[string]{
+				V: formatUuid(rec.TxId), Valid: 16 == len(rec.TxId),
+			}
+		} else {
+			args[idx+20] = sql.Null[[]byte]{V: rec.TxId, Valid: nil != rec.TxId}
+		}
+		args[idx+21] = sql.Null[string]{
+			V: rec.Direction, Valid: "" != rec.Direction,
+		}
+		args[idx+22] = isTruncated(rec.Attributes)
+		args[idx+23] = rec.SloViolated
+		rec.Trace.mark(StageTransform)
 		count++
 	}
+	args = args[:count*numColumns]
 	return
 }
 
-func SqlBuilder(log utils.TaggedLogger, failed io.Writer) func(data []any) (
-	string, []any,
-) {
+// encodeBody returns the body to be persisted and the name of its codec, empty
+// if it's kept as is.
+func (o *sqlOptions) encodeBody(body []byte) ([]byte, string) {
+	if nil == o.codec || len(body) < 1 || CodecIdentity == o.codec.Name() {
+		return body, ""
+	}
+	encoded, err := o.codec.Encode(body)
+	if nil != err || len(encoded) >= len(body) {
+		return body, ""
+	}
+	return encoded, o.codec.Name()
+}
+
+// prepare fits the record to its columns and encodes its body ahead of
+// buildValues. Records that don't fit are left for buildValues to fail.
+func (o *sqlOptions) prepare(rec TxRecord) TxRecord {
+	if "" != rec.BodyCodec {
+		return rec
+	}
+	fitted, err := o.fitColumns(rec)
+	if nil != err {
+		return rec
+	}
+	fitted.Body, fitted.BodyCodec = o.encodeBody(fitted.Body)
+	if "" == fitted.BodyCodec {
+		fitted.BodyCodec = CodecIdentity
+	}
+	return fitted
+}
+
+// fitColumns returns the record with headers and body fitting their columns,
+// or an error if they don't and aren't to be truncated.
+func (o *sqlOptions) fitColumns(rec TxRecord) (TxRecord, error) {
+	hl, bl := len(rec.Headers), len(rec.Body)
+	overHeaders := o.maxHeaders > 0 && hl > o.maxHeaders
+	overBody := o.maxBody > 0 && bl > o.maxBody
+	if !overHeaders && !overBody {
+		return o.fitAttributes(rec)
+	}
+	if !o.truncate {
+		return rec, fmt.Errorf(
+			"oversized record: %d bytes of headers, %d bytes of body", hl, bl)
+	}
+	attrs := maps.Clone(rec.Attributes)
+	if nil == attrs {
+		attrs = make(map[string]any, 2)
+	}
+	if overHeaders {
+		rec.Headers = truncateText(rec.Headers, o.maxHeaders)
+		attrs["headers_truncated"] = true
+		attrs["headers_size"] = hl
+	}
+	if overBody {
+		rec.Body = truncateBytes(rec.Body, o.maxBody)
+		attrs["body_truncated"] = true
+		// keep the size of the body before it was captured, if it's known
+		if _, ok := attrs["body_size"]; !ok {
+			attrs["body_size"] = bl
+		}
+	}
+	rec.Attributes = attrs
+	return o.fitAttributes(rec)
+}
+
+// fitAttributes returns the record with attributes fitting their column, or
+// an error if they don't and aren't to be truncated. JSON can't be cut, so
+// oversized attributes are replaced by their truncation flags and sizes,
+// along with `attributes_truncated` and `attributes_size`.
+func (o *sqlOptions) fitAttributes(rec TxRecord) (TxRecord, error) {
+	if o.maxAttrs < 1 || len(rec.Attributes) < 1 {
+		return rec, nil
+	}
+	b, err := json.Marshal(rec.Attributes)
+	// marshaling errors are reported by buildValues
+	if nil != err || len(b) <= o.maxAttrs {
+		return rec, nil
+	}
+	if !o.truncate {
+		return rec, fmt.Errorf(
+			"oversized record: %d bytes of attributes", len(b))
+	}
+	attrs := map[string]any{"attributes_truncated": true,
+		"attributes_size": len(b)}
+	for _, k := range append(truncationAttributes, "headers_size",
+		"body_size") {
+		if v, ok := rec.Attributes[k]; ok {
+			attrs[k] = v
+		}
+	}
+	rec.Attributes = attrs
+	return rec, nil
+}
+
+// truncateBytes truncates the bytes to at most `limit` bytes, including
+// TruncatedMarker.
+func truncateBytes(b []byte, limit int) []byte {
+	return withMarker(b[:max(limit-len(TruncatedMarker), 0)])
+}
+
+// truncateText works like truncateBytes, without splitting UTF-8 sequences,
+// which strict-mode MySQL refuses.
+func truncateText(b []byte, limit int) []byte {
+	n := max(limit-len(TruncatedMarker), 0)
+	for n > 0 && !utf8.RuneStart(b[n]) {
+		n--
+	}
+	return withMarker(b[:n])
+}
+
+// NormalizeRequestLine returns the request line as stored and hashed, which
+// is truncated to at most `limit` bytes, including TruncatedMarker. 0 means
+// unlimited. Lookups of long request lines by `req_hash` must hash this form.
+func NormalizeRequestLine(line string, limit int) string {
+	if limit <= 0 || len(line) <= limit {
+		return line
+	}
+	return string(truncateText([]byte(line), limit))
+}
+
+// requestLine formats the request line logged by RequestLogger.
+func requestLine(method, url string) string {
+	var sb strings.Builder
+	sb.Grow(len(method) + len(url) + 1)
+	sb.WriteString(method)
+	sb.WriteString(" ")
+	sb.WriteString(url)
+	return sb.String()
+}
+
+func withMarker(b []byte) []byte {
+	t := make([]byte, 0, len(b)+len(TruncatedMarker))
+	return append(append(t, b...), TruncatedMarker...)
+}
+
+// truncationAttributes flag records with any part truncated.
+var truncationAttributes = []string{
+	"body_truncated", "headers_truncated", "capture_truncated",
+	"attributes_truncated",
+}
+
+// isTruncated tells whether any part of the record is truncated, as stored in
+// `truncated`.
+func isTruncated(attrs map[string]any) bool {
+	for _, k := range truncationAttributes {
+		if _, ok := attrs[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func marshalAttributes(attrs map[string]any) (sql.Null[string], error) {
+	if len(attrs) < 1 {
+		return sql.Null[string]{}, nil
+	}
+	b, err := json.Marshal(attrs)
+	if nil != err {
+		return sql.Null[string]{}, err
+	}
+	return sql.Null[string]{V: string(b), Valid: true}, nil
+}
+
+// formatUuid formats a binary UUID in its canonical text form.
+func formatUuid(v any) string {
+	b, ok := v.([]byte)
+	if !ok || 16 != len(b) {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func SqlBuilder(
+	log utils.TaggedLogger, failed io.Writer, options ...SqlOption,
+) func(data []any) (string, []any) {
+	return newSqlBuilder(log, failed, insertSql, options...)
+}
+
+// ClickhouseBuilder works like SqlBuilder, building inserts for ClickHouse.
+// Each insert creates a part to be merged in the background, so inserts are
+// asynchronous on the server, which merges concurrent batches into one part,
+// see internal.ClickhouseInsertSettings. Batches are still acknowledged once
+// persisted, so failures are reported as usual. It's best used with large
+// batches and intervals.
+func ClickhouseBuilder(
+	log utils.TaggedLogger, failed io.Writer, options ...SqlOption,
+) func(data []any) (string, []any) {
+	return newSqlBuilder(log, failed, func(count int) string {
+		return insertRows(insertStmt+internal.ClickhouseInsertSettings, count)
+	}, options...)
+}
+
+// BuilderFor returns ClickhouseBuilder for ClickHouse, or SqlBuilder.
+func BuilderFor(
+	cfg *DbConfig, log utils.TaggedLogger, failed io.Writer,
+	options ...SqlOption,
+) func(data []any) (string, []any) {
+	if cfg.clickhouse() {
+		return ClickhouseBuilder(log, failed, options...)
+	}
+	return SqlBuilder(log, failed, options...)
+}
+
+// newSqlBuilder logs bad records to `failed` once, replacing them by nil in
+// the data, which retries of the batch skip.
+func newSqlBuilder(
+	log utils.TaggedLogger, failed io.Writer, stmt func(count int) string,
+	options ...SqlOption,
+) func(data []any) (string, []any) {
+	opts := newSqlOptions(options...)
+	// the hasher and UUID generator are stateful, build one batch at a time
+	var mu sync.Mutex
+	var batches atomic.Uint64
+	attempts := newAttemptCounter()
 	return func(data []any) (string, []any) {
-		count, args, fails, err := BuildValues(data)
+		batch := batches.Add(1)
+		mu.Lock()
+		count, args, fails, err := buildValues(data, opts)
+		mu.Unlock()
 		if nil != err {
-			log.Errorf("error building values: %v", err)
+			log.Errorf("error building values of batch %d: %v", batch, err)
 			for _, f := range fails {
-				_, err = fmt.Fprintf(failed, "%#v;\n", f)
-				if nil != err {
+				// retries of the batch skip the record, it's logged once
+				data[f.index] = nil
+				f.Batch, f.Attempt = batch, attempts.inc(f.Record.Id)
+				if err = writeFailedRecord(failed, f); nil != err {
 					log.Errorf("can't log fails: %s", err.Error())
 				}
 			}
+		}
+		// bad records are skipped, the rest of the batch is still persisted
+		if count < 1 {
 			return "", nil
 		}
-		var sb strings.Builder
-		pl := numColumns*2 + 2
-		sb.Grow(pl)
-		sb.WriteString(",(")
-		sb.WriteString(strings.Repeat(",?", numColumns)[1:])
-		sb.WriteString(")")
-		ps := sb.String()
-		sb.Reset()
-		sb.WriteString(`INSERT INTO tx_log (id, req_hash, headers, body, created_at) VALUES`)
-		sb.Grow(pl * count)
-		sb.WriteString(strings.Repeat(ps, count)[1:])
-		sb.WriteString(";")
-		return sb.String(), args
+		return stmt(count), args
 	}
 }
 
+// insertSql returns the statement inserting the given number of rows.
+func insertSql(count int) string {
+	return insertRows(insertStmt, count)
+}
+
+// insertRows appends placeholders of the given number of rows to the insert.
+func insertRows(insert string, count int) string {
+	var sb strings.Builder
+	pl := numColumns*2 + 2
+	sb.Grow(pl)
+	sb.WriteString(",(")
+	sb.WriteString(strings.Repeat(",?", numColumns)[1:])
+	sb.WriteString(")")
+	ps := sb.String()
+	sb.Reset()
+	sb.WriteString(insert)
+	sb.WriteString(" VALUES")
+	sb.Grow(pl * count)
+	sb.WriteString(strings.Repeat(ps, count)[1:])
+	sb.WriteString(";")
+	return sb.String()
+}
+
 func ConnectDB(cfg *DbConfig) (*sql.DB, error) {
 	if "" == cfg.Driver {
 		return nil, errors.New("invalid DB driver")
@@ -150,5 +983,6 @@ func ConnectDB(cfg *DbConfig) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	conn.SetMaxOpenConns(cfg.MaxOpenConns)
 	return conn, nil
 }
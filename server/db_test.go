@@ -2,13 +2,19 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"io"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/eidng8/go-utils"
 	ut "github.com/eidng8/go-utils/testing"
@@ -16,6 +22,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/zeebo/xxh3"
 
 	"github.com/eidng8/gin-persist-log/internal"
 )
@@ -86,6 +93,80 @@ func Test_CreateDefaultTable_supports_sqlite(t *testing.T) {
 	require.Nil(t, err)
 }
 
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_CreateDefaultTable_creates_secondary_indexes(t *testing.T) {
+	require.NoError(t, os.Setenv("DB_INDEXES", "req_hash+created_at,created_at"))
+	defer func() { require.NoError(t, os.Unsetenv("DB_INDEXES")) }()
+	cfg, conn := setupDb(t)
+	require.Equal(t,
+		[][]string{{"req_hash", "created_at"}, {"created_at"}}, cfg.Indexes)
+	// idempotent
+	require.Nil(t, CreateDefaultTable(cfg, conn))
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+		WHERE type='index' AND name IN
+		('ix_tx_log_req_hash_created_at', 'ix_tx_log_created_at');`).
+		Scan(&count))
+	require.Equal(t, 2, count)
+	cfg.Indexes = [][]string{{"body"}}
+	require.EqualError(t, CreateDefaultTable(cfg, conn),
+		"column can't be indexed: body")
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_CreateDefaultTable_creates_views(t *testing.T) {
+	cfg, conn := setupDb(t)
+	cfg.Views = true
+	require.Nil(t, CreateDefaultTable(cfg, conn))
+	// idempotent
+	require.Nil(t, CreateDefaultTable(cfg, conn))
+	ok, missing, orphan := []byte("tx-ok"), []byte("tx-404"), []byte("tx-x")
+	query, args := SqlBuilder(utils.NewLogger(), &mockWriter{})([]any{
+		TxRecord{Request: "GET /t", Method: "GET", Path: "/t", TxId: ok,
+			Direction: DirectionRequest},
+		TxRecord{Request: "GET /t", Method: "GET", Path: "/t", TxId: ok,
+			Direction: DirectionResponse, Status: 200,
+			Duration: 10 * time.Millisecond},
+		TxRecord{Request: "GET /t", Method: "GET", Path: "/t", TxId: missing,
+			Direction: DirectionRequest},
+		TxRecord{Request: "GET /t", Method: "GET", Path: "/t", TxId: missing,
+			Direction: DirectionResponse, Status: 404,
+			Duration: 30 * time.Millisecond},
+		// same request line, another transaction without response yet
+		TxRecord{Request: "GET /t", Method: "GET", Path: "/t", TxId: orphan,
+			Direction: DirectionRequest},
+	})
+	_, err := conn.Exec(query, args...)
+	require.Nil(t, err)
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM v_tx_pairs`).
+		Scan(&count))
+	require.Equal(t, 3, count)
+	var status sql.NullInt64
+	require.Nil(t, conn.QueryRow(`SELECT status_code FROM v_tx_pairs
+		WHERE tx_id = ?`, orphan).Scan(&status))
+	require.False(t, status.Valid)
+	var path string
+	var duration int
+	require.Nil(t, conn.QueryRow(`SELECT path, status_code, duration_ms
+		FROM v_tx_errors`).Scan(&path, &status, &duration))
+	require.Equal(t, "/t", path)
+	require.Equal(t, int64(404), status.Int64)
+	require.Equal(t, 30, duration)
+	var avg float64
+	var minMs, maxMs int
+	require.Nil(t, conn.QueryRow(`SELECT responses, avg_ms, min_ms, max_ms
+		FROM v_tx_latency_by_route WHERE method = 'GET' AND path = '/t'`).
+		Scan(&count, &avg, &minMs, &maxMs))
+	require.Equal(t, 2, count)
+	require.Equal(t, 20.0, avg)
+	require.Equal(t, 10, minMs)
+	require.Equal(t, 30, maxMs)
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM v_tx_status_by_route
+		WHERE path = '/t'`).Scan(&count))
+	require.Equal(t, 2, count)
+}
+
 func Test_CreateDefaultTable_returns_error_if_not_support(t *testing.T) {
 	cfg := DbConfig{
 		Driver:  "sqlite3",
@@ -112,9 +193,7 @@ func Test_BuildValues_returns_error_if_invalid_record(t *testing.T) {
 }
 
 func Test_BuildValues_returns_error_if_uuid_new_error(t *testing.T) {
-	defer func() { uuid = &utils.Uuid{} }()
 	mock := ut.NewUuidMock(ut.MockUuidConfig{NewReturnsError: true})
-	uuid = &mock
 	_, _, _, err := BuildValues([]interface{}{
 		TxRecord{
 			Request: "req",
@@ -122,7 +201,7 @@ func Test_BuildValues_returns_error_if_uuid_new_error(t *testing.T) {
 			Body:    []byte("test body"),
 			At:      time.Now(),
 		},
-	})
+	}, WithUuid(&mock))
 	require.NotNil(t, err)
 	require.Equal(t,
 		"error generating UUID: assert.AnError general error for testing",
@@ -130,9 +209,7 @@ func Test_BuildValues_returns_error_if_uuid_new_error(t *testing.T) {
 }
 
 func Test_BuildValues_returns_error_if_uuid_marshal_error(t *testing.T) {
-	defer func() { uuid = &utils.Uuid{} }()
 	mock := ut.NewUuidMock(ut.MockUuidConfig{MarshalBinaryReturnsError: true})
-	uuid = &mock
 	_, _, _, err := BuildValues([]interface{}{
 		TxRecord{
 			Request: "req",
@@ -140,7 +217,7 @@ func Test_BuildValues_returns_error_if_uuid_marshal_error(t *testing.T) {
 			Body:    []byte("test body"),
 			At:      time.Now(),
 		},
-	})
+	}, WithUuid(&mock))
 	require.NotNil(t, err)
 	require.Equal(t,
 		"error marshaling UUID: assert.AnError general error for testing",
@@ -148,8 +225,6 @@ func Test_BuildValues_returns_error_if_uuid_marshal_error(t *testing.T) {
 }
 
 func Test_BuildValues_returns_error_if_hasher_write_error(t *testing.T) {
-	defer func() { hasher = &internal.XxHasher{} }()
-	hasher = &mockHasher{}
 	_, _, _, err := BuildValues([]interface{}{
 		TxRecord{
 			Request: "req",
@@ -157,29 +232,244 @@ func Test_BuildValues_returns_error_if_hasher_write_error(t *testing.T) {
 			Body:    []byte("test body"),
 			At:      time.Now(),
 		},
-	})
+	}, WithHasher(&mockHasher{}))
 	require.ErrorIs(t, assert.AnError, err)
 }
 
+func Test_BuildValues_stores_raw_xxh3_digest(t *testing.T) {
+	_, args, _, err := BuildValues([]interface{}{
+		TxRecord{Request: "abc", Headers: []byte("test header")},
+	}, WithHasher(internal.NewHasher(internal.HashXxh3)))
+	require.NoError(t, err)
+	digest := xxh3.HashString128("abc").Bytes()
+	require.Equal(t, digest[:], args[1])
+	require.Equal(t, internal.HashXxh3, args[7])
+}
+
+func Test_HashRequestLine_matches_stored_req_hash(t *testing.T) {
+	url := "http://x.test/a?b=" + strings.Repeat("1", 40)
+	cfg := &Config{HashAlgorithm: internal.HashXxh3,
+		Db: &DbConfig{MaxRequestLine: 32}}
+	_, args := SqlBuilder(utils.NewLogger(), io.Discard,
+		WithHasher(internal.NewHasher(internal.HashXxh3)),
+		WithRequestLineLimit(32, false))([]interface{}{
+		TxRecord{Request: "GET " + url, Headers: []byte("h")},
+	})
+	svr := &Server{Conf: cfg}
+	require.Equal(t, args[1], svr.HashRequestLine("GET", url))
+	require.NotEqual(t, args[1],
+		internal.SumString(internal.HashXxh3, "GET "+url))
+	require.Len(t, svr.HashRequestLine("GET", "/"), 16)
+	require.Len(t, (&Server{Conf: &Config{}}).HashRequestLine("GET", "/"), 8)
+}
+
+func Test_SqlBuilder_doesnt_share_hasher_between_builders(t *testing.T) {
+	xxh3Builder := SqlBuilder(utils.NewLogger(), io.Discard,
+		WithHasher(internal.NewHasher(internal.HashXxh3)))
+	xxh64Builder := SqlBuilder(utils.NewLogger(), io.Discard)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, args := xxh3Builder([]any{TxRecord{Request: "abc"}})
+			assert.Equal(t, internal.HashXxh3, args[7])
+		}()
+		go func() {
+			defer wg.Done()
+			_, args := xxh64Builder([]any{TxRecord{Request: "abc"}})
+			assert.Equal(t, internal.HashXxh64, args[7])
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_SqlBuilder_sends_text_id_for_mariadb_uuid(t *testing.T) {
+	opts := SqlOptions(&DbConfig{Dialect: "mariadb", MariadbUuid: true})
+	require.Len(t, opts, 3)
+	fn := SqlBuilder(utils.NewLogger(), io.Discard, opts...)
+	id := []byte("0123456789abcdef")
+	_, args := fn([]interface{}{
+		TxRecord{Request: "abc"}, TxRecord{Id: id, Request: "abc"},
+	})
+	require.Len(t, args[0], 36)
+	require.Equal(t, "30313233-3435-3637-3839-616263646566", args[numColumns])
+	require.Len(t, SqlOptions(&DbConfig{Dialect: "mysql", MariadbUuid: true}), 2)
+}
+
+func Test_DefaultMariadbTable_applies_options(t *testing.T) {
+	schema := internal.MysqlSchema{}
+	require.Equal(t, internal.DefaultMysqlTable(schema),
+		internal.DefaultMariadbTable(false, false, schema))
+	stmt := internal.DefaultMariadbTable(true, true, schema)
+	require.Contains(t, stmt, "id UUID NOT NULL PRIMARY KEY")
+	require.True(t, strings.HasSuffix(stmt, " PAGE_COMPRESSED=1"))
+}
+
+func Test_DefaultMysqlTable_sets_charset_and_collation(t *testing.T) {
+	stmt := internal.DefaultMysqlTable(internal.MysqlSchema{})
+	require.Contains(t, stmt, "headers TEXT COLLATE utf8mb4_bin NOT NULL,")
+	require.Contains(t, stmt, ") DEFAULT CHARSET=utf8mb4")
+	schema := internal.MysqlSchema{
+		Charset: "utf8", HeadersCollation: "utf8_general_ci",
+	}
+	require.True(t, schema.Valid())
+	stmt = internal.DefaultTidbTable(0, schema)
+	require.Contains(t, stmt, "headers TEXT COLLATE utf8_general_ci NOT NULL,")
+	require.Contains(t, stmt, ") DEFAULT CHARSET=utf8 SHARD_ROW_ID_BITS=0")
+	schema.Charset = "utf8; DROP TABLE tx_log"
+	require.False(t, schema.Valid())
+}
+
+func Test_ClickhouseBuilder_inserts_asynchronously(t *testing.T) {
+	stmt := internal.DefaultClickhouseTable()
+	for _, col := range columns {
+		require.Regexp(t, `\n\s+`+col+` `, stmt)
+	}
+	cfg := &DbConfig{Driver: "clickhouse", Dsn: "clickhouse://localhost"}
+	require.Nil(t, cfg.Validate())
+	require.Equal(t, clickhouseBatchSize, cfg.batchSize())
+	fn := BuilderFor(cfg, utils.NewLogger(), io.Discard)
+	query, args := fn([]any{
+		TxRecord{Request: "GET /a", Headers: []byte("h")},
+		TxRecord{Request: "GET /b", Headers: []byte("h")},
+	})
+	require.True(t, strings.HasPrefix(query, insertStmt+
+		" SETTINGS async_insert=1, wait_for_async_insert=1 VALUES(?,"))
+	require.Equal(t, 2*numColumns, strings.Count(query, "?"))
+	require.Len(t, args, 2*numColumns)
+	cfg.Savepoints = true
+	require.ErrorContains(t, cfg.Validate(), "can't be used with clickhouse")
+}
+
+// clickhouseDriver records statements executed on it, standing in for a
+// ClickHouse server, which the DDL and inserts are checked against.
+type clickhouseDriver struct {
+	mu    sync.Mutex
+	stmts []string
+	args  [][]driver.NamedValue
+}
+
+var fakeClickhouse = &clickhouseDriver{}
+
+func init() {
+	sql.Register("clickhouse-fake", fakeClickhouse)
+}
+
+func (d *clickhouseDriver) Open(string) (driver.Conn, error) {
+	return d, nil
+}
+
+func (d *clickhouseDriver) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements aren't supported")
+}
+
+func (d *clickhouseDriver) Close() error { return nil }
+
+func (d *clickhouseDriver) Begin() (driver.Tx, error) { return d, nil }
+
+func (d *clickhouseDriver) Commit() error { return nil }
+
+func (d *clickhouseDriver) Rollback() error { return nil }
+
+func (d *clickhouseDriver) ExecContext(
+	_ context.Context, query string, args []driver.NamedValue,
+) (driver.Result, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stmts = append(d.stmts, query)
+	d.args = append(d.args, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (d *clickhouseDriver) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stmts, d.args = nil, nil
+}
+
+func Test_CreateDefaultTable_and_flush_on_clickhouse(t *testing.T) {
+	cfg := &DbConfig{Driver: "clickhouse-fake", Dialect: "clickhouse",
+		Dsn: "clickhouse://localhost", Indexes: [][]string{{"partner"}}}
+	require.Nil(t, cfg.Validate())
+	conn, err := ConnectDB(cfg)
+	require.Nil(t, err)
+	fakeClickhouse.reset()
+	require.Nil(t, CreateDefaultTable(cfg, conn))
+	logger := utils.NewLogger()
+	w := NewBatchWriter(conn,
+		BuilderFor(cfg, logger, io.Discard, SqlOptions(cfg)...), logger)
+	w.Push(TxRecord{Request: "GET /a", Headers: []byte("h"), Partner: "p"})
+	w.Push(TxRecord{Request: "GET /b", Headers: []byte("h"),
+		Status: http.StatusOK, Direction: DirectionResponse})
+	w.Write()
+	stmts, args := fakeClickhouse.stmts, fakeClickhouse.args
+	require.Len(t, stmts, 3)
+	require.Equal(t, internal.DefaultClickhouseTable(), stmts[0])
+	require.Equal(t, internal.ClickhouseIndex("ix_tx_log_partner",
+		[]string{"partner"}), stmts[1])
+	require.True(t, strings.HasPrefix(stmts[2],
+		insertStmt+internal.ClickhouseInsertSettings+" VALUES(?,"))
+	require.Len(t, args[2], 2*numColumns)
+	require.Len(t, args[2][0].Value, 16)
+	require.Equal(t, "p", args[2][8].Value)
+	require.Equal(t, int64(http.StatusOK), args[2][numColumns+18].Value)
+}
+
 func Test_SqlBuilder_returns_nil_if_BuildValues_error(t *testing.T) {
 	var buf bytes.Buffer
 	logger := utils.NewStringTaggedLogger()
 	fn := SqlBuilder(logger, &buf)
 	s, a := fn([]interface{}{1, 2, 3})
-	require.Equal(t, "[ERROR] error building values: invalid record: 3\n",
+	require.Equal(t,
+		"[ERROR] error building values of batch 1: invalid record: 3\n",
 		logger.String())
-	require.Equal(t, 3, strings.Count(buf.String(), "server.TxRecord"))
+	require.Equal(t, 3, strings.Count(buf.String(), "\n"))
+	require.Equal(t, 3, strings.Count(buf.String(),
+		`"Class":"invalid_record","Error":"invalid record: `))
+	require.Equal(t, 3, strings.Count(buf.String(), `"Attempt":1,"Batch":1`))
 	require.Empty(t, s)
 	require.Nil(t, a)
 }
 
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_SqlBuilder_persists_rest_of_batch(t *testing.T) {
+	_, conn := setupDb(t)
+	var buf bytes.Buffer
+	query, args := SqlBuilder(utils.NewLogger(), &buf)([]any{
+		TxRecord{Request: "GET /a"}, TxRecord{}, TxRecord{Request: "GET /b"},
+	})
+	require.Equal(t, 1, strings.Count(buf.String(), `"Class":"empty_request"`))
+	_, err := conn.Exec(query, args...)
+	require.Nil(t, err)
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log;`).Scan(&count))
+	require.Equal(t, 2, count)
+}
+
+func Test_SqlBuilder_counts_attempts_of_failed_records(t *testing.T) {
+	var buf bytes.Buffer
+	fn := SqlBuilder(utils.NewLogger(), &buf)
+	rec := TxRecord{
+		Id: []byte("0123456789abcdef"), Request: "GET /t",
+		Attributes: map[string]any{"f": func() {}},
+	}
+	for i := 0; i < 2; i++ {
+		s, _ := fn([]any{rec})
+		require.Empty(t, s)
+	}
+	require.Contains(t, buf.String(), `"Class":"attributes"`)
+	require.Contains(t, buf.String(), `"Attempt":1,"Batch":1`)
+	require.Contains(t, buf.String(), `"Attempt":2,"Batch":2`)
+}
+
 func Test_SqlBuilder_returns_nil_if_Fprintf_error(t *testing.T) {
 	logger := utils.NewStringTaggedLogger()
 	fn := SqlBuilder(logger, &mockWriter{})
 	s, a := fn([]interface{}{1, 2, 3})
 	require.Equal(
 		t,
-		"[ERROR] error building values: invalid record: 3\n"+
+		"[ERROR] error building values of batch 1: invalid record: 3\n"+
 			strings.Repeat("[ERROR] can't log fails: assert.AnError general error for testing\n",
 				3),
 		logger.String())
@@ -209,3 +499,104 @@ func (w *mockWriter) Write(p []byte) (n int, err error) {
 }
 
 var _ io.Writer = &mockWriter{}
+
+func Test_ParseIsolation(t *testing.T) {
+	level, err := ParseIsolation("READ_COMMITTED")
+	require.Nil(t, err)
+	require.Equal(t, sql.LevelReadCommitted, level)
+	level, err = ParseIsolation("")
+	require.Nil(t, err)
+	require.Equal(t, sql.LevelDefault, level)
+	_, err = ParseIsolation("snapshot")
+	require.EqualError(t, err, "unsupported isolation level: snapshot")
+}
+
+func Test_BuildValues_truncates_oversized_headers_and_body(t *testing.T) {
+	headers := []byte(strings.Repeat("a", 84) + strings.Repeat("语言", 3))
+	body := []byte(strings.Repeat("b", 200))
+	_, args, _, err := BuildValues([]interface{}{
+		TxRecord{Request: "abc", Headers: headers, Body: body},
+	}, WithColumnLimits(100, 100, true))
+	require.Nil(t, err)
+	h := args[2].(string)
+	require.Len(t, h, 99)
+	require.True(t, utf8.ValidString(h))
+	require.True(t, strings.HasSuffix(h, TruncatedMarker))
+	b := args[3].(sql.Null[[]byte]).V
+	require.Len(t, b, 100)
+	require.True(t, bytes.HasSuffix(b, []byte(TruncatedMarker)))
+	attrs := args[6].(sql.Null[string]).V
+	require.JSONEq(t, `{"headers_truncated":true,"headers_size":102,
+		"body_truncated":true,"body_size":200}`, attrs)
+}
+
+func Test_BuildValues_rejects_oversized_record(t *testing.T) {
+	count, _, failed, err := BuildValues([]interface{}{
+		TxRecord{Request: "abc", Headers: []byte("h"), Body: make([]byte, 101)},
+		TxRecord{Request: "abc", Headers: []byte("h")},
+	}, WithColumnLimits(100, 100, false))
+	require.EqualError(t, err,
+		"oversized record: 1 bytes of headers, 101 bytes of body")
+	require.Equal(t, 1, count)
+	require.Len(t, failed, 1)
+	require.Equal(t, FailOversized, failed[0].Class)
+}
+
+func Test_SqlOptions_limits_columns_of_mysql(t *testing.T) {
+	require.Empty(t, SqlOptions(&DbConfig{Dialect: "sqlite3"}))
+	require.Len(t, SqlOptions(&DbConfig{Dialect: "tidb"}), 2)
+	opts := newSqlOptions(SqlOptions(
+		&DbConfig{Dialect: "mysql", Oversized: OversizedReject})...)
+	require.Equal(t, mysqlTextBytes, opts.maxHeaders)
+	require.Equal(t, mysqlTextBytes, opts.maxBody)
+	require.Equal(t, mysqlTextBytes, opts.maxAttrs)
+	require.False(t, opts.truncate)
+}
+
+func Test_BuildValues_fits_oversized_attributes(t *testing.T) {
+	rec := TxRecord{Request: "abc", Body: bytes.Repeat([]byte("b"), 20),
+		Attributes: map[string]any{"note": strings.Repeat("a", 100)}}
+	_, args, _, err := BuildValues([]interface{}{rec},
+		WithColumnLimits(0, 10, true), WithAttributesLimit(64))
+	require.Nil(t, err)
+	require.JSONEq(t, `{"attributes_truncated":true,"attributes_size":148,
+		"body_truncated":true,"body_size":20}`,
+		args[6].(sql.Null[string]).V)
+	require.Equal(t, true, args[22])
+	count, _, failed, err := BuildValues([]interface{}{rec},
+		WithColumnLimits(0, 0, false), WithAttributesLimit(64))
+	require.ErrorContains(t, err, "oversized record: 111 bytes of attributes")
+	require.Zero(t, count)
+	require.Equal(t, FailOversized, failed[0].Class)
+}
+
+func Test_DbConfig_sizes_body_column_by_type(t *testing.T) {
+	cfg := &DbConfig{Dialect: "mysql", BodyType: "mediumblob"}
+	require.Contains(t, internal.DefaultMysqlTable(cfg.mysqlSchema()),
+		"body MEDIUMBLOB,")
+	opts := newSqlOptions(SqlOptions(cfg)...)
+	require.Equal(t, 16777215, opts.maxBody)
+	cfg.BodyType = internal.MysqlLongBlob
+	require.Zero(t, newSqlOptions(SqlOptions(cfg)...).maxBody)
+	require.Equal(t, mysqlTextBytes, opts.maxHeaders)
+	cfg.BodyType = "JSON"
+	require.EqualError(t, CreateDefaultTable(cfg, nil),
+		"unsupported MySQL schema: {Body:JSON Charset: HeadersCollation:}")
+}
+
+func Test_BuildValues_truncates_long_request_line(t *testing.T) {
+	long := "GET /t?q=" + strings.Repeat("a", 100)
+	_, args, _, err := BuildValues([]interface{}{
+		TxRecord{Request: long, Headers: []byte("h")},
+		TxRecord{Request: "GET /t", Headers: []byte("h")},
+	}, WithRequestLineLimit(50, true))
+	require.Nil(t, err)
+	line := NormalizeRequestLine(long, 50)
+	require.Len(t, line, 50)
+	require.True(t, strings.HasSuffix(line, TruncatedMarker))
+	require.Equal(t, line, args[10])
+	require.Equal(t, internal.SumString(internal.HashXxh64, line), args[1])
+	require.Equal(t, sql.Null[string]{V: long, Valid: true}, args[11])
+	require.Equal(t, "GET /t", args[numColumns+10])
+	require.False(t, args[numColumns+11].(sql.Null[string]).Valid)
+}
@@ -0,0 +1,55 @@
+package server
+
+import "bytes"
+
+// persistNotifier is implemented by writers reporting records once they're
+// committed, such as RowWriter.
+type persistNotifier interface {
+	OnPersisted(fn func([]TxRecord))
+}
+
+// Subscribe registers a consumer of records once they're persisted, such as
+// cache invalidation reacting to logged callbacks. Consumers are called on
+// the flush goroutine, which waits for them, so they should return quickly.
+// Bodies are as stored, encoded if `BodyCodec` is set, see DecodeBody.
+// Nothing is emitted if the writer doesn't report persisted records, unlike
+// CachedWriter wrapping a RowWriter.
+func (s *Server) Subscribe(fn func(TxRecord)) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.subscribers = append(s.subscribers, fn)
+}
+
+// emit calls subscribers with each of the persisted records.
+func (s *Server) emit(records []TxRecord) {
+	s.hooksMu.Lock()
+	subscribers := s.subscribers
+	s.hooksMu.Unlock()
+	for _, rec := range records {
+		for _, fn := range subscribers {
+			fn(rec)
+		}
+	}
+}
+
+// persistedRecords returns the records committed of the inserted data.
+func persistedRecords(data []any, refused []FailedRecord) []TxRecord {
+	records := make([]TxRecord, 0, len(data))
+	for _, d := range data {
+		rec, ok := d.(TxRecord)
+		if !ok || isRefused(rec, refused) || rec.owner.is(ownerHandler) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func isRefused(rec TxRecord, refused []FailedRecord) bool {
+	for _, f := range refused {
+		if nil != rec.Id && bytes.Equal(rec.Id, f.Record.Id) {
+			return true
+		}
+	}
+	return false
+}
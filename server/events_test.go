@@ -0,0 +1,40 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Subscribe_emits_persisted_records(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	inner := NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger)
+	w := NewWriter(NewSerializeWriter(inner, 1, 4), logger)
+	s := NewServer(&http.Server{}, w, logger, &Config{})
+	var emitted []TxRecord
+	s.Subscribe(func(rec TxRecord) { emitted = append(emitted, rec) })
+	s.Engine.GET("/cb", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	s.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/cb", nil))
+	require.Empty(t, emitted)
+	w.Write()
+	require.Len(t, emitted, 2)
+	require.True(t, strings.HasSuffix(emitted[0].Request, "/cb"))
+	require.Contains(t, string(emitted[1].Headers), "HTTP/1.1 200")
+	// nothing is emitted for records not persisted
+	require.Nil(t, conn.Close())
+	s.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/cb", nil))
+	inner.SetRetries(1)
+	w.Write()
+	require.Len(t, emitted, 2)
+}
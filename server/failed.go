@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eidng8/go-utils"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// Classes of errors failing records.
+const (
+	// FailInvalidRecord is of values pushed that are not TxRecord.
+	FailInvalidRecord = "invalid_record"
+	// FailUuid is of errors generating or formatting IDs.
+	FailUuid = "uuid"
+	// FailAttributes is of attributes can't be marshaled.
+	FailAttributes = "attributes"
+	// FailEmptyRequest is of records without request line.
+	FailEmptyRequest = "empty_request"
+	// FailHash is of errors hashing the request line.
+	FailHash = "hash"
+	// FailOversized is of headers or bodies not fitting their columns.
+	FailOversized = "oversized"
+	// FailDb is of records the DB refused after all retries.
+	FailDb = "db"
+	// FailOverflow is of records beyond the memory cap of CachedWriter.
+	FailOverflow = "overflow"
+)
+
+// FailedRecord is written to the failed logs for each record that can't be
+// persisted, telling why. Each is a line of JSON, read back by ReadFailedLog.
+type FailedRecord struct {
+	// class of the error, one of the `Fail*` constants
+	Class string
+	Error string
+	// number of times the record has failed, as far as the writer can tell
+	Attempt int
+	// sequence number of the batch the record was in
+	Batch  uint64
+	At     time.Time
+	Record TxRecord
+	// position of the record in the batch it was dropped from
+	index int
+}
+
+func failRecord(class string, err error, rec TxRecord) FailedRecord {
+	return FailedRecord{
+		Class: class, Error: err.Error(), At: time.Now(), Record: rec,
+	}
+}
+
+// writeFailedRecord writes the record as a line of JSON. Traces are left out.
+func writeFailedRecord(w io.Writer, f FailedRecord) error {
+	f.Record.Trace = nil
+	b, err := json.Marshal(f)
+	if nil != err && nil != f.Record.Attributes {
+		// attributes that can't be marshaled may be why the record failed
+		f.Record.Attributes = nil
+		b, err = json.Marshal(f)
+	}
+	if nil != err {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// maximum bytes of a line read by ReadFailedLog
+const maxFailedLine = 256 << 20
+
+// ReadFailedLog calls the function with each record of the failed log, in
+// order, stopping at the first error returned. Lines that can't be parsed,
+// such as those written by earlier versions, are reported with their line
+// numbers in the returned error, after the rest of the log is read.
+func ReadFailedLog(r io.Reader, fn func(FailedRecord) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), maxFailedLine)
+	var errs []error
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) < 1 {
+			continue
+		}
+		var f FailedRecord
+		if err := json.Unmarshal(sc.Bytes(), &f); nil != err {
+			errs = append(errs, fmt.Errorf("line %d: %w", line, err))
+			continue
+		}
+		if err := fn(f); nil != err {
+			return errors.Join(append(errs, err)...)
+		}
+	}
+	return errors.Join(append(errs, sc.Err())...)
+}
+
+// ReingestOptions controls ReingestFailedLog.
+type ReingestOptions struct {
+	// Optional, config of the DB the statements are built for
+	Db *DbConfig
+	// Optional, hash algorithm of request lines, defaults to that of the
+	// server
+	HashAlgorithm string
+	// Optional, where records failing again are written, to be reingested
+	// later
+	Failed io.Writer
+	// number of records inserted in each transaction, defaults to 1000
+	BatchSize int
+	Logger    utils.TaggedLogger
+}
+
+// ReingestFailedLog retries the inserts of records in the failed log at the
+// given path, and returns the number of records persisted. Each record is
+// inserted under its own savepoint, except on ClickHouse, and those refused
+// again are written to `Failed` as a new failed log.
+func ReingestFailedLog(
+	ctx context.Context, conn *sql.DB, path string, opts ReingestOptions,
+) (int, error) {
+	f, err := os.Open(path)
+	if nil != err {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+	if opts.BatchSize < 1 {
+		opts.BatchSize = 1000
+	}
+	if nil == opts.Logger {
+		opts.Logger = utils.NewLogger()
+	}
+	if nil == opts.Failed {
+		opts.Failed = io.Discard
+	}
+	options := SqlOptions(opts.Db)
+	if "" != opts.HashAlgorithm {
+		hasher := internal.NewHasher(opts.HashAlgorithm)
+		if nil == hasher {
+			return 0, fmt.Errorf("unsupported hash algorithm: %s",
+				opts.HashAlgorithm)
+		}
+		options = append(options, WithHasher(hasher))
+	}
+	w := NewRowWriter(conn,
+		BuilderFor(opts.Db, opts.Logger, opts.Failed, options...), opts.Logger)
+	w.SetContext(ctx)
+	w.SetFailedLog(opts.Failed)
+	// ClickHouse has no savepoints
+	w.SetSavepoints(!opts.Db.clickhouse())
+	persisted := 0
+	w.OnPersisted(func(records []TxRecord) { persisted += len(records) })
+	var batch []any
+	flush := func() {
+		for _, rec := range batch {
+			w.Push(rec)
+		}
+		batch = batch[:0]
+		w.Write()
+	}
+	err = ReadFailedLog(f, func(fr FailedRecord) error {
+		batch = append(batch, fr.Record)
+		if len(batch) >= opts.BatchSize {
+			flush()
+		}
+		return ctx.Err()
+	})
+	if len(batch) > 0 && nil == ctx.Err() {
+		flush()
+	}
+	return persisted, err
+}
+
+// maximum number of records tracked by attemptCounter
+const maxTrackedAttempts = 4096
+
+// attemptCounter counts failures of records by ID, as failed batches are
+// built again for each retry. It forgets all records once too many are
+// tracked.
+type attemptCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newAttemptCounter() *attemptCounter {
+	return &attemptCounter{counts: make(map[string]int)}
+}
+
+// inc increments and returns the number of failures of the record. Records
+// without ID are always at their first attempt.
+func (c *attemptCounter) inc(id []byte) int {
+	if len(id) < 1 {
+		return 1
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.counts) >= maxTrackedAttempts {
+		clear(c.counts)
+	}
+	c.counts[string(id)]++
+	return c.counts[string(id)]
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ReingestFailedLog_retries_failed_inserts(t *testing.T) {
+	// records failed by a DB that went away
+	_, gone := setupDb(t)
+	require.Nil(t, gone.Close())
+	var log bytes.Buffer
+	logger := utils.NewLogger()
+	w := NewRowWriter(gone, SqlBuilder(logger, io.Discard), logger)
+	w.SetRetries(1)
+	w.SetFailedLog(&log)
+	id := []byte("0123456789abcdef")
+	w.Push(TxRecord{Id: id, Request: "GET /a", Headers: []byte("h"),
+		Attributes: map[string]any{"n": 1}})
+	w.Push(TxRecord{Request: "GET /b", Headers: []byte("h")})
+	w.Write()
+	// a record failing again, and a line of an earlier version
+	w.Push(TxRecord{Id: id, Request: "GET /dup", Headers: []byte("h")})
+	w.Write()
+	log.WriteString("server.FailedRecord{Class:\"db\"};\n")
+	path := filepath.Join(t.TempDir(), "failed_db.log")
+	require.Nil(t, os.WriteFile(path, log.Bytes(), 0600))
+
+	dbcfg, conn := setupDb(t)
+	var again bytes.Buffer
+	n, err := ReingestFailedLog(context.Background(), conn, path,
+		ReingestOptions{Db: dbcfg, Failed: &again, BatchSize: 2})
+	require.ErrorContains(t, err, "line 4: ")
+	require.Equal(t, 2, n)
+	require.Equal(t, 1, strings.Count(again.String(), "\n"))
+	require.Contains(t, again.String(), `"Request":"GET /dup"`)
+	rows, err := NewRecordStore(conn, false).Records(context.Background(),
+		RecordQuery{})
+	require.Nil(t, err)
+	require.Len(t, rows, 2)
+	// in the order of ID, the generated UUID first
+	require.Equal(t, []string{`{"n":1}`, ""},
+		[]string{rows[1].Attributes, rows[0].Attributes})
+
+	var records []FailedRecord
+	require.Nil(t, ReadFailedLog(&again, func(f FailedRecord) error {
+		records = append(records, f)
+		return nil
+	}))
+	require.Len(t, records, 1)
+	require.Equal(t, FailDb, records[0].Class)
+	require.Equal(t, id, records[0].Record.Id)
+}
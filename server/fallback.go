@@ -0,0 +1,167 @@
+package server
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/eidng8/go-db"
+	"github.com/eidng8/go-utils"
+)
+
+// number of rows moved from the spill store in each transaction
+const spillBatch = 500
+
+// Fallback tracks the local SQLite spill store used while the DB is
+// unreachable at startup, and moves spilled rows to the DB once it is up.
+type Fallback struct {
+	cfg     *DbConfig
+	primary *sql.DB
+	spill   *sql.DB
+	// config of the spill store, with tables of `cfg`
+	spillCfg *DbConfig
+}
+
+// ConnectDBWithFallback connects to the DB and creates the default table. If
+// the DB can't be reached and `FallbackDsn` is set, the SQLite spill store is
+// connected instead, and returned along with the Fallback to be watched. The
+// returned Fallback is nil if the DB is connected. Since the dialect can't be
+// detected while the DB is down, MariaDB must be set as the `Dialect`
+// explicitly to use the native `UUID` type with fallback.
+func ConnectDBWithFallback(cfg *DbConfig) (*sql.DB, *Fallback, error) {
+	conn, err := ConnectDB(cfg)
+	if nil != err {
+		return nil, nil, err
+	}
+	if err = conn.Ping(); nil == err || "" == cfg.FallbackDsn {
+		if nil == err {
+			err = CreateDefaultTable(cfg, conn)
+		}
+		return conn, nil, err
+	}
+	spill, err := sql.Open("sqlite3", cfg.FallbackDsn)
+	if nil != err {
+		return nil, nil, err
+	}
+	spillCfg := &DbConfig{
+		Driver: "sqlite3", Dsn: cfg.FallbackDsn, Audit: cfg.Audit,
+		Meta: cfg.Meta, Checkpoints: cfg.Checkpoints, RawErrors: cfg.RawErrors,
+	}
+	if err = CreateDefaultTable(spillCfg, spill); nil != err {
+		return nil, nil, err
+	}
+	return spill, &Fallback{
+		cfg: cfg, primary: conn, spill: spill, spillCfg: spillCfg,
+	}, nil
+}
+
+// Watch checks the DB at the `FallbackRetry` interval, until it's reachable or
+// the given channel is signaled. Once the DB is up, the default table is
+// created, the writer is switched to the DB, and the spilled rows are moved.
+// Rows are moved again after another interval, to pick up those written by
+// flushes that were in progress during the switch.
+func (f *Fallback) Watch(
+	writer db.CachedWriter, logger utils.TaggedLogger, stopChan <-chan struct{},
+) {
+	interval := f.cfg.FallbackRetry
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+		}
+		if err := f.primary.Ping(); nil != err {
+			logger.Debugf("DB is still unreachable: %v", err)
+			continue
+		}
+		if err := CreateDefaultTable(f.cfg, f.primary); nil != err {
+			logger.Errorf("Error creating table: %v", err)
+			continue
+		}
+		writer.Pause()
+		writer.SetDB(f.primary)
+		writer.Resume()
+		logger.Infof("DB is reachable, switched from the spill store")
+		f.moveAll(logger)
+		select {
+		case <-stopChan:
+		case <-time.After(interval):
+		}
+		f.moveAll(logger)
+		return
+	}
+}
+
+// Config returns the config of the spill store, which speaks the dialect of
+// the connection returned by ConnectDBWithFallback.
+func (f *Fallback) Config() *DbConfig {
+	return f.spillCfg
+}
+
+// DB returns the connection of the primary DB, which should be closed upon
+// shutdown, besides the spill store.
+func (f *Fallback) DB() *sql.DB {
+	return f.primary
+}
+
+func (f *Fallback) moveAll(logger utils.TaggedLogger) {
+	var total int64
+	for {
+		n, err := f.move(spillBatch)
+		total += int64(n)
+		if nil != err {
+			logger.Errorf("Error moving spilled rows: %v", err)
+			return
+		}
+		if n < spillBatch {
+			logger.Infof("Moved %d spilled rows to DB", total)
+			return
+		}
+	}
+}
+
+// move copies up to the given number of rows from the spill store to the DB,
+// and deletes them from the spill store. It returns the number of rows moved.
+func (f *Fallback) move(limit int) (int, error) {
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	rows, err := f.spill.Query("SELECT "+strings.Join(columns[:], ", ")+
+		" FROM tx_log ORDER BY created_at LIMIT ?", limit)
+	if nil != err {
+		return 0, err
+	}
+	var args, ids []any
+	for rows.Next() {
+		row := make([]any, numColumns)
+		ptrs := make([]any, numColumns)
+		for i := range row {
+			ptrs[i] = &row[i]
+		}
+		if err = rows.Scan(ptrs...); nil != err {
+			_ = rows.Close()
+			return 0, err
+		}
+		args = append(args, row...)
+		ids = append(ids, row[0])
+	}
+	if err = rows.Close(); nil != err {
+		return 0, err
+	}
+	if err = rows.Err(); nil != err || len(ids) < 1 {
+		return 0, err
+	}
+	if _, err = f.primary.Exec(insertSql(len(ids)), args...); nil != err {
+		return 0, err
+	}
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	_, err = f.spill.Exec("DELETE FROM tx_log WHERE id IN ("+
+		strings.Repeat(",?", len(ids))[1:]+")", ids...)
+	if nil != err {
+		return 0, err
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-db"
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+)
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_ConnectDBWithFallback_moves_spilled_rows(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "primary")
+	cfg := &DbConfig{
+		Driver: "sqlite3", Dsn: filepath.Join(dir, "log.db"),
+		FallbackDsn:   filepath.Join(t.TempDir(), "spill.db"),
+		FallbackRetry: 10 * time.Millisecond,
+	}
+	conn, fb, err := ConnectDBWithFallback(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, fb)
+	defer func() { require.Nil(t, fb.DB().Close()) }()
+	defer func() { require.Nil(t, conn.Close()) }()
+	logger := utils.NewStringTaggedLogger()
+	writer := db.NewMemCachedWriter(conn, SqlBuilder(logger, &mockWriter{}),
+		logger)
+	for i := 0; i < spillBatch+1; i++ {
+		writer.Push(TxRecord{Request: "GET /", Headers: []byte("GET / HTTP/1.1")})
+	}
+	writer.Write()
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log`).Scan(&count))
+	require.Equal(t, spillBatch+1, count)
+	// the primary becomes reachable
+	require.Nil(t, os.Mkdir(dir, 0755))
+	fb.Watch(writer, logger, make(chan struct{}))
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log`).Scan(&count))
+	require.Zero(t, count)
+	writer.Push(TxRecord{Request: "GET /", Headers: []byte("GET / HTTP/1.1")})
+	writer.Write()
+	require.Nil(t, fb.DB().QueryRow(`SELECT COUNT(*) FROM tx_log`).Scan(&count))
+	require.Equal(t, spillBatch+2, count)
+}
+
+func Test_ConnectDBWithFallback_returns_error_without_fallback(t *testing.T) {
+	cfg := &DbConfig{
+		Driver: "sqlite3", Dsn: filepath.Join(t.TempDir(), "none", "log.db"),
+	}
+	_, fb, err := ConnectDBWithFallback(cfg)
+	require.NotNil(t, err)
+	require.Nil(t, fb)
+}
+
+func Test_DefaultServer_uses_spill_store_dialect(t *testing.T) {
+	cfg := DefaultConfigFromEnv()
+	cfg.LeaderLock = "test"
+	cfg.Db = &DbConfig{
+		Driver: "mysql", Dsn: "u:p@tcp(127.0.0.1:1)/test",
+		FallbackDsn:   filepath.Join(t.TempDir(), "spill.db"),
+		FallbackRetry: time.Hour, Audit: true,
+	}
+	svr, _, stopChan, cleanup := DefaultServer(nil, cfg)
+	defer cleanup()
+	defer close(stopChan)
+	// the spill store is always the leader, without MySQL locks
+	leader, err := svr.Elector.Elect(context.Background())
+	require.Nil(t, err)
+	require.True(t, leader)
+	require.Nil(t, svr.Audit.Record(context.Background(), "alice",
+		ActionQuery, nil))
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// ServeFile serves the given file like `gin.Context.File`. Instead of keeping
+// the file content in the response record, it records the file path, size
+// and the checksum of bytes served in the response record's attributes. The
+// content is still kept if ForceBody has been called.
+func ServeFile(gc *gin.Context, filepath string) {
+	rlw, ok := gc.Writer.(*internal.ResponseLogWriter)
+	if ok {
+		rlw.SkipBody = !gc.GetBool(ctxKeyForce)
+		rlw.EnableChecksum()
+	}
+	gc.File(filepath)
+	Annotate(gc, "file", filepath)
+	if st, err := os.Stat(filepath); nil == err {
+		Annotate(gc, "file_size", st.Size())
+	}
+	if ok {
+		Annotate(gc, "served_size", gc.Writer.Size())
+		Annotate(gc, "checksum", fmt.Sprintf("%016x", rlw.Checksum()))
+	}
+}
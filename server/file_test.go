@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ServeFile_records_file_metadata(t *testing.T) {
+	content := []byte("file content")
+	path := filepath.Join(t.TempDir(), "test.txt")
+	require.Nil(t, os.WriteFile(path, content, 0644))
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	svr.Engine.GET("/f", func(c *gin.Context) { ServeFile(c, path) })
+	w := httptest.NewRecorder()
+	svr.Engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/f", nil))
+	require.Equal(t, content, w.Body.Bytes())
+	require.Len(t, writer.records, 2)
+	res := writer.records[1]
+	require.Empty(t, res.Body)
+	require.Equal(t, path, res.Attributes["file"])
+	require.Equal(t, int64(len(content)), res.Attributes["file_size"])
+	require.Equal(t, len(content), res.Attributes["served_size"])
+	require.Equal(t, fmt.Sprintf("%016x", xxhash.Sum64(content)),
+		res.Attributes["checksum"])
+}
+
+func Test_RequestLogger_captures_WriteString(t *testing.T) {
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	svr.Engine.GET("/s", func(c *gin.Context) {
+		_, _ = c.Writer.WriteString("written string")
+	})
+	svr.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/s", nil))
+	require.Len(t, writer.records, 2)
+	require.Equal(t, []byte("written string"), writer.records[1].Body)
+}
+
+func Test_RequestLogger_records_partial_content(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.txt")
+	require.Nil(t, os.WriteFile(path, []byte("0123456789"), 0644))
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	svr.Engine.GET("/f", func(c *gin.Context) { c.File(path) })
+	req := httptest.NewRequest(http.MethodGet, "/f", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	w := httptest.NewRecorder()
+	svr.Engine.ServeHTTP(w, req)
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	require.Equal(t, "2345", w.Body.String())
+	require.Len(t, writer.records, 2)
+	res := writer.records[1]
+	require.Empty(t, res.Body)
+	require.Equal(t, "bytes=2-5", res.Attributes["range"])
+	require.Equal(t, "bytes 2-5/10", res.Attributes["content_range"])
+	require.Equal(t, 4, res.Attributes["served_size"])
+	require.Equal(t, uint64(1), svr.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyBodySkipped))
+}
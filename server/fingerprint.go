@@ -0,0 +1,29 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// prefix of Authorization credentials replaced by their fingerprints
+const fingerprintPrefix = "hmac:"
+
+// fingerprint returns a stable HMAC-SHA256 fingerprint of the credential,
+// the first 16 bytes in hex.
+func fingerprint(key []byte, credential string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(credential))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// fingerprintAuth replaces the credential of an Authorization value with its
+// fingerprint, keeping the scheme, e.g. `Bearer hmac:9f86d081884c7d65`.
+func fingerprintAuth(key []byte, value string) string {
+	scheme, credential, found := strings.Cut(value, " ")
+	if !found {
+		return fingerprintPrefix + fingerprint(key, value)
+	}
+	return scheme + " " + fingerprintPrefix + fingerprint(key, credential)
+}
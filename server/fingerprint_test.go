@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_fingerprintAuth_keeps_scheme(t *testing.T) {
+	key := []byte("key")
+	fp := fingerprintAuth(key, "Bearer token")
+	require.Equal(t, "Bearer hmac:"+fingerprint(key, "token"), fp)
+	require.Len(t, fingerprint(key, "token"), 32)
+	require.Equal(t, fp, fingerprintAuth(key, "Bearer token"))
+	require.NotEqual(t, fp, fingerprintAuth([]byte("other"), "Bearer token"))
+	require.Equal(t, "hmac:"+fingerprint(key, "token"),
+		fingerprintAuth(key, "token"))
+}
+
+func Test_RequestLogger_fingerprints_authorization(t *testing.T) {
+	key := []byte("key")
+	for _, workers := range []int{0, 1} {
+		writer := &mockCachedWriter{}
+		cfg := &Config{AuthFingerprintKey: key, CaptureWorkers: workers}
+		svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+		svr.Engine.GET("/t", func(c *gin.Context) {
+			require.Equal(t, "Bearer secret", c.GetHeader("Authorization"))
+			c.Status(http.StatusOK)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/t", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		svr.Engine.ServeHTTP(httptest.NewRecorder(), req)
+		_, err := svr.Shutdown()
+		require.Nil(t, err)
+		require.Len(t, writer.records, 2)
+		fp := fingerprint(key, "secret")
+		headers := string(writer.records[0].Headers)
+		require.False(t, strings.Contains(headers, "secret"))
+		require.Contains(t, headers, "Authorization: Bearer hmac:"+fp)
+		require.Equal(t, fp, writer.records[0].Attributes["auth_fingerprint"])
+	}
+}
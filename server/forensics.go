@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eidng8/go-utils"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// number of raw errors queued before new ones are dropped
+const rawErrorQueue = 256
+
+// maximum bytes of the server's response kept for each raw error
+const rawResponseBytes = 512
+
+// Forensics records connections on which no request ever reached a handler,
+// such as malformed or smuggled requests rejected by net/http, into the
+// `tx_raw_error` table, along with the first bytes received and the server's
+// response. Connections closed without sending anything are ignored.
+type Forensics struct {
+	conn   *sql.DB
+	logger utils.TaggedLogger
+	// maximum bytes received kept for each connection
+	maxBytes int
+	queue    chan rawError
+	dropped  atomic.Uint64
+}
+
+type rawError struct {
+	remote   string
+	raw      []byte
+	response string
+	at       time.Time
+}
+
+// NewForensics creates a recorder keeping up to `maxBytes` received on each
+// connection, 4096 if not positive.
+func NewForensics(
+	conn *sql.DB, logger utils.TaggedLogger, maxBytes int,
+) *Forensics {
+	if maxBytes < 1 {
+		maxBytes = 4096
+	}
+	return &Forensics{
+		conn: conn, logger: logger, maxBytes: maxBytes,
+		queue: make(chan rawError, rawErrorQueue),
+	}
+}
+
+// CreateRawErrorTable creates the `tx_raw_error` table.
+func CreateRawErrorTable(cfg *DbConfig, conn *sql.DB) error {
+	stmt := internal.SqliteRawErrorTable()
+	if cfg.mysqlFamily() {
+		stmt = internal.MysqlRawErrorTable()
+	}
+	_, err := conn.Exec(stmt)
+	return err
+}
+
+// Listener wraps the listener, so bytes of accepted connections are kept.
+func (f *Forensics) Listener(l net.Listener) net.Listener {
+	return &forensicListener{Listener: l, f: f}
+}
+
+// Attach hooks the recorder to the server, whose handler must have been set.
+// Connections must be accepted from a Listener wrapped by the recorder.
+func (f *Forensics) Attach(svr *http.Server) {
+	next := svr.Handler
+	connContext := svr.ConnContext
+	svr.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if nil != connContext {
+			ctx = connContext(ctx, c)
+		}
+		return context.WithValue(ctx, forensicConnKey{}, c)
+	}
+	svr.ConnState = func(c net.Conn, state http.ConnState) {
+		if fc, ok := c.(*forensicConn); ok && http.StateClosed == state {
+			f.closed(fc)
+		}
+	}
+	svr.Handler = http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fc, ok := r.Context().Value(forensicConnKey{}).(*forensicConn)
+			if ok {
+				fc.serve()
+			}
+			next.ServeHTTP(w, r)
+		})
+}
+
+// Dropped returns the number of raw errors dropped due to a full queue.
+func (f *Forensics) Dropped() uint64 {
+	return f.dropped.Load()
+}
+
+// Start inserts recorded errors in the background, until the given channel
+// is signaled. Errors still queued upon stop are inserted before returning.
+func (f *Forensics) Start(stopChan <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case e := <-f.queue:
+				f.insert(e)
+			case <-stopChan:
+				for {
+					select {
+					case e := <-f.queue:
+						f.insert(e)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (f *Forensics) closed(c *forensicConn) {
+	e, ok := c.rawError()
+	if !ok {
+		return
+	}
+	select {
+	case f.queue <- e:
+	default:
+		f.dropped.Add(1)
+		f.logger.Debugf("Raw error queue is full, dropped %s", e.remote)
+	}
+}
+
+func (f *Forensics) insert(e rawError) {
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	_, err := f.conn.Exec(`INSERT INTO tx_raw_error
+		(remote_addr, raw, response, created_at) VALUES (?, ?, ?, ?)`,
+		e.remote, e.raw, sql.Null[string]{V: e.response,
+			Valid: "" != e.response}, formatStoredTime(e.at))
+	if nil != err {
+		f.logger.Errorf("Error recording raw error of %s: %v", e.remote, err)
+	}
+}
+
+type forensicConnKey struct{}
+
+type forensicListener struct {
+	net.Listener
+	f *Forensics
+}
+
+func (l *forensicListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if nil != err {
+		return c, err
+	}
+	return &forensicConn{Conn: c, max: l.f.maxBytes, at: time.Now()}, nil
+}
+
+// forensicConn keeps the first bytes read from and written to the connection,
+// until a request of it reaches the handler.
+type forensicConn struct {
+	net.Conn
+	max int
+	at  time.Time
+	// guards the rest, reads may be made by net/http in the background
+	mu       sync.Mutex
+	served   bool
+	raw      []byte
+	response []byte
+}
+
+func (c *forensicConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		if !c.served && len(c.raw) < c.max {
+			c.raw = append(c.raw, b[:min(n, c.max-len(c.raw))]...)
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *forensicConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if !c.served && len(c.response) < rawResponseBytes {
+		c.response = append(c.response,
+			b[:min(len(b), rawResponseBytes-len(c.response))]...)
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// serve marks the connection as having a request reached the handler, and
+// stops keeping its bytes.
+func (c *forensicConn) serve() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.served, c.raw, c.response = true, nil, nil
+}
+
+func (c *forensicConn) rawError() (rawError, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.served || len(c.raw) < 1 {
+		return rawError{}, false
+	}
+	return rawError{
+		remote: c.RemoteAddr().String(), raw: c.raw,
+		response: string(c.response), at: c.at,
+	}, true
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_Forensics_records_requests_rejected_before_handlers(t *testing.T) {
+	cfg, conn := setupDb(t)
+	conn.SetMaxOpenConns(1)
+	cfg.RawErrors = true
+	require.Nil(t, CreateDefaultTable(cfg, conn))
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	svr.Engine.GET("/t", func(c *gin.Context) { c.Status(http.StatusOK) })
+	f := NewForensics(conn, utils.NewLogger(), 8)
+	f.Attach(svr.Server)
+	stop := make(chan struct{})
+	f.Start(stop)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() { _ = svr.Server.Serve(f.Listener(l)) }()
+	defer func() { _ = svr.Server.Close() }()
+	res, err := http.Get("http://" + l.Addr().String() + "/t")
+	require.Nil(t, err)
+	require.Nil(t, res.Body.Close())
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	_, err = c.Write([]byte("GARBAGE\r\n\r\n"))
+	require.Nil(t, err)
+	line, err := bufio.NewReader(c).ReadString('\n')
+	require.Nil(t, err)
+	require.Equal(t, "HTTP/1.1 400 Bad Request\r\n", line)
+	require.Nil(t, c.Close())
+	var raw []byte
+	var response string
+	require.Eventually(t, func() bool {
+		err = conn.QueryRow(`SELECT raw, response FROM tx_raw_error`).
+			Scan(&raw, &response)
+		return nil == err
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, "GARBAGE\r", string(raw))
+	require.Contains(t, response, "400 Bad Request")
+	close(stop)
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_raw_error`).
+		Scan(&count))
+	require.Equal(t, 1, count)
+	require.Len(t, writer.records, 2)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strings"
+)
+
+// HeaderFilter removes headers from records before they are persisted. The
+// zero value keeps all headers.
+type HeaderFilter struct {
+	// if not empty, only these headers are kept
+	allow []string
+	// headers removed, even if allowed
+	deny []string
+}
+
+// NewHeaderFilter creates a filter keeping only the allowed headers, all if
+// none is given, and removing the denied ones. Names are case-insensitive.
+func NewHeaderFilter(allow, deny []string) *HeaderFilter {
+	return &HeaderFilter{allow: canonicalKeys(allow), deny: canonicalKeys(deny)}
+}
+
+// Apply removes headers in place, and returns the number of removed ones.
+func (f *HeaderFilter) Apply(h http.Header) int {
+	if nil == f {
+		return 0
+	}
+	n := 0
+	for k := range h {
+		if slices.Contains(f.deny, k) ||
+			(len(f.allow) > 0 && !slices.Contains(f.allow, k)) {
+			delete(h, k)
+			n++
+		}
+	}
+	return n
+}
+
+func canonicalKeys(keys []string) []string {
+	c := make([]string, 0, len(keys))
+	for _, k := range keys {
+		c = append(c, textproto.CanonicalMIMEHeaderKey(k))
+	}
+	return c
+}
+
+// sanitizeRequest returns the request to dump headers from. It's a snapshot
+// with cookies scrubbed, Authorization fingerprinted and headers redacted if
+// configured, or the request itself if there is nothing to sanitize. The
+// fingerprint of the Authorization header, if any, is also returned.
+func (s *Server) sanitizeRequest(req *http.Request) (*http.Request, string) {
+	if nil == s.Conf {
+		return req, ""
+	}
+	scrub := s.Conf.ScrubCookies && nil != req.Header["Cookie"]
+	auth := len(s.Conf.AuthFingerprintKey) > 0 &&
+		nil != req.Header["Authorization"]
+	if !scrub && !auth && !s.Conf.Redact.Needed(req.Header) {
+		return req, ""
+	}
+	return s.sanitizeSnapshot(snapshotRequest(req))
+}
+
+// sanitizeSnapshot sanitizes headers of a snapshot taken by snapshotRequest
+// in place, see sanitizeRequest.
+func (s *Server) sanitizeSnapshot(req *http.Request) (*http.Request, string) {
+	if nil == s.Conf {
+		return req, ""
+	}
+	s.scrubCookies(req.Header)
+	fp := s.fingerprintAuthHeader(req.Header)
+	// the fingerprint is taken before the credential is redacted
+	s.redact(req.Header)
+	return req, fp
+}
+
+// fingerprintAuthHeader replaces Authorization values by their fingerprints
+// in place, if configured, and returns the fingerprint of the first one.
+func (s *Server) fingerprintAuthHeader(h http.Header) string {
+	if len(s.Conf.AuthFingerprintKey) < 1 {
+		return ""
+	}
+	values := h["Authorization"]
+	for i, v := range values {
+		values[i] = fingerprintAuth(s.Conf.AuthFingerprintKey, v)
+	}
+	if len(values) < 1 {
+		return ""
+	}
+	s.countPolicy(PolicyAuthFingerprinted)
+	_, fp, _ := strings.Cut(values[0], fingerprintPrefix)
+	return fp
+}
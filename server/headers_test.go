@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HeaderFilter_applies_allow_and_deny_lists(t *testing.T) {
+	h := http.Header{
+		"Content-Type": {"text/plain"}, "Set-Cookie": {"a=1"},
+		"X-Trace": {"t"},
+	}
+	require.Equal(t, 1, NewHeaderFilter(nil, []string{"set-cookie"}).Apply(h))
+	require.Equal(t, http.Header{
+		"Content-Type": {"text/plain"}, "X-Trace": {"t"},
+	}, h)
+	f := NewHeaderFilter([]string{"content-type", "x-trace"}, []string{"X-Trace"})
+	require.Equal(t, 1, f.Apply(h))
+	require.Equal(t, http.Header{"Content-Type": {"text/plain"}}, h)
+	require.Zero(t, (*HeaderFilter)(nil).Apply(h))
+}
+
+func Test_RequestLogger_filters_response_headers(t *testing.T) {
+	writer := &mockCachedWriter{}
+	cfg := &Config{ResponseHeaders: NewHeaderFilter(nil, []string{"Set-Cookie"})}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+	svr.Engine.GET("/t", func(c *gin.Context) {
+		c.SetCookie("session", "secret", 0, "/", "", false, true)
+		c.String(http.StatusOK, "ok")
+	})
+	res := httptest.NewRecorder()
+	svr.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/t", nil))
+	require.NotEmpty(t, res.Header().Get("Set-Cookie"))
+	require.Len(t, writer.records, 2)
+	require.NotContains(t, string(writer.records[1].Headers), "secret")
+	require.Contains(t, string(writer.records[1].Headers), "Content-Type")
+	require.Equal(t, uint64(1), svr.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyHeaderRemoved))
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Alert describes a suspicious request, passed to the hooks registered with
+// OnAlert.
+type Alert struct {
+	// what triggered the alert, e.g. "honeypot"
+	Kind     string
+	Method   string
+	Path     string
+	ClientIP string
+	// binary UUID of the request record, nil if not generated
+	RecordId []byte
+	// human readable description, e.g. of the anomaly detected
+	Detail string
+	Time   time.Time
+}
+
+// OnAlert registers a hook run upon each Alert. Hooks run synchronously in the
+// handler, and should hand slow work off to other goroutines.
+func (s *Server) OnAlert(fn func(Alert)) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.alertHooks = append(s.alertHooks, fn)
+}
+
+// Alert runs the hooks registered with OnAlert.
+func (s *Server) Alert(a Alert) {
+	s.hooksMu.Lock()
+	hooks := s.alertHooks
+	s.hooksMu.Unlock()
+	for _, fn := range hooks {
+		fn(a)
+	}
+}
+
+// Honeypot registers a decoy route of all methods, whose hits are flagged by
+// the `honeypot` attribute of their response records, and raise an Alert of
+// kind "honeypot" if `alert` is true. It responds 404 unless handlers are
+// given, so the decoy looks like any other missing path.
+func (s *Server) Honeypot(
+	path string, alert bool, handlers ...gin.HandlerFunc,
+) gin.IRoutes {
+	return s.Engine.Any(path, append([]gin.HandlerFunc{s.honeypot(alert)},
+		handlers...)...)
+}
+
+// Honeypots registers each path with Honeypot, responding 404.
+func (s *Server) Honeypots(alert bool, paths ...string) {
+	for _, path := range paths {
+		s.Honeypot(path, alert)
+	}
+}
+
+func (s *Server) honeypot(alert bool) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		Annotate(gc, "honeypot", true)
+		s.countPolicy(PolicyHoneypot)
+		if alert {
+			id, _ := RequestRecordId(gc)
+			s.Alert(Alert{
+				Kind:     "honeypot",
+				Method:   gc.Request.Method,
+				Path:     gc.Request.URL.Path,
+				ClientIP: gc.ClientIP(),
+				RecordId: id,
+				Time:     time.Now(),
+			})
+		}
+		gc.Next()
+		if !gc.Writer.Written() {
+			gc.String(http.StatusNotFound, "404 page not found")
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Honeypot_flags_hits_and_alerts(t *testing.T) {
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	var alerts []Alert
+	svr.OnAlert(func(a Alert) { alerts = append(alerts, a) })
+	svr.Honeypot("/wp-admin", true)
+	svr.Honeypots(false, "/.env")
+	res := httptest.NewRecorder()
+	svr.Engine.ServeHTTP(res,
+		httptest.NewRequest(http.MethodPost, "/wp-admin", nil))
+	require.Equal(t, http.StatusNotFound, res.Code)
+	res = httptest.NewRecorder()
+	svr.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/.env", nil))
+	require.Equal(t, http.StatusNotFound, res.Code)
+	require.Len(t, writer.records, 4)
+	require.Equal(t, true, writer.records[1].Attributes["honeypot"])
+	require.Equal(t, true, writer.records[3].Attributes["honeypot"])
+	require.Len(t, alerts, 1)
+	require.Equal(t, "honeypot", alerts[0].Kind)
+	require.Equal(t, http.MethodPost, alerts[0].Method)
+	require.Equal(t, "/wp-admin", alerts[0].Path)
+	require.Equal(t, writer.records[0].Id, alerts[0].RecordId)
+	require.Equal(t, uint64(2), svr.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyHoneypot))
+}
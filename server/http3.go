@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// HTTP3Server serves HTTP/3, such as `http3.Server` of
+// `github.com/quic-go/quic-go`, which the module doesn't depend on.
+type HTTP3Server interface {
+	ListenAndServe() error
+	Close() error
+	// SetQUICHeaders advertises the server in `Alt-Svc` of TCP responses
+	SetQUICHeaders(hdr http.Header) error
+}
+
+// HTTP3Factory creates an HTTP3Server serving the handler with the TLS config
+// on the UDP port of the address.
+type HTTP3Factory func(
+	addr string, handler http.Handler, tlsConfig *tls.Config,
+) HTTP3Server
+
+var http3Factory atomic.Pointer[HTTP3Factory]
+
+// RegisterHTTP3 registers the factory of HTTP/3 servers, which `HTTP3`
+// requires. With quic-go, it's:
+//
+//	server.RegisterHTTP3(func(
+//		addr string, h http.Handler, c *tls.Config,
+//	) server.HTTP3Server {
+//		return &http3.Server{
+//			Addr: addr, Handler: h, TLSConfig: http3.ConfigureTLSConfig(c),
+//		}
+//	})
+func RegisterHTTP3(factory HTTP3Factory) {
+	http3Factory.Store(&factory)
+}
+
+// startHTTP3 serves HTTP/3 in the background on the UDP port of the listen
+// address, with the same handler and TLS config as the TCP listener. TCP
+// responses advertise it in `Alt-Svc`. It must be called before the TCP
+// listener starts.
+func (s *Server) startHTTP3() {
+	factory := http3Factory.Load()
+	if nil == factory {
+		s.Logger.Panicf("HTTP/3 requires RegisterHTTP3")
+	}
+	if nil == s.Server.TLSConfig {
+		s.Logger.Panicf("HTTP/3 requires TLSConfig")
+	}
+	h3 := (*factory)(s.Server.Addr, s.Server.Handler, s.Server.TLSConfig)
+	s.onShutdown(h3.Close)
+	next := s.Server.Handler
+	s.Server.Handler = http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_ = h3.SetQUICHeaders(w.Header())
+			next.ServeHTTP(w, r)
+		})
+	go func() {
+		s.Logger.Infof("Serving HTTP/3 on %s", s.Server.Addr)
+		err := h3.ListenAndServe()
+		if nil != err && !errors.Is(err, http.ErrServerClosed) {
+			s.Logger.Errorf("HTTP/3 serve error: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+type mockHTTP3Server struct {
+	served chan struct{}
+	closed bool
+}
+
+func (m *mockHTTP3Server) ListenAndServe() error {
+	close(m.served)
+	return http.ErrServerClosed
+}
+
+func (m *mockHTTP3Server) Close() error {
+	m.closed = true
+	return nil
+}
+
+func (m *mockHTTP3Server) SetQUICHeaders(hdr http.Header) error {
+	hdr.Set("Alt-Svc", `h3=":443"`)
+	return nil
+}
+
+func Test_Validate_requires_registered_http3_server(t *testing.T) {
+	defer http3Factory.Store(nil)
+	cfg := &Config{ListenAddr: ":443", FilePerm: 0644, HTTP3: true}
+	require.ErrorContains(t, cfg.Validate(),
+		"HTTP3: no HTTP/3 server is registered")
+	require.ErrorContains(t, cfg.Validate(), "HTTP3: requires TLS_CERT")
+	RegisterHTTP3(func(string, http.Handler, *tls.Config) HTTP3Server {
+		return &mockHTTP3Server{}
+	})
+	cfg.TLSCert, cfg.TLSKey = "cert.pem", "key.pem"
+	require.Nil(t, cfg.Validate())
+}
+
+func Test_startHTTP3_advertises_registered_server(t *testing.T) {
+	defer http3Factory.Store(nil)
+	h3 := &mockHTTP3Server{served: make(chan struct{})}
+	RegisterHTTP3(func(string, http.Handler, *tls.Config) HTTP3Server {
+		return h3
+	})
+	s := NewServer(&http.Server{TLSConfig: &tls.Config{}},
+		&mockCachedWriter{}, utils.NewLogger(), &Config{})
+	s.Engine.GET("/t", func(gc *gin.Context) { gc.Status(http.StatusOK) })
+	s.startHTTP3()
+	<-h3.served
+	res := httptest.NewRecorder()
+	s.Server.Handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/t",
+		nil))
+	require.Equal(t, `h3=":443"`, res.Header().Get("Alt-Svc"))
+	cancel, err := s.Shutdown()
+	cancel()
+	require.Nil(t, err)
+	require.True(t, h3.closed)
+}
@@ -0,0 +1,389 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// IngestMethod is the path of the Push method of the gRPC service of
+// ServeIngest, defined in `ingest.proto`.
+const IngestMethod = "/persistlog.v1.Ingest/Push"
+
+// IngestScope is the scope of the admin keys allowed to push records to
+// ServeIngest.
+const IngestScope = ScopeOperator
+
+// MetricIngested counts records pushed to ServeIngest.
+const MetricIngested = "persist_ingested_records_total"
+
+// maxIngestMessage is the largest message accepted by ServeIngest, the
+// default of gRPC.
+const maxIngestMessage = 4 << 20
+
+// gRPC status codes responded by IngestHandler.
+const (
+	grpcOk                = 0
+	grpcInvalidArgument   = 3
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnauthenticated   = 16
+)
+
+// ServeIngest serves the gRPC service of `ingest.proto` on the listener, for
+// other services, such as sidecars and edge proxies, to push records into
+// the pipeline of the server, until the listener is closed. HTTP/2 is served
+// over TLS if the HTTP server has TLSConfig, or else in clear text. The
+// service is closed upon Shutdown.
+func (s *Server) ServeIngest(l net.Listener) error {
+	svr := &http.Server{
+		Handler: h2c.NewHandler(s.IngestHandler(), &http2.Server{}),
+	}
+	s.onShutdown(func() error {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			5*time.Second)
+		defer cancel()
+		return svr.Shutdown(ctx)
+	})
+	var err error
+	if nil != s.Server && nil != s.Server.TLSConfig {
+		svr.TLSConfig = s.Server.TLSConfig.Clone()
+		svr.TLSConfig.NextProtos = []string{http2.NextProtoTLS}
+		err = svr.ServeTLS(l, "", "")
+	} else {
+		err = svr.Serve(l)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) startIngest() {
+	l, err := net.Listen("tcp", s.Conf.GrpcListen)
+	if nil != err {
+		s.Logger.Panicf("gRPC listen error: %v", err)
+	}
+	go func() {
+		s.Logger.Infof("Serving gRPC ingestion on %s", l.Addr())
+		if err := s.ServeIngest(l); nil != err {
+			s.Logger.Errorf("gRPC serve error: %v", err)
+		}
+	}()
+}
+
+// IngestHandler handles unary calls of IngestMethod, requiring an admin key
+// of IngestScope in the `authorization` metadata as a bearer token, or in
+// `x-api-key`. Messages may be compressed with gzip.
+func (s *Server) IngestHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if 2 != r.ProtoMajor || http.MethodPost != r.Method ||
+			!isGrpcContentType(r.Header.Get("Content-Type")) {
+			http.Error(w, "gRPC requests only",
+				http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		if IngestMethod != r.URL.Path {
+			grpcStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+			return
+		}
+		key := s.adminKey(r)
+		if nil == key {
+			grpcStatus(w, grpcUnauthenticated, "invalid admin key")
+			return
+		}
+		if slices.Index(scopes, key.Scope) <
+			slices.Index(scopes, IngestScope) {
+			grpcStatus(w, grpcPermissionDenied, "insufficient scope")
+			return
+		}
+		msg, code, err := readGrpcMessage(r)
+		if nil != err {
+			grpcStatus(w, code, err.Error())
+			return
+		}
+		records, err := decodePushRequest(msg)
+		if nil != err {
+			grpcStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		for i := range records {
+			if err := s.sanitizeIngested(&records[i]); nil != err {
+				grpcStatus(w, grpcInvalidArgument, err.Error())
+				return
+			}
+		}
+		for _, rec := range records {
+			s.Writer.Push(rec)
+		}
+		s.metrics.Add(uint64(len(records)), MetricIngested)
+		res := protowire.AppendTag(nil, 1, protowire.VarintType)
+		res = protowire.AppendVarint(res, uint64(len(records)))
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		frame := make([]byte, 5, 5+len(res))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(res)))
+		_, _ = w.Write(append(frame, res...))
+		w.Header().Set("Grpc-Status", strconv.Itoa(grpcOk))
+	})
+}
+
+// sanitizeIngested applies the header policies of RequestLogger to the
+// stored headers of an ingested record: response header filters, cookie
+// scrubbing, Authorization fingerprints and redaction.
+func (s *Server) sanitizeIngested(rec *TxRecord) error {
+	if nil == s.Conf || len(rec.Headers) < 1 {
+		return nil
+	}
+	line, rest, _ := bytes.Cut(rec.Headers, []byte("\r\n"))
+	// stored response headers have no terminating empty line
+	tp := textproto.NewReader(bufio.NewReader(io.MultiReader(
+		bytes.NewReader(rest), strings.NewReader("\r\n"))))
+	mh, err := tp.ReadMIMEHeader()
+	if nil != err {
+		return fmt.Errorf("invalid headers: %w", err)
+	}
+	h := http.Header(mh)
+	response := bytes.HasPrefix(line, []byte("HTTP/"))
+	if response {
+		s.metrics.Add(uint64(s.Conf.ResponseHeaders.Apply(h)),
+			MetricPolicyDecisions, "policy", PolicyHeaderRemoved)
+		s.scrubCookies(h)
+	} else {
+		s.scrubCookies(h)
+		// the fingerprint is taken before the credential is redacted
+		if fp := s.fingerprintAuthHeader(h); "" != fp {
+			if nil == rec.Attributes {
+				rec.Attributes = map[string]any{}
+			}
+			rec.Attributes["auth_fingerprint"] = fp
+		}
+	}
+	s.redact(h)
+	var buf bytes.Buffer
+	buf.Write(line)
+	buf.WriteString("\r\n")
+	if err := h.Write(&buf); nil != err {
+		return err
+	}
+	if !response {
+		buf.WriteString("\r\n")
+	}
+	rec.Headers = buf.Bytes()
+	return nil
+}
+
+func isGrpcContentType(ct string) bool {
+	return "application/grpc" == ct ||
+		len(ct) > 17 && "application/grpc" == ct[:16] &&
+			('+' == ct[16] || ';' == ct[16])
+}
+
+// grpcStatus responds the status without messages, in headers, as a
+// Trailers-Only response.
+func grpcStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", msg)
+	w.WriteHeader(http.StatusOK)
+}
+
+// readGrpcMessage reads the single message of a unary call, returning the
+// status code to respond upon error.
+func readGrpcMessage(r *http.Request) ([]byte, int, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r.Body, prefix[:]); nil != err {
+		return nil, grpcInvalidArgument, errors.New("missing message")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxIngestMessage {
+		return nil, grpcResourceExhausted, fmt.Errorf(
+			"message of %d bytes exceeds %d", n, maxIngestMessage)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r.Body, msg); nil != err {
+		return nil, grpcInvalidArgument, errors.New("truncated message")
+	}
+	if 0 == prefix[0] {
+		return msg, grpcOk, nil
+	}
+	if "gzip" != r.Header.Get("Grpc-Encoding") {
+		return nil, grpcUnimplemented, errors.New("unsupported encoding")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(msg))
+	if nil != err {
+		return nil, grpcInternal, err
+	}
+	msg, err = io.ReadAll(io.LimitReader(zr, maxIngestMessage+1))
+	if nil != err {
+		return nil, grpcInternal, err
+	}
+	if len(msg) > maxIngestMessage {
+		return nil, grpcResourceExhausted, fmt.Errorf(
+			"message exceeds %d bytes", maxIngestMessage)
+	}
+	return msg, grpcOk, nil
+}
+
+// decodePushRequest decodes the records of a PushRequest of `ingest.proto`.
+func decodePushRequest(msg []byte) ([]TxRecord, error) {
+	var records []TxRecord
+	err := consumeFields(msg, func(num protowire.Number,
+		typ protowire.Type, b []byte) (int, error) {
+		if 1 != num || protowire.BytesType != typ {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		rec, err := decodeRecord(v)
+		if nil != err {
+			return 0, fmt.Errorf("record #%d: %w", len(records)+1, err)
+		}
+		records = append(records, rec)
+		return n, nil
+	})
+	return records, err
+}
+
+// decodeRecord decodes a Record of `ingest.proto`.
+func decodeRecord(msg []byte) (TxRecord, error) {
+	var rec TxRecord
+	var at int64
+	err := consumeFields(msg, func(num protowire.Number,
+		typ protowire.Type, b []byte) (int, error) {
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			switch num {
+			case 1:
+				rec.Id = bytes.Clone(v)
+			case 2:
+				rec.Request = string(v)
+			case 3:
+				rec.Headers = bytes.Clone(v)
+			case 4:
+				rec.Body = bytes.Clone(v)
+			case 7:
+				k, val, err := decodeMapEntry(v)
+				if nil != err {
+					return 0, err
+				}
+				if nil == rec.Attributes {
+					rec.Attributes = map[string]any{}
+				}
+				rec.Attributes[k] = val
+			case 8:
+				rec.Partner = string(v)
+			case 9:
+				rec.Method = string(v)
+			case 10:
+				rec.Path = string(v)
+			case 13:
+				rec.TxId = bytes.Clone(v)
+			case 14:
+				rec.Direction = string(v)
+			}
+			return n, nil
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return n, nil
+			}
+			switch num {
+			case 5:
+				at = int64(v)
+			case 6:
+				rec.ClientAborted = 0 != v
+			case 11:
+				rec.Status = int(int32(v))
+			case 12:
+				rec.Duration = time.Duration(int64(v)) * time.Millisecond
+			}
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if nil != err {
+		return rec, err
+	}
+	switch {
+	case "" == rec.Request:
+		return rec, errors.New("request is empty")
+	case 0 != len(rec.Id) && 16 != len(rec.Id):
+		return rec, errors.New("id must be a binary UUID")
+	case 0 != len(rec.TxId) && 16 != len(rec.TxId):
+		return rec, errors.New("tx_id must be a binary UUID")
+	case "" != rec.Direction && DirectionRequest != rec.Direction &&
+		DirectionResponse != rec.Direction:
+		return rec, fmt.Errorf("invalid direction: %s", rec.Direction)
+	}
+	rec.At = time.Now()
+	if 0 != at {
+		rec.At = time.Unix(0, at)
+	}
+	return rec, nil
+}
+
+// decodeMapEntry decodes an entry of a `map<string, string>` field.
+func decodeMapEntry(msg []byte) (string, string, error) {
+	var k, v string
+	err := consumeFields(msg, func(num protowire.Number,
+		typ protowire.Type, b []byte) (int, error) {
+		if protowire.BytesType != typ || (1 != num && 2 != num) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		s, n := protowire.ConsumeString(b)
+		if 1 == num {
+			k = s
+		} else {
+			v = s
+		}
+		return n, nil
+	})
+	return k, v, err
+}
+
+// consumeFields calls fn with the value of each field of the message, which
+// returns the length of the value consumed, negative if malformed.
+func consumeFields(msg []byte, fn func(
+	num protowire.Number, typ protowire.Type, b []byte,
+) (int, error)) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		n, err := fn(num, typ, msg)
+		if nil != err {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return nil
+}
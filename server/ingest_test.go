@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func ingestRecord(request, direction string, status int) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, request)
+	b = protowire.AppendTag(b, 5, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(time.Unix(100, 0).UnixNano()))
+	entry := protowire.AppendTag(nil, 1, protowire.BytesType)
+	entry = protowire.AppendString(entry, "source")
+	entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+	entry = protowire.AppendString(entry, "edge")
+	b = protowire.AppendTag(b, 7, protowire.BytesType)
+	b = protowire.AppendBytes(b, entry)
+	b = protowire.AppendTag(b, 11, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(status))
+	b = protowire.AppendTag(b, 14, protowire.BytesType)
+	return protowire.AppendString(b, direction)
+}
+
+func withIngestHeaders(record []byte, headers string) []byte {
+	record = protowire.AppendTag(record, 3, protowire.BytesType)
+	return protowire.AppendString(record, headers)
+}
+
+func pushIngest(
+	t *testing.T, addr, key string, records ...[]byte,
+) *http.Response {
+	var msg []byte
+	for _, r := range records {
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, r)
+	}
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(
+			ctx context.Context, network, addr string, _ *tls.Config,
+		) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+IngestMethod,
+		bytes.NewReader(append(frame, msg...)))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Authorization", "Bearer "+key)
+	res, err := client.Do(req)
+	require.Nil(t, err)
+	return res
+}
+
+func Test_ServeIngest_pushes_records_to_writer(t *testing.T) {
+	written := &memorySink{}
+	svr := NewSinkServer(&http.Server{}, written, utils.NewLogger(),
+		&Config{AdminKeys: []AdminKey{
+			{Name: "edge", Scope: ScopeOperator, Key: "op"},
+			{Name: "ops", Scope: ScopeViewer, Key: "view"},
+		}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	served := make(chan error, 1)
+	go func() { served <- svr.ServeIngest(l) }()
+
+	res := pushIngest(t, l.Addr().String(), "op",
+		ingestRecord("GET /a", DirectionRequest, 0),
+		ingestRecord("GET /a", DirectionResponse, http.StatusCreated))
+	body, err := io.ReadAll(res.Body)
+	require.Nil(t, err)
+	require.Nil(t, res.Body.Close())
+	require.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+	require.Equal(t, []byte{0, 0, 0, 0, 2, 8, 2}, body)
+	require.Eventually(t, func() bool {
+		written.mu.Lock()
+		defer written.mu.Unlock()
+		return 2 == len(written.records)
+	}, time.Second, 10*time.Millisecond)
+	req, rsp := written.records[0], written.records[1]
+	require.Equal(t, "GET /a", req.Request)
+	require.Equal(t, DirectionRequest, req.Direction)
+	require.Equal(t, "edge", req.Attributes["source"])
+	require.True(t, time.Unix(100, 0).Equal(req.At))
+	require.Equal(t, http.StatusCreated, rsp.Status)
+
+	res = pushIngest(t, l.Addr().String(), "view",
+		ingestRecord("GET /b", "", 0))
+	require.Nil(t, res.Body.Close())
+	require.Equal(t, "7", res.Header.Get("Grpc-Status"))
+	res = pushIngest(t, l.Addr().String(), "bad",
+		ingestRecord("GET /b", "", 0))
+	require.Nil(t, res.Body.Close())
+	require.Equal(t, "16", res.Header.Get("Grpc-Status"))
+	res = pushIngest(t, l.Addr().String(), "op",
+		ingestRecord("", "", 0))
+	require.Nil(t, res.Body.Close())
+	require.Equal(t, "3", res.Header.Get("Grpc-Status"))
+
+	cancel, err := svr.Shutdown()
+	defer cancel()
+	require.Nil(t, err)
+	require.Nil(t, <-served)
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_ServeIngest_redacts_headers(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger),
+		logger)
+	redact, err := ParseRedactor(DefaultRedactedHeaders, nil)
+	require.Nil(t, err)
+	svr := NewServer(&http.Server{}, w, logger, &Config{
+		AdminKeys:          []AdminKey{{Scope: ScopeOperator, Key: "op"}},
+		Redact:             redact,
+		AuthFingerprintKey: []byte("key"),
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	served := make(chan error, 1)
+	go func() { served <- svr.ServeIngest(l) }()
+
+	res := pushIngest(t, l.Addr().String(), "op",
+		withIngestHeaders(ingestRecord("GET /a", DirectionRequest, 0),
+			"GET /a HTTP/1.1\r\nHost: edge\r\n"+
+				"Authorization: Bearer secret\r\n\r\n"),
+		withIngestHeaders(
+			ingestRecord("GET /a", DirectionResponse, http.StatusOK),
+			"HTTP/1.1 200 OK\r\nSet-Cookie: sid=secret\r\n"))
+	_, err = io.Copy(io.Discard, res.Body)
+	require.Nil(t, err)
+	require.Nil(t, res.Body.Close())
+	require.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+	w.Write()
+	var req, rsp, attrs string
+	require.Nil(t, conn.QueryRow(`SELECT headers, attributes FROM tx_log
+		WHERE direction = 'req'`).Scan(&req, &attrs))
+	require.Nil(t, conn.QueryRow(`SELECT headers FROM tx_log
+		WHERE direction = 'res'`).Scan(&rsp))
+	require.Contains(t, req, "Authorization: "+RedactedValue+"\r\n")
+	require.Contains(t, req, "Host: edge\r\n")
+	require.Contains(t, attrs, "auth_fingerprint")
+	require.Contains(t, rsp, "Set-Cookie: "+RedactedValue)
+	require.NotContains(t, req+rsp, "secret")
+
+	cancel, err := svr.Shutdown()
+	defer cancel()
+	require.Nil(t, err)
+	require.Nil(t, <-served)
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eidng8/go-utils"
+)
+
+// Elector elects one leader among replicas sharing the DB, so singleton
+// background jobs such as Purger and Consumer run once instead of once per
+// replica. On MySQL and compatible DBs, the leader holds a named advisory
+// lock, `GET_LOCK`, on a dedicated connection of the pool. The lock is
+// released by the DB if the leader dies, and another replica takes over upon
+// its next election. SQLite databases aren't shared by replicas, so the
+// elector is always the leader there. Other dialects are refused by Elect.
+type Elector struct {
+	cfg    *DbConfig
+	db     *sql.DB
+	name   string
+	logger utils.TaggedLogger
+	mu     sync.Mutex
+	// the session holding the lock, nil if not the leader
+	conn   *sql.Conn
+	leader atomic.Bool
+}
+
+// NewElector creates an elector of the lock of given name.
+func NewElector(
+	cfg *DbConfig, db *sql.DB, name string, logger utils.TaggedLogger,
+) *Elector {
+	return &Elector{cfg: cfg, db: db, name: name, logger: logger}
+}
+
+// IsLeader reports whether the lock was held as of the last election.
+func (e *Elector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Elect tries to acquire the lock if it's not held, or checks that it still
+// is, returning whether this is the leader.
+func (e *Elector) Elect(ctx context.Context) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case "sqlite3" == e.cfg.dialect():
+		e.leader.Store(true)
+		return true, nil
+	case !e.cfg.mysqlFamily():
+		return false, errors.New("unsupported SQL dialect")
+	}
+	if nil != e.conn {
+		var held sql.NullInt64
+		//goland:noinspection SqlNoDataSourceInspection
+		err := e.conn.QueryRowContext(ctx,
+			"SELECT IS_USED_LOCK(?) = CONNECTION_ID()", e.name).Scan(&held)
+		if nil == err && held.Valid && 1 == held.Int64 {
+			return true, nil
+		}
+		// the session is lost, so is the lock
+		_ = e.conn.Close()
+		e.conn = nil
+		e.leader.Store(false)
+	}
+	conn, err := e.db.Conn(ctx)
+	if nil != err {
+		return false, err
+	}
+	var got sql.NullInt64
+	//goland:noinspection SqlNoDataSourceInspection
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", e.name).
+		Scan(&got)
+	if nil != err || !got.Valid || 1 != got.Int64 {
+		_ = conn.Close()
+		return false, err
+	}
+	e.conn = conn
+	e.leader.Store(true)
+	return true, nil
+}
+
+// Release releases the lock if it's held.
+func (e *Elector) Release(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leader.Store(false)
+	if nil == e.conn {
+		return nil
+	}
+	//goland:noinspection SqlNoDataSourceInspection
+	_, err := e.conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", e.name)
+	_ = e.conn.Close()
+	e.conn = nil
+	return err
+}
+
+// Start holds an election every `interval`, the first right away, until the
+// given channel is closed, upon which the lock is released.
+func (e *Elector) Start(interval time.Duration, stopChan <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			was := e.IsLeader()
+			leader, err := e.Elect(context.Background())
+			if nil != err {
+				e.logger.Errorf("Failed to elect leader of %s: %v", e.name,
+					err)
+			}
+			if leader && !was {
+				e.logger.Infof("Elected leader of %s", e.name)
+			} else if !leader && was {
+				e.logger.Infof("Lost leadership of %s", e.name)
+			}
+			select {
+			case <-stopChan:
+				if err = e.Release(context.Background()); nil != err {
+					e.logger.Errorf("Failed to release %s: %v", e.name, err)
+				}
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Elector_is_always_leader_of_sqlite(t *testing.T) {
+	cfg, conn := setupDb(t)
+	e := NewElector(cfg, conn, "jobs", utils.NewLogger())
+	require.False(t, e.IsLeader())
+	leader, err := e.Elect(context.Background())
+	require.Nil(t, err)
+	require.True(t, leader)
+	require.True(t, e.IsLeader())
+	require.Nil(t, e.Release(context.Background()))
+	require.False(t, e.IsLeader())
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_Purger_skips_purging_unless_leader(t *testing.T) {
+	cfg, conn := setupDb(t)
+	_, err := conn.Exec(`INSERT INTO tx_log (id, req_hash, headers,
+		created_at) VALUES (?, ?, '', ?);`, []byte{1}, []byte{1},
+		formatStoredTime(time.Now().AddDate(0, 0, -2)))
+	require.Nil(t, err)
+	p := NewPurger(cfg, conn, 24*time.Hour, 0, utils.NewLogger())
+	p.SetElector(NewElector(cfg, conn, "jobs", utils.NewLogger()))
+	stop := make(chan struct{})
+	p.Start(time.Millisecond, stop)
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log`).Scan(&count))
+	require.Equal(t, 1, count)
+}
+
+func Test_Validate_checks_leader_lock(t *testing.T) {
+	cfg := &Config{ListenAddr: ":80", FilePerm: 0644, LeaderLock: "jobs"}
+	require.ErrorContains(t, cfg.Validate(),
+		"LEADER_INTERVAL: must be positive")
+	cfg.LeaderInterval, cfg.LeaderLock = time.Second, strings.Repeat("a", 65)
+	require.ErrorContains(t, cfg.Validate(),
+		"LEADER_LOCK: must not be longer than 64")
+	cfg.LeaderLock, cfg.Db = "jobs", &DbConfig{Dialect: "clickhouse"}
+	require.ErrorContains(t, cfg.Validate(),
+		"LEADER_LOCK: can't be used with clickhouse")
+	cfg.Db = &DbConfig{Driver: "mysql", MaxOpenConns: 1}
+	require.ErrorContains(t, cfg.Validate(),
+		"DB_MAX_OPEN_CONNS: must be at least 2 with LEADER_LOCK")
+}
+
+func Test_Elector_refuses_unsupported_dialect(t *testing.T) {
+	_, conn := setupDb(t)
+	e := NewElector(&DbConfig{Driver: "sqlite3", Dialect: "clickhouse"},
+		conn, "jobs", utils.NewLogger())
+	leader, err := e.Elect(context.Background())
+	require.ErrorContains(t, err, "unsupported SQL dialect")
+	require.False(t, leader)
+	require.False(t, e.IsLeader())
+}
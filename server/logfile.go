@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogFile is an append only file, which can be reopened after being moved by
+// external tools such as logrotate, and optionally rotates itself once it has
+// grown beyond a size. Writes are serialized, so it can be shared.
+type LogFile struct {
+	path     string
+	perm     os.FileMode
+	maxBytes int64
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+// OpenLogFile opens the file for appending, creating it if necessary. It's
+// rotated before exceeding maxBytes, 0 to never rotate.
+func OpenLogFile(path string, perm os.FileMode, maxBytes int64) (
+	*LogFile, error,
+) {
+	f := &LogFile{path: path, perm: perm, maxBytes: maxBytes}
+	if err := f.open(); nil != err {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); nil != err {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Reopen closes and reopens the file at its path, swapping in the new file
+// created after the old one has been moved.
+func (f *LogFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.file.Close(); nil != err {
+		return err
+	}
+	return f.open()
+}
+
+func (f *LogFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// rotate moves the current file aside with a timestamp suffix, and opens a
+// new one.
+func (f *LogFile) rotate() error {
+	if err := f.file.Close(); nil != err {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", f.path,
+		time.Now().Format("20060102T150405.000000"))
+	if err := os.Rename(f.path, rotated); nil != err {
+		return err
+	}
+	return f.open()
+}
+
+func (f *LogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY,
+		f.perm)
+	if nil != err {
+		return err
+	}
+	st, err := file.Stat()
+	if nil != err {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size = file, st.Size()
+	return nil
+}
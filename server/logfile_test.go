@@ -0,0 +1,48 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LogFile_rotates_beyond_max_bytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failed.log")
+	f, err := OpenLogFile(path, 0644, 10)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, f.Close()) }()
+	for _, s := range []string{"0123456", "789", "abc"} {
+		_, err = f.Write([]byte(s))
+		require.Nil(t, err)
+	}
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "abc", string(b))
+	rotated, err := filepath.Glob(path + ".*")
+	require.Nil(t, err)
+	require.Len(t, rotated, 1)
+	b, err = os.ReadFile(rotated[0])
+	require.Nil(t, err)
+	require.Equal(t, "0123456789", string(b))
+}
+
+func Test_LogFile_reopens_moved_file(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failed.log")
+	f, err := OpenLogFile(path, 0644, 0)
+	require.Nil(t, err)
+	defer func() { require.Nil(t, f.Close()) }()
+	_, err = f.Write([]byte("old"))
+	require.Nil(t, err)
+	require.Nil(t, os.Rename(path, path+".1"))
+	require.Nil(t, f.Reopen())
+	_, err = f.Write([]byte("new"))
+	require.Nil(t, err)
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "new", string(b))
+	b, err = os.ReadFile(path + ".1")
+	require.Nil(t, err)
+	require.Equal(t, "old", string(b))
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxLogsLimit is the largest page served by LogsHandler.
+const maxLogsLimit = 1000
+
+// LogRecord is the JSON form of a StoredRow served by LogsHandler and
+// LogRecordHandler. Binary IDs are in the canonical UUID form, and hashes in
+// hex.
+type LogRecord struct {
+	Id            string         `json:"id"`
+	ReqHash       string         `json:"req_hash"`
+	HashAlgo      string         `json:"hash_algo"`
+	Version       int            `json:"schema_version"`
+	TxId          string         `json:"tx_id,omitempty"`
+	Direction     string         `json:"direction,omitempty"`
+	RequestLine   string         `json:"request_line,omitempty"`
+	Method        string         `json:"method,omitempty"`
+	Path          string         `json:"path,omitempty"`
+	Status        int            `json:"status,omitempty"`
+	DurationMs    int64          `json:"duration_ms,omitempty"`
+	Headers       string         `json:"headers"`
+	Body          []byte         `json:"body,omitempty"`
+	CreatedAt     time.Time      `json:"created_at"`
+	ClientAborted bool           `json:"client_aborted"`
+	Truncated     bool           `json:"truncated"`
+	SloViolated   bool           `json:"slo_violated"`
+	Partner       string         `json:"partner,omitempty"`
+	Attributes    map[string]any `json:"attributes,omitempty"`
+}
+
+// LogPage is a page of records served by LogsHandler.
+type LogPage struct {
+	Records []LogRecord `json:"records"`
+	// ID to be passed as `after` for the next page, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// LogsBodyScope is the scope required for LogRecordHandler to return bodies,
+// which may carry personal data, separately from ScopeViewer browsing
+// headers.
+const LogsBodyScope = ScopeOperator
+
+// ServeLogs registers LogsHandler at the path, and LogRecordHandler at
+// `path/:id`, both requiring ScopeViewer, and Audited. Stored headers carry
+// credentials, so routes are refused without AdminKeys. Requests of the
+// routes are not persisted.
+func (s *Server) ServeLogs(path string, store *RecordStore) error {
+	if nil == s.Conf || len(s.Conf.AdminKeys) < 1 {
+		return errors.New("logs can't be served without admin keys")
+	}
+	handlers := []gin.HandlerFunc{
+		s.RequireScope(ScopeViewer), s.Audited(ActionQuery),
+	}
+	path = strings.TrimSuffix(path, "/")
+	s.Engine.GET(path, append(slices.Clone(handlers),
+		s.LogsHandler(store))...)
+	s.Engine.GET(path+"/:id", append(slices.Clone(handlers),
+		s.LogRecordHandler(store))...)
+	return nil
+}
+
+// LogsHandler responds a LogPage of records in the order of ID, without
+// bodies. Records are filtered by the query parameters `req_hash` in hex,
+// `request_line`, `tx_id`, and `from` inclusive and `to` exclusive in
+// RFC 3339. Pages hold `limit` records, 100 by default and 1000 at most,
+// following the record of ID `after`.
+func (s *Server) LogsHandler(store *RecordStore) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		SkipLogging(gc)
+		q, err := s.logsQuery(gc)
+		if nil != err {
+			gc.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rows, err := store.Records(gc.Request.Context(), q)
+		if nil != err {
+			s.Logger.Errorf("Failed to query logs: %v", err)
+			gc.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		page := LogPage{Records: make([]LogRecord, 0, len(rows))}
+		for _, row := range rows {
+			page.Records = append(page.Records, newLogRecord(row))
+		}
+		if len(rows) == q.Limit {
+			page.Next = page.Records[len(rows)-1].Id
+		}
+		gc.JSON(http.StatusOK, page)
+	}
+}
+
+// LogRecordHandler responds the LogRecord of the ID in the `id` path
+// parameter, or 404. The body is included if the store has body access, and
+// the admin key grants LogsBodyScope.
+func (s *Server) LogRecordHandler(store *RecordStore) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		SkipLogging(gc)
+		id, err := s.storedIdArg(gc.Param("id"))
+		if nil != err {
+			gc.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx := gc.Request.Context()
+		rows, err := store.Records(ctx, RecordQuery{Id: id, Limit: 1})
+		if nil != err {
+			s.Logger.Errorf("Failed to query log %s: %v", gc.Param("id"),
+				err)
+			gc.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if len(rows) < 1 {
+			gc.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		rec := newLogRecord(rows[0])
+		if !HasScope(gc, LogsBodyScope) {
+			gc.JSON(http.StatusOK, rec)
+			return
+		}
+		bodies, err := store.Bodies(ctx, rows[0].Id)
+		if nil != err && !errors.Is(err, ErrBodyAccess) {
+			s.Logger.Errorf("Failed to query body of %s: %v", rec.Id, err)
+			gc.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		rec.Body = bodies[rec.Id]
+		gc.JSON(http.StatusOK, rec)
+	}
+}
+
+func (s *Server) logsQuery(gc *gin.Context) (RecordQuery, error) {
+	q := RecordQuery{RequestLine: gc.Query("request_line")}
+	var err error
+	if v := gc.Query("req_hash"); "" != v {
+		if q.ReqHash, err = hex.DecodeString(v); nil != err {
+			return q, errors.New("invalid req_hash")
+		}
+	}
+	if v := gc.Query("tx_id"); "" != v {
+		if q.TxId, err = parseUuid(v); nil != err {
+			return q, errors.New("invalid tx_id")
+		}
+	}
+	for _, t := range []struct {
+		key string
+		v   *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v := gc.Query(t.key); "" != v {
+			if *t.v, err = time.Parse(time.RFC3339Nano, v); nil != err {
+				return q, errors.New("invalid " + t.key)
+			}
+		}
+	}
+	if v := gc.Query("after"); "" != v {
+		if q.After, err = s.storedIdArg(v); nil != err {
+			return q, errors.New("invalid after")
+		}
+	}
+	q.Limit = 100
+	if v := gc.Query("limit"); "" != v {
+		n, err := strconv.Atoi(v)
+		if nil != err || n < 1 {
+			return q, errors.New("invalid limit")
+		}
+		q.Limit = min(n, maxLogsLimit)
+	}
+	return q, nil
+}
+
+// storedIdArg converts the ID in the canonical UUID form to the form stored.
+func (s *Server) storedIdArg(id string) (any, error) {
+	b, err := parseUuid(id)
+	if nil != err {
+		return nil, errors.New("invalid id")
+	}
+	if nil != s.Conf && s.Conf.Db.textId() {
+		return formatUuid(b), nil
+	}
+	return b, nil
+}
+
+// parseUuid parses a UUID in the canonical text form, or in plain hex.
+func parseUuid(id string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(id, "-", ""))
+	if nil != err {
+		return nil, err
+	}
+	if 16 != len(b) {
+		return nil, errors.New("invalid UUID")
+	}
+	return b, nil
+}
+
+func newLogRecord(row StoredRow) LogRecord {
+	rec := LogRecord{
+		Id: storedId(row.Id), ReqHash: hex.EncodeToString(row.ReqHash),
+		HashAlgo: row.HashAlgo, Version: row.Version,
+		TxId: formatUuid(row.TxId), Direction: row.Direction,
+		RequestLine: row.RequestLine, Method: row.Method, Path: row.Path,
+		Status: row.Status, DurationMs: row.DurationMs, Headers: row.Headers,
+		CreatedAt: row.CreatedAt, ClientAborted: row.ClientAborted,
+		Truncated: row.Truncated, SloViolated: row.SloViolated,
+		Partner: row.Partner,
+	}
+	if "" != row.Attributes {
+		// attributes are always stored as JSON objects
+		_ = json.Unmarshal([]byte(row.Attributes), &rec.Attributes)
+	}
+	return rec
+}
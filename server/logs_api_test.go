@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ServeLogs_pages_and_fetches_records(t *testing.T) {
+	_, conn := setupDb(t)
+	at := time.Now().Add(-time.Minute)
+	var records []any
+	for i := 0; i < 3; i++ {
+		records = append(records, TxRecord{
+			Request: "POST /cb", Headers: []byte("POST /cb HTTP/1.1\r\n"),
+			Body: []byte("payload"), At: at,
+			Attributes: map[string]any{"n": i},
+		})
+	}
+	records = append(records, TxRecord{
+		Request: "GET /x", Headers: []byte("h"), At: at,
+	})
+	query, args := SqlBuilder(utils.NewLogger(), &mockWriter{})(records)
+	_, err := conn.Exec(query, args...)
+	require.Nil(t, err)
+	keys, err := ParseAdminKeys([]string{"ops:operator:k1", "bob:viewer:k2"})
+	require.Nil(t, err)
+	s := NewServer(&http.Server{}, &mockCachedWriter{}, utils.NewLogger(),
+		&Config{AdminKeys: keys})
+	require.Nil(t, s.ServeLogs("/logs/", NewRecordStore(conn, true)))
+	key := "k1"
+	get := func(url string, out any) int {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("X-Api-Key", key)
+		s.Engine.ServeHTTP(res, req)
+		if nil != out {
+			require.Nil(t, json.Unmarshal(res.Body.Bytes(), out))
+		}
+		return res.Code
+	}
+	var page LogPage
+	url := "/logs?limit=2&req_hash=" +
+		hex.EncodeToString(s.HashRequestLine("POST", "/cb"))
+	require.Equal(t, http.StatusOK, get(url, &page))
+	require.Len(t, page.Records, 2)
+	require.NotEmpty(t, page.Next)
+	require.Equal(t, "POST /cb", page.Records[0].RequestLine)
+	require.Nil(t, page.Records[0].Body)
+	var last LogPage
+	require.Equal(t, http.StatusOK, get(url+"&after="+page.Next, &last))
+	require.Len(t, last.Records, 1)
+	require.Empty(t, last.Next)
+	var none LogPage
+	require.Equal(t, http.StatusOK, get("/logs?from="+
+		time.Now().Format(time.RFC3339), &none))
+	require.Empty(t, none.Records)
+	var rec LogRecord
+	require.Equal(t, http.StatusOK, get("/logs/"+last.Records[0].Id, &rec))
+	require.Equal(t, []byte("payload"), rec.Body)
+	require.Contains(t, rec.Attributes, "n")
+	key = "k2"
+	var headersOnly LogRecord
+	require.Equal(t, http.StatusOK,
+		get("/logs/"+last.Records[0].Id, &headersOnly))
+	require.Nil(t, headersOnly.Body)
+	require.Equal(t, rec.Headers, headersOnly.Headers)
+	key = ""
+	require.Equal(t, http.StatusUnauthorized, get("/logs", nil))
+	key = "k1"
+	require.Equal(t, http.StatusNotFound,
+		get("/logs/00000000-0000-0000-0000-000000000000", nil))
+	require.Equal(t, http.StatusBadRequest, get("/logs/nope", nil))
+	require.Equal(t, http.StatusBadRequest, get("/logs?limit=0", nil))
+}
+
+func Test_ServeLogs_requires_admin_keys(t *testing.T) {
+	s := NewServer(&http.Server{}, &mockCachedWriter{}, utils.NewLogger(),
+		&Config{})
+	require.EqualError(t, s.ServeLogs("/logs", nil),
+		"logs can't be served without admin keys")
+	cfg := &Config{ListenAddr: ":80", FilePerm: 0644, LogsPath: "/logs"}
+	require.ErrorContains(t, cfg.Validate(),
+		"LOGS_PATH, METRICS_PATH: require ADMIN_KEYS")
+	cfg = &Config{ListenAddr: ":80", FilePerm: 0644, MetricsPath: "/metrics"}
+	require.ErrorContains(t, cfg.Validate(),
+		"LOGS_PATH, METRICS_PATH: require ADMIN_KEYS")
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/gin-gonic/gin"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// Version is the version of the package stamped in `tx_meta`. It's read from
+// the build info if empty, and can be set at link time with
+// `-ldflags "-X github.com/eidng8/gin-persist-log/server.Version=v1.2.3"`.
+var Version = ""
+
+const modulePath = "github.com/eidng8/gin-persist-log"
+
+// BuildInfo describes the code writing the log, stamped in `tx_meta` upon
+// startup, and served by VersionHandler.
+type BuildInfo struct {
+	Version       string `json:"version"`
+	SchemaVersion int    `json:"schema_version"`
+	Dialect       string `json:"dialect"`
+	// hash of the config, telling apart rows written with different settings
+	ConfigHash string    `json:"config_hash"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// NewBuildInfo describes the code running with the given config.
+func NewBuildInfo(cfg *Config) BuildInfo {
+	info := BuildInfo{
+		Version: packageVersion(), SchemaVersion: RecordVersion,
+		ConfigHash: ConfigHash(cfg), StartedAt: time.Now(),
+	}
+	if nil != cfg && nil != cfg.Db {
+		info.Dialect = cfg.Db.dialect()
+	}
+	return info
+}
+
+// packageVersion returns Version, or the version of the module in the build
+// info, `(devel)` if unknown.
+func packageVersion() string {
+	if "" != Version {
+		return Version
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	if modulePath == bi.Main.Path && "" != bi.Main.Version {
+		return bi.Main.Version
+	}
+	for _, dep := range bi.Deps {
+		if modulePath == dep.Path {
+			return dep.Version
+		}
+	}
+	return "(devel)"
+}
+
+// ConfigHash returns the xxh64 digest in hex of the JSON form of the config,
+// including Db. Settings without exported fields, such as HeaderFilter and
+// PathFilter, are not covered, neither is AccessLogOutput.
+func ConfigHash(cfg *Config) string {
+	if nil == cfg {
+		return ""
+	}
+	c := *cfg
+	c.AccessLogOutput = nil
+	// signals can't be JSON keys
+	signals := make(map[string]string, len(c.Signals))
+	for sig, action := range c.Signals {
+		signals[sig.String()] = action
+	}
+	b, err := json.Marshal(struct {
+		*Config
+		Signals map[string]string
+	}{&c, signals})
+	if nil != err {
+		return ""
+	}
+	return fmt.Sprintf("%016x", xxhash.Sum64(b))
+}
+
+// CreateMetaTable creates the `tx_meta` table.
+func CreateMetaTable(cfg *DbConfig, conn *sql.DB) error {
+	stmt := internal.SqliteMetaTable()
+	if cfg.mysqlFamily() {
+		stmt = internal.MysqlMetaTable()
+	}
+	_, err := conn.Exec(stmt)
+	return err
+}
+
+// StampMeta inserts a row of the build info into `tx_meta`.
+func StampMeta(ctx context.Context, conn *sql.DB, info BuildInfo) error {
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	_, err := conn.ExecContext(ctx, `INSERT INTO tx_meta (version,
+		schema_version, dialect, config_hash, started_at)
+		VALUES (?, ?, ?, ?, ?)`, info.Version, info.SchemaVersion,
+		info.Dialect, info.ConfigHash, formatStoredTime(info.StartedAt))
+	return err
+}
+
+// BuildInfo returns the description of the running code.
+func (s *Server) BuildInfo() BuildInfo {
+	return s.build
+}
+
+// VersionHandler responds the BuildInfo in JSON.
+func (s *Server) VersionHandler() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		gc.JSON(http.StatusOK, s.build)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+)
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_StampMeta_records_build_info(t *testing.T) {
+	dbcfg, conn := setupDb(t)
+	dbcfg.Meta = true
+	require.Nil(t, CreateDefaultTable(dbcfg, conn))
+	info := NewBuildInfo(&Config{Db: dbcfg})
+	require.Equal(t, "sqlite3", info.Dialect)
+	require.Equal(t, RecordVersion, info.SchemaVersion)
+	require.NotEmpty(t, info.Version)
+	require.Len(t, info.ConfigHash, 16)
+	require.Nil(t, StampMeta(context.Background(), conn, info))
+	var version, dialect, hash string
+	var schema int
+	require.Nil(t, conn.QueryRow(`SELECT version, schema_version, dialect,
+		config_hash FROM tx_meta`).Scan(&version, &schema, &dialect, &hash))
+	require.Equal(t, info.Version, version)
+	require.Equal(t, RecordVersion, schema)
+	require.Equal(t, "sqlite3", dialect)
+	require.Equal(t, info.ConfigHash, hash)
+}
+
+func Test_ConfigHash_tells_apart_settings(t *testing.T) {
+	cfg := &Config{
+		ListenAddr: ":80", AccessLogOutput: os.Stdout,
+		Signals: map[os.Signal]string{syscall.SIGHUP: SignalReload},
+	}
+	hash := ConfigHash(cfg)
+	require.Len(t, hash, 16)
+	require.Equal(t, hash, ConfigHash(&Config{
+		ListenAddr: ":80", AccessLogOutput: os.Stderr,
+		Signals: map[os.Signal]string{syscall.SIGHUP: SignalReload},
+	}))
+	cfg.ListenAddr = ":8080"
+	require.NotEqual(t, hash, ConfigHash(cfg))
+}
+
+func Test_VersionHandler_responds_build_info(t *testing.T) {
+	cfg := &Config{VersionPath: "/version"}
+	s := NewServer(&http.Server{}, &mockCachedWriter{}, utils.NewLogger(), cfg)
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/version", nil))
+	require.Equal(t, http.StatusOK, res.Code)
+	var info BuildInfo
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &info))
+	require.Equal(t, s.BuildInfo().ConfigHash, info.ConfigHash)
+	require.Equal(t, RecordVersion, info.SchemaVersion)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// name of the counter of policy decisions, labeled by `policy`
+const MetricPolicyDecisions = "persist_policy_decisions_total"
+
+const (
+	// PolicyBodyTruncated counts response bodies truncated to
+	// `MaxResponseBuffer`.
+	PolicyBodyTruncated = "body_truncated"
+	// PolicyBodySkipped counts response bodies not kept, such as partial
+	// contents and files served by ServeFile.
+	PolicyBodySkipped = "body_skipped"
+	// PolicySuppressed counts requests matching SuppressRule, which are not
+	// persisted at all.
+	PolicySuppressed = "suppressed"
+	// PolicyPathSkipped counts requests of paths excluded by `SkipPaths`,
+	// which are not persisted at all.
+	PolicyPathSkipped = "path_skipped"
+	// PolicySampledOut counts requests not persisted due to `SampleRate`.
+	PolicySampledOut = "sampled_out"
+	// PolicyRuleSkipped counts requests not persisted due to `Policy`.
+	PolicyRuleSkipped = "policy_skipped"
+	// PolicyLoggingSkipped counts requests not persisted due to SkipLogging.
+	PolicyLoggingSkipped = "logging_skipped"
+	// PolicyBodyForced counts response bodies kept due to ForceBody.
+	PolicyBodyForced = "body_forced"
+	// PolicyHeaderRemoved counts headers removed by HeaderFilter.
+	PolicyHeaderRemoved = "header_removed"
+	// PolicyCookieScrubbed counts `Cookie` and `Set-Cookie` headers whose
+	// values are removed due to `ScrubCookies`.
+	PolicyCookieScrubbed = "cookie_scrubbed"
+	// PolicyHeaderRedacted counts header values masked by Redactor.
+	PolicyHeaderRedacted = "header_redacted"
+	// PolicyAuthFingerprinted counts requests whose Authorization credential
+	// is replaced by its fingerprint.
+	PolicyAuthFingerprinted = "auth_fingerprinted"
+	// PolicyHoneypot counts hits on routes registered with Honeypot.
+	PolicyHoneypot = "honeypot"
+	// PolicyCaptureCapped counts requests whose capture exceeded
+	// `MaxCaptureBytes`.
+	PolicyCaptureCapped = "capture_capped"
+	// PolicyAcknowledged counts request records persisted before their
+	// responses, by Acknowledged or SyncPersist.
+	PolicyAcknowledged = "acknowledged"
+	// PolicyAckFailed counts requests refused by Acknowledged, since their
+	// request records couldn't be persisted.
+	PolicyAckFailed = "ack_failed"
+	// PolicySyncFallback counts request records of SyncPersist routes that
+	// couldn't be persisted in time, and were cached instead.
+	PolicySyncFallback = "sync_fallback"
+	// PolicyAckHandlerFailed counts requests acknowledged by LogFirst whose
+	// handlers then failed.
+	PolicyAckHandlerFailed = "ack_handler_failed"
+	// PolicyOutbox counts request records inserted in transactions of the
+	// application, by PersistInTx.
+	PolicyOutbox = "outbox"
+)
+
+const (
+	// MetricDryRunStatements counts statements built but not sent to the DB
+	// in dry run mode.
+	MetricDryRunStatements = "persist_dry_run_statements_total"
+	// MetricDryRunRecords counts records of the statements of dry run mode.
+	MetricDryRunRecords = "persist_dry_run_records_total"
+)
+
+const (
+	// MetricRequestsLogged counts requests whose records are pushed to the
+	// writer.
+	MetricRequestsLogged = "persist_requests_logged_total"
+	// MetricCapturedBytes counts bytes of headers and bodies of records
+	// pushed to the writer, labeled by `direction`.
+	MetricCapturedBytes = "persist_captured_bytes_total"
+	// MetricFlushDuration is the histogram of milliseconds taken by flushes
+	// of CachedWriter with pending records.
+	MetricFlushDuration = "persist_flush_duration_milliseconds"
+	// MetricRowsInserted counts records committed by RowWriter.
+	MetricRowsInserted = "persist_rows_inserted_total"
+	// MetricInsertFailures counts records RowWriter failed to insert, which
+	// are written to the failed log.
+	MetricInsertFailures = "persist_insert_failures_total"
+	// MetricPendingRecords is the gauge of records cached by CachedWriter.
+	MetricPendingRecords = "persist_pending_records"
+	// MetricPendingBytes is the gauge of estimated bytes held by records
+	// cached by CachedWriter.
+	MetricPendingBytes = "persist_pending_bytes"
+	// MetricOverflowed counts records handled by the overflow policy of
+	// CachedWriter.
+	MetricOverflowed = "persist_overflowed_records_total"
+)
+
+// upper bounds of MetricFlushDuration buckets
+var flushBuckets = []uint64{5, 10, 50, 100, 500, 1_000, 5_000, 10_000, 60_000}
+
+// instrumented is implemented by writers counting their work in the metrics
+// of the server, such as CachedWriter and RowWriter.
+type instrumented interface {
+	instrument(metrics *internal.Counters)
+}
+
+// writerGauges is implemented by writers reporting their backlog, such as
+// CachedWriter.
+type writerGauges interface {
+	PendingRecords() int64
+	PendingBytes() int64
+	Overflowed() uint64
+}
+
+// Metrics returns the values of all counters, keyed in the Prometheus text
+// format, e.g. `persist_policy_decisions_total{policy="body_truncated"}`.
+// It includes MetricReqHashCardinality if tracked, and the gauges of the
+// writer if it reports them.
+func (s *Server) Metrics() map[string]uint64 {
+	m := s.metrics.Snapshot()
+	if nil != s.cardinality {
+		m[MetricReqHashCardinality] = s.cardinality.Estimate()
+	}
+	if g, ok := s.writer().(writerGauges); ok {
+		m[MetricPendingRecords] = uint64(max(0, g.PendingRecords()))
+		m[MetricPendingBytes] = uint64(max(0, g.PendingBytes()))
+		m[MetricOverflowed] = g.Overflowed()
+	}
+	return m
+}
+
+// MetricsHandler responds Metrics in the Prometheus text format.
+func (s *Server) MetricsHandler() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		m := s.Metrics()
+		var sb strings.Builder
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			sb.WriteString(k)
+			sb.WriteString(" ")
+			sb.WriteString(strconv.FormatUint(m[k], 10))
+			sb.WriteString("\n")
+		}
+		gc.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8",
+			[]byte(sb.String()))
+	}
+}
+
+// countCaptured counts the record pushed to the writer.
+func (s *Server) countCaptured(rec *TxRecord) {
+	s.metrics.Add(uint64(len(rec.Headers)+len(rec.Body)), MetricCapturedBytes,
+		"direction", rec.Direction)
+}
+
+// countDryRun counts the statement built in dry run mode, and logs it as
+// debug info.
+func (s *Server) countDryRun(query string, args []any) {
+	records := len(args) / numColumns
+	s.metrics.Inc(MetricDryRunStatements)
+	s.metrics.Add(uint64(records), MetricDryRunRecords)
+	s.Logger.Debugf("Dry run of %d records: %s", records, query)
+}
+
+func (s *Server) countPolicy(policy string) {
+	s.metrics.Inc(MetricPolicyDecisions, "policy", policy)
+}
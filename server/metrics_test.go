@@ -0,0 +1,72 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MetricsHandler_exposes_writer_and_middleware_metrics(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger),
+		logger)
+	s := NewServer(&http.Server{}, w, logger, &Config{MetricsPath: "/metrics"})
+	s.Engine.POST("/t", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	s.Engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+		http.MethodPost, "/t", strings.NewReader("body")))
+	m := s.Metrics()
+	require.Equal(t, uint64(1), m[MetricRequestsLogged])
+	require.Equal(t, uint64(2), m[MetricPendingRecords])
+	require.Positive(t, m[MetricPendingBytes])
+	w.Write()
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics",
+		nil))
+	require.Equal(t, http.StatusOK, res.Code)
+	body := res.Body.String()
+	require.Contains(t, body, MetricRowsInserted+" 2\n")
+	require.Contains(t, body, MetricPendingRecords+" 0\n")
+	require.Contains(t, body, MetricFlushDuration+"_count 1\n")
+	require.Contains(t, body, MetricCapturedBytes+`{direction="req"} `)
+	require.Contains(t, body, MetricCapturedBytes+`{direction="res"} `)
+	// scrapes are not persisted
+	require.Equal(t, uint64(1), s.Metrics()[MetricRequestsLogged])
+}
+
+func Test_MetricsHandler_requires_viewer_key(t *testing.T) {
+	cfg := &Config{
+		MetricsPath: "/metrics",
+		AdminKeys:   []AdminKey{{Name: "ops", Scope: ScopeViewer, Key: "k"}},
+	}
+	s := NewServer(&http.Server{}, &mockCachedWriter{}, utils.NewLogger(), cfg)
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics",
+		nil))
+	require.Equal(t, http.StatusUnauthorized, res.Code)
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("X-Api-Key", "k")
+	res = httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, req)
+	require.Equal(t, http.StatusOK, res.Code)
+}
+
+func Test_RowWriter_counts_insert_failures(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	rw := NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger)
+	rw.SetFailedLog(io.Discard)
+	w := NewWriter(rw, logger)
+	s := NewServer(&http.Server{}, w, logger, &Config{})
+	require.Nil(t, conn.Close())
+	w.Push(TxRecord{Request: "GET /t"})
+	w.Write()
+	require.Equal(t, uint64(1), s.Metrics()[MetricInsertFailures])
+	require.Zero(t, s.Metrics()[MetricRowsInserted])
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// SchemaVersion is the version of `tx_log` created by CreateDefaultTable, the
+// number of columns added since the first release, see internal.Column.
+var SchemaVersion = len(internal.SqliteColumns())
+
+// MigrateSchema brings `tx_log` created by an earlier release up to
+// SchemaVersion, adding the missing columns with their defaults, and records
+// the version in `tx_schema`. It's run by CreateDefaultTable, and does nothing
+// once the table is up to date. Columns are looked up in the table, as
+// releases before `tx_schema` added them without recording versions.
+func MigrateSchema(cfg *DbConfig, conn *sql.DB) error {
+	var stmt string
+	var cols []internal.Column
+	switch {
+	case cfg.mysqlFamily():
+		stmt = internal.MysqlSchemaTable()
+		cols = internal.MysqlColumns(cfg.mysqlIdType(), cfg.mysqlSchema())
+	case "sqlite3" == cfg.dialect():
+		stmt = internal.SqliteSchemaTable()
+		cols = internal.SqliteColumns()
+	default:
+		return errors.New("unsupported SQL dialect")
+	}
+	if _, err := conn.Exec(stmt); nil != err {
+		return err
+	}
+	var version sql.NullInt64
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	err := conn.QueryRow(`SELECT MAX(version) FROM tx_schema`).Scan(&version)
+	if nil != err {
+		return err
+	}
+	if int(version.Int64) >= len(cols) {
+		return nil
+	}
+	existing, err := tableColumns(conn)
+	if nil != err {
+		return err
+	}
+	var missing []internal.Column
+	for _, col := range cols[version.Int64:] {
+		if !existing[col.Name] {
+			missing = append(missing, col)
+		}
+	}
+	if len(missing) > 0 && cfg.mysqlFamily() {
+		// one statement, so the table is rebuilt at most once
+		if _, err = conn.Exec(internal.AddColumns(missing...)); nil != err {
+			return err
+		}
+	} else {
+		for _, col := range missing {
+			if _, err = conn.Exec(internal.AddColumns(col)); nil != err {
+				return err
+			}
+		}
+	}
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	_, err = conn.Exec(`INSERT INTO tx_schema (version) VALUES (?)`,
+		len(cols))
+	return err
+}
+
+// tableColumns returns the set of lower case column names of `tx_log`.
+func tableColumns(conn *sql.DB) (map[string]bool, error) {
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	rows, err := conn.Query(`SELECT * FROM tx_log LIMIT 0`)
+	if nil != err {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	names, err := rows.Columns()
+	if nil != err {
+		return nil, err
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[strings.ToLower(name)] = true
+	}
+	return set, nil
+}
+
+// MigrateHashToBinary converts `req_hash` of rows written as hex string by
+// earlier versions to the raw digest, in batches of the given size to avoid
+// locking the table for long. The table is migrated with MigrateSchema first,
+// so legacy rows have `hash_algo` of its default, xxh64. It returns the
+// number of rows converted.
+func MigrateHashToBinary(cfg *DbConfig, conn *sql.DB, batch int) (
+	int64, error,
+) {
+	if batch < 1 {
+		batch = 1000
+	}
+	if err := MigrateSchema(cfg, conn); nil != err {
+		return 0, err
+	}
+	var update string
+	switch {
+	case cfg.mysqlFamily():
+		var alter string
+		alter, update = internal.MysqlHashToBinary(batch)
+		if _, err := conn.Exec(alter); nil != err {
+			return 0, err
+		}
+	case "sqlite3" == cfg.dialect():
+		update = internal.SqliteHashToBinary(batch)
+	default:
+		return 0, errors.New("unsupported SQL dialect")
+	}
+	var total int64
+	for {
+		res, err := conn.Exec(update)
+		if nil != err {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if nil != err {
+			return total, err
+		}
+		total += n
+		if n < int64(batch) {
+			return total, nil
+		}
+	}
+}
+
+// ReqHashArgs returns the `req_hash` values of the request line to be used in
+// queries like `req_hash IN (?, ?)`. For xxh64, the legacy hex form is also
+// returned, so unmigrated rows are matched during transition.
+func ReqHashArgs(algorithm, requestLine string) []any {
+	sum := internal.SumString(algorithm, requestLine)
+	if "" == algorithm || internal.HashXxh64 == algorithm {
+		return []any{sum, hex.EncodeToString(sum)}
+	}
+	return []any{sum}
+}
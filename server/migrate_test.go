@@ -0,0 +1,120 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_MigrateHashToBinary_converts_legacy_hex_rows(t *testing.T) {
+	cfg, conn := setupDb(t)
+	line := "GET http://localhost/t"
+	sum := internal.SumString(internal.HashXxh64, line)
+	for i := 0; i < 3; i++ {
+		_, err := conn.Exec(
+			`INSERT INTO tx_log (id, req_hash, headers) VALUES (?, ?, '');`,
+			[]byte{byte(i)}, hex.EncodeToString(sum))
+		require.Nil(t, err)
+	}
+	_, err := conn.Exec(
+		`INSERT INTO tx_log (id, req_hash, headers) VALUES (?, ?, '');`,
+		[]byte{9}, sum)
+	require.Nil(t, err)
+	var count int
+	query := `SELECT COUNT(*) FROM tx_log WHERE req_hash IN (?, ?);`
+	require.Nil(t, conn.QueryRow(query,
+		ReqHashArgs(internal.HashXxh64, line)...).Scan(&count))
+	require.Equal(t, 4, count)
+	n, err := MigrateHashToBinary(cfg, conn, 2)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log WHERE req_hash=?;`,
+		sum).Scan(&count))
+	require.Equal(t, 4, count)
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_MigrateHashToBinary_converts_baseline_table(t *testing.T) {
+	cfg, conn := setupBaselineDb(t)
+	line := "GET http://localhost/t"
+	sum := internal.SumString(internal.HashXxh64, line)
+	for i := 0; i < 3; i++ {
+		_, err := conn.Exec(
+			`INSERT INTO tx_log (id, req_hash, headers) VALUES (?, ?, '');`,
+			[]byte{byte(i)}, hex.EncodeToString(sum))
+		require.Nil(t, err)
+	}
+	n, err := MigrateHashToBinary(cfg, conn, 2)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log WHERE req_hash=?;`,
+		sum).Scan(&count))
+	require.Equal(t, 3, count)
+}
+
+// setupBaselineDb creates `tx_log` as the first release did.
+//
+//goland:noinspection SqlNoDataSourceInspection
+func setupBaselineDb(tb testing.TB) (*DbConfig, *sql.DB) {
+	require.NoError(tb, os.Setenv("DB_DRIVER", "sqlite3"))
+	require.NoError(tb,
+		os.Setenv("DB_DSN", ":memory:?_journal=WAL&_timeout=5000"))
+	cfg := DefaultDbConfigFromEnv()
+	conn, err := ConnectDB(cfg)
+	require.Nil(tb, err)
+	// a single connection, so the in-memory DB is shared
+	conn.SetMaxOpenConns(1)
+	_, err = conn.Exec(`
+		CREATE TABLE IF NOT EXISTS tx_log (
+			id BYTEA PRIMARY KEY,
+			req_hash BYTEA NOT NULL,
+			headers TEXT NOT NULL,
+			body BYTEA,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS ix_tx_log_hash ON tx_log (req_hash);`)
+	require.Nil(tb, err)
+	return cfg, conn
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_CreateDefaultTable_migrates_baseline_table(t *testing.T) {
+	cfg, conn := setupBaselineDb(t)
+	_, err := conn.Exec(`INSERT INTO tx_log (id, req_hash, headers)
+		VALUES (?, ?, 'legacy');`, []byte{1}, []byte{1})
+	require.Nil(t, err)
+	require.Nil(t, CreateDefaultTable(cfg, conn))
+	// up to date, nothing is done
+	require.Nil(t, CreateDefaultTable(cfg, conn))
+	var version int
+	require.Nil(t, conn.QueryRow(`SELECT MAX(version) FROM tx_schema`).
+		Scan(&version))
+	require.Equal(t, SchemaVersion, version)
+	query, args := SqlBuilder(utils.NewLogger(), &mockWriter{})([]any{
+		TxRecord{
+			Request: "POST /cb", Headers: []byte("h"), Body: []byte("b"),
+			At: time.Now(), Direction: DirectionRequest,
+		},
+	})
+	_, err = conn.Exec(query, args...)
+	require.Nil(t, err)
+	var algo string
+	var aborted bool
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT hash_algo, client_aborted FROM tx_log
+		WHERE headers = 'legacy'`).Scan(&algo, &aborted))
+	require.Equal(t, internal.HashXxh64, algo)
+	require.False(t, aborted)
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log
+		WHERE direction = ?`, DirectionRequest).Scan(&count))
+	require.Equal(t, 1, count)
+}
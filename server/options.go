@@ -0,0 +1,202 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/eidng8/go-db"
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// Middleware names a middleware installed by the server on every route.
+type Middleware string
+
+const (
+	// MiddlewareRequestLogger persists requests and responses, see
+	// RequestLogger
+	MiddlewareRequestLogger Middleware = "request_logger"
+	// MiddlewareAccessLog writes the access log configured by `ACCESS_LOG`
+	MiddlewareAccessLog Middleware = "access_log"
+	// MiddlewareRecovery recovers panics of handlers, responding 500
+	MiddlewareRecovery Middleware = "recovery"
+)
+
+// defaultMiddlewareOrder is the order of middlewares of NewServer.
+var defaultMiddlewareOrder = []Middleware{
+	MiddlewareRequestLogger, MiddlewareAccessLog, MiddlewareRecovery,
+}
+
+func (s *Server) middleware(m Middleware) gin.HandlerFunc {
+	switch m {
+	case MiddlewareRequestLogger:
+		return s.RequestLogger()
+	case MiddlewareAccessLog:
+		return s.accessLogger()
+	default:
+		return gin.Recovery()
+	}
+}
+
+// Option configures the server created by NewServerWithOptions.
+type Option func(o *serverOptions)
+
+type serverOptions struct {
+	svr       *http.Server
+	cfg       *Config
+	logger    utils.TaggedLogger
+	sink      Sink
+	failedLog io.Writer
+	order     []Middleware
+	recovery  bool
+}
+
+// WithConfig sets the config of the server. Only the fields read by
+// NewServer are applied, as background jobs started by DefaultServer aren't.
+func WithConfig(cfg *Config) Option {
+	return func(o *serverOptions) { o.cfg = cfg }
+}
+
+// WithHTTPServer sets the HTTP server, whose handler is replaced by the
+// engine. Defaults to one listening at `Config.ListenAddr`.
+func WithHTTPServer(svr *http.Server) Option {
+	return func(o *serverOptions) { o.svr = svr }
+}
+
+// WithLogger sets the logger of the server.
+func WithLogger(logger utils.TaggedLogger) Option {
+	return func(o *serverOptions) { o.logger = logger }
+}
+
+// WithWriter makes the server push records to the writer, instead of a
+// CachedWriter of the DB connection. The writer must be started by the
+// caller.
+func WithWriter(writer db.CachedWriter) Option {
+	return func(o *serverOptions) { o.sink = NewWriterSink(writer) }
+}
+
+// WithSink makes the server deliver records to the sink, instead of a
+// CachedWriter of the DB connection.
+func WithSink(sink Sink) Option {
+	return func(o *serverOptions) { o.sink = sink }
+}
+
+// WithFailedLog sets where the writer of the DB connection writes records
+// failed to be persisted, stderr by default. It has no effect with WithWriter
+// or WithSink.
+func WithFailedLog(log io.Writer) Option {
+	return func(o *serverOptions) { o.failedLog = log }
+}
+
+// WithMiddlewareOrder sets the middlewares installed, in the given order.
+// Those missing from the order are not installed.
+func WithMiddlewareOrder(order ...Middleware) Option {
+	return func(o *serverOptions) { o.order = order }
+}
+
+// WithoutRecovery leaves out MiddlewareRecovery, for the application to
+// install its own.
+func WithoutRecovery() Option {
+	return func(o *serverOptions) { o.recovery = false }
+}
+
+// NewServerWithOptions creates a server composed of the given options, for
+// applications that don't want DefaultServer to open failure log files, read
+// writer settings from env, or fix the order of middlewares. Unless
+// WithWriter or WithSink is given, records are written to the DB connection
+// by a CachedWriter with default settings, which is started right away and
+// stopped upon Shutdown.
+func NewServerWithOptions(conn *sql.DB, opts ...Option) (*Server, error) {
+	o := serverOptions{order: defaultMiddlewareOrder, recovery: true}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if nil == o.cfg {
+		o.cfg = &Config{}
+	}
+	if nil == o.logger {
+		o.logger = utils.NewLogger()
+	}
+	if nil == o.svr {
+		o.svr = &http.Server{Addr: o.cfg.ListenAddr}
+	}
+	if nil == o.failedLog {
+		o.failedLog = os.Stderr
+	}
+	order := make([]Middleware, 0, len(o.order))
+	for _, m := range o.order {
+		if !slices.Contains(defaultMiddlewareOrder, m) {
+			return nil, fmt.Errorf("unknown middleware: %s", m)
+		}
+		if slices.Contains(order, m) {
+			return nil, fmt.Errorf("duplicate middleware: %s", m)
+		}
+		if MiddlewareRecovery != m || o.recovery {
+			order = append(order, m)
+		}
+	}
+	sink, writer := o.sink, (*CachedWriter)(nil)
+	if nil == sink {
+		if nil == conn {
+			return nil, errors.New("a DB connection, writer or sink is required")
+		}
+		hasher := internal.NewHasher(o.cfg.HashAlgorithm)
+		if nil == hasher {
+			return nil, fmt.Errorf("unsupported hash algorithm: %s",
+				o.cfg.HashAlgorithm)
+		}
+		builder := BuilderFor(o.cfg.Db, o.logger, o.failedLog,
+			append(SqlOptions(o.cfg.Db), WithHasher(hasher))...)
+		inner := NewBatchWriter(conn, builder, o.logger)
+		writer = NewWriter(inner, o.logger)
+		inner.SetFailedLog(writer.FailedLog(o.failedLog))
+		if nil != o.cfg.Db {
+			writer.SetBatchSize(o.cfg.Db.batchSize())
+		}
+		sink = NewWriterSink(writer)
+	}
+	s := newSinkServer(o.svr, sink, o.logger, o.cfg, order)
+	if nil != writer {
+		stop := make(chan struct{})
+		writer.Start(stop)
+		closeStop := sync.OnceFunc(func() { close(stop) })
+		s.onShutdown(func() error {
+			closeStop()
+			return nil
+		})
+	}
+	return s, nil
+}
+
+// NewMiddleware returns RequestLogger persisting requests and responses to the
+// writer, for applications having their own Gin engine and lifecycle. Of the
+// options, only WithConfig and WithLogger apply. The writer must be started
+// and drained by the caller, and records are captured on the goroutines of
+// requests, regardless of `Config.CaptureWorkers`. Details of connections,
+// such as `Config.TLSFingerprint`, are not recorded, as they're collected by
+// hooks of the HTTP server.
+func NewMiddleware(
+	writer db.CachedWriter, opts ...Option,
+) gin.HandlerFunc {
+	var o serverOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	cfg := Config{}
+	if nil != o.cfg {
+		cfg = *o.cfg
+	}
+	cfg.CaptureWorkers = 0
+	if nil == o.logger {
+		o.logger = utils.NewLogger()
+	}
+	return newRecorder(NewWriterSink(writer), o.logger, &cfg).RequestLogger()
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_NewServerWithOptions_persists_to_the_connection(t *testing.T) {
+	cfg, conn := setupDb(t)
+	s, err := NewServerWithOptions(conn, WithConfig(&Config{Db: cfg}),
+		WithLogger(utils.NewLogger()))
+	require.Nil(t, err)
+	s.Engine.POST("/cb", func(gc *gin.Context) { gc.Status(http.StatusOK) })
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/cb",
+		strings.NewReader("payload")))
+	require.Equal(t, http.StatusOK, res.Code)
+	cancel, err := s.Shutdown()
+	cancel()
+	require.Nil(t, err)
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log`).Scan(&count))
+	require.Equal(t, 2, count)
+}
+
+func Test_NewServerWithOptions_orders_middlewares(t *testing.T) {
+	s, err := NewServerWithOptions(nil, WithWriter(&mockCachedWriter{}),
+		WithMiddlewareOrder(MiddlewareRecovery, MiddlewareRequestLogger))
+	require.Nil(t, err)
+	s.Engine.GET("/panic", func(*gin.Context) { panic("boom") })
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	require.Equal(t, http.StatusInternalServerError, res.Code)
+	s, err = NewServerWithOptions(nil, WithWriter(&mockCachedWriter{}),
+		WithoutRecovery())
+	require.Nil(t, err)
+	s.Engine.GET("/panic", func(*gin.Context) { panic("boom") })
+	require.Panics(t, func() {
+		s.Engine.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, "/panic", nil))
+	})
+}
+
+func Test_NewServerWithOptions_rejects_invalid_options(t *testing.T) {
+	_, err := NewServerWithOptions(nil)
+	require.EqualError(t, err, "a DB connection, writer or sink is required")
+	_, err = NewServerWithOptions(nil, WithWriter(&mockCachedWriter{}),
+		WithMiddlewareOrder("gzip"))
+	require.EqualError(t, err, "unknown middleware: gzip")
+	_, err = NewServerWithOptions(nil, WithWriter(&mockCachedWriter{}),
+		WithMiddlewareOrder(MiddlewareAccessLog, MiddlewareAccessLog))
+	require.EqualError(t, err, "duplicate middleware: access_log")
+}
+
+func Test_NewMiddleware_persists_with_any_engine(t *testing.T) {
+	writer := &mockCachedWriter{}
+	engine := gin.New()
+	engine.Use(NewMiddleware(writer,
+		WithConfig(&Config{CaptureWorkers: 2})))
+	engine.POST("/cb", func(gc *gin.Context) {
+		gc.String(http.StatusOK, "ok")
+	})
+	res := httptest.NewRecorder()
+	engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/cb",
+		strings.NewReader("payload")))
+	require.Equal(t, http.StatusOK, res.Code)
+	writer.mu.Lock()
+	defer writer.mu.Unlock()
+	require.Len(t, writer.records, 2)
+	require.Equal(t, []byte("payload"), writer.records[0].Body)
+	require.Equal(t, []byte("ok"), writer.records[1].Body)
+}
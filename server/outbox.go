@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// txPersister is implemented by writers inserting records in transactions of
+// the caller, such as RowWriter.
+type txPersister interface {
+	PersistTx(ctx context.Context, tx *sql.Tx, data ...any) error
+}
+
+// ErrNotLogged is returned by PersistInTx for requests RequestLogger doesn't
+// persist, such as suppressed ones.
+var ErrNotLogged = errors.New("request is not logged")
+
+// PersistInTx inserts the request record of the current request in the given
+// transaction of the application, so business writes, such as those of an
+// outbox, and the request record are committed atomically. The record is
+// taken from the writer, so it's lost along with the business writes if the
+// transaction is rolled back. It fails if the writer is already flushing the
+// record, and does nothing if the record has been persisted, e.g. by
+// Acknowledged. The response record is cached as usual. The transaction must
+// be of the DB of the writer.
+func (s *Server) PersistInTx(gc *gin.Context, tx *sql.Tx) error {
+	v, ok := gc.Get(ctxKeyPending)
+	if !ok {
+		return ErrNotLogged
+	}
+	if gc.GetBool(ctxKeyAcked) {
+		return nil
+	}
+	w, ok := s.writer().(txPersister)
+	if !ok {
+		return ErrNoPersist
+	}
+	pending := v.(*pendingRequest)
+	if !pending.owner.take(ownerHandler) {
+		return errRecordTaken
+	}
+	rec, err := pending.record(gc)
+	if nil == err {
+		err = w.PersistTx(gc.Request.Context(), tx, rec)
+	}
+	if nil != err {
+		s.release(pending)
+		return err
+	}
+	gc.Set(ctxKeyAcked, true)
+	s.countPolicy(PolicyOutbox)
+	return nil
+}
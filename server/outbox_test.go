@@ -0,0 +1,72 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_PersistInTx_commits_with_business_writes(t *testing.T) {
+	_, conn := setupDb(t)
+	_, err := conn.Exec("CREATE TABLE outbox (event TEXT)")
+	require.Nil(t, err)
+	logger := utils.NewLogger()
+	w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger),
+		logger)
+	s := NewServer(&http.Server{}, w, logger, &Config{})
+	s.Engine.POST("/orders", func(c *gin.Context) {
+		tx, err := conn.Begin()
+		require.Nil(t, err)
+		_, err = tx.Exec("INSERT INTO outbox VALUES ('order')")
+		require.Nil(t, err)
+		require.Nil(t, s.PersistInTx(c, tx))
+		// persisted only once
+		require.Nil(t, s.PersistInTx(c, tx))
+		if "1" == c.Query("rollback") {
+			require.Nil(t, tx.Rollback())
+		} else {
+			require.Nil(t, tx.Commit())
+		}
+		c.Status(http.StatusCreated)
+	})
+	count := func(table string) int {
+		var n int
+		require.Nil(t, conn.QueryRow("SELECT COUNT(*) FROM "+table).Scan(&n))
+		return n
+	}
+	s.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodPost, "/orders", nil))
+	require.Equal(t, 1, count("outbox"))
+	require.Equal(t, 1, count("tx_log"))
+	w.Write()
+	require.Equal(t, 2, count("tx_log"))
+	// the request record is rolled back along with the business writes
+	s.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodPost, "/orders?rollback=1", nil))
+	w.Write()
+	require.Equal(t, 1, count("outbox"))
+	require.Equal(t, 3, count("tx_log"))
+	require.Equal(t, uint64(2), s.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyOutbox))
+}
+
+func Test_PersistInTx_requires_logged_requests(t *testing.T) {
+	s := NewServer(&http.Server{}, &mockCachedWriter{}, utils.NewLogger(),
+		&Config{})
+	var errs []error
+	s.Engine.GET("/t", func(c *gin.Context) {
+		errs = append(errs, s.PersistInTx(c, nil))
+	})
+	s.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/t", nil))
+	gc, _ := gin.CreateTestContext(httptest.NewRecorder())
+	errs = append(errs, s.PersistInTx(gc, nil))
+	require.ErrorIs(t, errs[0], ErrNoPersist)
+	require.ErrorIs(t, errs[1], ErrNotLogged)
+}
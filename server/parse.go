@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// IsResponse tells whether the row is a response record.
+func (r *StoredRow) IsResponse() bool {
+	return strings.HasPrefix(r.Headers, "HTTP/")
+}
+
+// ParseStoredRequest reconstructs the request of a request record. The
+// returned request is as read by a server, with `RequestURI` set.
+func ParseStoredRequest(row *StoredRow) (*http.Request, error) {
+	if row.IsResponse() {
+		return nil, errors.New("not a request record")
+	}
+	req, err := http.ReadRequest(
+		bufio.NewReader(strings.NewReader(row.Headers)))
+	if nil != err {
+		return nil, err
+	}
+	if req.Body, req.ContentLength, err = storedBody(row); nil != err {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ParseStoredResponse reconstructs the response of a response record. The
+// request is optional, and is set on the returned response. Trailers are
+// restored from the `trailers` attribute, if filled by RecordStore.
+func ParseStoredResponse(
+	row *StoredRow, req *http.Request,
+) (*http.Response, error) {
+	if !row.IsResponse() {
+		return nil, errors.New("not a response record")
+	}
+	headers := row.Headers
+	// response headers are persisted without the terminating empty line
+	if !strings.HasSuffix(headers, "\r\n\r\n") {
+		headers += "\r\n"
+	}
+	res, err := http.ReadResponse(
+		bufio.NewReader(strings.NewReader(headers)), req)
+	if nil != err {
+		return nil, err
+	}
+	if res.Body, res.ContentLength, err = storedBody(row); nil != err {
+		return nil, err
+	}
+	if "" != row.Attributes {
+		var attrs struct {
+			Trailers http.Header `json:"trailers"`
+		}
+		if err = json.Unmarshal([]byte(row.Attributes), &attrs); nil != err {
+			return nil, err
+		}
+		res.Trailer = attrs.Trailers
+	}
+	return res, nil
+}
+
+func storedBody(row *StoredRow) (io.ReadCloser, int64, error) {
+	body, err := DecodeBody(row.BodyCodec, row.Body)
+	if nil != err {
+		return nil, 0, err
+	}
+	if len(body) < 1 {
+		return http.NoBody, 0, nil
+	}
+	return io.NopCloser(bytes.NewReader(body)), int64(len(body)), nil
+}
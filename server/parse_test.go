@@ -0,0 +1,49 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseStoredRequest_reconstructs_request(t *testing.T) {
+	row := &StoredRow{
+		Headers: "POST /t?a=b%21c HTTP/1.1\r\nHost: localhost\r\n" +
+			"Content-Type: application/json\r\n\r\n",
+		Body: []byte(`{"test":"value"}`),
+	}
+	req, err := ParseStoredRequest(row)
+	require.Nil(t, err)
+	require.Equal(t, http.MethodPost, req.Method)
+	require.Equal(t, "/t?a=b%21c", req.RequestURI)
+	require.Equal(t, "localhost", req.Host)
+	require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	require.Equal(t, int64(16), req.ContentLength)
+	body, err := io.ReadAll(req.Body)
+	require.Nil(t, err)
+	require.Equal(t, row.Body, body)
+	_, err = ParseStoredResponse(row, nil)
+	require.NotNil(t, err)
+}
+
+func Test_ParseStoredResponse_reconstructs_response(t *testing.T) {
+	row := &StoredRow{
+		Headers: "HTTP/1.1 404 Not Found\r\nContent-Type: application/json\r\n",
+		Body:    []byte(`"post ok"`),
+	}
+	res, err := ParseStoredResponse(row, nil)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	body, err := io.ReadAll(res.Body)
+	require.Nil(t, err)
+	require.Equal(t, row.Body, body)
+	res, err = ParseStoredResponse(
+		&StoredRow{Headers: "HTTP/1.1 204 No Content\r\n"}, nil)
+	require.Nil(t, err)
+	require.Equal(t, http.NoBody, res.Body)
+	_, err = ParseStoredRequest(row)
+	require.NotNil(t, err)
+}
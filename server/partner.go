@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// MetricRequests is the name of the counter of requests, labeled by `partner`
+// and `status` class, e.g. `2xx`, when a partner header is configured.
+const MetricRequests = "persist_requests_total"
+
+// PartnerOther is the label of partners beyond the configured maximum.
+const PartnerOther = "other"
+
+// maximum length of partner labels, matching the column size
+const maxPartnerLen = 64
+
+// partnerLabels keeps the partner labels low-cardinality, values beyond the
+// maximum number of distinct ones are labeled PartnerOther.
+type partnerLabels struct {
+	header string
+	max    int
+	mu     sync.RWMutex
+	seen   map[string]struct{}
+}
+
+func newPartnerLabels(header string, max int) *partnerLabels {
+	return &partnerLabels{
+		header: header, max: max, seen: make(map[string]struct{}),
+	}
+}
+
+// label returns the partner label of the request, empty if the header is
+// absent.
+func (p *partnerLabels) label(req *http.Request) string {
+	v := req.Header.Get(p.header)
+	if "" == v {
+		return ""
+	}
+	if len(v) > maxPartnerLen {
+		v = v[:maxPartnerLen]
+	}
+	p.mu.RLock()
+	_, ok := p.seen[v]
+	p.mu.RUnlock()
+	if ok {
+		return v
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok = p.seen[v]; ok {
+		return v
+	}
+	if p.max > 0 && len(p.seen) >= p.max {
+		return PartnerOther
+	}
+	p.seen[v] = struct{}{}
+	return v
+}
+
+func (s *Server) countRequest(partner string, status int) {
+	s.metrics.Inc(MetricRequests, "partner", partner,
+		"status", strconv.Itoa(status/100)+"xx")
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RequestLogger_labels_partners(t *testing.T) {
+	writer := &mockCachedWriter{}
+	cfg := &Config{PartnerHeader: "X-Partner-Id", PartnerMaxValues: 1}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+	svr.Engine.GET("/t", func(c *gin.Context) { c.Status(http.StatusNotFound) })
+	for _, p := range []string{"a", "b", "a"} {
+		req := httptest.NewRequest(http.MethodGet, "/t", nil)
+		req.Header.Set("X-Partner-Id", p)
+		svr.Engine.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	require.Len(t, writer.records, 6)
+	require.Equal(t, "a", writer.records[0].Partner)
+	require.Equal(t, "a", writer.records[1].Partner)
+	require.Equal(t, PartnerOther, writer.records[3].Partner)
+	require.Equal(t, uint64(2), svr.metrics.Get(MetricRequests,
+		"partner", "a", "status", "4xx"))
+	require.Equal(t, uint64(1), svr.metrics.Get(MetricRequests,
+		"partner", PartnerOther, "status", "4xx"))
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_SqlBuilder_persists_partner_and_version(t *testing.T) {
+	_, conn := setupDb(t)
+	query, args := SqlBuilder(utils.NewLogger(), &mockWriter{})([]any{
+		TxRecord{Request: "GET /t", Partner: "a"},
+		TxRecord{Request: "GET /t"},
+	})
+	_, err := conn.Exec(query, args...)
+	require.Nil(t, err)
+	var partners []any
+	rows, err := conn.Query(`SELECT partner FROM tx_log ORDER BY partner;`)
+	require.Nil(t, err)
+	for rows.Next() {
+		var p any
+		require.Nil(t, rows.Scan(&p))
+		partners = append(partners, p)
+	}
+	require.Nil(t, rows.Close())
+	require.Equal(t, []any{nil, "a"}, partners)
+	var count int
+	require.Nil(t, conn.QueryRow(
+		`SELECT COUNT(*) FROM tx_log WHERE schema_version=?;`, RecordVersion,
+	).Scan(&count))
+	require.Equal(t, 2, count)
+}
@@ -0,0 +1,522 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Policy decides whether responses are persisted by rules read from the
+// `LOG_POLICY` env, evaluated once the handler returns, after the request
+// record has been pushed. Rules are separated by `;`, the first one matching
+// the request decides, and requests matching no rule are kept, e.g.
+//
+//	skip if path startsWith "/up" and status == 200;
+//	sample(0.1) if method == "GET" and status < 400;
+//	keep
+//
+// A rule is `keep`, `skip`, or `sample(rate)` keeping the fraction of
+// requests, optionally followed by `if` and a condition. Conditions combine
+// comparisons with `and`, `or`, `not` and parentheses. Comparisons are `==`,
+// `!=`, `<`, `<=`, `>`, `>=` of numbers, and `startsWith`, `endsWith`,
+// `contains`, `matches` (a regular expression) of strings. Values are string
+// and number literals, `true`, `false`, and these fields of the request:
+//
+//   - method, path, host, ip, agent: strings
+//   - status, duration_ms: numbers
+//   - header("Name"), query("name"): strings, empty if absent
+//
+// Types are checked when parsing, so a policy accepted by ParsePolicy can't
+// fail on any request. A nil Policy keeps all requests.
+type Policy struct {
+	src   string
+	rules []policyRule
+}
+
+type policyRule struct {
+	// fraction of matching requests kept, 0 for skip and 1 for keep
+	rate float64
+	// nil matches all requests
+	cond policyExpr
+}
+
+// policyEnv is what conditions are evaluated against.
+type policyEnv struct {
+	gc       *gin.Context
+	status   int
+	duration time.Duration
+}
+
+type policyExpr func(*policyEnv) any
+
+type policyKind int
+
+const (
+	policyString policyKind = iota
+	policyNumber
+	policyBool
+)
+
+func (k policyKind) String() string {
+	return [...]string{"string", "number", "bool"}[k]
+}
+
+// ParsePolicy parses the policy, nil if there is no rule.
+func ParsePolicy(src string) (*Policy, error) {
+	toks, err := lexPolicy(src)
+	if nil != err {
+		return nil, err
+	}
+	p := &policyParser{toks: toks}
+	policy := &Policy{src: strings.TrimSpace(src)}
+	for !p.done() {
+		if p.op(";") {
+			continue
+		}
+		rule, err := p.rule()
+		if nil != err {
+			return nil, err
+		}
+		policy.rules = append(policy.rules, rule)
+		if !p.done() && !p.op(";") {
+			return nil, p.unexpected()
+		}
+	}
+	if len(policy.rules) < 1 {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+// String returns the source of the policy.
+func (p *Policy) String() string {
+	if nil == p {
+		return ""
+	}
+	return p.src
+}
+
+// keep tells whether the request is persisted.
+func (p *Policy) keep(env *policyEnv) bool {
+	if nil == p {
+		return true
+	}
+	for _, r := range p.rules {
+		if nil != r.cond && !r.cond(env).(bool) {
+			continue
+		}
+		if r.rate >= 1 {
+			return true
+		}
+		return r.rate > 0 && sampleFloat() < r.rate
+	}
+	return true
+}
+
+// responseKept tells whether the policy keeps the response record of current
+// request. It's decided once, so RequestLogger and the access log agree.
+func (s *Server) responseKept(gc *gin.Context, start time.Time) bool {
+	if kept, ok := gc.Get(ctxKeyKept); ok {
+		return kept.(bool)
+	}
+	kept := s.policyKept(gc, start)
+	gc.Set(ctxKeyKept, kept)
+	return kept
+}
+
+// policyKept tells whether the request is persisted according to `Policy`.
+func (s *Server) policyKept(gc *gin.Context, start time.Time) bool {
+	if nil == s.Conf || nil == s.Conf.Policy {
+		return true
+	}
+	return s.Conf.Policy.keep(&policyEnv{
+		gc: gc, status: gc.Writer.Status(), duration: time.Since(start),
+	})
+}
+
+type policyTokenKind int
+
+const (
+	tokEOF policyTokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type policyToken struct {
+	kind policyTokenKind
+	text string
+	pos  int
+}
+
+var policyOps = []string{"==", "!=", "<=", ">=", "&&", "||"}
+
+func lexPolicy(src string) ([]policyToken, error) {
+	var toks []policyToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case ' ' == c || '\t' == c || '\n' == c || '\r' == c:
+			i++
+		case '"' == c:
+			j := i + 1
+			for ; j < len(src) && '"' != src[j]; j++ {
+				if '\\' == src[j] {
+					j++
+				}
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if nil != err {
+				return nil, fmt.Errorf("invalid string at %d: %w", i, err)
+			}
+			toks = append(toks, policyToken{tokString, s, i})
+			i = j + 1
+		case isPolicyDigit(c):
+			j := i
+			for j < len(src) && (isPolicyDigit(src[j]) || '.' == src[j]) {
+				j++
+			}
+			toks = append(toks, policyToken{tokNumber, src[i:j], i})
+			i = j
+		case isPolicyLetter(c):
+			j := i
+			for j < len(src) && (isPolicyLetter(src[j]) ||
+				isPolicyDigit(src[j])) {
+				j++
+			}
+			toks = append(toks, policyToken{tokIdent, src[i:j], i})
+			i = j
+		case i+1 < len(src) && slices.Contains(policyOps, src[i:i+2]):
+			toks = append(toks, policyToken{tokOp, src[i : i+2], i})
+			i += 2
+		case strings.IndexByte("<>()!;", c) >= 0:
+			toks = append(toks, policyToken{tokOp, src[i : i+1], i})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return append(toks, policyToken{tokEOF, "", len(src)}), nil
+}
+
+func isPolicyDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isPolicyLetter(c byte) bool {
+	return '_' == c || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+type policyParser struct {
+	toks []policyToken
+	pos  int
+}
+
+func (p *policyParser) peek() policyToken {
+	return p.toks[p.pos]
+}
+
+func (p *policyParser) next() policyToken {
+	t := p.toks[p.pos]
+	if tokEOF != t.kind {
+		p.pos++
+	}
+	return t
+}
+
+func (p *policyParser) done() bool {
+	return tokEOF == p.peek().kind
+}
+
+// op consumes the operator if it's the next token.
+func (p *policyParser) op(text string) bool {
+	if t := p.peek(); tokOp == t.kind && text == t.text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// word consumes the identifier if it's the next token.
+func (p *policyParser) word(text string) bool {
+	if t := p.peek(); tokIdent == t.kind && text == t.text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *policyParser) unexpected() error {
+	t := p.peek()
+	if tokEOF == t.kind {
+		return fmt.Errorf("unexpected end of policy")
+	}
+	return fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+func (p *policyParser) expect(text string) error {
+	if !p.op(text) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *policyParser) rule() (policyRule, error) {
+	var rule policyRule
+	switch {
+	case p.word("keep"):
+		rule.rate = 1
+	case p.word("skip"):
+	case p.word("sample"):
+		if err := p.expect("("); nil != err {
+			return rule, err
+		}
+		t := p.next()
+		rate, err := strconv.ParseFloat(t.text, 64)
+		if tokNumber != t.kind || nil != err || rate > 1 {
+			return rule, fmt.Errorf("invalid sample rate %q at %d", t.text,
+				t.pos)
+		}
+		rule.rate = rate
+		if err = p.expect(")"); nil != err {
+			return rule, err
+		}
+	default:
+		return rule, p.unexpected()
+	}
+	if !p.word("if") {
+		return rule, nil
+	}
+	pos := p.peek().pos
+	cond, kind, err := p.or()
+	if nil != err {
+		return rule, err
+	}
+	if policyBool != kind {
+		return rule, fmt.Errorf("condition at %d is %s, not bool", pos, kind)
+	}
+	rule.cond = cond
+	return rule, nil
+}
+
+func (p *policyParser) or() (policyExpr, policyKind, error) {
+	l, kind, err := p.and()
+	for nil == err && (p.op("||") || p.word("or")) {
+		var r policyExpr
+		if r, err = p.boolOperand(kind, p.and); nil == err {
+			left := l
+			l = func(e *policyEnv) any { return left(e).(bool) || r(e).(bool) }
+		}
+	}
+	return l, kind, err
+}
+
+func (p *policyParser) and() (policyExpr, policyKind, error) {
+	l, kind, err := p.not()
+	for nil == err && (p.op("&&") || p.word("and")) {
+		var r policyExpr
+		if r, err = p.boolOperand(kind, p.not); nil == err {
+			left := l
+			l = func(e *policyEnv) any { return left(e).(bool) && r(e).(bool) }
+		}
+	}
+	return l, kind, err
+}
+
+// boolOperand parses the right operand of a logical operator, checking both
+// operands are bool.
+func (p *policyParser) boolOperand(
+	left policyKind, parse func() (policyExpr, policyKind, error),
+) (policyExpr, error) {
+	pos := p.peek().pos
+	r, kind, err := parse()
+	if nil != err {
+		return nil, err
+	}
+	if policyBool != left || policyBool != kind {
+		return nil, fmt.Errorf("logical operator before %d needs bool", pos)
+	}
+	return r, nil
+}
+
+func (p *policyParser) not() (policyExpr, policyKind, error) {
+	if !p.op("!") && !p.word("not") {
+		return p.comparison()
+	}
+	pos := p.peek().pos
+	e, kind, err := p.not()
+	if nil != err {
+		return nil, kind, err
+	}
+	if policyBool != kind {
+		return nil, kind, fmt.Errorf("not at %d needs bool", pos)
+	}
+	return func(env *policyEnv) any { return !e(env).(bool) }, policyBool, nil
+}
+
+var policyStringOps = map[string]func(a, b string) bool{
+	"startsWith": strings.HasPrefix,
+	"endsWith":   strings.HasSuffix,
+	"contains":   strings.Contains,
+}
+
+var policyNumberOps = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+}
+
+func (p *policyParser) comparison() (policyExpr, policyKind, error) {
+	l, lk, err := p.operand()
+	if nil != err {
+		return nil, lk, err
+	}
+	t := p.peek()
+	if (tokOp != t.kind && tokIdent != t.kind) ||
+		(tokIdent == t.kind && "matches" != t.text &&
+			nil == policyStringOps[t.text]) {
+		return l, lk, nil
+	}
+	if "matches" == t.text {
+		p.next()
+		pat := p.next()
+		if tokString != pat.kind {
+			return nil, lk, fmt.Errorf("matches at %d needs a string pattern",
+				t.pos)
+		}
+		re, err := regexp.Compile(pat.text)
+		if nil != err {
+			return nil, lk, fmt.Errorf("invalid pattern at %d: %w", pat.pos,
+				err)
+		}
+		if policyString != lk {
+			return nil, lk, fmt.Errorf("matches at %d needs string", t.pos)
+		}
+		return func(e *policyEnv) any { return re.MatchString(l(e).(string)) },
+			policyBool, nil
+	}
+	numOp, strOp := policyNumberOps[t.text], policyStringOps[t.text]
+	if "==" != t.text && "!=" != t.text && nil == numOp && nil == strOp {
+		return l, lk, nil
+	}
+	p.next()
+	r, rk, err := p.operand()
+	if nil != err {
+		return nil, rk, err
+	}
+	switch {
+	case "==" == t.text && lk == rk:
+		return func(e *policyEnv) any { return l(e) == r(e) }, policyBool, nil
+	case "!=" == t.text && lk == rk:
+		return func(e *policyEnv) any { return l(e) != r(e) }, policyBool, nil
+	case nil != numOp && policyNumber == lk && policyNumber == rk:
+		return func(e *policyEnv) any {
+			return numOp(l(e).(float64), r(e).(float64))
+		}, policyBool, nil
+	case nil != strOp && policyString == lk && policyString == rk:
+		return func(e *policyEnv) any {
+			return strOp(l(e).(string), r(e).(string))
+		}, policyBool, nil
+	}
+	return nil, lk, fmt.Errorf("can't compare %s %s %s at %d", lk, t.text, rk,
+		t.pos)
+}
+
+// policyFields are the fields of the request available to conditions.
+var policyFields = map[string]struct {
+	kind  policyKind
+	value policyExpr
+}{
+	"method": {policyString, func(e *policyEnv) any {
+		return e.gc.Request.Method
+	}},
+	"path": {policyString, func(e *policyEnv) any {
+		return e.gc.Request.URL.Path
+	}},
+	"host": {policyString, func(e *policyEnv) any {
+		return e.gc.Request.Host
+	}},
+	"ip": {policyString, func(e *policyEnv) any { return e.gc.ClientIP() }},
+	"agent": {policyString, func(e *policyEnv) any {
+		return e.gc.Request.UserAgent()
+	}},
+	"status": {policyNumber, func(e *policyEnv) any {
+		return float64(e.status)
+	}},
+	"duration_ms": {policyNumber, func(e *policyEnv) any {
+		return float64(e.duration.Milliseconds())
+	}},
+}
+
+func (p *policyParser) operand() (policyExpr, policyKind, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return func(*policyEnv) any { return t.text }, policyString, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if nil != err {
+			return nil, policyNumber,
+				fmt.Errorf("invalid number %q at %d", t.text, t.pos)
+		}
+		return func(*policyEnv) any { return n }, policyNumber, nil
+	case tokOp:
+		if "(" != t.text {
+			break
+		}
+		e, kind, err := p.or()
+		if nil == err {
+			err = p.expect(")")
+		}
+		return e, kind, err
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			b := "true" == t.text
+			return func(*policyEnv) any { return b }, policyBool, nil
+		case "header", "query":
+			return p.lookup(t)
+		}
+		if f, ok := policyFields[t.text]; ok {
+			return f.value, f.kind, nil
+		}
+		return nil, policyBool,
+			fmt.Errorf("unknown field %q at %d", t.text, t.pos)
+	}
+	if tokEOF != t.kind {
+		p.pos--
+	}
+	return nil, policyBool, p.unexpected()
+}
+
+// lookup parses `header("Name")` or `query("name")`.
+func (p *policyParser) lookup(fn policyToken) (policyExpr, policyKind, error) {
+	if err := p.expect("("); nil != err {
+		return nil, policyString, err
+	}
+	name := p.next()
+	if tokString != name.kind {
+		return nil, policyString,
+			fmt.Errorf("%s at %d needs a string name", fn.text, fn.pos)
+	}
+	if err := p.expect(")"); nil != err {
+		return nil, policyString, err
+	}
+	if "header" == fn.text {
+		return func(e *policyEnv) any {
+			return e.gc.Request.Header.Get(name.text)
+		}, policyString, nil
+	}
+	return func(e *policyEnv) any { return e.gc.Query(name.text) },
+		policyString, nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParsePolicy_checks_syntax_and_types(t *testing.T) {
+	p, err := ParsePolicy(" ; ")
+	require.Nil(t, err)
+	require.Nil(t, p)
+	p, err = ParsePolicy(`skip if path startsWith "/up";keep`)
+	require.Nil(t, err)
+	require.Len(t, p.rules, 2)
+	require.Equal(t, `skip if path startsWith "/up";keep`, p.String())
+	for src, msg := range map[string]string{
+		`drop`:                       `unexpected "drop" at 0`,
+		`skip if`:                    "unexpected end of policy",
+		`skip if path`:               "condition at 8 is string, not bool",
+		`skip if status == "200"`:    "can't compare number == string at 15",
+		`skip if path < 3`:           "can't compare string < number at 13",
+		`skip if not status`:         "not at 12 needs bool",
+		`skip if path matches "("`:   "invalid pattern at 21: ",
+		`skip if size > 1`:           `unknown field "size" at 8`,
+		`sample(2)`:                  `invalid sample rate "2" at 7`,
+		`skip if (status == 1`:       "unexpected end of policy",
+		`skip if header(1) == ""`:    "header at 8 needs a string name",
+		`skip if path == "/a" and 1`: "logical operator before 25 needs bool",
+		`skip if path == "/a" keep`:  `unexpected "keep" at 21`,
+		`skip if path == "/a\`:       "unterminated string at 16",
+		`skip if path == '/a'`:       `unexpected '\'' at 16`,
+		`skip if status == 2.0.0`:    `invalid number "2.0.0" at 18`,
+	} {
+		_, err = ParsePolicy(src)
+		require.ErrorContains(t, err, msg, src)
+	}
+	t.Setenv("LOG_POLICY", "keep if")
+	_, err = ConfigFromEnv()
+	require.ErrorContains(t, err, "LOG_POLICY: unexpected end of policy")
+}
+
+func Test_RequestLogger_applies_policy(t *testing.T) {
+	defer func(fn func() float64) { sampleFloat = fn }(sampleFloat)
+	sampleFloat = func() float64 { return 0.5 }
+	policy, err := ParsePolicy(`
+		skip if path startsWith "/up" and status == 200;
+		sample(0.4) if method == "GET" && !(header("X-Debug") == "1");
+		sample(0.6) if query("a") == "b" or path matches "^/r/\\d+$";
+		skip if duration_ms >= 0 and agent contains "bot";
+	`)
+	require.Nil(t, err)
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(),
+		&Config{Policy: policy})
+	svr.Engine.Any("/*p", func(c *gin.Context) {
+		if "/up/fail" == c.Request.URL.Path {
+			c.Status(http.StatusServiceUnavailable)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	for _, r := range []struct {
+		method, target, agent string
+		kept                  bool
+	}{
+		{http.MethodPost, "/up/ok", "", false},
+		{http.MethodPost, "/up/fail", "", true},
+		{http.MethodGet, "/a", "", false},
+		{http.MethodPost, "/q?a=b", "", true},
+		{http.MethodPut, "/r/12", "", true},
+		{http.MethodPut, "/r/x", "crawl-bot", false},
+		{http.MethodPut, "/r/x", "curl", true},
+	} {
+		n := len(writer.records)
+		req := httptest.NewRequest(r.method, r.target, nil)
+		req.Header.Set("User-Agent", r.agent)
+		svr.Engine.ServeHTTP(httptest.NewRecorder(), req)
+		// request records are pushed before the rules are evaluated
+		if r.kept {
+			require.Len(t, writer.records, n+2, r.target)
+		} else {
+			require.Len(t, writer.records, n+1, r.target)
+		}
+	}
+	require.Equal(t, uint64(3), svr.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyRuleSkipped))
+}
@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// ErrBodyAccess is returned by RecordStore.Bodies if body access isn't
+// granted to the store.
+var ErrBodyAccess = errors.New("access to bodies is not granted")
+
+// StoredRow holds the columns of a persisted row.
+type StoredRow struct {
+	Id       any
+	ReqHash  []byte
+	Headers  string
+	Body     []byte
+	HashAlgo string
+	Version  int
+	// codec of Body as stored, empty if it's not compressed
+	BodyCodec string
+	// the following are filled by RecordStore only
+	CreatedAt     time.Time
+	ClientAborted bool
+	// raw JSON of attributes, empty if there is none
+	Attributes string
+	Partner    string
+	// the request line hashed into `req_hash`, empty for rows persisted before
+	// the column was added
+	RequestLine string
+	// connection of request records, zero if unknown
+	RemotePort int
+	ConnId     uint64
+	ConnReused bool
+	// empty or zero for rows persisted before the columns were added
+	Method string
+	Path   string
+	// status code of response records, zero for request records
+	Status     int
+	DurationMs int64
+	// shared by the request and response rows of one exchange, nil for rows
+	// persisted before the columns were added
+	TxId      []byte
+	Direction string
+	// whether any part of the record is truncated
+	Truncated bool
+	// whether the response is slower than the SLO of its route
+	SloViolated bool
+}
+
+// RecordQuery filters the records returned by RecordStore.Records. Zero
+// fields are not filtered on.
+type RecordQuery struct {
+	// ID of the record, binary or text as stored
+	Id      any
+	ReqHash []byte
+	// the `tx_id` of both records of one exchange
+	TxId []byte
+	// the exact request line, telling apart requests of colliding hashes
+	RequestLine string
+	From, To    time.Time
+	// ID of the last record of the previous page
+	After any
+	// position of the last record of the previous page, returning records in
+	// the order of `created_at` and ID instead, see Consumer
+	Since *Cursor
+	// maximum number of records returned, defaults to 100
+	Limit int
+}
+
+// RecordStore queries persisted records. Records are returned with headers
+// and metadata only, bodies, which may carry personal data, are read
+// separately, and only if access is granted when the store is created.
+type RecordStore struct {
+	conn       *sql.DB
+	bodyAccess bool
+}
+
+// NewRecordStore creates a store, granting body access if told so.
+func NewRecordStore(conn *sql.DB, bodyAccess bool) *RecordStore {
+	return &RecordStore{conn: conn, bodyAccess: bodyAccess}
+}
+
+// Records returns records matching the query in the order of ID, without
+// bodies.
+func (s *RecordStore) Records(
+	ctx context.Context, q RecordQuery,
+) ([]StoredRow, error) {
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	query := `SELECT id, req_hash, headers, hash_algo, schema_version,
+		created_at, client_aborted, attributes, partner, request_line,
+		remote_port, conn_id, conn_reused, method, path, status_code,
+		duration_ms, tx_id, direction, truncated, slo_violated FROM tx_log`
+	var conds []string
+	var args []any
+	if nil != q.Id {
+		conds = append(conds, "id = ?")
+		args = append(args, q.Id)
+	}
+	if len(q.ReqHash) > 0 {
+		conds = append(conds, "req_hash = ?")
+		args = append(args, q.ReqHash)
+	}
+	if len(q.TxId) > 0 {
+		conds = append(conds, "tx_id = ?")
+		args = append(args, q.TxId)
+	}
+	if "" != q.RequestLine {
+		conds = append(conds, "request_line = ?")
+		args = append(args, q.RequestLine)
+	}
+	if !q.From.IsZero() {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, formatStoredTime(q.From))
+	}
+	if !q.To.IsZero() {
+		conds = append(conds, "created_at < ?")
+		args = append(args, formatStoredTime(q.To))
+	}
+	if nil != q.After {
+		conds = append(conds, "id > ?")
+		args = append(args, q.After)
+	}
+	order := " ORDER BY id LIMIT ?"
+	if nil != q.Since {
+		at := formatStoredTime(q.Since.CreatedAt)
+		conds = append(conds,
+			"(created_at > ? OR (created_at = ? AND id > ?))")
+		args = append(args, at, at, q.Since.Id)
+		order = " ORDER BY created_at, id LIMIT ?"
+	}
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if q.Limit < 1 {
+		q.Limit = 100
+	}
+	args = append(args, q.Limit)
+	rows, err := s.conn.QueryContext(ctx, query+order, args...)
+	if nil != err {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var records []StoredRow
+	for rows.Next() {
+		var row StoredRow
+		var at any
+		var attrs, partner, line sql.NullString
+		var port sql.Null[int]
+		var connId sql.Null[uint64]
+		var reused sql.NullBool
+		var method, path sql.NullString
+		var status sql.Null[int]
+		var duration sql.Null[int64]
+		var direction sql.NullString
+		err = rows.Scan(&row.Id, &row.ReqHash, &row.Headers, &row.HashAlgo,
+			&row.Version, &at, &row.ClientAborted, &attrs, &partner, &line,
+			&port, &connId, &reused, &method, &path, &status, &duration,
+			&row.TxId, &direction, &row.Truncated, &row.SloViolated)
+		if nil != err {
+			return nil, err
+		}
+		row.RemotePort, row.ConnId = port.V, connId.V
+		row.ConnReused = reused.Bool
+		row.Method, row.Path = method.String, path.String
+		row.Status, row.DurationMs = status.V, duration.V
+		row.Direction = direction.String
+		if row.CreatedAt, err = parseStoredTime(at); nil != err {
+			return nil, err
+		}
+		row.Attributes, row.Partner = attrs.String, partner.String
+		row.RequestLine = line.String
+		records = append(records, row)
+	}
+	return records, rows.Err()
+}
+
+// requestConds returns the conditions matching request records of the request
+// line, by `req_hash` of all supported algorithms, so the hashing scheme
+// rows were written with needn't be known.
+func requestConds(requestLine string) (string, []any) {
+	args := append(ReqHashArgs(internal.HashXxh64, requestLine),
+		ReqHashArgs(internal.HashXxh3, requestLine)...)
+	// rows persisted before `direction` was added are all counted
+	cond := "req_hash IN (" + strings.Repeat(",?", len(args))[1:] +
+		") AND (direction IS NULL OR direction = ?)"
+	return cond, append(args, DirectionRequest)
+}
+
+// CountRequests returns the number of requests of the request line, such as
+// `POST /callback?id=1`, received within `from` inclusive and `to`
+// exclusive. Either zero time leaves the range open. It's served by the
+// `req_hash` index.
+func (s *RecordStore) CountRequests(
+	ctx context.Context, requestLine string, from, to time.Time,
+) (int64, error) {
+	cond, args := requestConds(requestLine)
+	if !from.IsZero() {
+		cond += " AND created_at >= ?"
+		args = append(args, formatStoredTime(from))
+	}
+	if !to.IsZero() {
+		cond += " AND created_at < ?"
+		args = append(args, formatStoredTime(to))
+	}
+	var n int64
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	err := s.conn.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM tx_log WHERE "+cond, args...).Scan(&n)
+	return n, err
+}
+
+// LastSeen returns when the latest request of the request line was received,
+// and false if it has never been.
+func (s *RecordStore) LastSeen(
+	ctx context.Context, requestLine string,
+) (time.Time, bool, error) {
+	cond, args := requestConds(requestLine)
+	var at any
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	err := s.conn.QueryRowContext(ctx,
+		"SELECT MAX(created_at) FROM tx_log WHERE "+cond, args...).Scan(&at)
+	if nil != err || nil == at {
+		return time.Time{}, false, err
+	}
+	t, err := parseStoredTime(at)
+	return t, nil == err, err
+}
+
+// Bodies returns decoded bodies of the records of given IDs, keyed by the ID
+// formatted with formatUuid. Records without body are absent from the map.
+func (s *RecordStore) Bodies(
+	ctx context.Context, ids ...any,
+) (map[string][]byte, error) {
+	if !s.bodyAccess {
+		return nil, ErrBodyAccess
+	}
+	bodies := make(map[string][]byte)
+	if len(ids) < 1 {
+		return bodies, nil
+	}
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	rows, err := s.conn.QueryContext(ctx, "SELECT id, body, body_codec "+
+		"FROM tx_log WHERE body IS NOT NULL AND id IN ("+
+		strings.Repeat(",?", len(ids))[1:]+")", ids...)
+	if nil != err {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		var id any
+		var body []byte
+		var codec sql.NullString
+		if err = rows.Scan(&id, &body, &codec); nil != err {
+			return nil, err
+		}
+		if body, err = DecodeBody(codec.String, body); nil != err {
+			return nil, err
+		}
+		bodies[storedId(id)] = body
+	}
+	return bodies, rows.Err()
+}
+
+// storedId formats the scanned ID, binary or text, in the canonical text form.
+func storedId(id any) string {
+	switch v := id.(type) {
+	case []byte:
+		if 16 == len(v) {
+			return formatUuid(v)
+		}
+		return string(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// records are stamped in local time
+func formatStoredTime(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04:05.000000")
+}
+
+func parseStoredTime(v any) (time.Time, error) {
+	switch t := v.(type) {
+	case nil:
+		return time.Time{}, nil
+	case time.Time:
+		return t, nil
+	case []byte:
+		return time.ParseInLocation("2006-01-02 15:04:05.999999",
+			string(t), time.Local)
+	case string:
+		return time.ParseInLocation("2006-01-02 15:04:05.999999", t,
+			time.Local)
+	}
+	return time.Time{}, errors.New("invalid created_at")
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+func Test_RecordStore_excludes_bodies_by_default(t *testing.T) {
+	_, conn := setupDb(t)
+	var records []any
+	for i := 0; i < 3; i++ {
+		records = append(records, TxRecord{
+			Request: "GET /t", Headers: []byte("GET /t HTTP/1.1\r\n"),
+			Body: []byte("secret"), At: time.Now(), Partner: "p",
+			Attributes: map[string]any{"a": 1},
+		})
+	}
+	records = append(records, TxRecord{Request: "GET /x", At: time.Now()})
+	query, args := SqlBuilder(utils.NewLogger(), &mockWriter{})(records)
+	_, err := conn.Exec(query, args...)
+	require.Nil(t, err)
+	store := NewRecordStore(conn, false)
+	ctx := context.Background()
+	q := RecordQuery{
+		ReqHash: internal.SumString(internal.HashXxh64, "GET /t"), Limit: 2,
+	}
+	page, err := store.Records(ctx, q)
+	require.Nil(t, err)
+	require.Len(t, page, 2)
+	require.Nil(t, page[0].Body)
+	require.Equal(t, "GET /t HTTP/1.1\r\n", page[0].Headers)
+	require.Equal(t, "p", page[0].Partner)
+	require.Equal(t, `{"a":1}`, page[0].Attributes)
+	require.False(t, page[0].CreatedAt.IsZero())
+	q.After = page[1].Id
+	page, err = store.Records(ctx, q)
+	require.Nil(t, err)
+	require.Len(t, page, 1)
+	_, err = store.Bodies(ctx, page[0].Id)
+	require.ErrorIs(t, err, ErrBodyAccess)
+	bodies, err := NewRecordStore(conn, true).Bodies(ctx, page[0].Id)
+	require.Nil(t, err)
+	require.Equal(t, map[string][]byte{
+		formatUuid(page[0].Id): []byte("secret"),
+	}, bodies)
+}
+
+func Test_RecordStore_filters_by_request_line(t *testing.T) {
+	_, conn := setupDb(t)
+	hash := internal.SumString(internal.HashXxh64, "GET /t")
+	query, args := SqlBuilder(utils.NewLogger(), &mockWriter{})([]any{
+		TxRecord{Request: "GET /t", Headers: []byte("h"), At: time.Now()},
+		TxRecord{Request: "GET /x", Headers: []byte("h"), At: time.Now()},
+	})
+	_, err := conn.Exec(query, args...)
+	require.Nil(t, err)
+	// pretend the other request collides on the hash
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	_, err = conn.Exec("UPDATE tx_log SET req_hash = ?", hash)
+	require.Nil(t, err)
+	store := NewRecordStore(conn, false)
+	page, err := store.Records(context.Background(), RecordQuery{ReqHash: hash})
+	require.Nil(t, err)
+	require.Len(t, page, 2)
+	page, err = store.Records(context.Background(),
+		RecordQuery{ReqHash: hash, RequestLine: "GET /x"})
+	require.Nil(t, err)
+	require.Len(t, page, 1)
+	require.Equal(t, "GET /x", page[0].RequestLine)
+}
+
+func Test_RecordStore_counts_requests_of_any_hash_scheme(t *testing.T) {
+	_, conn := setupDb(t)
+	now := time.Now()
+	line := "POST /callback?id=1"
+	xxh3 := SqlBuilder(utils.NewLogger(), &mockWriter{},
+		WithHasher(internal.NewHasher(internal.HashXxh3)))
+	for _, b := range []struct {
+		build   func([]any) (string, []any)
+		records []any
+	}{
+		{SqlBuilder(utils.NewLogger(), &mockWriter{}), []any{
+			TxRecord{Request: line, At: now.Add(-2 * time.Hour)},
+			TxRecord{Request: line, At: now.Add(-time.Hour),
+				Direction: DirectionRequest},
+			TxRecord{Request: line, At: now, Direction: DirectionResponse},
+			TxRecord{Request: "POST /callback?id=2", At: now},
+		}},
+		{xxh3, []any{TxRecord{Request: line, At: now.Add(-time.Minute)}}},
+	} {
+		query, args := b.build(b.records)
+		_, err := conn.Exec(query, args...)
+		require.Nil(t, err)
+	}
+	store := NewRecordStore(conn, false)
+	ctx := context.Background()
+	n, err := store.CountRequests(ctx, line, time.Time{}, time.Time{})
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	n, err = store.CountRequests(ctx, line, now.Add(-90*time.Minute),
+		now.Add(-30*time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, int64(1), n)
+	at, ok, err := store.LastSeen(ctx, line)
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.WithinDuration(t, now.Add(-time.Minute), at, time.Millisecond)
+	_, ok, err = store.LastSeen(ctx, "GET /never")
+	require.Nil(t, err)
+	require.False(t, ok)
+}
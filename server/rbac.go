@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes of admin keys, each granting access to the ones before it.
+const (
+	ScopeViewer   = "viewer"
+	ScopeOperator = "operator"
+	ScopeAdmin    = "admin"
+)
+
+var scopes = []string{ScopeViewer, ScopeOperator, ScopeAdmin}
+
+// AdminKey is an API key granted to an actor with a scope.
+type AdminKey struct {
+	// name of the actor, recorded in audit
+	Name  string
+	Scope string
+	Key   string
+}
+
+// ParseAdminKeys parses admin keys in the form of `name:scope:key`, as read
+// from the comma separated `ADMIN_KEYS` env.
+func ParseAdminKeys(entries []string) ([]AdminKey, error) {
+	keys := make([]AdminKey, 0, len(entries))
+	for i, e := range entries {
+		parts := strings.SplitN(e, ":", 3)
+		// don't tell the entry, which may be the key itself
+		if 3 != len(parts) || "" == parts[0] || "" == parts[2] {
+			return nil, fmt.Errorf("invalid admin key #%d", i+1)
+		}
+		if !slices.Contains(scopes, parts[1]) {
+			return nil, fmt.Errorf("invalid scope of %s: %s", parts[0],
+				parts[1])
+		}
+		keys = append(keys, AdminKey{Name: parts[0], Scope: parts[1],
+			Key: parts[2]})
+	}
+	return keys, nil
+}
+
+// RequireScope returns a middleware allowing requests carrying an admin key
+// of the given scope or above, in the `X-Api-Key` header or as a bearer token.
+// Others are responded 401 if no valid key is given, or 403 if the scope is
+// insufficient. The actor name is available from AdminActor.
+func (s *Server) RequireScope(scope string) gin.HandlerFunc {
+	required := slices.Index(scopes, scope)
+	return func(gc *gin.Context) {
+		key := s.adminKey(gc.Request)
+		if nil == key {
+			gc.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if slices.Index(scopes, key.Scope) < required {
+			gc.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		gc.Set(ctxKeyActor, key.Name)
+		gc.Set(ctxKeyScope, key.Scope)
+		gc.Next()
+	}
+}
+
+// AdminActor returns the name of the actor authorized by RequireScope.
+func AdminActor(gc *gin.Context) string {
+	return gc.GetString(ctxKeyActor)
+}
+
+// HasScope reports whether the admin key authorized by RequireScope grants
+// the given scope.
+func HasScope(gc *gin.Context, scope string) bool {
+	granted := slices.Index(scopes, gc.GetString(ctxKeyScope))
+	return granted >= 0 && granted >= slices.Index(scopes, scope)
+}
+
+func (s *Server) adminKey(req *http.Request) *AdminKey {
+	given := req.Header.Get("X-Api-Key")
+	if "" == given {
+		given, _ = strings.CutPrefix(req.Header.Get("Authorization"),
+			"Bearer ")
+	}
+	if "" == given || nil == s.Conf {
+		return nil
+	}
+	var found *AdminKey
+	// compare with all keys, so timing doesn't tell which one is close
+	for i, k := range s.Conf.AdminKeys {
+		if 1 == subtle.ConstantTimeCompare([]byte(k.Key), []byte(given)) {
+			found = &s.Conf.AdminKeys[i]
+		}
+	}
+	return found
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RequireScope_checks_admin_keys(t *testing.T) {
+	keys, err := ParseAdminKeys([]string{
+		"alice:admin:k1", "bob:viewer:k2:with:colons",
+	})
+	require.Nil(t, err)
+	svr := NewServer(&http.Server{}, &mockCachedWriter{}, utils.NewLogger(),
+		&Config{AdminKeys: keys})
+	svr.Engine.POST("/erase", svr.RequireScope(ScopeOperator),
+		func(c *gin.Context) { c.String(http.StatusOK, AdminActor(c)) })
+	tests := []struct {
+		header, value string
+		code          int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"X-Api-Key", "k0", http.StatusUnauthorized},
+		{"X-Api-Key", "k2:with:colons", http.StatusForbidden},
+		{"Authorization", "Bearer k1", http.StatusOK},
+	}
+	var w *httptest.ResponseRecorder
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/erase", nil)
+		if "" != tt.header {
+			req.Header.Set(tt.header, tt.value)
+		}
+		w = httptest.NewRecorder()
+		svr.Engine.ServeHTTP(w, req)
+		require.Equal(t, tt.code, w.Code, tt.value)
+	}
+	require.Equal(t, "alice", w.Body.String())
+	_, err = ParseAdminKeys([]string{"secret"})
+	require.EqualError(t, err, "invalid admin key #1")
+	_, err = ParseAdminKeys([]string{"carol:root:k3"})
+	require.EqualError(t, err, "invalid scope of carol: root")
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writerHealth is implemented by writers reporting whether records are being
+// persisted, such as CachedWriter.
+type writerHealth interface {
+	Failing() int
+	PendingBytes() int64
+}
+
+// Ready reports whether the writer is still persisting records. It's not ready
+// if flushes have failed more than `ReadyMaxFailures` times in a row, or the
+// pending records exceed `ReadyMaxPendingBytes`. Zero disables either check.
+func (s *Server) Ready() bool {
+	wh, ok := s.writer().(writerHealth)
+	if !ok || nil == s.Conf {
+		return true
+	}
+	if s.Conf.ReadyMaxFailures > 0 && wh.Failing() > s.Conf.ReadyMaxFailures {
+		return false
+	}
+	return s.Conf.ReadyMaxPendingBytes <= 0 ||
+		wh.PendingBytes() <= s.Conf.ReadyMaxPendingBytes
+}
+
+// ReadyHandler responds 200 if the server is Ready, 503 otherwise.
+func (s *Server) ReadyHandler() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		if s.Ready() {
+			gc.JSON(http.StatusOK, gin.H{"ready": true})
+			return
+		}
+		gc.JSON(http.StatusServiceUnavailable, gin.H{"ready": false})
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Ready_reports_failing_writer(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	inner := NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger)
+	inner.SetRetries(1)
+	w := NewWriter(inner, logger)
+	inner.SetFailedLog(w.FailedLog(nil))
+	cfg := &Config{ReadyPath: "/ready", ReadyMaxFailures: 1}
+	s := NewServer(&http.Server{}, w, logger, cfg)
+	require.Nil(t, conn.Close())
+	for i := 0; i < 2; i++ {
+		require.True(t, s.Ready())
+		w.Push(TxRecord{Request: "GET /t", Headers: []byte("h")})
+		w.Write()
+	}
+	require.Equal(t, 2, w.Failing())
+	res := httptest.NewRecorder()
+	s.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	require.Equal(t, http.StatusServiceUnavailable, res.Code)
+	_, conn = setupDb(t)
+	inner.SetDB(conn)
+	w.Push(TxRecord{Request: "GET /t", Headers: []byte("h")})
+	w.Write()
+	require.Zero(t, w.Failing())
+	require.True(t, s.Ready())
+}
+
+func Test_Ready_reports_backlog(t *testing.T) {
+	mock := &mockCachedWriter{}
+	w := NewWriter(mock, utils.NewLogger())
+	rec := TxRecord{Request: "GET /t"}
+	cfg := &Config{ReadyMaxPendingBytes: estimateSize(rec)}
+	s := NewServer(&http.Server{}, w, utils.NewLogger(), cfg)
+	w.Push(rec)
+	require.True(t, s.Ready())
+	w.Push(rec)
+	require.False(t, s.Ready())
+	w.Write()
+	require.True(t, s.Ready())
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// RedactedValue replaces values of headers masked by Redactor.
+const RedactedValue = "[REDACTED]"
+
+// DefaultRedactedHeaders are headers carrying credentials in common setups,
+// as a starting point of `REDACT_HEADERS`.
+var DefaultRedactedHeaders = []string{
+	"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+	"X-Api-Key", "X-Auth-Token", "X-Csrf-Token",
+}
+
+// Redactor masks sensitive header values of records before they're pushed to
+// the writer. Unlike HeaderFilter, the headers are kept, only their values
+// are replaced by RedactedValue.
+type Redactor struct {
+	// names of headers whose whole values are masked
+	names map[string]bool
+	// patterns of names of headers whose whole values are masked
+	namePatterns []*regexp.Regexp
+	// patterns of parts of values masked in any header
+	valuePatterns []*regexp.Regexp
+}
+
+// ParseRedactor creates a redactor from lists of `REDACT_HEADERS` and
+// `REDACT_VALUES` in env. Headers are names matched case-insensitively, or
+// regular expressions matching canonical names if they start with `~`, e.g.
+// `Authorization,~-Token$`. Values are regular expressions, whose matches are
+// masked in values of all headers, e.g. `sk_live_\w+`. It returns nil if
+// there is nothing to redact.
+func ParseRedactor(headers, values []string) (*Redactor, error) {
+	r := &Redactor{names: make(map[string]bool)}
+	for _, h := range headers {
+		h = strings.TrimSpace(h)
+		switch {
+		case "" == h:
+			continue
+		case strings.HasPrefix(h, "~"):
+			re, err := regexp.Compile(h[1:])
+			if nil != err {
+				return nil, fmt.Errorf("invalid header pattern %s: %w", h, err)
+			}
+			r.namePatterns = append(r.namePatterns, re)
+		default:
+			r.names[textproto.CanonicalMIMEHeaderKey(h)] = true
+		}
+	}
+	for _, v := range values {
+		if "" == strings.TrimSpace(v) {
+			continue
+		}
+		re, err := regexp.Compile(v)
+		if nil != err {
+			return nil, fmt.Errorf("invalid value pattern %s: %w", v, err)
+		}
+		r.valuePatterns = append(r.valuePatterns, re)
+	}
+	if len(r.names) < 1 && len(r.namePatterns) < 1 &&
+		len(r.valuePatterns) < 1 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// Needed tells whether any of the headers may be redacted.
+func (r *Redactor) Needed(h http.Header) bool {
+	if nil == r || len(h) < 1 {
+		return false
+	}
+	if len(r.valuePatterns) > 0 {
+		return true
+	}
+	for k := range h {
+		if r.maskName(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply masks header values in place, and returns the number of values
+// changed.
+func (r *Redactor) Apply(h http.Header) int {
+	if nil == r {
+		return 0
+	}
+	n := 0
+	for k, values := range h {
+		whole := r.maskName(k)
+		for i, v := range values {
+			masked := RedactedValue
+			if !whole {
+				masked = v
+				for _, re := range r.valuePatterns {
+					masked = re.ReplaceAllLiteralString(masked, RedactedValue)
+				}
+			}
+			if masked != v {
+				values[i] = masked
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (r *Redactor) maskName(name string) bool {
+	if r.names[name] {
+		return true
+	}
+	for _, re := range r.namePatterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) redact(h http.Header) {
+	if nil == s.Conf || nil == s.Conf.Redact {
+		return
+	}
+	s.metrics.Add(uint64(s.Conf.Redact.Apply(h)), MetricPolicyDecisions,
+		"policy", PolicyHeaderRedacted)
+}
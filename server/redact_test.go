@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Redactor_masks_names_patterns_and_values(t *testing.T) {
+	r, err := ParseRedactor([]string{"authorization", " ~-Token$", ""},
+		[]string{`sk_live_\w+`})
+	require.Nil(t, err)
+	h := http.Header{
+		"Authorization": {"Bearer abc"},
+		"X-Auth-Token":  {"t1", "t2"},
+		"X-Note":        {"key sk_live_123 here"},
+		"Accept":        {"*/*"},
+	}
+	require.Equal(t, 4, r.Apply(h))
+	require.Equal(t, []string{RedactedValue}, h["Authorization"])
+	require.Equal(t, []string{RedactedValue, RedactedValue}, h["X-Auth-Token"])
+	require.Equal(t, []string{"key " + RedactedValue + " here"}, h["X-Note"])
+	require.Equal(t, []string{"*/*"}, h["Accept"])
+}
+
+func Test_ParseRedactor_rejects_invalid_patterns(t *testing.T) {
+	r, err := ParseRedactor(nil, []string{" "})
+	require.Nil(t, err)
+	require.Nil(t, r)
+	require.False(t, r.Needed(http.Header{"Cookie": {"a=1"}}))
+	_, err = ParseRedactor([]string{"~("}, nil)
+	require.ErrorContains(t, err, "invalid header pattern ~(")
+	_, err = ParseRedactor(nil, []string{"("})
+	require.ErrorContains(t, err, "invalid value pattern (")
+	t.Setenv("REDACT_HEADERS", "~[")
+	_, err = ConfigFromEnv()
+	require.ErrorContains(t, err, "REDACT_HEADERS, REDACT_VALUES: ")
+}
+
+func Test_RequestLogger_redacts_headers(t *testing.T) {
+	for _, workers := range []int{0, 1} {
+		writer := &mockCachedWriter{}
+		redact, err := ParseRedactor(DefaultRedactedHeaders, nil)
+		require.Nil(t, err)
+		cfg := &Config{
+			Redact: redact, CaptureWorkers: workers,
+			AuthFingerprintKey: []byte("key"),
+		}
+		svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+		svr.Engine.GET("/t", func(c *gin.Context) {
+			// the handler still sees the credentials
+			require.Equal(t, "secret", c.GetHeader("X-Api-Key"))
+			c.Header("Set-Cookie", "sid=renewed")
+			c.Status(http.StatusOK)
+		})
+		req := httptest.NewRequest(http.MethodGet, "/t", nil)
+		req.Header.Set("X-Api-Key", "secret")
+		req.Header.Set("Authorization", "Bearer abc")
+		svr.Engine.ServeHTTP(httptest.NewRecorder(), req)
+		_, err = svr.Shutdown()
+		require.Nil(t, err)
+		require.Len(t, writer.records, 2)
+		headers := string(writer.records[0].Headers)
+		require.Contains(t, headers, "X-Api-Key: "+RedactedValue+"\r\n")
+		require.Contains(t, headers, "Authorization: "+RedactedValue+"\r\n")
+		require.NotContains(t, headers, "secret")
+		require.NotEmpty(t, writer.records[0].Attributes["auth_fingerprint"])
+		require.Contains(t, string(writer.records[1].Headers),
+			"Set-Cookie: "+RedactedValue)
+		require.Equal(t, uint64(3), svr.metrics.Get(MetricPolicyDecisions,
+			"policy", PolicyHeaderRedacted))
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eidng8/go-utils"
+)
+
+// maxRelayFrame is the largest frame accepted by ServeRelay.
+const maxRelayFrame = 64 << 20
+
+// RelaySink sends records to a writer daemon serving ServeRelay on a unix
+// socket, so that several processes on one host share the DB connections and
+// batches of the daemon. Each record is sent as a frame of JSON prefixed by
+// its length in 4 bytes of big endian. Traces are not sent.
+type RelaySink struct {
+	path    string
+	logger  utils.TaggedLogger
+	queue   chan TxRecord
+	dropped atomic.Uint64
+	// guards conn, shared by the sending goroutine and Stop
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+var _ Sink = &RelaySink{}
+
+// NewRelaySink creates a sink sending records to the unix socket of the given
+// path, holding at most `queue` records while the daemon is not reachable.
+func NewRelaySink(
+	path string, queue int, logger utils.TaggedLogger,
+) *RelaySink {
+	return &RelaySink{
+		path: path, logger: logger, queue: make(chan TxRecord, queue),
+	}
+}
+
+// Push queues the record, dropping it if the queue is full.
+func (r *RelaySink) Push(rec TxRecord) {
+	rec.Trace = nil
+	select {
+	case r.queue <- rec:
+	default:
+		r.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of records not delivered to the daemon.
+func (r *RelaySink) Dropped() uint64 {
+	return r.dropped.Load()
+}
+
+// Start sends queued records until the given channel is closed.
+func (r *RelaySink) Start(stop <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case rec := <-r.queue:
+				r.send(rec)
+			}
+		}
+	}()
+}
+
+// Stop sends records still queued within the given context, then closes the
+// connection to the daemon.
+func (r *RelaySink) Stop(ctx context.Context) error {
+	for {
+		select {
+		case rec := <-r.queue:
+			r.send(rec)
+		case <-ctx.Done():
+			return errors.Join(ctx.Err(), r.close())
+		default:
+			return r.close()
+		}
+	}
+}
+
+// send writes the record to the daemon, reconnecting once if the connection
+// is broken.
+func (r *RelaySink) send(rec TxRecord) {
+	frame, err := encodeRelayFrame(rec)
+	if nil != err {
+		r.dropped.Add(1)
+		r.logger.Errorf("failed to encode relayed record: %v", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if nil == r.conn {
+			r.conn, err = net.DialTimeout("unix", r.path, time.Second)
+			if nil != err {
+				continue
+			}
+		}
+		if _, err = r.conn.Write(frame); nil == err {
+			return
+		}
+		_ = r.conn.Close()
+		r.conn = nil
+	}
+	r.dropped.Add(1)
+	r.logger.Errorf("failed to relay record to %s: %v", r.path, err)
+}
+
+func (r *RelaySink) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if nil == r.conn {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+// ListenRelay listens on the unix socket of the given path for ServeRelay,
+// removing the socket left by an earlier run.
+func ListenRelay(path string) (net.Listener, error) {
+	if err := os.Remove(path); nil != err && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// ServeRelay accepts connections from RelaySink on the listener, pushing the
+// records received to the writer of the server, until the listener is closed.
+// The listener is closed upon Shutdown.
+func (s *Server) ServeRelay(l net.Listener) error {
+	s.onShutdown(func() error {
+		if err := l.Close(); nil != err && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		return nil
+	})
+	for {
+		conn, err := l.Accept()
+		if nil != err {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.relayConn(conn)
+	}
+}
+
+func (s *Server) relayConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	rd := bufio.NewReader(conn)
+	for {
+		rec, err := readRelayFrame(rd)
+		if nil != err {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.Logger.Errorf("failed to read relayed record: %v", err)
+			}
+			return
+		}
+		s.Writer.Push(rec)
+	}
+}
+
+func encodeRelayFrame(rec TxRecord) ([]byte, error) {
+	b, err := json.Marshal(rec)
+	if nil != err {
+		return nil, err
+	}
+	if len(b) > maxRelayFrame {
+		return nil, fmt.Errorf("frame of %d bytes exceeds %d", len(b),
+			maxRelayFrame)
+	}
+	frame := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	return append(frame, b...), nil
+}
+
+func readRelayFrame(rd io.Reader) (TxRecord, error) {
+	var rec TxRecord
+	var size [4]byte
+	if _, err := io.ReadFull(rd, size[:]); nil != err {
+		return rec, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxRelayFrame {
+		return rec, fmt.Errorf("frame of %d bytes exceeds %d", n, maxRelayFrame)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rd, b); nil != err {
+		return rec, err
+	}
+	return rec, json.Unmarshal(b, &rec)
+}
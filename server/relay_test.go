@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RelaySink_delivers_records_to_daemon(t *testing.T) {
+	// keep the socket path short
+	dir, err := os.MkdirTemp("", "relay")
+	require.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "w.sock")
+	sock, err := ListenRelay(path)
+	require.Nil(t, err)
+	written := &memorySink{}
+	daemon := NewSinkServer(&http.Server{}, written, utils.NewLogger(),
+		&Config{})
+	served := make(chan error, 1)
+	go func() { served <- daemon.ServeRelay(sock) }()
+
+	relay := NewRelaySink(path, 10, utils.NewLogger())
+	app := NewSinkServer(&http.Server{}, relay, utils.NewLogger(), &Config{})
+	app.Engine.POST("/t", func(c *gin.Context) { c.Status(http.StatusOK) })
+	app.Engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+		http.MethodPost, "/t?a=1", nil))
+	require.Nil(t, relay.Stop(context.Background()))
+	require.Zero(t, relay.Dropped())
+	require.Eventually(t, func() bool {
+		written.mu.Lock()
+		defer written.mu.Unlock()
+		return 2 == len(written.records)
+	}, time.Second, 10*time.Millisecond)
+	req, res := written.records[0], written.records[1]
+	require.Equal(t, "POST", req.Method)
+	require.Equal(t, "/t", req.Path)
+	require.Equal(t, DirectionResponse, res.Direction)
+	require.Equal(t, http.StatusOK, res.Status)
+	require.Equal(t, req.TxId, res.TxId)
+
+	cancel, err := daemon.Shutdown()
+	defer cancel()
+	require.Nil(t, err)
+	require.Nil(t, <-served)
+}
+
+func Test_RelaySink_counts_undelivered_records(t *testing.T) {
+	relay := NewRelaySink(filepath.Join(os.TempDir(), "absent.sock"), 1,
+		utils.NewLogger())
+	relay.Push(TxRecord{Request: "GET /a"})
+	relay.Push(TxRecord{Request: "GET /b"})
+	require.Equal(t, uint64(1), relay.Dropped())
+	require.Nil(t, relay.Stop(context.Background()))
+	require.Equal(t, uint64(2), relay.Dropped())
+}
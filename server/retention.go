@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/eidng8/go-utils"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// MetricRowsPurged counts rows deleted by Purger.
+const MetricRowsPurged = "persist_rows_purged_total"
+
+// PurgeBefore deletes rows of `tx_log` created before the given time, in
+// batches of the given size, each in its own statement, to avoid locking the
+// table for long. It returns the number of rows deleted. An index of
+// `created_at` is recommended, see DbConfig.Indexes.
+func PurgeBefore(
+	ctx context.Context, cfg *DbConfig, conn *sql.DB, before time.Time,
+	batch int,
+) (int64, error) {
+	if batch < 1 {
+		batch = 1000
+	}
+	var stmt string
+	switch {
+	case cfg.mysqlFamily():
+		stmt = internal.MysqlPurge(batch)
+	case "sqlite3" == cfg.dialect():
+		stmt = internal.SqlitePurge(batch)
+	default:
+		return 0, errors.New("unsupported SQL dialect")
+	}
+	bound := formatStoredTime(before)
+	var total int64
+	for {
+		res, err := conn.ExecContext(ctx, stmt, bound)
+		if nil != err {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if nil != err {
+			return total, err
+		}
+		total += n
+		if n < int64(batch) {
+			return total, nil
+		}
+	}
+}
+
+// Purger periodically deletes rows older than the retention with
+// PurgeBefore, as configured by `RETENTION_DAYS`, `PURGE_INTERVAL` and
+// `PURGE_BATCH`.
+type Purger struct {
+	cfg       *DbConfig
+	conn      *sql.DB
+	retention time.Duration
+	batch     int
+	logger    utils.TaggedLogger
+	metrics   *internal.Counters
+	elector   *Elector
+}
+
+// NewPurger creates a purger of rows older than the retention.
+func NewPurger(
+	cfg *DbConfig, conn *sql.DB, retention time.Duration, batch int,
+	logger utils.TaggedLogger,
+) *Purger {
+	return &Purger{
+		cfg: cfg, conn: conn, retention: retention, batch: batch,
+		logger: logger,
+	}
+}
+
+func (p *Purger) instrument(metrics *internal.Counters) {
+	p.metrics = metrics
+}
+
+// SetElector makes Start purge only while the elector is the leader.
+func (p *Purger) SetElector(e *Elector) {
+	p.elector = e
+}
+
+// Purge deletes rows older than the retention now, returning the number of
+// rows deleted.
+func (p *Purger) Purge(ctx context.Context) (int64, error) {
+	n, err := PurgeBefore(ctx, p.cfg, p.conn, time.Now().Add(-p.retention),
+		p.batch)
+	if nil != p.metrics {
+		p.metrics.Add(uint64(n), MetricRowsPurged)
+	}
+	return n, err
+}
+
+// Start purges every `interval`, the first right away, until the given
+// channel is closed, which also cancels the purge in flight.
+func (p *Purger) Start(interval time.Duration, stopChan <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopChan
+		cancel()
+	}()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if nil == p.elector || p.elector.IsLeader() {
+				n, err := p.Purge(ctx)
+				if nil != err && !errors.Is(err, context.Canceled) {
+					p.logger.Errorf("Failed to purge expired rows: %v", err)
+				} else if n > 0 {
+					p.logger.Infof("Purged %d expired rows", n)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
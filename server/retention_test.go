@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_Purger_deletes_expired_rows_in_batches(t *testing.T) {
+	cfg, conn := setupDb(t)
+	now := time.Now()
+	for i, at := range []time.Time{
+		now.AddDate(0, 0, -40), now.AddDate(0, 0, -35),
+		now.AddDate(0, 0, -31), now.AddDate(0, 0, -29), now,
+	} {
+		_, err := conn.Exec(`INSERT INTO tx_log (id, req_hash, headers,
+			created_at) VALUES (?, ?, '', ?);`, []byte{byte(i)}, []byte{1},
+			formatStoredTime(at))
+		require.Nil(t, err)
+	}
+	p := NewPurger(cfg, conn, 30*24*time.Hour, 2, utils.NewLogger())
+	metrics := &internal.Counters{}
+	p.instrument(metrics)
+	n, err := p.Purge(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+	require.Equal(t, uint64(3), metrics.Get(MetricRowsPurged))
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log`).Scan(&count))
+	require.Equal(t, 2, count)
+	n, err = p.Purge(context.Background())
+	require.Nil(t, err)
+	require.Zero(t, n)
+}
+
+func Test_PurgeBefore_rejects_unsupported_dialect(t *testing.T) {
+	_, err := PurgeBefore(context.Background(), &DbConfig{Dialect: "pg"}, nil,
+		time.Now(), 0)
+	require.EqualError(t, err, "unsupported SQL dialect")
+}
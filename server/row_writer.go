@@ -0,0 +1,500 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eidng8/go-db"
+	"github.com/eidng8/go-utils"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// RowWriter is a db.CachedWriter inserting each record with its own
+// statement, all records of a batch in one transaction. It suits proxies,
+// such as Vitess and ProxySQL, that can't handle very long statements.
+// Unlike db.MemCachedWriter, DB calls are made with the context set by
+// SetContext, and each flush is bound by the timeout set by SetFlushTimeout.
+type RowWriter struct {
+	db        *sql.DB
+	dataCache []any
+	cacheMu   sync.Mutex
+	// serializes flushes, so a flush waits for the one in flight
+	writeMu    sync.Mutex
+	maxRetries int
+	interval   time.Duration
+	// delay before the first retry of a flush, doubled with each retry
+	backoff   time.Duration
+	failedLog io.Writer
+	paused    int32
+	logger    utils.TaggedLogger
+	builder   db.SqlBuilderFunc
+	// whether a chunk of records is inserted in one multi-value statement
+	multiRow bool
+	ctx      context.Context
+	// maximum duration of each flush, including retries, 0 means unlimited
+	timeout time.Duration
+	// options of insert transactions, nil to use the driver's defaults
+	txOpts *sql.TxOptions
+	// whether each record is inserted under its own savepoint
+	savepoints bool
+	// sequence number of flushes
+	flushes atomic.Uint64
+	// Optional, called with records committed
+	persisted atomic.Pointer[func([]TxRecord)]
+	// Optional, receives statements instead of the DB, see SetDryRun
+	dryRun func(query string, args []any)
+	// Optional, counts inserted and failed records
+	metrics *internal.Counters
+}
+
+// NewRowWriter creates a RowWriter with the builder used for MemCachedWriter,
+// which is called with one record at a time.
+func NewRowWriter(
+	conn *sql.DB, builder db.SqlBuilderFunc, logger utils.TaggedLogger,
+) *RowWriter {
+	return &RowWriter{
+		db:         conn,
+		maxRetries: 3,
+		interval:   time.Second,
+		logger:     logger,
+		builder:    builder,
+		ctx:        context.Background(),
+	}
+}
+
+// NewBatchWriter creates a RowWriter inserting each chunk of records in one
+// multi-value statement, like db.MemCachedWriter does.
+func NewBatchWriter(
+	conn *sql.DB, builder db.SqlBuilderFunc, logger utils.TaggedLogger,
+) *RowWriter {
+	w := NewRowWriter(conn, builder, logger)
+	w.multiRow = true
+	return w
+}
+
+// OnPersisted sets the function called with records once they're committed,
+// on the flushing goroutine.
+func (w *RowWriter) OnPersisted(fn func([]TxRecord)) {
+	w.persisted.Store(&fn)
+}
+
+func (w *RowWriter) notifyPersisted(data []any, refused []FailedRecord) {
+	if fn := w.persisted.Load(); nil != fn {
+		(*fn)(persistedRecords(data, refused))
+	}
+}
+
+func (w *RowWriter) instrument(metrics *internal.Counters) {
+	w.metrics = metrics
+}
+
+func (w *RowWriter) SetLogger(log utils.TaggedLogger) {
+	w.logger = log
+}
+
+func (w *RowWriter) SetDB(conn *sql.DB) {
+	w.cacheMu.Lock()
+	defer w.cacheMu.Unlock()
+	w.db = conn
+}
+
+func (w *RowWriter) SetRetries(numRetries int) {
+	w.maxRetries = numRetries
+}
+
+func (w *RowWriter) SetInterval(duration time.Duration) {
+	w.interval = duration
+}
+
+// SetBackoff sets the delay before the first retry of a flush, which is doubled
+// with each retry up to 30 seconds, plus up to as much random jitter. Flushes
+// are retried right away if it's not positive.
+func (w *RowWriter) SetBackoff(delay time.Duration) {
+	w.backoff = delay
+}
+
+func (w *RowWriter) SetFailedLog(log io.Writer) {
+	w.failedLog = log
+}
+
+// SetContext sets the context of DB calls, cancelling it aborts in-flight
+// inserts, whose records are then written to the failed log.
+func (w *RowWriter) SetContext(ctx context.Context) {
+	w.ctx = ctx
+}
+
+// SetFlushTimeout sets the maximum duration of each flush, including retries.
+func (w *RowWriter) SetFlushTimeout(timeout time.Duration) {
+	w.timeout = timeout
+}
+
+// SetIsolation sets the isolation level of insert transactions.
+func (w *RowWriter) SetIsolation(level sql.IsolationLevel) {
+	w.txOpts = &sql.TxOptions{Isolation: level}
+}
+
+// SetSavepoints inserts each record with its own statement under a savepoint,
+// even with NewBatchWriter. A record refused by the DB, such as one too long
+// for strict-mode MySQL, is rolled back to its savepoint and written to the
+// failed log, while the rest of the batch is committed.
+func (w *RowWriter) SetSavepoints(enabled bool) {
+	w.savepoints = enabled
+}
+
+// SetDryRun builds statements as usual, but gives them to the function instead
+// of sending them to the DB, nil to disable. Records are then neither retried
+// nor reported by OnPersisted, since nothing is persisted.
+func (w *RowWriter) SetDryRun(fn func(query string, args []any)) {
+	w.dryRun = fn
+}
+
+// Pause stops flushing, waiting for the flush in flight.
+func (w *RowWriter) Pause() {
+	atomic.StoreInt32(&w.paused, 1)
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+}
+
+func (w *RowWriter) Resume() {
+	atomic.StoreInt32(&w.paused, 0)
+}
+
+func (w *RowWriter) Push(data any) {
+	w.cacheMu.Lock()
+	defer w.cacheMu.Unlock()
+	w.dataCache = append(w.dataCache, data)
+}
+
+// Write inserts all cached records, in transactions of up to 1000 records.
+func (w *RowWriter) Write() {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if 1 == atomic.LoadInt32(&w.paused) {
+		return
+	}
+	w.cacheMu.Lock()
+	conn := w.db
+	cached := w.dataCache
+	w.dataCache = nil
+	w.cacheMu.Unlock()
+	if len(cached) < 1 {
+		return
+	}
+	batch := w.flushes.Add(1)
+	ctx, cancel := w.flushContext()
+	defer cancel()
+	var todo []any
+	var err error
+	for i := 0; i < w.maxRetries; i++ {
+		todo, cached = cached, nil
+		for data := range slices.Chunk(todo, 1000) {
+			if e := w.insert(ctx, conn, data, batch); nil != e {
+				w.logger.Errorf("Error writing db: %v\n", e)
+				// bad records dropped by the builder aren't retried
+				for _, rec := range data {
+					if nil != rec {
+						cached = append(cached, rec)
+					}
+				}
+				err = e
+			}
+		}
+		// no point retrying once the flush is cancelled or timed out
+		if len(cached) < 1 || i+1 >= w.maxRetries || !w.waitRetry(ctx, i) {
+			break
+		}
+	}
+	if len(cached) > 0 {
+		w.logFailed(cached, err, batch)
+	}
+}
+
+// maximum delay between retries of a flush, before jitter
+const maxRetryBackoff = 30 * time.Second
+
+// waitRetry waits out the backoff after the given attempt, returning false if
+// the context is done meanwhile.
+func (w *RowWriter) waitRetry(ctx context.Context, attempt int) bool {
+	if w.backoff <= 0 {
+		return nil == ctx.Err()
+	}
+	delay := w.backoff
+	for range attempt {
+		delay = min(2*delay, maxRetryBackoff)
+	}
+	timer := time.NewTimer(delay + rand.N(delay))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Pending returns the number of cached records, including those of the flush
+// in flight, which is waited for.
+func (w *RowWriter) Pending() int {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	w.cacheMu.Lock()
+	defer w.cacheMu.Unlock()
+	return len(w.dataCache)
+}
+
+// Backlog returns the number and estimated bytes of cached records, without
+// those of the flush in flight.
+func (w *RowWriter) Backlog() (int, int64) {
+	w.cacheMu.Lock()
+	defer w.cacheMu.Unlock()
+	return backlog(w.dataCache)
+}
+
+// FailPending writes cached records to the failed log, as failed due to the
+// given cause, and returns their number.
+func (w *RowWriter) FailPending(cause error) int {
+	w.cacheMu.Lock()
+	cached := w.dataCache
+	w.dataCache = nil
+	w.cacheMu.Unlock()
+	if len(cached) > 0 {
+		w.logFailed(cached, cause, w.flushes.Add(1))
+	}
+	return len(cached)
+}
+
+func (w *RowWriter) Start(stopChan <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.Write()
+			case <-stopChan:
+				w.Write()
+				return
+			}
+		}
+	}()
+}
+
+func (w *RowWriter) flushContext() (context.Context, context.CancelFunc) {
+	if w.timeout <= 0 {
+		return context.WithCancel(w.ctx)
+	}
+	return context.WithTimeout(w.ctx, w.timeout)
+}
+
+func (w *RowWriter) insert(
+	ctx context.Context, conn *sql.DB, data []any, batch uint64,
+) error {
+	if nil != w.dryRun {
+		w.buildDry(data)
+		for _, rec := range data {
+			markStage(rec, StagePersist)
+		}
+		return nil
+	}
+	var refused []FailedRecord
+	err := transaction(ctx, conn, w.txOpts, func(tx *sql.Tx) error {
+		refused = nil
+		if w.multiRow && !w.savepoints {
+			return w.exec(ctx, tx, data)
+		}
+		for i := range data {
+			// the builder drops bad records from the data in place
+			rec := data[i : i+1]
+			if !w.savepoints {
+				if err := w.exec(ctx, tx, rec); nil != err {
+					return err
+				}
+				continue
+			}
+			r, err := w.execSavepoint(ctx, tx, rec)
+			if nil != err {
+				return err
+			}
+			if nil != r {
+				refused = append(refused, *r)
+			}
+		}
+		return nil
+	})
+	if nil != err {
+		return err
+	}
+	w.metrics.Add(uint64(len(data)-len(refused)), MetricRowsInserted)
+	w.metrics.Add(uint64(len(refused)), MetricInsertFailures)
+	for _, f := range refused {
+		f.Attempt, f.Batch = 1, batch
+		w.writeFailed(f)
+		f.Record.Trace.drop()
+	}
+	for _, rec := range data {
+		markStage(rec, StagePersist)
+	}
+	w.notifyPersisted(data, refused)
+	return nil
+}
+
+// execSavepoint inserts the record under a savepoint. It returns the failed
+// record if the DB refused it, or an error if the transaction can't go on.
+func (w *RowWriter) execSavepoint(
+	ctx context.Context, tx *sql.Tx, data []any,
+) (*FailedRecord, error) {
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT rec;"); nil != err {
+		return nil, err
+	}
+	err := w.exec(ctx, tx, data)
+	if nil == err {
+		//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+		_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT rec;")
+		return nil, err
+	}
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	if _, e := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT rec;"); nil != e {
+		return nil, fmt.Errorf("%w; %w", err, e)
+	}
+	w.logger.Errorf("Record refused by db: %v\n", err)
+	rec, _ := data[0].(TxRecord)
+	f := failRecord(FailDb, err, rec)
+	return &f, nil
+}
+
+// buildDry builds the statements the records would be inserted with, giving
+// them to the dry run function.
+func (w *RowWriter) buildDry(data []any) {
+	chunks := [][]any{data}
+	if !w.multiRow || w.savepoints {
+		chunks = make([][]any, len(data))
+		for i, rec := range data {
+			chunks[i] = []any{rec}
+		}
+	}
+	for _, chunk := range chunks {
+		if query, args := w.builder(chunk); "" != query {
+			w.dryRun(query, args)
+		}
+	}
+}
+
+func (w *RowWriter) exec(ctx context.Context, tx *sql.Tx, data []any) error {
+	query, args := w.builder(data)
+	if "" == query {
+		// the builder has logged the failed records
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Persist inserts the records right away in one transaction, bypassing the
+// cache, and returns once it's committed. Unlike Write, it doesn't retry, and
+// returns errors instead of logging the records as failed.
+func (w *RowWriter) Persist(ctx context.Context, data ...any) error {
+	if nil != w.dryRun {
+		w.buildDry(data)
+		return nil
+	}
+	w.cacheMu.Lock()
+	conn := w.db
+	w.cacheMu.Unlock()
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+	err := transaction(ctx, conn, w.txOpts, func(tx *sql.Tx) error {
+		query, args := w.builder(data)
+		if "" == query {
+			return ErrNotPersisted
+		}
+		_, err := tx.ExecContext(ctx, query, args...)
+		return err
+	})
+	if nil == err {
+		w.notifyPersisted(data, nil)
+	}
+	return err
+}
+
+// transaction works like db.Transaction, with the given context and options.
+func transaction(
+	ctx context.Context, conn *sql.DB, opts *sql.TxOptions,
+	fn func(tx *sql.Tx) error,
+) error {
+	tx, err := conn.BeginTx(ctx, opts)
+	if nil != err {
+		return err
+	}
+	if err = fn(tx); nil != err {
+		if er := tx.Rollback(); nil != er && !errors.Is(er, sql.ErrTxDone) {
+			return fmt.Errorf("%w; %w", err, er)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// logFailed writes a FailedRecord for each record the DB refused.
+func (w *RowWriter) logFailed(failed []any, cause error, batch uint64) {
+	w.metrics.Add(uint64(len(failed)), MetricInsertFailures)
+	if nil == w.failedLog {
+		return
+	}
+	for _, data := range failed {
+		rec, _ := data.(TxRecord)
+		f := failRecord(FailDb, cause, rec)
+		f.Attempt, f.Batch = w.maxRetries, batch
+		if !w.writeFailed(f) {
+			return
+		}
+	}
+}
+
+// writeFailed writes the record to the failed log, returning whether it's
+// written.
+func (w *RowWriter) writeFailed(f FailedRecord) bool {
+	if nil == w.failedLog {
+		return false
+	}
+	if err := writeFailedRecord(w.failedLog, f); nil != err {
+		w.logger.Errorf("Error writing failed data log: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// PersistTx inserts the records in the given transaction, which is committed
+// or rolled back by the caller. Records are neither retried nor reported by
+// OnPersisted.
+func (w *RowWriter) PersistTx(
+	ctx context.Context, tx *sql.Tx, data ...any,
+) error {
+	if nil != w.dryRun {
+		w.buildDry(data)
+		return nil
+	}
+	query, args := w.builder(data)
+	if "" == query {
+		return ErrNotPersisted
+	}
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+// ErrNotPersisted is returned by Persist for records the builder rejected.
+var ErrNotPersisted = errors.New("record not persisted")
+
+var _ db.CachedWriter = &RowWriter{}
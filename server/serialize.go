@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// SerializeWriter prepares records on a bounded pool of workers before handing
+// them to the wrapped writer, which then persists them as prepared. Fitting
+// records to their columns and encoding bodies don't run on the request
+// goroutines, nor again on the flush goroutine upon each retry. Records are
+// prepared inline if the queue is full.
+type SerializeWriter struct {
+	splitLoggedCachedWriter
+	opts *sqlOptions
+	pool *capturePool
+	mu   sync.Mutex
+	idle *sync.Cond
+	// number of records being prepared
+	preparing int
+}
+
+// NewSerializeWriter wraps the given writer with the given number of workers
+// and queued records. The options must be those of the builder of the writer.
+func NewSerializeWriter(
+	writer splitLoggedCachedWriter, workers, queue int, options ...SqlOption,
+) *SerializeWriter {
+	w := &SerializeWriter{
+		splitLoggedCachedWriter: writer,
+		opts:                    newSqlOptions(options...),
+		pool:                    newCapturePool(workers, queue),
+	}
+	w.idle = sync.NewCond(&w.mu)
+	return w
+}
+
+func (w *SerializeWriter) instrument(metrics *internal.Counters) {
+	if i, ok := w.splitLoggedCachedWriter.(instrumented); ok {
+		i.instrument(metrics)
+	}
+}
+
+// Pending returns the number of records being prepared, and those held by
+// the wrapped writer if it reports them.
+func (w *SerializeWriter) Pending() int {
+	w.mu.Lock()
+	n := w.preparing
+	w.mu.Unlock()
+	if pw, ok := w.splitLoggedCachedWriter.(pendingWriter); ok {
+		n += pw.Pending()
+	}
+	return n
+}
+
+// Backlog returns the backlog of the wrapped writer if it reports one, not
+// including records being prepared.
+func (w *SerializeWriter) Backlog() (int, int64) {
+	if bw, ok := w.splitLoggedCachedWriter.(backlogWriter); ok {
+		return bw.Backlog()
+	}
+	return 0, 0
+}
+
+// FailPending has the wrapped writer write its pending records to the failed
+// log, if it supports. Records being prepared are not waited for.
+func (w *SerializeWriter) FailPending(cause error) int {
+	if pw, ok := w.splitLoggedCachedWriter.(pendingWriter); ok {
+		return pw.FailPending(cause)
+	}
+	return 0
+}
+
+// Push queues the record to be prepared, and pushes it to the wrapped writer
+// afterwards.
+func (w *SerializeWriter) Push(data any) {
+	rec, ok := data.(TxRecord)
+	if !ok {
+		w.splitLoggedCachedWriter.Push(data)
+		return
+	}
+	w.mu.Lock()
+	w.preparing++
+	w.mu.Unlock()
+	w.pool.submit(func() {
+		rec = w.opts.prepare(rec)
+		rec.Trace.mark(StageTransform)
+		w.splitLoggedCachedWriter.Push(rec)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.preparing--; 0 == w.preparing {
+			w.idle.Broadcast()
+		}
+	})
+}
+
+// Write waits for records being prepared, then flushes the wrapped writer.
+func (w *SerializeWriter) Write() {
+	w.mu.Lock()
+	for w.preparing > 0 {
+		w.idle.Wait()
+	}
+	w.mu.Unlock()
+	w.splitLoggedCachedWriter.Write()
+}
+
+// Persist prepares the records inline, and persists them right away with the
+// wrapped writer.
+func (w *SerializeWriter) Persist(ctx context.Context, data ...any) error {
+	p, ok := w.splitLoggedCachedWriter.(persister)
+	if !ok {
+		return ErrNoPersist
+	}
+	return p.Persist(ctx, w.prepareAll(data)...)
+}
+
+// PersistTx prepares the records inline, and inserts them in the given
+// transaction with the wrapped writer.
+func (w *SerializeWriter) PersistTx(
+	ctx context.Context, tx *sql.Tx, data ...any,
+) error {
+	p, ok := w.splitLoggedCachedWriter.(txPersister)
+	if !ok {
+		return ErrNoPersist
+	}
+	return p.PersistTx(ctx, tx, w.prepareAll(data)...)
+}
+
+func (w *SerializeWriter) prepareAll(data []any) []any {
+	prepared := make([]any, len(data))
+	for i, d := range data {
+		if rec, ok := d.(TxRecord); ok {
+			d = w.opts.prepare(rec)
+		}
+		prepared[i] = d
+	}
+	return prepared
+}
+
+// OnPersisted sets the function called with records once they're committed,
+// if the wrapped writer reports them.
+func (w *SerializeWriter) OnPersisted(fn func([]TxRecord)) {
+	if n, ok := w.splitLoggedCachedWriter.(persistNotifier); ok {
+		n.OnPersisted(fn)
+	}
+}
+
+// Close waits for queued records, and stops the workers. Records pushed
+// afterwards are prepared inline.
+func (w *SerializeWriter) Close() {
+	w.pool.close()
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SerializeWriter_prepares_records_before_push(t *testing.T) {
+	inner := &mockCachedWriter{}
+	codec, _ := LookupCodec(CodecZstd)
+	w := NewSerializeWriter(inner, 2, 4, WithBodyCodec(codec))
+	defer w.Close()
+	body := bytes.Repeat([]byte(`{"id":1,"status":"ok"}`), 50)
+	for i := range 10 {
+		w.Push(TxRecord{
+			Request: fmt.Sprintf("GET /%d", i), Body: body, At: time.Now(),
+		})
+	}
+	w.Push(TxRecord{Request: "GET /x", Body: []byte("x"), At: time.Now()})
+	w.Write()
+	require.Len(t, inner.records, 11)
+	var records []any
+	for _, rec := range inner.records {
+		records = append(records, rec)
+		if "GET /x" == rec.Request {
+			require.Equal(t, CodecIdentity, rec.BodyCodec)
+			continue
+		}
+		require.Equal(t, CodecZstd, rec.BodyCodec)
+		decoded, err := DecodeBody(rec.BodyCodec, rec.Body)
+		require.Nil(t, err)
+		require.Equal(t, body, decoded)
+	}
+	// prepared records are persisted as is, without encoding them again
+	_, args := SqlBuilder(utils.NewLogger(), &mockWriter{})(records)
+	for i, rec := range inner.records {
+		idx := i * numColumns
+		require.Equal(t, rec.Body, args[idx+3].(sql.Null[[]byte]).V)
+		require.Equal(t, CodecIdentity != rec.BodyCodec,
+			args[idx+12].(sql.Null[string]).Valid)
+	}
+}
+
+func Test_SerializeWriter_fits_records_before_encoding(t *testing.T) {
+	inner := &mockCachedWriter{}
+	codec, _ := LookupCodec(CodecGzip)
+	w := NewSerializeWriter(inner, 1, 1, WithBodyCodec(codec),
+		WithColumnLimits(0, 64, true))
+	defer w.Close()
+	w.Push(TxRecord{
+		Request: "GET /a", Body: bytes.Repeat([]byte("a"), 128),
+		At: time.Now(),
+	})
+	w.Write()
+	require.Len(t, inner.records, 1)
+	rec := inner.records[0]
+	require.Equal(t, true, rec.Attributes["body_truncated"])
+	require.Equal(t, 128, rec.Attributes["body_size"])
+	decoded, err := DecodeBody(rec.BodyCodec, rec.Body)
+	require.Nil(t, err)
+	require.Len(t, decoded, 64)
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -32,12 +33,50 @@ var (
 	writeResponseHeaders = writeResHeaders
 )
 
+const (
+	// AccessLogText uses gin's default text access log.
+	AccessLogText = "text"
+	// AccessLogJson emits one JSON object per request to stdout.
+	AccessLogJson = "json"
+)
+
 // Server is a struct that contains necessary instances.
 type Server struct {
 	Engine *gin.Engine
 	Server *http.Server
-	Writer db.CachedWriter
+	Writer Sink
 	Logger utils.TaggedLogger
+	Conf   *Config
+	// Optional, records admin actions guarded by Audited
+	Audit *Auditor
+	// Optional, elects the replica running background jobs, set by
+	// DefaultServer if `LEADER_LOCK` is set, to be passed to Consumer
+	Elector *Elector
+	// hooks run upon SignalReload
+	reloadHooks []func()
+	// hooks run upon Alert
+	alertHooks []func(Alert)
+	// consumers of persisted records, see Subscribe
+	subscribers []func(TxRecord)
+	// hooks run upon Shutdown, such as closing other listeners
+	shutdownHooks []func() error
+	hooksMu       sync.Mutex
+	pool          *internal.BufferPool
+	capture       *capturePool
+	metrics       *internal.Counters
+	partner       *partnerLabels
+	// cancels the context of DB calls made by the writer
+	cancelWrites context.CancelFunc
+	// Optional, records connections rejected before reaching handlers
+	forensics *Forensics
+	// Optional, estimates distinct `req_hash` values
+	cardinality *CardinalityTracker
+	// routes of SyncRoutes, keyed by method and full path
+	syncRoutes map[string]bool
+	// maximum latency keyed by `METHOD /full/:path`, see LatencySlos
+	slos map[string]time.Duration
+	// describes the running code, see BuildInfo
+	build BuildInfo
 }
 
 type Config struct {
@@ -47,87 +86,687 @@ type Config struct {
 	DbLogFile string
 	// permission of log files to be created
 	FilePerm os.FileMode
+	// size beyond which log files are rotated, 0 to never rotate
+	LogFileMaxBytes int64
 	// signals to listen for graceful shutdown
 	TermSignals []os.Signal
+	// actions taken upon signals, signals mapped to `shutdown` replace
+	// TermSignals
+	Signals map[os.Signal]string
 	// address to listen on
 	ListenAddr string
 	// whether to log debug info
 	DebugLog bool
+	// access log format, either `text` (default) or `json`
+	AccessLog string
+	// where the access log is written, defaults to stdout
+	AccessLogOutput io.Writer
+	// capacity tiers of pooled response capture buffers
+	ResponseBufferTiers []int
+	// maximum bytes of response body to keep, 0 means unlimited
+	MaxResponseBuffer int
+	// number of workers capturing records off the request goroutines, 0 to
+	// capture on the request goroutines
+	CaptureWorkers int
+	// number of capture jobs queued before running them inline
+	CaptureQueue int
+	// algorithm of `req_hash`, either `xxh64` (default) or `xxh3-128`
+	HashAlgorithm string
+	// header of the partner ID, which is persisted and labels request
+	// metrics, disabled if empty
+	PartnerHeader string
+	// maximum number of distinct partners, others are labeled `other`
+	PartnerMaxValues int
+	// path of the readiness probe, not registered if empty
+	ReadyPath string
+	// path responding the BuildInfo, such as `/version`, not registered if
+	// empty
+	VersionPath string
+	// Optional, path of the routes querying persisted records served by
+	// DefaultServer, see LogsHandler. AdminKeys are required.
+	LogsPath string
+	// whether LogRecordHandler returns bodies to keys of LogsBodyScope, as
+	// bodies may carry personal data
+	LogsBodies bool
+	// path serving Metrics in the Prometheus text format, such as `/metrics`,
+	// not registered if empty. AdminKeys are required by Validate, and a
+	// viewer key by the route.
+	MetricsPath string
+	// consecutive failed flushes tolerated before not being ready, 0 to
+	// ignore failures
+	ReadyMaxFailures int
+	// pending bytes tolerated before not being ready, 0 to ignore backlog
+	ReadyMaxPendingBytes int64
+	// keys granted access to admin endpoints guarded by RequireScope
+	AdminKeys []AdminKey
+	// requests not to be persisted, such as health checks
+	Suppress []SuppressRule
+	// paths of requests not to be persisted, checked before anything is
+	// captured
+	SkipPaths *PathFilter
+	// fraction of requests persisted, within 0.0 to 1.0, both 0 and 1 persist
+	// all requests. Each request is sampled once, its request and response
+	// records are kept or dropped together.
+	SampleRate float64
+	// Optional, rules deciding which responses are persisted once their
+	// handlers return, see Policy
+	Policy *Policy
+	// Optional, filters headers of response records, e.g. removing
+	// `Set-Cookie`
+	ResponseHeaders *HeaderFilter
+	// whether values of cookies are removed from persisted headers, keeping
+	// their names
+	ScrubCookies bool
+	// Optional, HMAC key of fingerprints replacing Authorization credentials
+	// in persisted headers, so traffic can be grouped by caller. The
+	// fingerprint is also kept in the `auth_fingerprint` attribute.
+	AuthFingerprintKey []byte
+	// Optional, masks sensitive header values of request and response
+	// records, see ParseRedactor and DefaultRedactedHeaders
+	Redact *Redactor
+	// bytes received kept for each connection recorded in `tx_raw_error`
+	ForensicsMaxBytes int
+	// whether requests matching no route are marked in their response
+	// records, see Unmatched
+	MarkUnmatched bool
+	// whether requests matching a route of other methods are responded 405,
+	// instead of 404
+	HandleNoMethod bool
+	// length of each slot of the rolling window of distinct `req_hash`
+	// values, disabled if 0, see CardinalityTracker
+	CardinalityWindow time.Duration
+	// number of slots of the rolling window
+	CardinalitySlots int
+	// factor of rise of distinct `req_hash` values raising an Alert, 0 to
+	// disable alerts
+	CardinalitySpike float64
+	// distinct values in a slot tolerated regardless of the rise
+	CardinalityFloor uint64
+	// whether TLS clients are fingerprinted, in the `ja3` and `ja4` attributes
+	// of request records, see TLSFingerprintListener
+	TLSFingerprint bool
+	// whether HTTP/3 is also served on the UDP port of ListenAddr, which
+	// requires RegisterHTTP3 and TLSConfig of the http.Server
+	HTTP3 bool
+	// Optional, TCP address of the gRPC service other services push records
+	// to, which requires AdminKeys, see ServeIngest
+	GrpcListen string
+	// Optional, paths of the PEM encoded certificate and key served over TLS
+	// by DefaultServer, see CertReloader
+	TLSCert, TLSKey string
+	// interval of checking TLSCert and TLSKey for changes, 0 to reload them
+	// only upon SignalReload
+	TLSReloadInterval time.Duration
+	// whether request bodies are captured as handlers read them, instead of
+	// being read up front, so streamed uploads stay streamed. Bytes not read
+	// by handlers are not persisted. The request record is pushed once the
+	// body is read through or closed, or else once the handlers return.
+	LazyRequestBody bool
+	// maximum bytes captured of each request, of its request line, request
+	// headers, request body and response body together, 0 means unlimited.
+	// Bodies beyond it are truncated, and their records are flagged with the
+	// `capture_truncated` attribute. Headers are counted but never truncated.
+	MaxCaptureBytes int
+	// maximum bytes kept of each request body and response body, 0 means
+	// unlimited. Bodies beyond it are truncated, or removed if
+	// SkipOversizedBody is set, and their records are flagged with the
+	// `body_truncated` attribute, which is always `true`, along with the
+	// original size in `body_size` if it's known. Responses are kept up to
+	// the lower of it and MaxResponseBuffer.
+	MaxBodyBytes int
+	// whether bodies beyond MaxBodyBytes are removed, instead of truncated
+	SkipOversizedBody bool
+	// number of workers preparing records before they're cached by the
+	// writer, 0 to prepare them upon flush, see SerializeWriter
+	SerializeWorkers int
+	// number of records queued to be prepared before preparing them inline
+	SerializeQueue int
+	// whether records are traced through the pipeline, observing
+	// MetricStageLatency, see Trace
+	TraceStages bool
+	// routes whose request records are persisted before their handlers run,
+	// in the form of `METHOD /full/:path` as registered, `*` for any method,
+	// see SyncPersist
+	SyncRoutes []string
+	// latency objectives of routes, whose violations are flagged and counted
+	// by MetricSloViolations
+	LatencySlos []LatencySlo
+	// whether SLO violations raise an Alert of kind "slo"
+	SloAlert bool
+	// maximum duration of persisting records of SyncRoutes, 0 means
+	// unlimited
+	SyncTimeout time.Duration
+	// maximum duration of Shutdown, including draining the writer, defaults
+	// to 10 seconds
+	ShutdownTimeout time.Duration
+	// number of attempts of each flush of the writer, 0 for 3
+	MaxRetries int
+	// delay before the first retry of a flush, doubled with each retry, see
+	// RowWriter.SetBackoff
+	RetryBackoff time.Duration
+	// interval of flushing cached records, 0 for 1 second
+	FlushInterval time.Duration
+	// maximum random delay added to each flush interval
+	FlushJitter time.Duration
+	// maximum duration of flushing pending records upon stop, 0 for 10
+	// seconds
+	DrainTimeout time.Duration
+	// maximum estimated bytes of pending records, 0 means unlimited
+	MaxPendingBytes int64
+	// how records beyond MaxPendingBytes are handled, either `log` (default)
+	// or `drop`
+	OverflowPolicy string
+	// whether DefaultServer runs the whole pipeline, building statements,
+	// without writing anything to the DB, see RowWriter.SetDryRun. Statements
+	// are counted by MetricDryRunStatements, and logged as debug info. Admin
+	// actions are not audited, and rejected connections are not recorded.
+	DryRun bool
+	// Optional, path of the unix socket of the writer daemon shared by
+	// processes on the host, see RelaySink and ServeRelay
+	RelaySocket string
+	// number of records RelaySink holds while the daemon is not reachable
+	RelayQueue int
+	// days rows are kept in `tx_log` before DefaultServer purges them, 0 to
+	// keep them forever, see Purger
+	RetentionDays int
+	// interval of purging expired rows
+	PurgeInterval time.Duration
+	// maximum number of rows deleted by each statement of purging
+	PurgeBatch int
+	// Optional, name of the DB lock electing the replica running background
+	// jobs, such as purging, see Elector
+	LeaderLock string
+	// interval of electing the leader
+	LeaderInterval time.Duration
+	// Optional, the DB config to build dialect specific statements
+	Db *DbConfig
 }
 
+// DefaultConfigFromEnv reads config from env, panicking with the error of
+// ConfigFromEnv.
 func DefaultConfigFromEnv() *Config {
-	mode, err := utils.GetEnvUint32("LOG_FILE_MODE", 0644)
-	utils.PanicIfError(err)
-	debug, err := utils.GetEnvBool("LOG_DEBUG", false)
+	cfg, err := ConfigFromEnv()
 	utils.PanicIfError(err)
-	return &Config{
+	return cfg
+}
+
+// ConfigFromEnv reads config from env. It returns all problems found, of
+// unparsable variables and those found by Config.Validate, joined in one
+// error, along with the config read.
+func ConfigFromEnv() (*Config, error) {
+	r := &envReader{}
+	mode := envValue(r, "LOG_FILE_MODE", utils.GetEnvUint32, 0644)
+	maxLog := envValue(r, "LOG_FILE_MAX_BYTES", utils.GetEnvUint64, 0)
+	debug := envValue(r, "LOG_DEBUG", utils.GetEnvBool, false)
+	tiers := envValue(r, "RES_BUFFER_TIERS", utils.GetEnvUint32Csv,
+		[]uint32{4096, 65536, 1048576})
+	maxBuf := envValue(r, "RES_BUFFER_MAX", utils.GetEnvUint32, 0)
+	workers := envValue(r, "CAPTURE_WORKERS", utils.GetEnvUint16, 0)
+	queue := envValue(r, "CAPTURE_QUEUE", utils.GetEnvUint32, 1024)
+	partners := envValue(r, "PARTNER_MAX_VALUES", utils.GetEnvUint16, 100)
+	readyFailures := envValue(r, "READY_MAX_FAILURES", utils.GetEnvUint16, 3)
+	readyBytes := envValue(r, "READY_MAX_PENDING_BYTES", utils.GetEnvUint64,
+		0)
+	signals, err := ParseSignalActions(utils.GetEnvCsv("SIGNAL_ACTIONS",
+		[]string{"HUP:reload"}))
+	r.check("SIGNAL_ACTIONS", err)
+	adminKeys, err := ParseAdminKeys(utils.GetEnvCsv("ADMIN_KEYS", nil))
+	r.check("ADMIN_KEYS", err)
+	suppress, err := ParseSuppressRules(utils.GetEnvCsv("SUPPRESS_RULES", nil))
+	r.check("SUPPRESS_RULES", err)
+	skipPaths, err := ParsePathFilter(utils.GetEnvCsv("SKIP_PATHS", nil))
+	r.check("SKIP_PATHS", err)
+	scrubCookies := envValue(r, "SCRUB_COOKIES", utils.GetEnvBool, false)
+	redact, err := ParseRedactor(utils.GetEnvCsv("REDACT_HEADERS", nil),
+		utils.GetEnvCsv("REDACT_VALUES", nil))
+	r.check("REDACT_HEADERS, REDACT_VALUES", err)
+	forensicsBytes := envValue(r, "FORENSICS_MAX_BYTES", utils.GetEnvUint32,
+		4096)
+	markUnmatched := envValue(r, "MARK_UNMATCHED", utils.GetEnvBool, true)
+	noMethod := envValue(r, "HANDLE_NO_METHOD", utils.GetEnvBool, false)
+	cardWindow := envValue(r, "CARDINALITY_WINDOW", envDuration(time.Second),
+		0)
+	cardSlots := envValue(r, "CARDINALITY_SLOTS", utils.GetEnvUint16, 10)
+	cardSpike := envValue(r, "CARDINALITY_SPIKE", utils.GetEnvFloat64, 0)
+	cardFloor := envValue(r, "CARDINALITY_FLOOR", utils.GetEnvUint64, 100)
+	tlsFingerprint := envValue(r, "TLS_FINGERPRINT", utils.GetEnvBool,
+		false)
+	http3 := envValue(r, "HTTP3", utils.GetEnvBool, false)
+	tlsReload := envValue(r, "TLS_RELOAD_INTERVAL", envDuration(time.Second),
+		time.Minute)
+	lazyBody := envValue(r, "LAZY_REQUEST_BODY", utils.GetEnvBool, false)
+	maxCapture := envValue(r, "MAX_CAPTURE_BYTES", utils.GetEnvUint64, 0)
+	maxBody := envValue(r, "MAX_BODY_BYTES", utils.GetEnvUint64, 0)
+	skipOversized := envValue(r, "SKIP_OVERSIZED_BODY", utils.GetEnvBool,
+		false)
+	serializers := envValue(r, "SERIALIZE_WORKERS", utils.GetEnvUint16, 0)
+	serializeQueue := envValue(r, "SERIALIZE_QUEUE", utils.GetEnvUint32,
+		1024)
+	traceStages := envValue(r, "TRACE_STAGES", utils.GetEnvBool, false)
+	syncTimeout := envValue(r, "SYNC_TIMEOUT_MS",
+		envDuration(time.Millisecond), time.Second)
+	shutdownTimeout := envValue(r, "SHUTDOWN_TIMEOUT",
+		envDuration(time.Second), 10*time.Second)
+	dryRun := envValue(r, "DRY_RUN", utils.GetEnvBool, false)
+	retries := envValue(r, "MAX_RETRIES", utils.GetEnvUint8, 3)
+	flushInterval := envValue(r, "INTERVAL", envDuration(time.Second),
+		time.Second)
+	flushJitter := envValue(r, "INTERVAL_JITTER_MS",
+		envDuration(time.Millisecond), 0)
+	backoff := envValue(r, "RETRY_BACKOFF_MS", envDuration(time.Millisecond),
+		100*time.Millisecond)
+	drainTimeout := envValue(r, "DRAIN_TIMEOUT", envDuration(time.Second),
+		10*time.Second)
+	maxPending := envValue(r, "MAX_PENDING_BYTES", utils.GetEnvUint64,
+		256<<20)
+	slos, err := ParseLatencySlos(utils.GetEnvCsv("LATENCY_SLOS", nil))
+	r.check("LATENCY_SLOS", err)
+	sloAlert := envValue(r, "SLO_ALERT", utils.GetEnvBool, false)
+	sampleRate := envValue(r, "LOG_SAMPLE_RATE", utils.GetEnvFloat64, 1)
+	policy, err := ParsePolicy(utils.GetEnvWithDefault("LOG_POLICY", ""))
+	r.check("LOG_POLICY", err)
+	relayQueue := envValue(r, "RELAY_QUEUE", utils.GetEnvUint32, 10000)
+	logsBodies := envValue(r, "LOGS_BODIES", utils.GetEnvBool, false)
+	retention := envValue(r, "RETENTION_DAYS", utils.GetEnvUint16, 0)
+	purgeInterval := envValue(r, "PURGE_INTERVAL", envDuration(time.Second),
+		time.Hour)
+	purgeBatch := envValue(r, "PURGE_BATCH", utils.GetEnvUint32, 1000)
+	leaderInterval := envValue(r, "LEADER_INTERVAL",
+		envDuration(time.Second), 10*time.Second)
+	cfg := &Config{
 		RequestLogFile: utils.GetEnvWithDefault("REQ_FAILED_FILE",
 			"failed_req.log"),
 		DbLogFile: utils.GetEnvWithDefault("DB_FAILED_FILE",
 			"failed_db.log"),
-		FilePerm:    os.FileMode(mode),
-		TermSignals: []os.Signal{syscall.SIGINT, syscall.SIGTERM},
-		ListenAddr:  utils.GetEnvWithDefault("LISTEN", ":80"),
-		DebugLog:    debug,
+		FilePerm:        os.FileMode(mode),
+		LogFileMaxBytes: int64(maxLog),
+		TermSignals:     []os.Signal{syscall.SIGINT, syscall.SIGTERM},
+		Signals:         signals,
+		ListenAddr:      utils.GetEnvWithDefault("LISTEN", ":80"),
+		DebugLog:        debug,
+		AccessLog: utils.GetEnvWithDefault("ACCESS_LOG",
+			AccessLogText),
+		AccessLogOutput: os.Stdout,
+		ResponseBufferTiers: utils.SliceMapFunc[[]int](tiers,
+			func(v uint32) int { return int(v) }),
+		MaxResponseBuffer: int(maxBuf),
+		CaptureWorkers:    int(workers),
+		CaptureQueue:      int(queue),
+		HashAlgorithm: utils.GetEnvWithDefault("HASH_ALGO",
+			internal.HashXxh64),
+		PartnerHeader:        utils.GetEnvWithDefault("PARTNER_HEADER", ""),
+		PartnerMaxValues:     int(partners),
+		ReadyPath:            utils.GetEnvWithDefault("READY_PATH", ""),
+		VersionPath:          utils.GetEnvWithDefault("VERSION_PATH", ""),
+		LogsPath:             utils.GetEnvWithDefault("LOGS_PATH", ""),
+		LogsBodies:           logsBodies,
+		MetricsPath:          utils.GetEnvWithDefault("METRICS_PATH", ""),
+		ReadyMaxFailures:     int(readyFailures),
+		ReadyMaxPendingBytes: int64(readyBytes),
+		AdminKeys:            adminKeys,
+		Suppress:             suppress,
+		SkipPaths:            skipPaths,
+		SampleRate:           sampleRate,
+		Policy:               policy,
+		ResponseHeaders: NewHeaderFilter(
+			utils.GetEnvCsv("RES_HEADERS_ALLOW", nil),
+			utils.GetEnvCsv("RES_HEADERS_DENY", nil)),
+		ScrubCookies: scrubCookies,
+		AuthFingerprintKey: []byte(
+			utils.GetEnvWithDefault("AUTH_FINGERPRINT_KEY", "")),
+		Redact:            redact,
+		ForensicsMaxBytes: int(forensicsBytes),
+		MarkUnmatched:     markUnmatched,
+		HandleNoMethod:    noMethod,
+		CardinalityWindow: cardWindow,
+		CardinalitySlots:  int(cardSlots),
+		CardinalitySpike:  cardSpike,
+		CardinalityFloor:  cardFloor,
+		TLSFingerprint:    tlsFingerprint,
+		HTTP3:             http3,
+		GrpcListen:        utils.GetEnvWithDefault("GRPC_LISTEN", ""),
+		TLSCert:           utils.GetEnvWithDefault("TLS_CERT", ""),
+		TLSKey:            utils.GetEnvWithDefault("TLS_KEY", ""),
+		TLSReloadInterval: tlsReload,
+		LazyRequestBody:   lazyBody,
+		MaxCaptureBytes:   int(maxCapture),
+		MaxBodyBytes:      int(maxBody),
+		SkipOversizedBody: skipOversized,
+		SerializeWorkers:  int(serializers),
+		SerializeQueue:    int(serializeQueue),
+		TraceStages:       traceStages,
+		SyncRoutes:        utils.GetEnvCsv("SYNC_ROUTES", nil),
+		LatencySlos:       slos,
+		SloAlert:          sloAlert,
+		SyncTimeout:       syncTimeout,
+		ShutdownTimeout:   shutdownTimeout,
+		MaxRetries:        int(retries),
+		RetryBackoff:      backoff,
+		FlushInterval:     flushInterval,
+		FlushJitter:       flushJitter,
+		DrainTimeout:      drainTimeout,
+		MaxPendingBytes:   int64(maxPending),
+		OverflowPolicy: utils.GetEnvWithDefault("OVERFLOW_POLICY",
+			OverflowLog),
+		DryRun:         dryRun,
+		RelaySocket:    utils.GetEnvWithDefault("RELAY_SOCKET", ""),
+		RelayQueue:     int(relayQueue),
+		RetentionDays:  int(retention),
+		PurgeInterval:  purgeInterval,
+		PurgeBatch:     int(purgeBatch),
+		LeaderLock:     utils.GetEnvWithDefault("LEADER_LOCK", ""),
+		LeaderInterval: leaderInterval,
 	}
+	return cfg, errors.Join(r.err(), cfg.Validate())
 }
 
 // DefaultServer creates a new server with default configurations. It returns:
 // 1) the created Server struct; 2) a cleanup function that must be called in
 // the main loop; 3) the channel for graceful shutdown signals; and 4) the
-// channel to stop the CachedWriter goroutine.
+// channel to stop the CachedWriter goroutine. If `conn` is nil, the DB of
+// `cfg.Db` is connected with ConnectDBWithFallback, and watched while it's
+// unreachable.
 func DefaultServer(conn *sql.DB, cfg *Config) (
 	*Server, chan os.Signal, chan struct{}, func(),
 ) {
 	logger := createLogger(cfg)
+	hasher := internal.NewHasher(cfg.HashAlgorithm)
+	if nil == hasher {
+		logger.Panicf("Unsupported hash algorithm: %s", cfg.HashAlgorithm)
+	}
+	if nil != cfg.Db {
+		for _, path := range cfg.Db.BodyDicts {
+			_, err := LoadZstdDict(path)
+			utils.PanicIfError(err)
+		}
+		if _, ok := LookupCodec(cfg.Db.BodyCodec); !ok {
+			logger.Panicf("Unsupported body codec: %s", cfg.Db.BodyCodec)
+		}
+	}
 	// Prepare log files
-	dblog, err := os.OpenFile(cfg.DbLogFile,
-		os.O_CREATE|os.O_APPEND|os.O_WRONLY, cfg.FilePerm)
+	dblog, err := OpenLogFile(cfg.DbLogFile, cfg.FilePerm, cfg.LogFileMaxBytes)
 	utils.PanicIfError(err)
-	reqlog, err := os.OpenFile(cfg.RequestLogFile,
-		os.O_CREATE|os.O_APPEND|os.O_WRONLY, cfg.FilePerm)
+	reqlog, err := OpenLogFile(cfg.RequestLogFile, cfg.FilePerm,
+		cfg.LogFileMaxBytes)
 	utils.PanicIfError(err)
+	// Connect to the DB, or the spill store, whose dialect is used from then
+	dbcfg := cfg.Db
+	var fallback *Fallback
+	if nil == conn && nil != cfg.Db {
+		conn, fallback, err = ConnectDBWithFallback(cfg.Db)
+		utils.PanicIfError(err)
+		if nil != fallback {
+			logger.Errorf("DB is unreachable, writing to the spill store")
+			dbcfg = fallback.Config()
+		}
+	}
 	// Prepare graceful shutdown signals
 	stopChan := make(chan struct{})
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, cfg.TermSignals...)
+	signal.Notify(sigChan, cfg.termSignals()...)
+	if nil == fallback && nil != cfg.Db && cfg.Db.WarmupConns > 0 {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(),
+			cfg.Db.WarmupTimeout)
+		if err = WarmUp(ctx, cfg.Db, conn); nil != err {
+			logger.Errorf("Failed to warm up the DB: %v", err)
+		} else {
+			logger.Infof("Warmed up %d DB connections in %v",
+				cfg.Db.WarmupConns, time.Since(start))
+		}
+		cancel()
+	}
 	// Start the background writer
-	builder := SqlBuilder(logger, reqlog)
-	writer := NewCachedWriter(conn, builder, logger, dblog)
-	writer.Start(stopChan)
+	options := append(SqlOptions(cfg.Db), WithHasher(hasher))
+	var cardinality *CardinalityTracker
+	if cfg.CardinalityWindow > 0 {
+		cardinality = NewCardinalityTracker(cfg.CardinalityWindow,
+			cfg.CardinalitySlots)
+		options = append(options, WithCardinality(cardinality))
+	}
+	builder := BuilderFor(cfg.Db, logger, reqlog, options...)
+	inner := NewBatchWriter(conn, builder, logger)
+	if nil != cfg.Db && cfg.Db.SingleRowInserts {
+		inner = NewRowWriter(conn, builder, logger)
+	}
+	ctx, cancelWrites := context.WithCancel(context.Background())
+	inner.SetContext(ctx)
+	inner.SetBackoff(cfg.RetryBackoff)
+	if nil != cfg.Db {
+		inner.SetFlushTimeout(cfg.Db.FlushTimeout)
+		inner.SetSavepoints(cfg.Db.Savepoints)
+		if sql.LevelDefault != cfg.Db.Isolation {
+			inner.SetIsolation(cfg.Db.Isolation)
+		}
+	}
+	var wrapped splitLoggedCachedWriter = inner
+	var serializer *SerializeWriter
+	if cfg.SerializeWorkers > 0 {
+		serializer = NewSerializeWriter(inner, cfg.SerializeWorkers,
+			cfg.SerializeQueue, options...)
+		wrapped = serializer
+	}
+	writer := wrapWriter(wrapped, logger, dblog, cfg)
+	if nil != cfg.Db {
+		writer.SetBatchSize(cfg.Db.batchSize())
+	}
 	// Create the server
 	svr := http.Server{Addr: cfg.ListenAddr}
-	s := NewServer(&svr, writer, logger)
+	var certs *CertReloader
+	if "" != cfg.TLSCert {
+		certs, err = NewCertReloader(cfg.TLSCert, cfg.TLSKey, logger)
+		utils.PanicIfError(err)
+		svr.TLSConfig = certs.TLSConfig()
+	}
+	s := NewServer(&svr, writer, logger, cfg)
+	if cfg.DryRun {
+		logger.Infof("Dry run, records are not written to the DB")
+		inner.SetDryRun(s.countDryRun)
+	}
+	writer.Start(stopChan)
+	if nil != fallback {
+		go fallback.Watch(writer, logger, stopChan)
+	}
+	s.cancelWrites = cancelWrites
+	if nil != cardinality {
+		s.TrackCardinality(cardinality)
+	}
+	if nil != serializer {
+		s.onShutdown(func() error {
+			serializer.Close()
+			return nil
+		})
+	}
+	if nil != cfg.Db && cfg.Db.Meta && !cfg.DryRun {
+		err = StampMeta(context.Background(), conn, s.build)
+		if nil != err {
+			logger.Errorf("Failed to stamp tx_meta: %v", err)
+		}
+	}
+	if nil != cfg.Db && cfg.Db.Audit && !cfg.DryRun {
+		s.Audit = NewAuditor(conn)
+	}
+	if nil != cfg.Db && cfg.Db.RawErrors && !cfg.DryRun {
+		s.forensics = NewForensics(conn, logger, cfg.ForensicsMaxBytes)
+		s.forensics.Attach(&svr)
+		s.forensics.Start(stopChan)
+	}
+	if nil != certs {
+		if cfg.TLSReloadInterval > 0 {
+			certs.Watch(cfg.TLSReloadInterval, stopChan)
+		}
+		s.OnReload(func() {
+			if err := certs.Reload(); nil != err {
+				logger.Errorf("Failed to reload certificate: %v", err)
+			}
+		})
+	}
+	if "" != cfg.LogsPath {
+		err = s.ServeLogs(cfg.LogsPath, NewRecordStore(conn, cfg.LogsBodies))
+		utils.PanicIfError(err)
+	}
+	if "" != cfg.LeaderLock && nil != cfg.Db && !cfg.DryRun {
+		s.Elector = NewElector(dbcfg, conn, cfg.LeaderLock, logger)
+		s.Elector.Start(cfg.LeaderInterval, stopChan)
+	}
+	if cfg.RetentionDays > 0 && nil != cfg.Db && !cfg.DryRun {
+		purger := NewPurger(dbcfg, conn,
+			time.Duration(cfg.RetentionDays)*24*time.Hour, cfg.PurgeBatch,
+			logger)
+		purger.instrument(s.metrics)
+		if nil != s.Elector {
+			purger.SetElector(s.Elector)
+		}
+		purger.Start(cfg.PurgeInterval, stopChan)
+	}
+	s.OnReload(func() {
+		for _, f := range []*LogFile{dblog, reqlog} {
+			if err := f.Reopen(); nil != err {
+				logger.Errorf("Failed to reopen %s: %v", f.path, err)
+			}
+		}
+	})
+	s.watchSignals(stopChan)
 	cleanup := func() {
 		defer func() { utils.PanicIfError(conn.Close()) }()
+		if nil != fallback {
+			defer func() { utils.PanicIfError(fallback.DB().Close()) }()
+		}
 		defer func() { utils.PanicIfError(reqlog.Close()) }()
 		defer func() { utils.PanicIfError(dblog.Close()) }()
 	}
 	return s, sigChan, stopChan, cleanup
 }
 
+// NewServer creates a server persisting records with the given writer, which
+// is adapted by WriterSink.
 func NewServer(
 	svr *http.Server, writer db.CachedWriter, logger utils.TaggedLogger,
+	cfg *Config,
 ) *Server {
-	s := &Server{
-		Server: svr, Writer: writer, Logger: logger,
-	}
+	return NewSinkServer(svr, NewWriterSink(writer), logger, cfg)
+}
+
+// NewSinkServer creates a server delivering records to the given sink.
+func NewSinkServer(
+	svr *http.Server, sink Sink, logger utils.TaggedLogger, cfg *Config,
+) *Server {
+	return newSinkServer(svr, sink, logger, cfg, defaultMiddlewareOrder)
+}
+
+func newSinkServer(
+	svr *http.Server, sink Sink, logger utils.TaggedLogger, cfg *Config,
+	order []Middleware,
+) *Server {
+	s := newRecorder(sink, logger, cfg)
+	s.Server = svr
 	s.Engine = gin.New()
-	s.Engine.Use(s.RequestLogger(), gin.Logger(), gin.Recovery())
+	if nil != cfg && "" != cfg.ReadyPath {
+		// registered before middlewares, so probes are not persisted
+		s.Engine.GET(cfg.ReadyPath, s.ReadyHandler())
+	}
+	if nil != cfg && "" != cfg.VersionPath {
+		s.Engine.GET(cfg.VersionPath, s.VersionHandler())
+	}
+	if nil != cfg && "" != cfg.MetricsPath {
+		handlers := []gin.HandlerFunc{s.MetricsHandler()}
+		if len(cfg.AdminKeys) > 0 {
+			handlers = append([]gin.HandlerFunc{s.RequireScope(ScopeViewer)},
+				handlers...)
+		}
+		s.Engine.GET(cfg.MetricsPath, handlers...)
+	}
+	for _, m := range order {
+		s.Engine.Use(s.middleware(m))
+	}
+	s.markUnmatched()
 	svr.Handler = s.Engine
+	s.attachConnMeta(svr)
+	if nil != cfg && cfg.TLSFingerprint {
+		s.attachTLSFingerprint(svr)
+	}
+	return s
+}
+
+// newRecorder creates the server state of RequestLogger, delivering records to
+// the sink, without the HTTP server and engine.
+func newRecorder(sink Sink, logger utils.TaggedLogger, cfg *Config) *Server {
+	s := &Server{
+		Writer: sink, Logger: logger, Conf: cfg,
+		metrics: &internal.Counters{}, build: NewBuildInfo(cfg),
+	}
+	if nil != cfg && len(cfg.ResponseBufferTiers) > 0 {
+		s.pool = internal.NewBufferPool(cfg.ResponseBufferTiers)
+	}
+	if nil != cfg && cfg.CaptureWorkers > 0 {
+		s.capture = newCapturePool(cfg.CaptureWorkers, cfg.CaptureQueue)
+	}
+	if nil != cfg && len(cfg.SyncRoutes) > 0 {
+		s.syncRoutes = make(map[string]bool, len(cfg.SyncRoutes))
+		for _, r := range cfg.SyncRoutes {
+			method, path, _ := strings.Cut(strings.TrimSpace(r), " ")
+			s.syncRoutes[strings.ToUpper(method)+" "+
+				strings.TrimSpace(path)] = true
+		}
+	}
+	if nil != cfg && len(cfg.LatencySlos) > 0 {
+		s.slos = make(map[string]time.Duration, len(cfg.LatencySlos))
+		for _, slo := range cfg.LatencySlos {
+			s.slos[slo.Route] = slo.Max
+		}
+	}
+	if n, ok := s.writer().(persistNotifier); ok {
+		n.OnPersisted(s.emit)
+	}
+	if i, ok := s.writer().(instrumented); ok {
+		i.instrument(s.metrics)
+	}
+	if nil != cfg && "" != cfg.PartnerHeader {
+		s.partner = newPartnerLabels(cfg.PartnerHeader, cfg.PartnerMaxValues)
+	}
 	return s
 }
 
+// NewCachedWriter creates a CachedWriter of a batch writer, with the default
+// settings of the flushes, failing records to the given log.
 func NewCachedWriter(
 	sdb *sql.DB, builder func(params []any) (string, []any),
 	logger utils.TaggedLogger, log io.Writer,
-) *db.MemCachedWriter {
-	writer := db.NewMemCachedWriter(sdb, builder, logger)
-	retries := utils.ReturnOrPanic(utils.GetEnvUint8("MAX_RETRIES", 3))
-	writer.SetRetries(int(retries))
-	dur := utils.ReturnOrPanic(utils.GetEnvUint8("INTERVAL", 1))
-	writer.SetInterval(time.Duration(dur) * time.Second)
-	writer.SetFailedLog(log)
+) *CachedWriter {
+	return wrapWriter(NewBatchWriter(sdb, builder, logger), logger, log, nil)
+}
+
+type splitLoggedCachedWriter interface {
+	db.CachedWriter
+	db.SplitLoggedWriter
+}
+
+// wrapWriter configures the writer with the config, if given, and wraps it
+// in CachedWriter.
+func wrapWriter(
+	inner splitLoggedCachedWriter, logger utils.TaggedLogger, log io.Writer,
+	cfg *Config,
+) *CachedWriter {
+	writer := NewWriter(inner, logger)
+	inner.SetFailedLog(writer.FailedLog(log))
+	writer.SetOverflow(OverflowLog, log)
+	if nil == cfg {
+		return writer
+	}
+	if cfg.MaxRetries > 0 {
+		inner.SetRetries(cfg.MaxRetries)
+	}
+	if cfg.FlushInterval > 0 {
+		writer.SetInterval(cfg.FlushInterval)
+	}
+	writer.SetJitter(cfg.FlushJitter)
+	if cfg.DrainTimeout > 0 {
+		writer.SetDrainTimeout(cfg.DrainTimeout)
+	}
+	writer.SetMaxPendingBytes(cfg.MaxPendingBytes)
+	if "" != cfg.OverflowPolicy {
+		writer.SetOverflow(cfg.OverflowPolicy, log)
+	}
 	return writer
 }
 
@@ -135,62 +774,292 @@ func (s *Server) Config(fn func(*Server)) { fn(s) }
 
 func (s *Server) RequestLogger() func(gc *gin.Context) {
 	return func(gc *gin.Context) {
+		if s.skippedPath(gc) {
+			s.countPolicy(PolicyPathSkipped)
+			gc.Next()
+			return
+		}
+		if s.suppressed(gc) {
+			s.countPolicy(PolicySuppressed)
+			gc.Next()
+			return
+		}
+		if s.sampledOut() {
+			s.countPolicy(PolicySampledOut)
+			gc.Next()
+			return
+		}
+		start := time.Now()
 		var err error
-		var body []byte
+		var headers, body []byte
 		rlw := &internal.ResponseLogWriter{
-			Body:           bytes.NewBuffer(make([]byte, 0, 65536)),
+			Body: internal.NewCaptureBuffer(
+				s.pool, s.maxResponseBuffer()),
 			ResponseWriter: gc.Writer,
+			SkipPartial:    true,
 		}
 		gc.Writer = rlw
 		url := utils.RequestFullUrl(gc.Request)
 		method := gc.Request.Method
-		var sb strings.Builder
-		sb.Grow(len(url) + 10)
-		sb.WriteString(method)
-		sb.WriteString(" ")
-		sb.WriteString(url)
-		line := sb.String()
-		headers, err := dumpRequest(gc.Request, false)
-		if err != nil {
-			s.Logger.Errorf("Failed to read request headers: %v", err)
-			gc.AbortWithStatus(http.StatusBadRequest)
-			return
+		line := requestLine(method, url)
+		reqId, resId := s.newRecordId(), s.newRecordId()
+		txId := s.newRecordId()
+		if nil != s.Conf && AccessLogJson == s.Conf.AccessLog {
+			gc.Set(ctxKeyReqHash, s.reqHash(line))
+		}
+		gc.Set(ctxKeyReqId, reqId)
+		gc.Set(ctxKeyResId, resId)
+		gc.Set(ctxKeyTxId, txId)
+		var req *http.Request
+		var fp string
+		if nil == s.capture {
+			var dumped *http.Request
+			dumped, fp = s.sanitizeRequest(gc.Request)
+			headers, err = dumpRequest(dumped, false)
+			if err != nil {
+				s.Logger.Errorf("Failed to read request headers: %v", err)
+				dropRecordId(gc, ctxKeyReqId)
+				dropRecordId(gc, ctxKeyResId)
+				gc.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		} else {
+			req, fp = s.sanitizeSnapshot(snapshotRequest(gc.Request))
+		}
+		var partner string
+		if nil != s.partner {
+			partner = s.partner.label(gc.Request)
+		}
+		path := gc.Request.URL.Path
+		rec := TxRecord{
+			Id: reqId, Request: line, Headers: headers, Partner: partner,
+			Method: method, Path: path, TxId: txId,
+			Direction: DirectionRequest,
+		}
+		annotateConn(gc.Request, &rec)
+		if "" != fp {
+			rec.Attributes = map[string]any{"auth_fingerprint": fp}
 		}
-		if nil != gc.Request.Body {
+		if tfp, ok := s.tlsFingerprint(gc.Request); ok {
+			if nil == rec.Attributes {
+				rec.Attributes = make(map[string]any)
+			}
+			rec.Attributes["ja3"], rec.Attributes["ja4"] = tfp.JA3, tfp.JA4
+		}
+		budget := s.captureBudget(line, headers, gc.Request.Header)
+		rlw.Body.Budget = budget
+		// the request body is also bound by `MaxBodyBytes`
+		reqBudget := budget.Sub(s.maxBodyBytes())
+		var cr *captureReader
+		var truncated bool
+		continues := expectsContinue(gc.Request)
+		if nil != gc.Request.Body && (continues || s.lazyBody()) {
+			// read along with the handler, which may reject it unread
+			cr = &captureReader{
+				ReadCloser: gc.Request.Body, written: rlw.Written,
+				budget: reqBudget,
+			}
+			gc.Request.Body = cr
+		} else if nil != gc.Request.Body && nil != reqBudget {
+			body, truncated, err = readCapped(gc.Request, reqBudget)
+			if err != nil {
+				s.Logger.Errorf("Failed to read request body: %v", err)
+				rec.Body, rec.At, rec.ClientAborted = body, time.Now(), true
+				s.pushRequest(req, rec)
+				dropRecordId(gc, ctxKeyResId)
+				gc.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		} else if nil != gc.Request.Body {
 			body, err = readBody(gc.Request.Body)
 			if err != nil {
 				s.Logger.Errorf("Failed to read request body: %v", err)
+				// persist whatever was received before the client went away
+				rec.Body, rec.At, rec.ClientAborted = body, time.Now(), true
+				s.pushRequest(req, rec)
+				dropRecordId(gc, ctxKeyResId)
 				gc.AbortWithStatus(http.StatusBadRequest)
 				return
 			}
 			gc.Request.Body = io.NopCloser(bytes.NewBuffer(body))
 		}
-		s.Writer.Push(TxRecord{line, headers, body, time.Now()})
+		rec.Body, rec.At = body, time.Now()
+		if truncated {
+			if nil == rec.Attributes {
+				rec.Attributes = make(map[string]any)
+			}
+			key := truncationKey(reqBudget, budget)
+			rec.Attributes[key] = true
+			if "body_truncated" == key && s.Conf.SkipOversizedBody {
+				rec.Body = nil
+			}
+		}
+		pending := &pendingRequest{
+			rec: &rec, req: req, cr: cr, owner: &recordOwner{},
+			start: start, budget: budget, continues: continues,
+			skipOversized: nil != s.Conf && s.Conf.SkipOversizedBody,
+		}
+		rec.owner = pending.owner
+		gc.Set(ctxKeyPending, pending)
+		if s.syncRoute(gc) {
+			s.persistSync(gc, s.Conf.SyncTimeout)
+		}
+		if nil == cr {
+			// pushed before the handlers run, so it's kept even if they
+			// never return, unless it has just been persisted
+			s.pushPending(pending)
+		} else {
+			// pushed once the handlers have read the body, or return
+			cr.done = func() { s.pushPending(pending) }
+			defer s.pushPending(pending)
+		}
 		gc.Next()
-		var buf bytes.Buffer
-		buf.Grow(4096)
-		if err = writeResponseLine(gc, &buf); err != nil {
-			s.Logger.Errorf("Failed to dump response status: %v", err)
-			gc.AbortWithStatus(http.StatusInternalServerError)
+		s.pushPending(pending)
+		if gc.GetBool(ctxKeySkip) {
+			s.countPolicy(PolicyLoggingSkipped)
+			rlw.Body.Release()
+			dropRecordId(gc, ctxKeyResId)
 			return
 		}
-		if err = writeResponseHeaders(gc, &buf); err != nil {
-			s.Logger.Errorf("Failed to dump response headers: %v", err)
-			gc.AbortWithStatus(http.StatusInternalServerError)
+		if !s.responseKept(gc, start) {
+			s.countPolicy(PolicyRuleSkipped)
+			rlw.Body.Release()
+			dropRecordId(gc, ctxKeyResId)
+			return
+		}
+		annotateRange(gc)
+		if budget.Exhausted() {
+			s.countPolicy(PolicyCaptureCapped)
+			if rlw.Body.Truncated {
+				Annotate(gc, "capture_truncated", true)
+			}
+		}
+		if gc.GetBool(ctxKeyForce) {
+			s.countPolicy(PolicyBodyForced)
+		}
+		if rlw.SkipBody {
+			s.countPolicy(PolicyBodySkipped)
+		}
+		if nil != s.partner {
+			s.countRequest(partner, gc.Writer.Status())
+		}
+		// response records are always pushed, even partially captured ones
+		status, header := rlw.Sent()
+		duration := time.Since(start)
+		rc := &responseCapture{
+			id: resId, line: line, proto: responseProto(gc.Request),
+			status: status, header: header, trailer: rlw.Trailers(),
+			body:    rlw.Body,
+			aborted: clientAborted(gc, rlw), attrs: attributes(gc),
+			partner: partner, at: time.Now(), trace: s.newTrace(),
+			method: method, path: path, duration: duration,
+			txId: txId, skipOversized: s.maxBodyBytes() > 0 &&
+				s.Conf.SkipOversizedBody,
+			sloViolated: s.checkSlo(gc, duration),
+		}
+		if nil != s.capture {
+			s.capture.submit(func() { s.pushResponse(rc) })
 			return
 		}
-		s.Writer.Push(TxRecord{line, buf.Bytes(), rlw.Body.Bytes(), time.Now()})
+		if err = s.pushResponse(rc); err != nil {
+			gc.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+}
+
+// truncationKey returns the attribute flagging a truncated request body,
+// `body_truncated` if it's cut by `MaxBodyBytes`, or `capture_truncated`.
+func truncationKey(reqBudget, budget *internal.Budget) string {
+	if reqBudget != budget && reqBudget.Exhausted() {
+		return "body_truncated"
+	}
+	return "capture_truncated"
+}
+
+// pushPending pushes the request record once, after its body is captured,
+// unless its handler has taken it, see Acknowledged and SkipLogging.
+func (s *Server) pushPending(pending *pendingRequest) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	if pending.pushed || pending.owner.is(ownerHandler) {
+		return
 	}
+	pending.captureBody()
+	pending.rec.Trace = s.newTrace()
+	s.pushRequest(pending.req, *pending.rec)
+	pending.pushed = true
+}
+
+// pushRequest pushes the request record. If the capture pool is in use, the
+// headers are dumped from the given request snapshot by the pool.
+func (s *Server) pushRequest(req *http.Request, rec TxRecord) {
+	if nil == s.capture {
+		s.countCaptured(&rec)
+		s.Writer.Push(rec)
+		return
+	}
+	s.capture.submit(func() {
+		var err error
+		if rec.Headers, err = dumpRequest(req, false); err != nil {
+			s.Logger.Errorf("Failed to read request headers: %v", err)
+		}
+		s.countCaptured(&rec)
+		s.Writer.Push(rec)
+	})
+}
+
+func (s *Server) pushResponse(rc *responseCapture) error {
+	if rc.oversized() {
+		s.countPolicy(PolicyBodyTruncated)
+	}
+	if nil != s.Conf {
+		n := s.Conf.ResponseHeaders.Apply(rc.header)
+		n += s.Conf.ResponseHeaders.Apply(rc.trailer)
+		s.metrics.Add(uint64(n), MetricPolicyDecisions,
+			"policy", PolicyHeaderRemoved)
+		s.scrubCookies(rc.header)
+		s.redact(rc.header)
+		s.redact(rc.trailer)
+	}
+	rec, err := rc.build()
+	if err != nil {
+		s.Logger.Errorf("Failed to capture response: %v", err)
+	}
+	s.metrics.Inc(MetricRequestsLogged)
+	s.countCaptured(&rec)
+	s.Writer.Push(rec)
+	return err
 }
 
 func (s *Server) Serve() {
+	if nil != s.Conf && s.Conf.HTTP3 {
+		s.startHTTP3()
+	}
+	if nil != s.Conf && "" != s.Conf.GrpcListen {
+		s.startIngest()
+	}
 	s.Logger.Infof("Serving on %s", s.Server.Addr)
 	if strings.HasPrefix(s.Server.Addr, "unix:") {
 		sock, err := listenSock(s.Server.Addr[5:])
 		if nil != err {
 			s.Logger.Panicf("Listen error: %v", err)
 		}
-		err = serveSock(s, sock)
+		err = serveSock(s, s.listener(sock))
+		if nil != err && !errors.Is(err, http.ErrServerClosed) {
+			s.Logger.Panicf("Serve error: %v", err)
+		}
+	} else if nil != s.forensics || nil != s.Server.TLSConfig {
+		// ListenAndServe doesn't allow wrapping the listener
+		l, err := net.Listen("tcp", s.Server.Addr)
+		if nil != err {
+			s.Logger.Panicf("Listen error: %v", err)
+		}
+		if nil == s.Server.TLSConfig {
+			err = s.Server.Serve(s.listener(l))
+		} else {
+			// certificates are provided by TLSConfig, e.g. CertReloader
+			err = s.Server.ServeTLS(s.listener(l), "", "")
+		}
 		if nil != err && !errors.Is(err, http.ErrServerClosed) {
 			s.Logger.Panicf("Serve error: %v", err)
 		}
@@ -202,26 +1071,163 @@ func (s *Server) Serve() {
 	}
 }
 
+// Shutdown gracefully shuts down the HTTP server within `ShutdownTimeout`,
+// 10 seconds by default, then Drains the writer within the rest of the time.
+// Inserts still in flight are cancelled once the time is up, or the returned
+// function is called.
 func (s *Server) Shutdown() (context.CancelFunc, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	return cancel, s.Server.Shutdown(ctx)
+	timeout := 10 * time.Second
+	if nil != s.Conf && s.Conf.ShutdownTimeout > 0 {
+		timeout = s.Conf.ShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	if nil != s.cancelWrites {
+		context.AfterFunc(ctx, s.cancelWrites)
+	}
+	err := s.Server.Shutdown(ctx)
+	s.hooksMu.Lock()
+	hooks := s.shutdownHooks
+	s.hooksMu.Unlock()
+	for _, fn := range hooks {
+		err = errors.Join(err, fn())
+	}
+	// records of requests served during the shutdown
+	err = errors.Join(err, s.Drain(ctx))
+	return cancel, err
+}
+
+// Drain waits for capture workers, then flushes the writer until every record
+// pushed so far is persisted or written to the failed log, or the context is
+// done. Captures of later requests are run on their own goroutines.
+func (s *Server) Drain(ctx context.Context) error {
+	if nil != s.capture {
+		s.capture.close()
+	}
+	return s.Writer.Stop(ctx)
+}
+
+// drainer is implemented by writers flushing until empty, such as
+// CachedWriter.
+type drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// onShutdown registers a hook run upon Shutdown.
+func (s *Server) onShutdown(fn func() error) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.shutdownHooks = append(s.shutdownHooks, fn)
+}
+
+func (s *Server) maxResponseBuffer() int {
+	if nil == s.Conf {
+		return 0
+	}
+	if s.Conf.MaxBodyBytes > 0 && (s.Conf.MaxResponseBuffer <= 0 ||
+		s.Conf.MaxBodyBytes < s.Conf.MaxResponseBuffer) {
+		return s.Conf.MaxBodyBytes
+	}
+	return s.Conf.MaxResponseBuffer
+}
+
+func (s *Server) maxBodyBytes() int {
+	if nil == s.Conf {
+		return 0
+	}
+	return s.Conf.MaxBodyBytes
+}
+
+// HashRequestLine returns the `req_hash` stored by the server for requests of
+// the given method and full URL, under its HASH_ALGO and DB_MAX_REQUEST_LINE.
+// The value is the raw digest, not its hex form.
+func (s *Server) HashRequestLine(method, url string) []byte {
+	return s.reqHash(requestLine(method, url))
+}
+
+// reqHash returns the `req_hash` stored for the request line, which is hashed
+// in the normalized form, as BuildValues does.
+func (s *Server) reqHash(line string) []byte {
+	if nil == s.Conf {
+		return internal.SumString("", line)
+	}
+	var limit int
+	if nil != s.Conf.Db {
+		limit = s.Conf.Db.MaxRequestLine
+	}
+	return internal.SumString(s.Conf.HashAlgorithm,
+		NormalizeRequestLine(line, limit))
+}
+
+// newRecordId generates a binary UUID for a record. It returns nil on error,
+// leaving the ID to be generated upon insert.
+func (s *Server) newRecordId() []byte {
+	id, err := utils.NewUuid()
+	if nil != err {
+		s.Logger.Errorf("Failed to generate record ID: %v", err)
+		return nil
+	}
+	return id[:]
+}
+
+// annotateRange records the requested range and the served partial content,
+// whose body is not kept in the response record.
+func annotateRange(gc *gin.Context) {
+	if r := gc.GetHeader("Range"); "" != r {
+		Annotate(gc, "range", r)
+	}
+	if http.StatusPartialContent != gc.Writer.Status() {
+		return
+	}
+	Annotate(gc, "content_range", gc.Writer.Header().Get("Content-Range"))
+	Annotate(gc, "served_size", gc.Writer.Size())
+}
+
+// clientAborted reports whether the client disconnected before the response
+// was completely written.
+func clientAborted(gc *gin.Context, rlw *internal.ResponseLogWriter) bool {
+	return nil != rlw.Err || nil != gc.Request.Context().Err()
 }
 
 func createLogger(cfg *Config) utils.TaggedLogger {
-	if cfg.DebugLog {
-		return utils.NewDebugLogger()
+	l := &switchLogger{
+		TaggedLogger: utils.NewLogger(), debugLogger: utils.NewDebugLogger(),
 	}
-	return utils.NewLogger()
+	l.debug.Store(cfg.DebugLog)
+	return l
 }
 
-func writeResLine(gc *gin.Context, writer io.Writer) error {
-	_, err := fmt.Fprintf(writer, "HTTP/1.1 %d %s\r\n", gc.Writer.Status(),
-		http.StatusText(gc.Writer.Status()))
+func writeResLine(proto string, status int, writer io.Writer) error {
+	_, err := fmt.Fprintf(writer, "%s %d %s\r\n", proto, status,
+		http.StatusText(status))
 	return err
 }
 
-func writeResHeaders(gc *gin.Context, writer io.Writer) error {
-	return gc.Writer.Header().Clone().Write(writer)
+// responseProto returns the protocol of the response to the request, which
+// is HTTP/1.0 for HTTP/1.0 requests, as net/http does, or the major version
+// for the others, e.g. `HTTP/2.0`.
+func responseProto(req *http.Request) string {
+	if req.ProtoMajor < 2 && !req.ProtoAtLeast(1, 1) {
+		return "HTTP/1.0"
+	}
+	if req.ProtoMajor < 2 {
+		return "HTTP/1.1"
+	}
+	return fmt.Sprintf("HTTP/%d.0", req.ProtoMajor)
+}
+
+func writeResHeaders(header http.Header, writer io.Writer) error {
+	return header.Write(writer)
+}
+
+// listener wraps the listener for forensics, if enabled.
+func (s *Server) listener(l net.Listener) net.Listener {
+	if nil != s.forensics {
+		l = s.forensics.Listener(l)
+	}
+	if nil != s.Conf && s.Conf.TLSFingerprint && nil != s.Server.TLSConfig {
+		l = TLSFingerprintListener(l)
+	}
+	return l
 }
 
 func listenSocket(addr string) (net.Listener, error) {
@@ -2,8 +2,8 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
-	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -12,11 +12,13 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/eidng8/go-db"
 	"github.com/eidng8/go-utils"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -39,7 +41,7 @@ func Test_BuildValues_with_response(t *testing.T) {
 	hasher := xxhash.New()
 	_, err = hasher.WriteString("abc")
 	require.NoError(t, err)
-	require.Equal(t, fmt.Sprintf("%016x", hasher.Sum64()), args[1])
+	require.Equal(t, hasher.Sum(nil), args[1])
 	require.Equal(t, "test header", args[2])
 	require.Equal(t,
 		sql.Null[[]byte]{V: []byte("test body"), Valid: true}, args[3])
@@ -56,6 +58,21 @@ func Test_BuildValues_empty_response_returns_error(t *testing.T) {
 	require.NotNil(t, err)
 }
 
+func Test_BuildValues_skips_bad_records(t *testing.T) {
+	data := []interface{}{
+		TxRecord{Request: "abc"}, 1, TxRecord{Headers: []byte("no line")},
+		TxRecord{Request: "def"},
+	}
+	count, args, failed, err := BuildValues(data)
+	require.EqualError(t, err, "empty_request")
+	require.Equal(t, 2, count)
+	require.Len(t, args, 2*numColumns)
+	require.Len(t, failed, 2)
+	require.Equal(t, FailInvalidRecord, failed[0].Class)
+	require.Equal(t, FailEmptyRequest, failed[1].Class)
+	require.Equal(t, []byte("no line"), failed[1].Record.Headers)
+}
+
 func Test_Server_handles_error(t *testing.T) {
 	lsnr, err := net.Listen("tcp", ":0")
 	require.NoError(t, err)
@@ -114,7 +131,7 @@ func Test_RequestLogger_handles_read_body_error(t *testing.T) {
 
 func Test_RequestLogger_handles_write_response_error(t *testing.T) {
 	defer func() { writeResponseLine = writeResLine }()
-	writeResponseLine = func(gc *gin.Context, r io.Writer) error {
+	writeResponseLine = func(proto string, status int, r io.Writer) error {
 		return assert.AnError
 	}
 	listens := []string{"127.0.0.1:0", "unix:/tmp/test.sock"}
@@ -137,7 +154,7 @@ func Test_RequestLogger_handles_write_response_error(t *testing.T) {
 
 func Test_RequestLogger_handles_write_headers_error(t *testing.T) {
 	defer func() { writeResponseHeaders = writeResHeaders }()
-	writeResponseHeaders = func(gc *gin.Context, r io.Writer) error {
+	writeResponseHeaders = func(header http.Header, r io.Writer) error {
 		return assert.AnError
 	}
 	listens := []string{"127.0.0.1:0", "unix:/tmp/test.sock"}
@@ -198,7 +215,7 @@ func Test_DefaultServer_inserts_body(t *testing.T) {
 			hasher := xxhash.New()
 			_, err := hasher.WriteString("POST http://localhost/t?a=b%21c")
 			require.Nil(t, err)
-			hs := fmt.Sprintf("%016x", hasher.Sum64())
+			hs := hasher.Sum(nil)
 			//goland:noinspection SqlNoDataSourceInspection,SqlResolve
 			err = db.QueryRow(
 				`SELECT COUNT(*) FROM tx_log WHERE req_hash=? AND headers=? AND body=?;`,
@@ -250,9 +267,13 @@ func Test_Serve_handles_socket_serve_error(t *testing.T) {
 }
 
 func setup(tb testing.TB) (*Server, *sql.DB) {
+	tb.Helper()
+	return setupWithConfig(tb, DefaultConfigFromEnv())
+}
+
+func setupWithConfig(tb testing.TB, cfg *Config) (*Server, *sql.DB) {
 	tb.Helper()
 	_, conn := setupDb(tb)
-	cfg := DefaultConfigFromEnv()
 	svr, sigChan, stopChan, cleanup := DefaultServer(conn, cfg)
 	svr.Config(
 		func(s *Server) {
@@ -312,7 +333,7 @@ func requireDbCountWithoutBody(tb testing.TB, db *sql.DB, expected int) {
 	hasher := xxhash.New()
 	_, err := hasher.WriteString("GET http://localhost/t")
 	require.Nil(tb, err)
-	hs := fmt.Sprintf("%016x", hasher.Sum64())
+	hs := hasher.Sum(nil)
 	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
 	err = db.QueryRow(
 		`SELECT COUNT(*) FROM tx_log WHERE req_hash=? AND headers=? AND body IS NULL;`,
@@ -337,7 +358,7 @@ func requireDbCountWithBody(tb testing.TB, db *sql.DB, expected int) {
 	hasher := xxhash.New()
 	_, err := hasher.WriteString("POST http://localhost/t?a=b%21c")
 	require.Nil(tb, err)
-	hs := fmt.Sprintf("%016x", hasher.Sum64())
+	hs := hasher.Sum(nil)
 	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
 	err = db.QueryRow(
 		`SELECT COUNT(*) FROM tx_log WHERE req_hash=? AND headers=? AND body=?;`,
@@ -357,3 +378,186 @@ func requireDbCountWithBody(tb testing.TB, db *sql.DB, expected int) {
 	require.Nil(tb, err)
 	require.Equal(tb, expected, count)
 }
+
+func Test_RequestLogger_flags_client_aborted(t *testing.T) {
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	svr.Engine.GET("/t", func(c *gin.Context) {
+		c.String(http.StatusOK, "partial")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet,
+		"http://localhost/t", nil)
+	svr.Engine.ServeHTTP(httptest.NewRecorder(), req)
+	require.Len(t, writer.records, 2)
+	require.False(t, writer.records[0].ClientAborted)
+	require.True(t, writer.records[1].ClientAborted)
+	require.Equal(t, []byte("partial"), writer.records[1].Body)
+}
+
+func Test_RequestLogger_persists_partial_body_on_read_error(t *testing.T) {
+	defer func() { readBody = io.ReadAll }()
+	readBody = func(r io.Reader) ([]byte, error) {
+		return []byte("par"), io.ErrUnexpectedEOF
+	}
+	writer := &mockCachedWriter{}
+	svr := Server{Logger: utils.NewLogger(), Writer: NewWriterSink(writer)}
+	gc, _ := gin.CreateTestContext(httptest.NewRecorder())
+	gc.Request = httptest.NewRequest(http.MethodPost, "/t",
+		strings.NewReader("partial"))
+	svr.RequestLogger()(gc)
+	require.True(t, gc.IsAborted())
+	require.Len(t, writer.records, 1)
+	require.True(t, writer.records[0].ClientAborted)
+	require.Equal(t, []byte("par"), writer.records[0].Body)
+}
+
+type mockCachedWriter struct {
+	db.MemCachedWriter
+	mu      sync.Mutex
+	records []TxRecord
+}
+
+func (w *mockCachedWriter) Push(data any) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.records = append(w.records, data.(TxRecord))
+}
+
+func Test_RequestLogger_truncates_response_beyond_cap(t *testing.T) {
+	writer := &mockCachedWriter{}
+	cfg := &Config{ResponseBufferTiers: []int{2, 8}, MaxResponseBuffer: 6}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+	svr.Engine.GET("/t", func(c *gin.Context) {
+		_, _ = c.Writer.Write([]byte("0123"))
+		_, _ = c.Writer.Write([]byte("456789"))
+	})
+	w := httptest.NewRecorder()
+	svr.Engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/t", nil))
+	require.Equal(t, "0123456789", w.Body.String())
+	require.Len(t, writer.records, 2)
+	res := writer.records[1]
+	require.Equal(t, []byte("012345"), res.Body)
+	require.Equal(t, true, res.Attributes["body_truncated"])
+	require.Equal(t, 10, res.Attributes["body_size"])
+	require.Equal(t, uint64(1), svr.Metrics()[MetricPolicyDecisions+
+		`{policy="body_truncated"}`])
+}
+
+func Test_RequestLogger_captures_with_worker_pool(t *testing.T) {
+	writer := &mockCachedWriter{}
+	cfg := &Config{CaptureWorkers: 2, CaptureQueue: 4}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+	svr.Engine.POST("/t", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", []byte(`"post ok"`))
+	})
+	for i := 0; i < 10; i++ {
+		testPost(t, svr)
+	}
+	_, err := svr.Shutdown()
+	require.Nil(t, err)
+	require.Len(t, writer.records, 20)
+	for _, rec := range writer.records {
+		if strings.HasPrefix(string(rec.Headers), "POST") {
+			require.Equal(t, "POST /t?a=b%21c HTTP/1.1\r\nHost: localhost\r\n"+
+				"Content-Type: application/json\r\n\r\n", string(rec.Headers))
+			require.Equal(t, []byte(`{"test":"value"}`), rec.Body)
+		} else {
+			require.Equal(t,
+				"HTTP/1.1 200 OK\r\nContent-Type: application/json\r\n",
+				string(rec.Headers))
+			require.Equal(t, []byte(`"post ok"`), rec.Body)
+		}
+	}
+}
+
+func Test_RequestLogger_records_connection_reuse(t *testing.T) {
+	writer := &mockCachedWriter{}
+	ts := httptest.NewUnstartedServer(nil)
+	s := NewServer(ts.Config, writer, utils.NewLogger(), &Config{})
+	s.Engine.GET("/t", func(c *gin.Context) { c.Status(http.StatusOK) })
+	ts.Start()
+	defer ts.Close()
+	for i := 0; i < 2; i++ {
+		res, err := ts.Client().Get(ts.URL + "/t")
+		require.Nil(t, err)
+		_, _ = io.Copy(io.Discard, res.Body)
+		require.Nil(t, res.Body.Close())
+	}
+	require.Len(t, writer.records, 4)
+	first, second := writer.records[0], writer.records[2]
+	require.Positive(t, first.RemotePort)
+	require.Positive(t, first.ConnId)
+	require.False(t, first.ConnReused)
+	require.Equal(t, first.ConnId, second.ConnId)
+	require.True(t, second.ConnReused)
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_RequestLogger_stores_status_and_duration(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger),
+		logger)
+	s := NewServer(&http.Server{}, w, logger, &Config{})
+	s.Engine.POST("/orders/:id", func(c *gin.Context) {
+		time.Sleep(5 * time.Millisecond)
+		c.Status(http.StatusBadGateway)
+	})
+	s.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodPost, "/orders/1?x=1", nil))
+	w.Write()
+	rows, err := NewRecordStore(conn, false).Records(context.Background(),
+		RecordQuery{})
+	require.Nil(t, err)
+	require.Len(t, rows, 2)
+	for _, row := range rows {
+		require.Equal(t, http.MethodPost, row.Method)
+		require.Equal(t, "/orders/1", row.Path)
+	}
+	req, res := rows[0], rows[1]
+	if 0 != req.Status {
+		req, res = res, req
+	}
+	require.Zero(t, req.DurationMs)
+	require.Equal(t, http.StatusBadGateway, res.Status)
+	require.GreaterOrEqual(t, res.DurationMs, int64(5))
+	var n int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log
+		WHERE status_code >= 500`).Scan(&n))
+	require.Equal(t, 1, n)
+}
+
+func Test_RequestLogger_correlates_request_and_response(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger),
+		logger)
+	s := NewServer(&http.Server{}, w, logger, &Config{})
+	var txId []byte
+	s.Engine.GET("/t", func(c *gin.Context) {
+		txId, _ = TransactionId(c)
+		c.Status(http.StatusOK)
+	})
+	for i := 0; i < 2; i++ {
+		s.Engine.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, "/t", nil))
+	}
+	w.Write()
+	require.Len(t, txId, 16)
+	rows, err := NewRecordStore(conn, false).Records(context.Background(),
+		RecordQuery{TxId: txId})
+	require.Nil(t, err)
+	require.Len(t, rows, 2)
+	directions := []string{rows[0].Direction, rows[1].Direction}
+	require.ElementsMatch(t,
+		[]string{DirectionRequest, DirectionResponse}, directions)
+	for _, row := range rows {
+		require.Equal(t, txId, row.TxId)
+	}
+	var n int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(DISTINCT tx_id) FROM tx_log`).
+		Scan(&n))
+	require.Equal(t, 2, n)
+}
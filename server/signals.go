@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/eidng8/go-utils"
+)
+
+// Actions that can be mapped to signals.
+const (
+	// SignalShutdown gracefully shuts down the server.
+	SignalShutdown = "shutdown"
+	// SignalReload runs the hooks registered with OnReload.
+	SignalReload = "reload"
+	// SignalFlush flushes pending records of the writer.
+	SignalFlush = "flush"
+	// SignalDebug toggles debug logging.
+	SignalDebug = "debug"
+)
+
+var signalActions = []string{
+	SignalShutdown, SignalReload, SignalFlush, SignalDebug,
+}
+
+// ParseSignalActions parses signal mappings in the form of `SIGNAL:action`,
+// e.g. `HUP:reload`, as read from the comma separated `SIGNAL_ACTIONS` env.
+func ParseSignalActions(entries []string) (map[os.Signal]string, error) {
+	if len(entries) < 1 {
+		return nil, nil
+	}
+	actions := make(map[os.Signal]string, len(entries))
+	for _, e := range entries {
+		name, action, _ := strings.Cut(e, ":")
+		name = strings.TrimPrefix(strings.ToUpper(name), "SIG")
+		sig, ok := signalNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported signal: %s", name)
+		}
+		if !slices.Contains(signalActions, action) {
+			return nil, fmt.Errorf("unsupported signal action: %s", action)
+		}
+		actions[sig] = action
+	}
+	return actions, nil
+}
+
+// termSignals returns signals mapped to SignalShutdown, or TermSignals if
+// there is none.
+func (c *Config) termSignals() []os.Signal {
+	var sigs []os.Signal
+	for sig, action := range c.Signals {
+		if SignalShutdown == action {
+			sigs = append(sigs, sig)
+		}
+	}
+	if len(sigs) < 1 {
+		return c.TermSignals
+	}
+	return sigs
+}
+
+// OnReload registers a hook run upon SignalReload.
+func (s *Server) OnReload(fn func()) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+	s.reloadHooks = append(s.reloadHooks, fn)
+}
+
+// Reload runs the hooks registered with OnReload.
+func (s *Server) Reload() {
+	s.hooksMu.Lock()
+	hooks := s.reloadHooks
+	s.hooksMu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// watchSignals takes actions mapped to signals, other than SignalShutdown,
+// until the given channel is closed.
+func (s *Server) watchSignals(stopChan <-chan struct{}) {
+	var sigs []os.Signal
+	for sig, action := range s.Conf.Signals {
+		if SignalShutdown != action {
+			sigs = append(sigs, sig)
+		}
+	}
+	if len(sigs) < 1 {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case sig := <-ch:
+				s.handleSignal(sig)
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// handleSignal takes the action mapped to the signal, other than
+// SignalShutdown, which is left to the main loop.
+func (s *Server) handleSignal(sig os.Signal) {
+	action := s.Conf.Signals[sig]
+	s.Logger.Infof("Received signal: %v, %s", sig, action)
+	switch action {
+	case SignalReload:
+		s.Reload()
+	case SignalFlush:
+		if f, ok := s.writer().(interface{ Write() }); ok {
+			f.Write()
+		}
+	case SignalDebug:
+		if l, ok := s.Logger.(*switchLogger); ok {
+			l.debug.Store(!l.debug.Load())
+		}
+	}
+}
+
+// switchLogger is a logger whose debug output can be toggled at runtime.
+type switchLogger struct {
+	utils.TaggedLogger
+	debugLogger utils.TaggedLogger
+	debug       atomic.Bool
+}
+
+func (l *switchLogger) Debugf(format string, args ...interface{}) {
+	if l.debug.Load() {
+		l.debugLogger.Debugf(format, args...)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseSignalActions_maps_signals(t *testing.T) {
+	actions, err := ParseSignalActions(
+		[]string{"SIGHUP:reload", "int:shutdown"})
+	require.Nil(t, err)
+	require.Equal(t, map[os.Signal]string{
+		syscall.SIGHUP: SignalReload, syscall.SIGINT: SignalShutdown,
+	}, actions)
+	cfg := &Config{TermSignals: []os.Signal{syscall.SIGTERM}, Signals: actions}
+	require.Equal(t, []os.Signal{syscall.SIGINT}, cfg.termSignals())
+	cfg.Signals = map[os.Signal]string{syscall.SIGHUP: SignalReload}
+	require.Equal(t, []os.Signal{syscall.SIGTERM}, cfg.termSignals())
+	_, err = ParseSignalActions([]string{"KILL:reload"})
+	require.EqualError(t, err, "unsupported signal: KILL")
+	_, err = ParseSignalActions([]string{"HUP:restart"})
+	require.EqualError(t, err, "unsupported signal action: restart")
+}
+
+func Test_handleSignal_takes_mapped_actions(t *testing.T) {
+	writer := &batchRecorder{}
+	cfg := &Config{Signals: map[os.Signal]string{
+		syscall.SIGHUP: SignalReload, syscall.SIGQUIT: SignalDebug,
+		syscall.SIGINT: SignalFlush,
+	}}
+	logger := createLogger(cfg)
+	svr := NewServer(&http.Server{}, writer, logger, cfg)
+	reloads := 0
+	svr.OnReload(func() { reloads++ })
+	svr.handleSignal(syscall.SIGHUP)
+	require.Equal(t, 1, reloads)
+	svr.handleSignal(syscall.SIGQUIT)
+	require.True(t, logger.(*switchLogger).debug.Load())
+	svr.handleSignal(syscall.SIGQUIT)
+	require.False(t, logger.(*switchLogger).debug.Load())
+	writer.Push(TxRecord{Request: "GET /t"})
+	svr.handleSignal(syscall.SIGINT)
+	require.Equal(t, []int{1}, writer.batches)
+}
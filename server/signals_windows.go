@@ -0,0 +1,16 @@
+//go:build windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// signals can be mapped to actions, by name without the `SIG` prefix
+var signalNames = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+
+	"github.com/eidng8/go-db"
+)
+
+// Sink receives the records captured by RequestLogger. WriterSink persisting
+// records to the DB is the default one, custom sinks, such as Kafka producers
+// or files, can be given to NewSinkServer instead.
+type Sink interface {
+	// Push receives a record, it must not block the request for long
+	Push(TxRecord)
+	// Start runs the sink until the given channel is closed
+	Start(<-chan struct{})
+	// Stop delivers records still pending, within the given context
+	Stop(context.Context) error
+}
+
+// WriterSink adapts a db.CachedWriter, such as CachedWriter, to Sink.
+// Optional features of the writer, such as Persist and Failing, are still
+// found by the server.
+type WriterSink struct {
+	db.CachedWriter
+}
+
+var _ Sink = &WriterSink{}
+
+// NewWriterSink adapts the writer to Sink.
+func NewWriterSink(writer db.CachedWriter) *WriterSink {
+	return &WriterSink{CachedWriter: writer}
+}
+
+// Push caches the record in the writer.
+func (s *WriterSink) Push(rec TxRecord) {
+	s.CachedWriter.Push(rec)
+}
+
+// Stop drains the writer if it supports, or else flushes it once.
+func (s *WriterSink) Stop(ctx context.Context) error {
+	if d, ok := s.CachedWriter.(drainer); ok {
+		return d.Drain(ctx)
+	}
+	s.CachedWriter.Write()
+	return nil
+}
+
+// writer returns the writer adapted by the sink, or the sink itself, for
+// optional features to be looked up.
+func (s *Server) writer() any {
+	if ws, ok := s.Writer.(*WriterSink); ok {
+		return ws.CachedWriter
+	}
+	return s.Writer
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+type memorySink struct {
+	mu      sync.Mutex
+	records []TxRecord
+	stopped bool
+}
+
+func (s *memorySink) Push(rec TxRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, rec)
+}
+
+func (s *memorySink) Start(<-chan struct{}) {}
+
+func (s *memorySink) Stop(context.Context) error {
+	s.stopped = true
+	return nil
+}
+
+func Test_NewSinkServer_delivers_records_to_custom_sink(t *testing.T) {
+	sink := &memorySink{}
+	s := NewSinkServer(&http.Server{}, sink, utils.NewLogger(), &Config{})
+	s.Engine.GET("/t", func(c *gin.Context) { c.Status(http.StatusOK) })
+	s.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/t", nil))
+	require.Len(t, sink.records, 2)
+	require.Equal(t, DirectionRequest, sink.records[0].Direction)
+	require.Equal(t, DirectionResponse, sink.records[1].Direction)
+	// writer features are not available to custom sinks
+	require.True(t, s.Ready())
+	cancel, err := s.Shutdown()
+	defer cancel()
+	require.Nil(t, err)
+	require.True(t, sink.stopped)
+}
+
+func Test_WriterSink_Stop_flushes_writer(t *testing.T) {
+	mock := &mockCachedWriter{}
+	sink := NewWriterSink(mock)
+	sink.Push(TxRecord{Request: "GET /t"})
+	require.Nil(t, sink.Stop(context.Background()))
+	require.Len(t, mock.records, 1)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MetricSloViolations counts responses slower than the LatencySlo of their
+// routes, labeled by `route`.
+const MetricSloViolations = "persist_slo_violations_total"
+
+// LatencySlo is the maximum latency of responses of a route. Slower ones are
+// flagged by the `slo_violated` column of their response records.
+type LatencySlo struct {
+	// `METHOD /full/:path` as registered, `*` for any method
+	Route string
+	Max   time.Duration
+}
+
+// ParseLatencySlos parses SLOs in the form of `METHOD /full/:path=duration`,
+// as read from the comma separated `LATENCY_SLOS` env, e.g.
+// `GET /users/:id=250ms,* /upload=2s`.
+func ParseLatencySlos(entries []string) ([]LatencySlo, error) {
+	slos := make([]LatencySlo, 0, len(entries))
+	for _, e := range entries {
+		route, limit, found := strings.Cut(strings.TrimSpace(e), "=")
+		method, path, _ := strings.Cut(strings.TrimSpace(route), " ")
+		path = strings.TrimSpace(path)
+		if !found || "" == method || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf(
+				"invalid SLO %s, expecting METHOD /path=duration", e)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(limit))
+		if nil != err || d <= 0 {
+			return nil, fmt.Errorf("invalid latency of SLO %s", e)
+		}
+		slos = append(slos, LatencySlo{
+			Route: strings.ToUpper(method) + " " + path, Max: d,
+		})
+	}
+	return slos, nil
+}
+
+// checkSlo tells whether the response violates the SLO of its route,
+// counting violations, and raising an Alert of kind "slo" if `SloAlert` is
+// set.
+func (s *Server) checkSlo(gc *gin.Context, duration time.Duration) bool {
+	if len(s.slos) < 1 || "" == gc.FullPath() {
+		return false
+	}
+	route := gc.Request.Method + " " + gc.FullPath()
+	limit, ok := s.slos[route]
+	if !ok {
+		route = "* " + gc.FullPath()
+		if limit, ok = s.slos[route]; !ok {
+			return false
+		}
+	}
+	if duration <= limit {
+		return false
+	}
+	s.metrics.Inc(MetricSloViolations, "route", route)
+	if s.Conf.SloAlert {
+		id, _ := RequestRecordId(gc)
+		s.Alert(Alert{
+			Kind:     "slo",
+			Method:   gc.Request.Method,
+			Path:     gc.Request.URL.Path,
+			ClientIP: gc.ClientIP(),
+			RecordId: id,
+			Detail:   fmt.Sprintf("%s took %v, SLO %v", route, duration, limit),
+			Time:     time.Now(),
+		})
+	}
+	return true
+}
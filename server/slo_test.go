@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseLatencySlos(t *testing.T) {
+	slos, err := ParseLatencySlos([]string{"get /u/:id=250ms", " * /up = 2s"})
+	require.Nil(t, err)
+	require.Equal(t, []LatencySlo{
+		{Route: "GET /u/:id", Max: 250 * time.Millisecond},
+		{Route: "* /up", Max: 2 * time.Second},
+	}, slos)
+	_, err = ParseLatencySlos([]string{"GET /u"})
+	require.ErrorContains(t, err, "invalid SLO GET /u")
+	_, err = ParseLatencySlos([]string{"GET /u=fast"})
+	require.ErrorContains(t, err, "invalid latency of SLO GET /u=fast")
+	t.Setenv("LATENCY_SLOS", "/u=1s")
+	_, err = ConfigFromEnv()
+	require.ErrorContains(t, err, "LATENCY_SLOS: invalid SLO /u=1s")
+}
+
+func Test_RequestLogger_flags_slo_violations(t *testing.T) {
+	dbcfg, conn := setupDb(t)
+	logger := utils.NewLogger()
+	w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger),
+		logger)
+	slos, err := ParseLatencySlos([]string{"GET /slow/:n=1ms", "* /fast=1m"})
+	require.Nil(t, err)
+	cfg := &Config{LatencySlos: slos, SloAlert: true, Db: dbcfg}
+	s := NewServer(&http.Server{}, w, logger, cfg)
+	var alerts []Alert
+	s.OnAlert(func(a Alert) { alerts = append(alerts, a) })
+	s.Engine.GET("/slow/:n", func(c *gin.Context) {
+		time.Sleep(5 * time.Millisecond)
+		c.Status(http.StatusOK)
+	})
+	s.Engine.GET("/fast", func(c *gin.Context) { c.Status(http.StatusOK) })
+	for _, target := range []string{"/slow/1", "/fast"} {
+		s.Engine.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	require.Nil(t, s.Drain(context.Background()))
+	require.Equal(t, uint64(1), s.metrics.Get(MetricSloViolations,
+		"route", "GET /slow/:n"))
+	require.Len(t, alerts, 1)
+	require.Equal(t, "slo", alerts[0].Kind)
+	require.Equal(t, "/slow/1", alerts[0].Path)
+	rows, err := NewRecordStore(conn, false).Records(context.Background(),
+		RecordQuery{})
+	require.Nil(t, err)
+	require.Len(t, rows, 4)
+	var violated []string
+	for _, row := range rows {
+		if row.SloViolated {
+			violated = append(violated, row.Path+" "+row.Direction)
+		}
+	}
+	require.Equal(t, []string{"/slow/1 res"}, violated)
+}
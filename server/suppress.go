@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SuppressRule excludes requests of matching clients from being persisted,
+// such as health checks of load balancers. A request matches if its client IP
+// is in any of the networks, and its `User-Agent` matches the pattern. Empty
+// networks or nil pattern matches all.
+type SuppressRule struct {
+	Nets  []netip.Prefix
+	Agent *regexp.Regexp
+}
+
+// ParseSuppressRules parses rules in the form of `cidr|pattern`, as read from
+// the comma separated `SUPPRESS_RULES` env. Either part can be left empty, or
+// `*` for the networks, and multiple networks are separated by spaces, e.g.
+// `10.0.0.0/8 192.168.1.1|^ELB-HealthChecker/`.
+func ParseSuppressRules(entries []string) ([]SuppressRule, error) {
+	rules := make([]SuppressRule, 0, len(entries))
+	for _, e := range entries {
+		nets, agent, _ := strings.Cut(e, "|")
+		var rule SuppressRule
+		for _, n := range strings.Fields(nets) {
+			if "*" == n {
+				continue
+			}
+			p, err := parsePrefix(n)
+			if nil != err {
+				return nil, fmt.Errorf("invalid network of rule %s: %w", e, err)
+			}
+			rule.Nets = append(rule.Nets, p)
+		}
+		if "" != agent {
+			re, err := regexp.Compile(agent)
+			if nil != err {
+				return nil, fmt.Errorf("invalid agent of rule %s: %w", e, err)
+			}
+			rule.Agent = re
+		}
+		if len(rule.Nets) < 1 && nil == rule.Agent {
+			return nil, fmt.Errorf("rule %s suppresses everything", e)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parsePrefix parses a CIDR, or a single IP.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if nil != err {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Match tells whether the request of given client IP and agent is suppressed.
+func (r *SuppressRule) Match(ip netip.Addr, agent string) bool {
+	if nil != r.Agent && !r.Agent.MatchString(agent) {
+		return false
+	}
+	if len(r.Nets) < 1 {
+		return true
+	}
+	for _, n := range r.Nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// PathFilter excludes requests of matching paths from being persisted, such as
+// health checks and metrics scraping. A nil PathFilter matches nothing.
+type PathFilter struct {
+	exact    map[string]bool
+	prefixes []string
+	patterns []*regexp.Regexp
+}
+
+// ParsePathFilter parses paths as read from the comma separated `SKIP_PATHS`
+// env. Paths ending with `*` are prefixes, and those starting with `~` are
+// regular expressions, others are matched exactly, e.g.
+// `/healthz,/static/*,~^/debug/`. It returns nil if there is no path.
+func ParsePathFilter(paths []string) (*PathFilter, error) {
+	if len(paths) < 1 {
+		return nil, nil
+	}
+	f := &PathFilter{exact: make(map[string]bool)}
+	for _, p := range paths {
+		p = strings.TrimSpace(p)
+		switch {
+		case "" == p:
+			continue
+		case strings.HasPrefix(p, "~"):
+			re, err := regexp.Compile(p[1:])
+			if nil != err {
+				return nil, fmt.Errorf("invalid path pattern %s: %w", p, err)
+			}
+			f.patterns = append(f.patterns, re)
+		case strings.HasSuffix(p, "*"):
+			f.prefixes = append(f.prefixes, p[:len(p)-1])
+		default:
+			f.exact[p] = true
+		}
+	}
+	return f, nil
+}
+
+// Match tells whether the path is excluded.
+func (f *PathFilter) Match(path string) bool {
+	if nil == f {
+		return false
+	}
+	if f.exact[path] {
+		return true
+	}
+	for _, p := range f.prefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	for _, re := range f.patterns {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// skippedPath tells whether the path of the current request is excluded by
+// `SkipPaths`.
+func (s *Server) skippedPath(gc *gin.Context) bool {
+	return nil != s.Conf && s.Conf.SkipPaths.Match(gc.Request.URL.Path)
+}
+
+// sampleFloat draws the number deciding whether a request is sampled.
+var sampleFloat = rand.Float64
+
+// sampledOut decides once for the current request, whether it's dropped by
+// `SampleRate`, along with its response.
+func (s *Server) sampledOut() bool {
+	if nil == s.Conf || s.Conf.SampleRate <= 0 || s.Conf.SampleRate >= 1 {
+		return false
+	}
+	return sampleFloat() >= s.Conf.SampleRate
+}
+
+// suppressed tells whether the current request matches any suppress rule.
+// The client IP is determined by gin, honoring its trusted proxies.
+func (s *Server) suppressed(gc *gin.Context) bool {
+	if nil == s.Conf || len(s.Conf.Suppress) < 1 {
+		return false
+	}
+	ip, _ := netip.ParseAddr(gc.ClientIP())
+	ip = ip.Unmap()
+	agent := gc.Request.UserAgent()
+	for i := range s.Conf.Suppress {
+		if s.Conf.Suppress[i].Match(ip, agent) {
+			return true
+		}
+	}
+	return false
+}
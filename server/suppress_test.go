@@ -0,0 +1,111 @@
+package server
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RequestLogger_suppresses_matching_clients(t *testing.T) {
+	rules, err := ParseSuppressRules([]string{
+		"10.0.0.0/8 192.168.1.1|^ELB-HealthChecker/", "|^kube-probe/",
+	})
+	require.Nil(t, err)
+	writer := &mockCachedWriter{}
+	cfg := &Config{Suppress: rules}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+	svr.Engine.GET("/t", func(c *gin.Context) { c.Status(http.StatusOK) })
+	for _, c := range []struct{ addr, agent string }{
+		{"10.1.2.3:80", "ELB-HealthChecker/2.0"},
+		{"192.168.1.1:80", "ELB-HealthChecker/2.0"},
+		{"172.16.0.1:80", "kube-probe/1.29"},
+		// persisted
+		{"192.168.1.2:80", "ELB-HealthChecker/2.0"},
+		{"10.1.2.3:80", "curl/8.0"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/t", nil)
+		req.RemoteAddr = c.addr
+		req.Header.Set("User-Agent", c.agent)
+		res := httptest.NewRecorder()
+		svr.Engine.ServeHTTP(res, req)
+		require.Equal(t, http.StatusOK, res.Code)
+	}
+	require.Len(t, writer.records, 4)
+	require.Equal(t, uint64(3), svr.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicySuppressed))
+}
+
+func Test_ParseSuppressRules_returns_error_if_invalid(t *testing.T) {
+	_, err := ParseSuppressRules([]string{"10.0.0.0/33|x"})
+	require.ErrorContains(t, err, "invalid network of rule 10.0.0.0/33|x")
+	_, err = ParseSuppressRules([]string{"*|("})
+	require.ErrorContains(t, err, "invalid agent of rule *|(")
+	_, err = ParseSuppressRules([]string{"*|"})
+	require.EqualError(t, err, "rule *| suppresses everything")
+}
+
+func Test_RequestLogger_skips_excluded_paths(t *testing.T) {
+	t.Setenv("SKIP_PATHS", "/healthz,/static/*,~^/debug/[0-9]+$")
+	cfg, err := ConfigFromEnv()
+	require.Nil(t, err)
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+	svr.Engine.Any("/*path", func(c *gin.Context) {
+		_, err := io.ReadAll(c.Request.Body)
+		require.Nil(t, err)
+		c.Status(http.StatusOK)
+	})
+	for _, path := range []string{
+		"/healthz", "/static/app.js", "/debug/1",
+		// persisted
+		"/healthz/deep", "/debug/x", "/orders",
+	} {
+		res := httptest.NewRecorder()
+		svr.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodPost, path,
+			strings.NewReader("body")))
+		require.Equal(t, http.StatusOK, res.Code)
+	}
+	require.Len(t, writer.records, 6)
+	require.Equal(t, uint64(3), svr.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicyPathSkipped))
+}
+
+func Test_ParsePathFilter_rejects_bad_pattern(t *testing.T) {
+	_, err := ParsePathFilter([]string{"~[a-"})
+	require.ErrorContains(t, err, "invalid path pattern ~[a-")
+	f, err := ParsePathFilter(nil)
+	require.Nil(t, err)
+	require.False(t, f.Match("/"))
+}
+
+func Test_RequestLogger_samples_requests(t *testing.T) {
+	defer func() { sampleFloat = rand.Float64 }()
+	draws := []float64{0.1, 0.5, 0.24, 0.9}
+	sampleFloat = func() float64 {
+		f := draws[0]
+		draws = draws[1:]
+		return f
+	}
+	writer := &mockCachedWriter{}
+	cfg := &Config{SampleRate: 0.25}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+	svr.Engine.GET("/t", func(c *gin.Context) { c.Status(http.StatusOK) })
+	for i := 0; i < 4; i++ {
+		res := httptest.NewRecorder()
+		svr.Engine.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/t", nil))
+		require.Equal(t, http.StatusOK, res.Code)
+	}
+	// both records of each sampled request
+	require.Len(t, writer.records, 4)
+	require.Equal(t, writer.records[0].TxId, writer.records[1].TxId)
+	require.Equal(t, writer.records[2].TxId, writer.records[3].TxId)
+	require.Equal(t, uint64(2), svr.metrics.Get(MetricPolicyDecisions,
+		"policy", PolicySampledOut))
+}
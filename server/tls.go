@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eidng8/go-utils"
+)
+
+// CertReloader serves the certificate of `TLS_CERT` and `TLS_KEY`, reloading
+// it when the files change, so renewed certificates are picked up without a
+// restart. Connections keep the certificate loaded when they were
+// established.
+type CertReloader struct {
+	certFile, keyFile string
+	logger            utils.TaggedLogger
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+	// modification times of the cert and key files loaded
+	certMod, keyMod time.Time
+}
+
+// NewCertReloader loads the PEM encoded certificate and key of the given
+// files.
+func NewCertReloader(
+	certFile, keyFile string, logger utils.TaggedLogger,
+) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := c.Reload(); nil != err {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the loaded certificate, to be used as
+// tls.Config.GetCertificate.
+func (c *CertReloader) GetCertificate(
+	*tls.ClientHelloInfo,
+) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// TLSConfig returns a TLS config serving the loaded certificate.
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12, GetCertificate: c.GetCertificate,
+	}
+}
+
+// Reload loads the certificate and key files. The previous certificate is
+// kept if they can't be loaded, e.g. while only one of them is replaced.
+func (c *CertReloader) Reload() error {
+	certMod, keyMod, err := c.modTimes()
+	if nil != err {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if nil != err {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert, c.certMod, c.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+// Watch checks the files every `interval`, reloading the certificate upon
+// change, until the given channel is closed.
+func (c *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if !c.changed() {
+					continue
+				}
+				if err := c.Reload(); nil != err {
+					c.logger.Errorf("Failed to reload certificate: %v", err)
+					continue
+				}
+				c.logger.Infof("Reloaded certificate %s", c.certFile)
+			}
+		}
+	}()
+}
+
+func (c *CertReloader) changed() bool {
+	certMod, keyMod, err := c.modTimes()
+	if nil != err {
+		// the loaded certificate is kept until the files are back
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !certMod.Equal(c.certMod) || !keyMod.Equal(c.keyMod)
+}
+
+func (c *CertReloader) modTimes() (time.Time, time.Time, error) {
+	ci, err1 := os.Stat(c.certFile)
+	ki, err2 := os.Stat(c.keyFile)
+	if err := errors.Join(err1, err2); nil != err {
+		return time.Time{}, time.Time{}, err
+	}
+	return ci.ModTime(), ki.ModTime(), nil
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// maximum bytes of a TLS record, plus its header
+const tlsRecordBytes = 5 + 16384
+
+// TLSFingerprint identifies the TLS stack of a client by its ClientHello.
+type TLSFingerprint struct {
+	// MD5 digest of the JA3 string, in hex
+	JA3 string
+	JA4 string
+}
+
+// TLSFingerprintListener wraps the listener, so ClientHello messages of
+// accepted connections are fingerprinted. It must be served with TLS, and
+// requests are annotated if the server has `TLSFingerprint` enabled.
+func TLSFingerprintListener(l net.Listener) net.Listener {
+	return &helloListener{Listener: l}
+}
+
+type helloListener struct {
+	net.Listener
+}
+
+func (l *helloListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if nil != err {
+		return nil, err
+	}
+	return &helloConn{Conn: c}, nil
+}
+
+// helloConn buffers the first TLS record read, which is the ClientHello, and
+// fingerprints it once completed.
+type helloConn struct {
+	net.Conn
+	buf []byte
+	// whether buffering is over, set by the reading goroutine only
+	done bool
+	fp   atomic.Pointer[TLSFingerprint]
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.done {
+		c.buf = append(c.buf, b[:n]...)
+		c.inspect()
+	}
+	return n, err
+}
+
+func (c *helloConn) inspect() {
+	if 0x16 != c.buf[0] {
+		c.done, c.buf = true, nil
+		return
+	}
+	if len(c.buf) < 5 {
+		return
+	}
+	size := 5 + (int(c.buf[3])<<8 | int(c.buf[4]))
+	if len(c.buf) < size && size <= tlsRecordBytes {
+		return
+	}
+	fp, err := FingerprintClientHello(c.buf[:min(size, len(c.buf))])
+	if nil == err {
+		c.fp.Store(&fp)
+	}
+	c.done, c.buf = true, nil
+}
+
+type tlsConnKey struct{}
+
+// ConnTLSFingerprint returns the fingerprint of the connection accepted from
+// TLSFingerprintListener, false if the handshake didn't complete, or the
+// connection isn't fingerprinted.
+func ConnTLSFingerprint(c net.Conn) (TLSFingerprint, bool) {
+	for {
+		switch v := c.(type) {
+		case *helloConn:
+			if fp := v.fp.Load(); nil != fp {
+				return *fp, true
+			}
+			return TLSFingerprint{}, false
+		case *tls.Conn:
+			c = v.NetConn()
+		case interface{ NetConn() net.Conn }:
+			c = v.NetConn()
+		default:
+			return TLSFingerprint{}, false
+		}
+	}
+}
+
+// attachTLSFingerprint keeps connections in request contexts, chaining the
+// existing ConnContext.
+func (s *Server) attachTLSFingerprint(svr *http.Server) {
+	next := svr.ConnContext
+	svr.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if nil != next {
+			ctx = next(ctx, c)
+		}
+		return context.WithValue(ctx, tlsConnKey{}, c)
+	}
+}
+
+func (s *Server) tlsFingerprint(req *http.Request) (TLSFingerprint, bool) {
+	if nil == s.Conf || !s.Conf.TLSFingerprint {
+		return TLSFingerprint{}, false
+	}
+	c, ok := req.Context().Value(tlsConnKey{}).(net.Conn)
+	if !ok {
+		return TLSFingerprint{}, false
+	}
+	return ConnTLSFingerprint(c)
+}
+
+// FingerprintClientHello computes the JA3 and JA4 fingerprints of the TLS
+// record carrying a ClientHello. GREASE values are ignored.
+func FingerprintClientHello(record []byte) (TLSFingerprint, error) {
+	h, err := parseClientHello(record)
+	if nil != err {
+		return TLSFingerprint{}, err
+	}
+	return TLSFingerprint{JA3: h.ja3(), JA4: h.ja4()}, nil
+}
+
+type clientHello struct {
+	version    uint16
+	ciphers    []uint16
+	extensions []uint16
+	curves     []uint16
+	points     []uint8
+	sigAlgs    []uint16
+	versions   []uint16
+	alpn       []string
+	sni        bool
+}
+
+var errClientHello = errors.New("malformed ClientHello")
+
+// isGrease reports whether the value is reserved by RFC 8701.
+func isGrease(v uint16) bool {
+	return 0x0a0a == v&0x0f0f && v>>8 == v&0xff
+}
+
+func parseClientHello(record []byte) (*clientHello, error) {
+	in := cryptobyte.String(record)
+	var typ uint8
+	var hs cryptobyte.String
+	if !in.ReadUint8(&typ) || 0x16 != typ || !in.Skip(2) ||
+		!in.ReadUint16LengthPrefixed(&hs) {
+		return nil, errClientHello
+	}
+	var body cryptobyte.String
+	if !hs.ReadUint8(&typ) || 1 != typ || !hs.ReadUint24LengthPrefixed(&body) {
+		return nil, errClientHello
+	}
+	h := &clientHello{}
+	var sessionId, ciphers, compression, exts cryptobyte.String
+	if !body.ReadUint16(&h.version) || !body.Skip(32) ||
+		!body.ReadUint8LengthPrefixed(&sessionId) ||
+		!body.ReadUint16LengthPrefixed(&ciphers) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return nil, errClientHello
+	}
+	for !ciphers.Empty() {
+		var c uint16
+		if !ciphers.ReadUint16(&c) {
+			return nil, errClientHello
+		}
+		if !isGrease(c) {
+			h.ciphers = append(h.ciphers, c)
+		}
+	}
+	if body.Empty() {
+		return h, nil
+	}
+	if !body.ReadUint16LengthPrefixed(&exts) {
+		return nil, errClientHello
+	}
+	for !exts.Empty() {
+		var ext uint16
+		var data cryptobyte.String
+		if !exts.ReadUint16(&ext) || !exts.ReadUint16LengthPrefixed(&data) {
+			return nil, errClientHello
+		}
+		if isGrease(ext) {
+			continue
+		}
+		h.extensions = append(h.extensions, ext)
+		if !h.parseExtension(ext, data) {
+			return nil, errClientHello
+		}
+	}
+	return h, nil
+}
+
+func (h *clientHello) parseExtension(ext uint16, data cryptobyte.String) bool {
+	var list cryptobyte.String
+	switch ext {
+	case 0:
+		h.sni = true
+	case 10:
+		return data.ReadUint16LengthPrefixed(&list) &&
+			readUint16s(list, &h.curves)
+	case 11:
+		if !data.ReadUint8LengthPrefixed(&list) {
+			return false
+		}
+		h.points = append(h.points, list...)
+	case 13:
+		return data.ReadUint16LengthPrefixed(&list) &&
+			readUint16s(list, &h.sigAlgs)
+	case 16:
+		if !data.ReadUint16LengthPrefixed(&list) {
+			return false
+		}
+		for !list.Empty() {
+			var proto cryptobyte.String
+			if !list.ReadUint8LengthPrefixed(&proto) {
+				return false
+			}
+			h.alpn = append(h.alpn, string(proto))
+		}
+	case 43:
+		return data.ReadUint8LengthPrefixed(&list) &&
+			readUint16s(list, &h.versions)
+	}
+	return true
+}
+
+// readUint16s appends non-GREASE values of the list.
+func readUint16s(list cryptobyte.String, out *[]uint16) bool {
+	for !list.Empty() {
+		var v uint16
+		if !list.ReadUint16(&v) {
+			return false
+		}
+		if !isGrease(v) {
+			*out = append(*out, v)
+		}
+	}
+	return true
+}
+
+func (h *clientHello) ja3() string {
+	points := make([]uint16, len(h.points))
+	for i, p := range h.points {
+		points[i] = uint16(p)
+	}
+	s := strconv.Itoa(int(h.version)) + "," + joinDecimal(h.ciphers) + "," +
+		joinDecimal(h.extensions) + "," + joinDecimal(h.curves) + "," +
+		joinDecimal(points)
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *clientHello) ja4() string {
+	version := h.version
+	if len(h.versions) > 0 {
+		version = slices.Max(h.versions)
+	}
+	sni := "i"
+	if h.sni {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.alpn) > 0 && "" != h.alpn[0] {
+		p := h.alpn[0]
+		if !isAlnum(p[0]) || !isAlnum(p[len(p)-1]) {
+			p = hex.EncodeToString([]byte(p))
+		}
+		alpn = p[:1] + p[len(p)-1:]
+	}
+	var exts []uint16
+	for _, e := range h.extensions {
+		// SNI and ALPN are already told by the first part
+		if 0 != e && 16 != e {
+			exts = append(exts, e)
+		}
+	}
+	extHash := sortedHex(exts)
+	if len(h.sigAlgs) > 0 {
+		extHash += "_" + joinHex(h.sigAlgs)
+	}
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", ja4Version(version), sni,
+		min(len(h.ciphers), 99), min(len(h.extensions), 99), alpn,
+		truncatedSha256(sortedHex(h.ciphers)), truncatedSha256(extHash))
+}
+
+func isAlnum(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z')
+}
+
+func ja4Version(v uint16) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+func truncatedSha256(s string) string {
+	if "" == s {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+func sortedHex(values []uint16) string {
+	return joinHex(slices.Sorted(slices.Values(values)))
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RequestLogger_records_tls_fingerprints(t *testing.T) {
+	writer := &mockCachedWriter{}
+	ts := httptest.NewUnstartedServer(nil)
+	s := NewServer(ts.Config, writer, utils.NewLogger(),
+		&Config{TLSFingerprint: true})
+	s.Engine.GET("/t", func(c *gin.Context) { c.Status(http.StatusOK) })
+	ts.Listener = TLSFingerprintListener(ts.Listener)
+	ts.StartTLS()
+	defer ts.Close()
+	res, err := ts.Client().Get(ts.URL + "/t")
+	require.Nil(t, err)
+	require.Nil(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Len(t, writer.records, 2)
+	attrs := writer.records[0].Attributes
+	require.Len(t, attrs["ja3"], 32)
+	// an IP address is dialed, so there's no SNI
+	require.Regexp(t, `^t13i\d{4}[0-9a-z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`,
+		attrs["ja4"])
+}
+
+func Test_FingerprintClientHello_rejects_other_records(t *testing.T) {
+	_, err := FingerprintClientHello([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.ErrorIs(t, err, errClientHello)
+	_, err = FingerprintClientHello([]byte{0x16, 3, 1, 0, 4, 1, 0, 0, 9})
+	require.ErrorIs(t, err, errClientHello)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestCert(t *testing.T, dir string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial), DNSNames: []string{"localhost"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey,
+		key)
+	require.Nil(t, err)
+	kb, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.Nil(t, os.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, os.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600))
+	// the file system may not tell apart writes within its time resolution
+	mod := time.Now().Add(time.Duration(serial) * time.Second)
+	require.Nil(t, os.Chtimes(certFile, mod, mod))
+	require.Nil(t, os.Chtimes(keyFile, mod, mod))
+	return certFile, keyFile
+}
+
+func servedSerial(t *testing.T, c *CertReloader) int64 {
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{})
+	require.Nil(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.Nil(t, err)
+	return leaf.SerialNumber.Int64()
+}
+
+func Test_CertReloader_reloads_changed_files(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, 1)
+	c, err := NewCertReloader(certFile, keyFile, utils.NewLogger())
+	require.Nil(t, err)
+	require.Equal(t, int64(1), servedSerial(t, c))
+	stop := make(chan struct{})
+	defer close(stop)
+	c.Watch(10*time.Millisecond, stop)
+	writeTestCert(t, dir, 2)
+	require.Eventually(t, func() bool { return 2 == servedSerial(t, c) },
+		time.Second, 10*time.Millisecond)
+}
+
+func Test_CertReloader_keeps_certificate_if_files_are_invalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, 1)
+	c, err := NewCertReloader(certFile, keyFile, utils.NewLogger())
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(keyFile, []byte("broken"), 0600))
+	require.NotNil(t, c.Reload())
+	require.Equal(t, int64(1), servedSerial(t, c))
+	_, err = NewCertReloader(certFile, filepath.Join(dir, "missing.pem"),
+		utils.NewLogger())
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func Test_Validate_requires_both_tls_files(t *testing.T) {
+	cfg := &Config{ListenAddr: ":443", FilePerm: 0644, TLSCert: "cert.pem"}
+	require.ErrorContains(t, cfg.Validate(),
+		"TLS_CERT, TLS_KEY: both or neither must be set")
+	cfg.TLSKey, cfg.ListenAddr = "key.pem", "unix:/tmp/t.sock"
+	require.ErrorContains(t, cfg.Validate(), "TLS_CERT: TLS can't be served")
+}
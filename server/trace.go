@@ -0,0 +1,91 @@
+package server
+
+import (
+	"time"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+// MetricStageLatency is the histogram of microseconds records spend in each
+// stage of the pipeline, labeled by `stage`.
+const MetricStageLatency = "persist_stage_latency_microseconds"
+
+const (
+	// StageCapture is from the handler returning to the record being pushed
+	// to the writer, including the wait for capture workers.
+	StageCapture = "capture"
+	// StageTransform is from the record being pushed to it being prepared
+	// by SerializeWriter, or built by SqlBuilder upon flush.
+	StageTransform = "transform"
+	// StagePersist is from the record being prepared to it being committed,
+	// including retries.
+	StagePersist = "persist"
+)
+
+// upper bounds of MetricStageLatency buckets
+var stageBuckets = []uint64{
+	100, 1_000, 10_000, 100_000, 1_000_000, 10_000_000, 60_000_000,
+}
+
+// Trace keeps the times a record passes each stage of the pipeline, which is
+// enabled by `TraceStages`. Each time is only set once, the first time the
+// record passes the stage, e.g. retries don't move Transformed.
+type Trace struct {
+	Captured    time.Time
+	Enqueued    time.Time
+	Transformed time.Time
+	Persisted   time.Time
+	metrics     *internal.Counters
+	// whether the record has been refused, and won't pass further stages
+	dropped bool
+}
+
+// newTrace starts the trace of a record captured now, nil if not enabled.
+func (s *Server) newTrace() *Trace {
+	if nil == s.Conf || !s.Conf.TraceStages {
+		return nil
+	}
+	return &Trace{Captured: time.Now(), metrics: s.metrics}
+}
+
+// mark records the end of the given stage, and observes its latency.
+func (t *Trace) mark(stage string) {
+	if nil == t || t.dropped {
+		return
+	}
+	var from time.Time
+	var at *time.Time
+	switch stage {
+	case StageCapture:
+		from, at = t.Captured, &t.Enqueued
+	case StageTransform:
+		from, at = t.Enqueued, &t.Transformed
+	case StagePersist:
+		from, at = t.Transformed, &t.Persisted
+	default:
+		return
+	}
+	if !at.IsZero() {
+		return
+	}
+	*at = time.Now()
+	if from.IsZero() {
+		return
+	}
+	t.metrics.Observe(uint64(max(0, at.Sub(from).Microseconds())),
+		MetricStageLatency, stageBuckets, "stage", stage)
+}
+
+// drop stops tracing the record, which is refused.
+func (t *Trace) drop() {
+	if nil != t {
+		t.dropped = true
+	}
+}
+
+// markStage marks the stage of the record, if it's a traced TxRecord.
+func markStage(data any, stage string) {
+	if rec, ok := data.(TxRecord); ok {
+		rec.Trace.mark(stage)
+	}
+}
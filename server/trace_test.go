@@ -0,0 +1,57 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+func Test_Trace_observes_stage_latency(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	for _, workers := range []int{0, 2} {
+		w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard),
+			logger), logger)
+		if workers > 0 {
+			w = NewWriter(NewSerializeWriter(
+				NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger),
+				workers, 4), logger)
+		}
+		s := NewServer(&http.Server{}, w, logger, &Config{TraceStages: true})
+		s.Engine.GET("/t", func(c *gin.Context) {
+			c.String(http.StatusOK, "ok")
+		})
+		s.Engine.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, "/t", nil))
+		w.Write()
+		m := s.Metrics()
+		stages := []string{StageCapture, StageTransform, StagePersist}
+		for _, stage := range stages {
+			require.Equal(t, uint64(2), m[internal.CounterKey(
+				MetricStageLatency+"_count", "stage", stage)], stage)
+			require.Equal(t, uint64(2), m[internal.CounterKey(
+				MetricStageLatency+"_bucket", "stage", stage, "le", "+Inf")])
+		}
+	}
+}
+
+func Test_Trace_is_disabled_by_default(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger),
+		logger)
+	s := NewServer(&http.Server{}, w, logger, &Config{})
+	s.Engine.GET("/t", func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	s.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/t", nil))
+	w.Write()
+	require.Zero(t, s.metrics.Get(MetricStageLatency+"_count",
+		"stage", StagePersist))
+}
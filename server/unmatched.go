@@ -0,0 +1,36 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Markers of requests matching no route, kept in the `unmatched` attribute of
+// the response record.
+const (
+	UnmatchedRoute  = "no_route"
+	UnmatchedMethod = "no_method"
+)
+
+// Unmatched returns a NoRoute or NoMethod handler marking the request with
+// the given marker, so scans and probes can be told apart. Gin responds its
+// default 404 or 405 unless the handlers chained after it do.
+func Unmatched(marker string) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		Annotate(gc, "unmatched", marker)
+	}
+}
+
+// markUnmatched registers the NoRoute and NoMethod handlers as configured.
+func (s *Server) markUnmatched() {
+	if nil == s.Conf {
+		return
+	}
+	if s.Conf.HandleNoMethod {
+		s.Engine.HandleMethodNotAllowed = true
+	}
+	if !s.Conf.MarkUnmatched {
+		return
+	}
+	s.Engine.NoRoute(Unmatched(UnmatchedRoute))
+	s.Engine.NoMethod(Unmatched(UnmatchedMethod))
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RequestLogger_marks_unmatched_requests(t *testing.T) {
+	writer := &mockCachedWriter{}
+	cfg := &Config{MarkUnmatched: true, HandleNoMethod: true}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), cfg)
+	svr.Engine.GET("/t", func(c *gin.Context) { c.Status(http.StatusOK) })
+	for _, c := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/wp-login.php", http.StatusNotFound},
+		{http.MethodPost, "/t", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/t", http.StatusOK},
+	} {
+		res := httptest.NewRecorder()
+		svr.Engine.ServeHTTP(res, httptest.NewRequest(c.method, c.path, nil))
+		require.Equal(t, c.status, res.Code)
+	}
+	require.Len(t, writer.records, 6)
+	require.Equal(t, UnmatchedRoute, writer.records[1].Attributes["unmatched"])
+	require.Equal(t, UnmatchedMethod, writer.records[3].Attributes["unmatched"])
+	require.Nil(t, writer.records[5].Attributes)
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MetricVerifications counts callbacks checked by Verify, labeled by `result`,
+// and `check` of rejections, the name of the Verifier rejecting them.
+const MetricVerifications = "persist_verifications_total"
+
+// Outcomes of Verify, stored in the `verification` attribute of response
+// records.
+const (
+	VerificationPassed   = "passed"
+	VerificationRejected = "rejected"
+)
+
+// maxVerifiedBody is the largest request body read by Verify.
+const maxVerifiedBody = 1 << 20
+
+// Verifier checks authenticity of a callback request, whose body is given.
+type Verifier interface {
+	// Name identifies the check in records, e.g. "signature".
+	Name() string
+	// Verify returns the reason of rejecting the request, nil if it passes.
+	Verify(req *http.Request, body []byte) error
+}
+
+// HmacVerifier checks the signature of request bodies in a header, in hex of
+// the HMAC digest, such as `X-Signature: sha256=2cf24d...`.
+type HmacVerifier struct {
+	Header string
+	// Optional, prefix of the header value before the digest, e.g. `sha256=`
+	Prefix string
+	Secret []byte
+	// Optional, defaults to sha256.New
+	Hash func() hash.Hash
+}
+
+func (v *HmacVerifier) Name() string {
+	return "signature"
+}
+
+func (v *HmacVerifier) Verify(req *http.Request, body []byte) error {
+	value := req.Header.Get(v.Header)
+	if "" == value {
+		return fmt.Errorf("missing %s", v.Header)
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(value, v.Prefix))
+	if nil != err {
+		return fmt.Errorf("malformed %s", v.Header)
+	}
+	fn := v.Hash
+	if nil == fn {
+		fn = sha256.New
+	}
+	mac := hmac.New(fn, v.Secret)
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// TimestampVerifier checks freshness of requests by the Unix time in seconds
+// given in a header, such as `X-Timestamp: 1700000000`.
+type TimestampVerifier struct {
+	Header string
+	// maximum difference from the current time, in either direction
+	MaxSkew time.Duration
+	// Optional, defaults to time.Now
+	Now func() time.Time
+}
+
+func (v *TimestampVerifier) Name() string {
+	return "timestamp"
+}
+
+func (v *TimestampVerifier) Verify(req *http.Request, _ []byte) error {
+	value := req.Header.Get(v.Header)
+	if "" == value {
+		return fmt.Errorf("missing %s", v.Header)
+	}
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if nil != err {
+		return fmt.Errorf("malformed %s", v.Header)
+	}
+	now := time.Now
+	if nil != v.Now {
+		now = v.Now
+	}
+	skew := now().Sub(time.Unix(sec, 0))
+	if skew > v.MaxSkew || skew < -v.MaxSkew {
+		return fmt.Errorf("timestamp off by %v", skew.Truncate(time.Second))
+	}
+	return nil
+}
+
+// ReplayVerifier rejects requests carrying a nonce in a header which has been
+// seen within the window. It should run after the checks of signature and
+// timestamp, so that forged requests don't consume nonces, and the window
+// should cover the timestamp skew allowed.
+type ReplayVerifier struct {
+	header string
+	window time.Duration
+	mu     sync.Mutex
+	// time each nonce was first seen
+	seen  map[string]time.Time
+	prune time.Time
+}
+
+// NewReplayVerifier creates a verifier remembering nonces of the header for
+// the window.
+func NewReplayVerifier(header string, window time.Duration) *ReplayVerifier {
+	return &ReplayVerifier{
+		header: header, window: window, seen: make(map[string]time.Time),
+	}
+}
+
+func (v *ReplayVerifier) Name() string {
+	return "replay"
+}
+
+func (v *ReplayVerifier) Verify(req *http.Request, _ []byte) error {
+	nonce := req.Header.Get(v.header)
+	if "" == nonce {
+		return fmt.Errorf("missing %s", v.header)
+	}
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.After(v.prune) {
+		for n, at := range v.seen {
+			if now.Sub(at) > v.window {
+				delete(v.seen, n)
+			}
+		}
+		v.prune = now.Add(v.window)
+	}
+	if at, ok := v.seen[nonce]; ok && now.Sub(at) <= v.window {
+		return fmt.Errorf("nonce replayed within %v", v.window)
+	}
+	v.seen[nonce] = now
+	return nil
+}
+
+// Verify runs the verifiers in order on callback requests, stopping at the
+// first rejection. The outcome is stored in the `verification` attribute of
+// the response record, along with `verification_check` and
+// `verification_error` of rejections, giving an audit trail of rejected
+// callbacks. Rejected requests are responded 401 if `reject` is true, or
+// passed on to the handlers otherwise. Either way, they raise an Alert of
+// kind "verification". Request bodies beyond 1MiB are rejected.
+func (s *Server) Verify(reject bool, verifiers ...Verifier) gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		check, err := runVerifiers(gc.Request, verifiers)
+		if nil == err {
+			Annotate(gc, "verification", VerificationPassed)
+			s.metrics.Inc(MetricVerifications, "result", VerificationPassed)
+			gc.Next()
+			return
+		}
+		Annotate(gc, "verification", VerificationRejected)
+		Annotate(gc, "verification_check", check)
+		Annotate(gc, "verification_error", err.Error())
+		s.metrics.Inc(MetricVerifications, "result", VerificationRejected,
+			"check", check)
+		id, _ := RequestRecordId(gc)
+		s.Alert(Alert{
+			Kind:     "verification",
+			Method:   gc.Request.Method,
+			Path:     gc.Request.URL.Path,
+			ClientIP: gc.ClientIP(),
+			RecordId: id,
+			Detail:   fmt.Sprintf("%s: %v", check, err),
+			Time:     time.Now(),
+		})
+		if reject {
+			gc.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		gc.Next()
+	}
+}
+
+// runVerifiers returns the name of the verifier rejecting the request along
+// with the reason. The body is restored for handlers.
+func runVerifiers(req *http.Request, verifiers []Verifier) (string, error) {
+	var body []byte
+	if nil != req.Body && http.NoBody != req.Body {
+		var err error
+		orig := req.Body
+		body, err = io.ReadAll(io.LimitReader(orig, maxVerifiedBody+1))
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), orig), orig}
+		if nil != err {
+			return "body", err
+		}
+		if len(body) > maxVerifiedBody {
+			return "body", fmt.Errorf("body exceeds %d bytes",
+				maxVerifiedBody)
+		}
+	}
+	for _, v := range verifiers {
+		if err := v.Verify(req, body); nil != err {
+			return v.Name(), err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func signedCallback(
+	secret, body string, at time.Time, nonce string,
+) *http.Request {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	req := httptest.NewRequest(http.MethodPost, "/cb", strings.NewReader(body))
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Set("X-Timestamp", strconv.FormatInt(at.Unix(), 10))
+	req.Header.Set("X-Nonce", nonce)
+	return req
+}
+
+func Test_Verify_records_outcomes_of_callbacks(t *testing.T) {
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	var alerts []Alert
+	svr.OnAlert(func(a Alert) { alerts = append(alerts, a) })
+	var bodies []string
+	svr.Engine.POST("/cb", svr.Verify(true,
+		&HmacVerifier{Header: "X-Signature", Prefix: "sha256=",
+			Secret: []byte("s3cret")},
+		&TimestampVerifier{Header: "X-Timestamp", MaxSkew: time.Minute},
+		NewReplayVerifier("X-Nonce", 2*time.Minute),
+	), func(gc *gin.Context) {
+		b, _ := io.ReadAll(gc.Request.Body)
+		bodies = append(bodies, string(b))
+		gc.Status(http.StatusNoContent)
+	})
+	for _, v := range []struct {
+		req    *http.Request
+		status int
+		check  string
+	}{
+		{signedCallback("s3cret", `{"a":1}`, time.Now(), "n1"),
+			http.StatusNoContent, ""},
+		{signedCallback("s3cret", `{"a":1}`, time.Now(), "n1"),
+			http.StatusUnauthorized, "replay"},
+		{signedCallback("wrong", `{"a":1}`, time.Now(), "n2"),
+			http.StatusUnauthorized, "signature"},
+		{signedCallback("s3cret", `{"a":1}`, time.Now().Add(-time.Hour), "n3"),
+			http.StatusUnauthorized, "timestamp"},
+	} {
+		res := httptest.NewRecorder()
+		svr.Engine.ServeHTTP(res, v.req)
+		require.Equal(t, v.status, res.Code)
+	}
+	require.Equal(t, []string{`{"a":1}`}, bodies)
+	require.Len(t, writer.records, 8)
+	attrs := writer.records[1].Attributes
+	require.Equal(t, VerificationPassed, attrs["verification"])
+	require.NotContains(t, attrs, "verification_check")
+	for i, check := range []string{"replay", "signature", "timestamp"} {
+		attrs = writer.records[2*i+3].Attributes
+		require.Equal(t, VerificationRejected, attrs["verification"])
+		require.Equal(t, check, attrs["verification_check"])
+		require.NotEmpty(t, attrs["verification_error"])
+		require.Equal(t, "verification", alerts[i].Kind)
+		require.Equal(t, writer.records[2*i+2].Id, alerts[i].RecordId)
+	}
+	require.Equal(t, uint64(1), svr.metrics.Get(MetricVerifications,
+		"result", VerificationPassed))
+	require.Equal(t, uint64(1), svr.metrics.Get(MetricVerifications,
+		"result", VerificationRejected, "check", "signature"))
+}
+
+func Test_Verify_passes_rejected_callbacks_if_not_rejecting(t *testing.T) {
+	writer := &mockCachedWriter{}
+	svr := NewServer(&http.Server{}, writer, utils.NewLogger(), &Config{})
+	svr.Engine.POST("/cb", svr.Verify(false,
+		&HmacVerifier{Header: "X-Signature", Secret: []byte("s3cret")},
+	), func(gc *gin.Context) { gc.Status(http.StatusAccepted) })
+	res := httptest.NewRecorder()
+	svr.Engine.ServeHTTP(res,
+		httptest.NewRequest(http.MethodPost, "/cb", strings.NewReader("x")))
+	require.Equal(t, http.StatusAccepted, res.Code)
+	require.Equal(t, "missing X-Signature",
+		writer.records[1].Attributes["verification_error"])
+}
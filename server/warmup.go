@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// WarmUp establishes and pings `WarmupConns` connections, at least one, and
+// has each prepare the inserts of a single record and of a full batch, so
+// the first flush after startup doesn't pay for connecting, and the DB has
+// loaded the metadata of the table. Statements aren't prepared for
+// ClickHouse, whose drivers prepare batches on the client. Connections are
+// released to the pool afterward, which keeps those within its idle limit,
+// see sql.DB.SetMaxIdleConns. There are no partitions to create ahead, as
+// `tx_log` isn't partitioned, other than by ClickHouse upon insert.
+func WarmUp(ctx context.Context, cfg *DbConfig, conn *sql.DB) error {
+	var stmts []string
+	if !cfg.clickhouse() {
+		stmts = append(stmts, insertSql(1))
+		if n := cfg.batchSize(); n > 1 {
+			stmts = append(stmts, insertSql(n))
+		}
+	}
+	conns := make([]*sql.Conn, 0, max(cfg.WarmupConns, 1))
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	for range cap(conns) {
+		// connections are held until all are established, or the pool would
+		// hand out the same one again
+		c, err := conn.Conn(ctx)
+		if nil != err {
+			return fmt.Errorf("error connecting to the DB: %w", err)
+		}
+		conns = append(conns, c)
+		if err = c.PingContext(ctx); nil != err {
+			return fmt.Errorf("error pinging the DB: %w", err)
+		}
+		for _, stmt := range stmts {
+			prepared, err := c.PrepareContext(ctx, stmt)
+			if nil != err {
+				return fmt.Errorf("error preparing insert: %w", err)
+			}
+			_ = prepared.Close()
+		}
+	}
+	return nil
+}
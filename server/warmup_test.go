@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WarmUp_establishes_connections_and_prepares_inserts(t *testing.T) {
+	cfg := &DbConfig{
+		Driver: "sqlite3", Dsn: filepath.Join(t.TempDir(), "warmup.db"),
+		WarmupConns: 3, BatchSize: 10,
+	}
+	conn, err := ConnectDB(cfg)
+	require.Nil(t, err)
+	defer func() { _ = conn.Close() }()
+	require.ErrorContains(t, WarmUp(context.Background(), cfg, conn),
+		"error preparing insert")
+	require.Nil(t, CreateDefaultTable(cfg, conn))
+	require.Nil(t, WarmUp(context.Background(), cfg, conn))
+	require.Equal(t, 2, conn.Stats().Idle)
+}
+
+func Test_WarmUp_fails_if_the_db_is_unreachable(t *testing.T) {
+	cfg := &DbConfig{Driver: "sqlite3", Dsn: "file:/nonexistent/dir/x.db"}
+	conn, err := ConnectDB(cfg)
+	require.Nil(t, err)
+	require.ErrorContains(t, WarmUp(context.Background(), cfg, conn),
+		"error connecting to the DB")
+}
@@ -0,0 +1,431 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eidng8/go-db"
+	"github.com/eidng8/go-utils"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+const (
+	// OverflowLog writes records beyond the memory cap to the failed log.
+	OverflowLog = "log"
+	// OverflowDrop discards records beyond the memory cap.
+	OverflowDrop = "drop"
+)
+
+// estimated bytes taken by a record besides its variable length fields
+const recordOverhead = 128
+
+// CachedWriter wraps a db.CachedWriter, keeping track of the estimated memory
+// held by pending records. Records pushed beyond the cap are handled by the
+// overflow policy instead of being cached.
+type CachedWriter struct {
+	db.CachedWriter
+	logger   utils.TaggedLogger
+	interval time.Duration
+	// maximum random delay added to each interval
+	jitter time.Duration
+	// maximum estimated bytes of pending records, 0 means unlimited
+	maxBytes int64
+	pending  atomic.Int64
+	// number of pending records
+	queued   atomic.Int64
+	overflow string
+	// where overflowed records are written with the `log` policy
+	overflowLog io.Writer
+	overflowed  atomic.Uint64
+	// if set, records are cached here, and handed to the wrapped writer in
+	// batches of this size
+	batchSize int
+	cache     []any
+	cacheMu   sync.Mutex
+	// number of writes to the failed log
+	failed atomic.Uint64
+	// number of consecutive flushes that failed
+	failing atomic.Int32
+	// maximum duration of flushing upon stop
+	drainTimeout time.Duration
+	// Optional, counts flushes
+	metrics *internal.Counters
+}
+
+// NewWriter wraps the given writer with a flush interval of 1 second and no
+// memory cap.
+func NewWriter(writer db.CachedWriter, logger utils.TaggedLogger) *CachedWriter {
+	return &CachedWriter{
+		CachedWriter: writer,
+		logger:       logger,
+		interval:     time.Second,
+		overflow:     OverflowLog,
+		drainTimeout: 10 * time.Second,
+	}
+}
+
+// SetMaxPendingBytes sets the memory cap of pending records.
+func (w *CachedWriter) SetMaxPendingBytes(n int64) {
+	w.maxBytes = n
+}
+
+// SetOverflow sets the policy, and where records are written with the `log`
+// policy.
+func (w *CachedWriter) SetOverflow(policy string, log io.Writer) {
+	w.overflow = policy
+	w.overflowLog = log
+}
+
+// SetInterval sets the interval at which cached records are flushed.
+func (w *CachedWriter) SetInterval(duration time.Duration) {
+	w.interval = duration
+	w.CachedWriter.SetInterval(duration)
+}
+
+// SetJitter sets the maximum random delay added to each flush interval, so
+// writers of many replicas don't hit the DB at the same moment.
+func (w *CachedWriter) SetJitter(jitter time.Duration) {
+	w.jitter = jitter
+}
+
+// SetDrainTimeout sets the maximum duration of flushing upon stop.
+func (w *CachedWriter) SetDrainTimeout(timeout time.Duration) {
+	w.drainTimeout = timeout
+}
+
+// SetBatchSize sets the maximum number of records in each insert transaction,
+// 0 to leave it to the wrapped writer. The wrapped RowWriter inserts up
+// to 1000 records per transaction.
+func (w *CachedWriter) SetBatchSize(size int) {
+	w.batchSize = size
+}
+
+// contextWriter is implemented by writers making DB calls with a context,
+// such as RowWriter.
+type contextWriter interface {
+	SetContext(ctx context.Context)
+	SetFlushTimeout(timeout time.Duration)
+}
+
+// SetContext sets the context of DB calls made by the wrapped writer, if it
+// supports one.
+func (w *CachedWriter) SetContext(ctx context.Context) {
+	if cw, ok := w.CachedWriter.(contextWriter); ok {
+		cw.SetContext(ctx)
+	}
+}
+
+// SetFlushTimeout sets the maximum duration of each flush of the wrapped
+// writer, if it supports one.
+func (w *CachedWriter) SetFlushTimeout(timeout time.Duration) {
+	if cw, ok := w.CachedWriter.(contextWriter); ok {
+		cw.SetFlushTimeout(timeout)
+	}
+}
+
+// PendingBytes returns the estimated bytes held by pending records.
+func (w *CachedWriter) PendingBytes() int64 {
+	return w.pending.Load()
+}
+
+// PendingRecords returns the number of pending records.
+func (w *CachedWriter) PendingRecords() int64 {
+	return w.queued.Load()
+}
+
+// Overflowed returns the number of records handled by the overflow policy.
+func (w *CachedWriter) Overflowed() uint64 {
+	return w.overflowed.Load()
+}
+
+// Failing returns the number of consecutive flushes that had records written
+// to the failed log.
+func (w *CachedWriter) Failing() int {
+	return int(w.failing.Load())
+}
+
+// FailedLog returns a writer counting the writes to the given failed log, to
+// be set on the wrapped writer, so flush failures can be told by Failing.
+func (w *CachedWriter) FailedLog(log io.Writer) io.Writer {
+	return &failedLog{Writer: log, count: &w.failed}
+}
+
+// Push adds a record to the cache, or applies the overflow policy if the
+// memory cap has been reached.
+func (w *CachedWriter) Push(data any) {
+	size := estimateSize(data)
+	if w.maxBytes > 0 && w.pending.Load()+size > w.maxBytes {
+		w.overflowed.Add(1)
+		w.handleOverflow(data)
+		return
+	}
+	w.pending.Add(size)
+	w.queued.Add(1)
+	markStage(data, StageCapture)
+	if w.batchSize < 1 {
+		w.CachedWriter.Push(data)
+		return
+	}
+	w.cacheMu.Lock()
+	defer w.cacheMu.Unlock()
+	w.cache = append(w.cache, data)
+}
+
+// Write flushes all cached records. If the wrapped writer reports its
+// backlog, records it still holds, such as while being paused, stay pending.
+// Otherwise, records pushed during the flush may be accounted to the flushed
+// batch, so the estimate errs on the low side until the next flush. A flush
+// of pending records without failure resets Failing.
+func (w *CachedWriter) Write() {
+	failed := w.failed.Load()
+	bw, reports := w.CachedWriter.(backlogWriter)
+	pending := w.pending.Load()
+	if !reports {
+		pending = w.pending.Swap(0)
+		w.queued.Store(0)
+	}
+	start := time.Now()
+	w.flush()
+	if reports {
+		w.recount(bw)
+	}
+	if pending > 0 {
+		w.metrics.Observe(uint64(time.Since(start).Milliseconds()),
+			MetricFlushDuration, flushBuckets)
+	}
+	if w.failed.Load() != failed {
+		w.failing.Add(1)
+	} else if pending > 0 {
+		w.failing.Store(0)
+	}
+}
+
+// backlogWriter is implemented by writers reporting the records they hold,
+// such as RowWriter.
+type backlogWriter interface {
+	// Backlog returns the number and estimated bytes of cached records
+	Backlog() (int, int64)
+}
+
+// recount sets the pending records to those cached, and those held by the
+// wrapped writer. Records pushed meanwhile may be missed until the next
+// flush.
+func (w *CachedWriter) recount(bw backlogWriter) {
+	w.cacheMu.Lock()
+	n, size := backlog(w.cache)
+	w.cacheMu.Unlock()
+	held, heldSize := bw.Backlog()
+	w.pending.Store(size + heldSize)
+	w.queued.Store(int64(n + held))
+}
+
+// backlog returns the number and estimated bytes of the records.
+func backlog(cached []any) (int, int64) {
+	var size int64
+	for _, data := range cached {
+		size += estimateSize(data)
+	}
+	return len(cached), size
+}
+
+func (w *CachedWriter) flush() {
+	if w.batchSize < 1 {
+		w.CachedWriter.Write()
+		return
+	}
+	w.cacheMu.Lock()
+	cached := w.cache
+	w.cache = nil
+	w.cacheMu.Unlock()
+	for batch := range slices.Chunk(cached, w.batchSize) {
+		for _, data := range batch {
+			w.CachedWriter.Push(data)
+		}
+		w.CachedWriter.Write()
+	}
+	// flush records kept by the wrapped writer while being paused
+	if len(cached) < 1 {
+		w.CachedWriter.Write()
+	}
+}
+
+// Start flushes cached records at the configured interval, until the given
+// channel is signaled.
+func (w *CachedWriter) Start(stopChan <-chan struct{}) {
+	timer := time.NewTimer(w.nextInterval())
+	go func() {
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				w.Write()
+				timer.Reset(w.nextInterval())
+			case <-stopChan:
+				// flush right away upon shutdown, instead of waiting out the
+				// interval, then records of requests still being served
+				ctx, cancel := context.WithTimeout(context.Background(),
+					w.drainTimeout)
+				_ = w.Drain(ctx)
+				cancel()
+				return
+			}
+		}
+	}()
+}
+
+// Drain flushes pending records, and keeps flushing those pushed meanwhile,
+// until every record is persisted or written to the failed log by the
+// wrapped writer, or the context is done. Records still pending then are
+// written to the failed log, if the wrapped writer supports, instead of being
+// lost with the process.
+func (w *CachedWriter) Drain(ctx context.Context) error {
+	for {
+		w.Write()
+		if w.pending.Load() <= 0 && w.wrappedPending() < 1 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			w.failPending(ctx.Err())
+			return ctx.Err()
+		case <-time.After(drainPoll):
+		}
+	}
+}
+
+// interval of flushes of Drain while records are held by the wrapped writer,
+// such as when it's paused
+const drainPoll = 10 * time.Millisecond
+
+// pendingWriter is implemented by writers holding records until they're
+// inserted, such as RowWriter.
+type pendingWriter interface {
+	// Pending returns the number of records not yet inserted
+	Pending() int
+	// FailPending writes records not yet inserted to the failed log
+	FailPending(cause error) int
+}
+
+func (w *CachedWriter) wrappedPending() int {
+	if pw, ok := w.CachedWriter.(pendingWriter); ok {
+		return pw.Pending()
+	}
+	return 0
+}
+
+// failPending hands over cached records to the wrapped writer, to be written
+// to the failed log.
+func (w *CachedWriter) failPending(cause error) {
+	pw, ok := w.CachedWriter.(pendingWriter)
+	if !ok {
+		return
+	}
+	w.cacheMu.Lock()
+	cached := w.cache
+	w.cache = nil
+	w.cacheMu.Unlock()
+	for _, data := range cached {
+		w.CachedWriter.Push(data)
+	}
+	if n := pw.FailPending(cause); n > 0 {
+		w.logger.Errorf("%d records not persisted upon drain: %v", n, cause)
+	}
+}
+
+// instrument counts flushes, and the work of the wrapped writer if it
+// supports, in the given metrics.
+func (w *CachedWriter) instrument(metrics *internal.Counters) {
+	w.metrics = metrics
+	if i, ok := w.CachedWriter.(instrumented); ok {
+		i.instrument(metrics)
+	}
+}
+
+// persister is implemented by writers persisting records synchronously, such
+// as RowWriter.
+type persister interface {
+	Persist(ctx context.Context, data ...any) error
+}
+
+// ErrNoPersist is returned by Persist if the wrapped writer can't persist
+// records synchronously.
+var ErrNoPersist = errors.New("writer can't persist synchronously")
+
+// Persist persists the records right away with the wrapped writer, bypassing
+// the cache and the memory cap.
+func (w *CachedWriter) Persist(ctx context.Context, data ...any) error {
+	if p, ok := w.CachedWriter.(persister); ok {
+		return p.Persist(ctx, data...)
+	}
+	return ErrNoPersist
+}
+
+// PersistTx inserts the records in the given transaction with the wrapped
+// writer, if it supports one.
+func (w *CachedWriter) PersistTx(
+	ctx context.Context, tx *sql.Tx, data ...any,
+) error {
+	if p, ok := w.CachedWriter.(txPersister); ok {
+		return p.PersistTx(ctx, tx, data...)
+	}
+	return ErrNoPersist
+}
+
+// OnPersisted sets the function called with records once they're committed,
+// if the wrapped writer reports them.
+func (w *CachedWriter) OnPersisted(fn func([]TxRecord)) {
+	if n, ok := w.CachedWriter.(persistNotifier); ok {
+		n.OnPersisted(fn)
+	}
+}
+
+func (w *CachedWriter) nextInterval() time.Duration {
+	if w.jitter <= 0 {
+		return w.interval
+	}
+	return w.interval + rand.N(w.jitter)
+}
+
+func (w *CachedWriter) handleOverflow(data any) {
+	if OverflowDrop == w.overflow || nil == w.overflowLog {
+		w.logger.Debugf("Pending records exceed %d bytes, dropped", w.maxBytes)
+		return
+	}
+	rec, _ := data.(TxRecord)
+	f := failRecord(FailOverflow,
+		fmt.Errorf("pending records exceed %d bytes", w.maxBytes), rec)
+	if err := writeFailedRecord(w.overflowLog, f); nil != err {
+		w.logger.Errorf("Error writing overflowed record: %v", err)
+	}
+}
+
+func estimateSize(data any) int64 {
+	rec, ok := data.(TxRecord)
+	if !ok {
+		return recordOverhead
+	}
+	return int64(recordOverhead + len(rec.Id) + len(rec.Request) +
+		len(rec.Headers) + len(rec.Body) + 32*len(rec.Attributes))
+}
+
+type failedLog struct {
+	io.Writer
+	count *atomic.Uint64
+}
+
+func (l *failedLog) Write(p []byte) (int, error) {
+	l.count.Add(1)
+	if nil == l.Writer {
+		return len(p), nil
+	}
+	return l.Writer.Write(p)
+}
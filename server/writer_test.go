@@ -0,0 +1,392 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eidng8/go-utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eidng8/gin-persist-log/internal"
+)
+
+func Test_CachedWriter_applies_overflow_policy_beyond_cap(t *testing.T) {
+	var log bytes.Buffer
+	mock := &mockCachedWriter{}
+	w := NewWriter(mock, utils.NewLogger())
+	rec := TxRecord{Request: "GET /t", Body: []byte("body")}
+	size := estimateSize(rec)
+	w.SetMaxPendingBytes(2 * size)
+	w.SetOverflow(OverflowLog, &log)
+	for i := 0; i < 3; i++ {
+		w.Push(rec)
+	}
+	require.Len(t, mock.records, 2)
+	require.Equal(t, 2*size, w.PendingBytes())
+	require.Equal(t, uint64(1), w.Overflowed())
+	require.Equal(t, 1, strings.Count(log.String(), `"Class":"overflow"`))
+	w.Write()
+	require.Zero(t, w.PendingBytes())
+	w.SetOverflow(OverflowDrop, &log)
+	for i := 0; i < 3; i++ {
+		w.Push(rec)
+	}
+	require.Len(t, mock.records, 4)
+	require.Equal(t, uint64(2), w.Overflowed())
+	require.Equal(t, 1, strings.Count(log.String(), `"Class":"overflow"`))
+}
+
+func Test_CachedWriter_adds_jitter_to_interval(t *testing.T) {
+	w := NewWriter(&mockCachedWriter{}, utils.NewLogger())
+	require.Equal(t, time.Second, w.nextInterval())
+	w.SetJitter(100 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		d := w.nextInterval()
+		require.GreaterOrEqual(t, d, time.Second)
+		require.Less(t, d, 1100*time.Millisecond)
+	}
+}
+
+func Test_CachedWriter_writes_in_batches(t *testing.T) {
+	mock := &batchRecorder{}
+	w := NewWriter(mock, utils.NewLogger())
+	w.SetBatchSize(2)
+	for i := 0; i < 5; i++ {
+		w.Push(TxRecord{Request: "GET /t"})
+	}
+	require.Empty(t, mock.pending)
+	w.Write()
+	require.Equal(t, []int{2, 2, 1}, mock.batches)
+}
+
+func Test_CachedWriter_flushes_right_away_upon_stop(t *testing.T) {
+	mock := &drainRecorder{written: make(chan int, 1)}
+	w := NewWriter(mock, utils.NewLogger())
+	w.SetInterval(time.Hour)
+	w.Push(TxRecord{Request: "GET /t"})
+	stop := make(chan struct{})
+	w.Start(stop)
+	close(stop)
+	select {
+	case n := <-mock.written:
+		require.Equal(t, 1, n)
+	case <-time.After(time.Second):
+		require.Fail(t, "not flushed upon stop")
+	}
+}
+
+func Test_CachedWriter_drains_records_pushed_during_flush(t *testing.T) {
+	mock := &drainRecorder{written: make(chan int, 2)}
+	w := NewWriter(mock, utils.NewLogger())
+	// a request finishing while the first batch is flushed
+	mock.during = func() { w.Push(TxRecord{Request: "GET /late"}) }
+	w.Push(TxRecord{Request: "GET /t"})
+	require.Nil(t, w.Drain(context.Background()))
+	require.Equal(t, []int{1, 1}, mock.batches)
+	require.Zero(t, w.PendingBytes())
+	w.Push(TxRecord{Request: "GET /t"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mock.during = func() { w.Push(TxRecord{Request: "GET /late"}) }
+	require.ErrorIs(t, w.Drain(ctx), context.Canceled)
+}
+
+func Test_CachedWriter_Drain_fails_records_held_by_paused_writer(t *testing.T) {
+	_, conn := setupDb(t)
+	var log bytes.Buffer
+	rw := NewRowWriter(conn, SqlBuilder(utils.NewLogger(), io.Discard),
+		utils.NewLogger())
+	rw.SetFailedLog(&log)
+	rw.Pause()
+	w := NewWriter(rw, utils.NewLogger())
+	w.SetBatchSize(10)
+	w.Push(TxRecord{Request: "GET /t"})
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, w.Drain(ctx), context.DeadlineExceeded)
+	require.Contains(t, log.String(), `"Request":"GET /t"`)
+	require.Contains(t, log.String(), `"Error":"context deadline exceeded"`)
+	require.Zero(t, rw.Pending())
+}
+
+func Test_CachedWriter_keeps_records_held_by_paused_writer_pending(
+	t *testing.T,
+) {
+	_, conn := setupDb(t)
+	rw := NewRowWriter(conn, SqlBuilder(utils.NewLogger(), io.Discard),
+		utils.NewLogger())
+	rw.Pause()
+	w := NewWriter(rw, utils.NewLogger())
+	rec := TxRecord{Request: "GET /t"}
+	w.Push(rec)
+	w.Write()
+	require.Equal(t, estimateSize(rec), w.PendingBytes())
+	require.Equal(t, int64(1), w.PendingRecords())
+	rw.Resume()
+	w.Write()
+	require.Zero(t, w.PendingBytes())
+	require.Zero(t, w.PendingRecords())
+}
+
+func Test_Server_Drain_persists_records_of_capture_workers(t *testing.T) {
+	_, conn := setupDb(t)
+	logger := utils.NewLogger()
+	w := NewWriter(NewRowWriter(conn, SqlBuilder(logger, io.Discard), logger),
+		logger)
+	s := NewServer(&http.Server{}, w, logger, &Config{CaptureWorkers: 2})
+	s.Engine.GET("/t", func(c *gin.Context) { c.Status(http.StatusOK) })
+	for range 5 {
+		s.Engine.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, "/t", nil))
+	}
+	require.Nil(t, s.Drain(context.Background()))
+	var n int
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	require.Nil(t, conn.QueryRow("SELECT COUNT(*) FROM tx_log").Scan(&n))
+	require.Equal(t, 10, n)
+	// captures afterwards are run inline
+	s.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/t", nil))
+	require.Equal(t, int64(2), w.PendingRecords())
+}
+
+func Test_DbConfig_defaults_tidb_batch_size(t *testing.T) {
+	require.Equal(t, tidbBatchSize, (&DbConfig{Dialect: "tidb"}).batchSize())
+	require.Equal(t, 10,
+		(&DbConfig{Dialect: "tidb", BatchSize: 10}).batchSize())
+	require.Zero(t, (&DbConfig{Driver: "mysql"}).batchSize())
+	require.Contains(t, internal.DefaultTidbTable(4, internal.MysqlSchema{}),
+		"PRIMARY KEY NONCLUSTERED")
+}
+
+type batchRecorder struct {
+	mockCachedWriter
+	pending []any
+	batches []int
+}
+
+func (w *batchRecorder) Push(data any) {
+	w.pending = append(w.pending, data)
+}
+
+func (w *batchRecorder) Write() {
+	if len(w.pending) > 0 {
+		w.batches = append(w.batches, len(w.pending))
+		w.pending = nil
+	}
+}
+
+// drainRecorder signals each flush, and calls `during` once upon a flush.
+type drainRecorder struct {
+	batchRecorder
+	written chan int
+	during  func()
+}
+
+func (w *drainRecorder) Write() {
+	n := len(w.pending)
+	w.batchRecorder.Write()
+	if nil != w.during {
+		during := w.during
+		w.during = nil
+		during()
+	}
+	select {
+	case w.written <- n:
+	default:
+	}
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_RowWriter_inserts_each_record_in_one_transaction(t *testing.T) {
+	_, conn := setupDb(t)
+	var statements []string
+	builder := SqlBuilder(utils.NewLogger(), io.Discard)
+	w := NewRowWriter(conn, func(data []any) (string, []any) {
+		query, args := builder(data)
+		statements = append(statements, query)
+		return query, args
+	}, utils.NewLogger())
+	for i := 0; i < 3; i++ {
+		w.Push(TxRecord{Request: "GET /t", Headers: []byte("h")})
+	}
+	w.Write()
+	require.Len(t, statements, 3)
+	require.Equal(t, 1, strings.Count(statements[0], "(?"))
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log;`).Scan(&count))
+	require.Equal(t, 3, count)
+}
+
+func Test_RowWriter_logs_refused_records_with_cause(t *testing.T) {
+	_, conn := setupDb(t)
+	require.Nil(t, conn.Close())
+	var log bytes.Buffer
+	w := NewRowWriter(conn, SqlBuilder(utils.NewLogger(), io.Discard),
+		utils.NewLogger())
+	w.SetRetries(2)
+	w.SetFailedLog(&log)
+	w.Push(TxRecord{Request: "GET /t", Headers: []byte("h")})
+	w.Write()
+	require.Contains(t, log.String(), `"Class":"db","Error":"sql: database is closed"`)
+	require.Contains(t, log.String(), `"Attempt":2,"Batch":1`)
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_RowWriter_logs_bad_records_once_across_retries(t *testing.T) {
+	for _, savepoints := range []bool{false, true} {
+		_, conn := setupDb(t)
+		_, err := conn.Exec(`DROP TABLE tx_log;`)
+		require.Nil(t, err)
+		var log bytes.Buffer
+		w := NewRowWriter(conn, SqlBuilder(utils.NewLogger(), &log),
+			utils.NewLogger())
+		w.SetRetries(3)
+		w.SetSavepoints(savepoints)
+		w.SetFailedLog(&log)
+		w.Push(TxRecord{Headers: []byte("no line")})
+		w.Push(TxRecord{Request: "GET /t", Headers: []byte("h")})
+		w.Write()
+		require.Equal(t, 1,
+			strings.Count(log.String(), `"Class":"empty_request"`))
+		require.Equal(t, 1, strings.Count(log.String(), `"Class":"db"`))
+		require.Equal(t, 2, strings.Count(log.String(), "\n"))
+	}
+}
+
+func Test_RowWriter_backs_off_between_retries(t *testing.T) {
+	_, conn := setupDb(t)
+	require.Nil(t, conn.Close())
+	var log bytes.Buffer
+	w := NewRowWriter(conn, SqlBuilder(utils.NewLogger(), io.Discard),
+		utils.NewLogger())
+	w.SetRetries(3)
+	w.SetBackoff(20 * time.Millisecond)
+	w.SetFailedLog(&log)
+	w.Push(TxRecord{Request: "GET /t", Headers: []byte("h")})
+	start := time.Now()
+	w.Write()
+	require.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+	require.Contains(t, log.String(), `"Attempt":3,"Batch":1`)
+	// the backoff is cut short by cancellation
+	log.Reset()
+	ctx, cancel := context.WithCancel(context.Background())
+	w.SetContext(ctx)
+	w.SetBackoff(time.Hour)
+	w.Push(TxRecord{Request: "GET /t", Headers: []byte("h")})
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start = time.Now()
+	w.Write()
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, 1, strings.Count(log.String(), `"Class":"db"`))
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_BatchWriter_inserts_chunk_in_one_statement(t *testing.T) {
+	_, conn := setupDb(t)
+	var statements []string
+	builder := SqlBuilder(utils.NewLogger(), io.Discard)
+	w := NewBatchWriter(conn, func(data []any) (string, []any) {
+		query, args := builder(data)
+		statements = append(statements, query)
+		return query, args
+	}, utils.NewLogger())
+	for i := 0; i < 3; i++ {
+		w.Push(TxRecord{Request: "GET /t", Headers: []byte("h")})
+	}
+	w.Write()
+	require.Len(t, statements, 1)
+	require.Equal(t, 3, strings.Count(statements[0], "(?"))
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log;`).Scan(&count))
+	require.Equal(t, 3, count)
+}
+
+func Test_RowWriter_dry_run_builds_without_writing(t *testing.T) {
+	_, conn := setupDb(t)
+	// any DB call fails
+	require.Nil(t, conn.Close())
+	var log bytes.Buffer
+	logger := utils.NewLogger()
+	inner := NewBatchWriter(conn, SqlBuilder(logger, io.Discard), logger)
+	inner.SetFailedLog(&log)
+	w := NewWriter(inner, logger)
+	s := NewServer(&http.Server{}, w, logger, &Config{})
+	inner.SetDryRun(s.countDryRun)
+	s.Engine.GET("/t", func(c *gin.Context) { c.Status(http.StatusOK) })
+	s.Engine.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/t", nil))
+	w.Write()
+	require.Empty(t, log.String())
+	require.Zero(t, w.Failing())
+	require.Nil(t, inner.Persist(context.Background(),
+		TxRecord{Request: "GET /t", Headers: []byte("h")}))
+	m := s.Metrics()
+	require.Equal(t, uint64(2), m[MetricDryRunStatements])
+	require.Equal(t, uint64(3), m[MetricDryRunRecords])
+}
+
+// endless is a statement never finishing on its own
+const endless = `WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c)
+	SELECT COUNT(*) FROM c;`
+
+func Test_RowWriter_times_out_hung_flush(t *testing.T) {
+	_, conn := setupDb(t)
+	var log bytes.Buffer
+	w := NewBatchWriter(conn, func(data []any) (string, []any) {
+		return endless, nil
+	}, utils.NewLogger())
+	w.SetFailedLog(&log)
+	w.SetFlushTimeout(50 * time.Millisecond)
+	w.Push(TxRecord{Request: "GET /t", Headers: []byte("h")})
+	start := time.Now()
+	w.Write()
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, 1, strings.Count(log.String(), `"Class":"db"`))
+}
+
+func Test_RowWriter_aborts_inserts_upon_cancellation(t *testing.T) {
+	_, conn := setupDb(t)
+	var log bytes.Buffer
+	w := NewBatchWriter(conn, func(data []any) (string, []any) {
+		return endless, nil
+	}, utils.NewLogger())
+	w.SetFailedLog(&log)
+	ctx, cancel := context.WithCancel(context.Background())
+	w.SetContext(ctx)
+	w.Push(TxRecord{Request: "GET /t", Headers: []byte("h")})
+	time.AfterFunc(50*time.Millisecond, cancel)
+	w.Write()
+	require.Equal(t, 1, strings.Count(log.String(), `"Class":"db"`))
+}
+
+//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+func Test_RowWriter_rolls_back_refused_record_to_savepoint(t *testing.T) {
+	_, conn := setupDb(t)
+	var log bytes.Buffer
+	w := NewBatchWriter(conn, SqlBuilder(utils.NewLogger(), io.Discard),
+		utils.NewLogger())
+	w.SetFailedLog(&log)
+	w.SetSavepoints(true)
+	w.SetIsolation(sql.LevelSerializable)
+	id := []byte("0123456789abcdef")
+	w.Push(TxRecord{Id: id, Request: "GET /a", Headers: []byte("h")})
+	w.Push(TxRecord{Id: id, Request: "GET /b", Headers: []byte("h")})
+	w.Push(TxRecord{Request: "GET /c", Headers: []byte("h")})
+	w.Write()
+	require.Equal(t, 1, strings.Count(log.String(), `"Class":"db"`))
+	require.Contains(t, log.String(), `"Request":"GET /b"`)
+	require.Contains(t, log.String(), `"Attempt":1,"Batch":1`)
+	var count int
+	require.Nil(t, conn.QueryRow(`SELECT COUNT(*) FROM tx_log;`).Scan(&count))
+	require.Equal(t, 2, count)
+}
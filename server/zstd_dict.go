@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ZstdDictOptions controls TrainZstdDict.
+type ZstdDictOptions struct {
+	// number of the most recent bodies sampled, defaults to 1000
+	Samples int
+	// maximum bytes of the dictionary, defaults to 64KiB
+	MaxSize int
+	// ID of the dictionary, random if 0
+	Id uint32
+}
+
+// ZstdDictCodecName returns the name of the codec of the zstd dictionary of
+// the given ID, e.g. `zstd:32768`, which records the ID in `body_codec`.
+func ZstdDictCodecName(id uint32) string {
+	return CodecZstd + ":" + strconv.FormatUint(uint64(id), 10)
+}
+
+// NewZstdDictCodec creates the codec compressing with the given zstd
+// dictionary, named by ZstdDictCodecName. Bodies are only readable while the
+// codec of their dictionary is registered.
+func NewZstdDictCodec(dictionary []byte) (Codec, error) {
+	d, err := zstd.InspectDictionary(dictionary)
+	if nil != err {
+		return nil, err
+	}
+	return &zstdCodec{name: ZstdDictCodecName(d.ID()), dict: dictionary}, nil
+}
+
+// LoadZstdDict registers the codec of the dictionary in the given file, and
+// returns its name.
+func LoadZstdDict(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if nil != err {
+		return "", err
+	}
+	c, err := NewZstdDictCodec(b)
+	if nil != err {
+		return "", fmt.Errorf("invalid zstd dictionary %s: %w", path, err)
+	}
+	RegisterCodec(c)
+	return c.Name(), nil
+}
+
+// TrainZstdDict builds a zstd dictionary from a sample of the most recent
+// bodies. Small and similar bodies, such as JSON callbacks, compress far
+// better with a dictionary than on their own.
+func TrainZstdDict(
+	ctx context.Context, conn *sql.DB, opts ZstdDictOptions,
+) ([]byte, error) {
+	if opts.Samples < 1 {
+		opts.Samples = 1000
+	}
+	if opts.MaxSize < 1 {
+		opts.MaxSize = 64 << 10
+	}
+	//goland:noinspection SqlNoDataSourceInspection,SqlResolve
+	rows, err := conn.QueryContext(ctx, `SELECT body, body_codec FROM tx_log
+		WHERE body IS NOT NULL ORDER BY created_at DESC LIMIT ?`, opts.Samples)
+	if nil != err {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	var samples [][]byte
+	for rows.Next() {
+		var body []byte
+		var codec sql.NullString
+		if err = rows.Scan(&body, &codec); nil != err {
+			return nil, err
+		}
+		if body, err = DecodeBody(codec.String, body); nil != err {
+			return nil, err
+		}
+		samples = append(samples, body)
+	}
+	if err = rows.Err(); nil != err {
+		return nil, err
+	}
+	return dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: opts.MaxSize, HashBytes: 6, ZstdDictID: opts.Id,
+	})
+}